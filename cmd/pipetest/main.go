@@ -1,13 +1,19 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"net"
+	"net/http"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strings"
 	"time"
@@ -15,16 +21,25 @@ import (
 	"github.com/mehditeymorian/pipetest/internal/ast"
 	"github.com/mehditeymorian/pipetest/internal/compiler"
 	"github.com/mehditeymorian/pipetest/internal/diagnostics"
+	"github.com/mehditeymorian/pipetest/internal/lexer"
 	"github.com/mehditeymorian/pipetest/internal/parser"
+	"github.com/mehditeymorian/pipetest/internal/postman"
 	"github.com/mehditeymorian/pipetest/internal/report"
 	"github.com/mehditeymorian/pipetest/internal/runtime"
+	"github.com/mehditeymorian/pipetest/internal/yaml"
 	"github.com/spf13/cobra"
 )
 
 const (
-	evalUsage    = "pipetest eval <program.pt> [--format pretty|json]"
-	runUsage     = "pipetest run <program.pt> [--report-dir dir] [--format pretty|json] [--timeout duration] [--verbose] [--hide-passing-assertions]"
-	requestUsage = "pipetest request <program.pt> <request-name> [--format pretty|json] [--timeout duration] [--verbose] [--hide-passing-assertions]"
+	evalUsage    = "pipetest eval <program.pt> [--format pretty|json] [--require-assertions] [--strict-json] [--indent tabs|spaces] [--warn-as-error] [--program-dir dir]"
+	runUsage     = "pipetest run <program.pt> [--report-dir dir] [--format pretty|json] [--timeout duration] [--verbose] [--hide-passing-assertions] [--log-file path] [--log-to stdout|file|both] [--validate-only] [--report-stdout] [--parallel-requests n] [--grep text] [--summary-only] [--no-report] [--default-accept value] [--only-changed ref] [--var-file vars.json|vars.yaml] [--require-assertions] [--no-progress] [--print-config] [--tag name]... [--retry-on-transport n] [--retry-on-transport-delay duration] [--strict-json] [--baseline-report report.json] [--fail-on-empty-suite] [--preflight] [--jitter min-max] [--seed n] [--suite-name name] [--prefix-suite-names] [--bundle-sources] [--indent tabs|spaces] [--explain] [--max-assertions n] [--quiet-success] [--correlation-header name] [--timeouts-as-failures] [--step] [--shared-vars] [--capture-bodies-on-failure] [--warn-as-error] [--count-assertions] [--program-dir dir] [--only-flow-asserts|--only-request-asserts] [--record dir|--replay dir]"
+	assertsUsage = "pipetest assertions <program.pt> [--format pretty|json] [--indent tabs|spaces]"
+	diffUsage    = "pipetest diff <old-report.json> <new-report.json> [--format pretty|json]"
+	debugUsage   = "pipetest debug tokens|ast <program.pt>"
+	importUsage  = "pipetest import-postman <collection.json> [-o out.pt] [--flows]"
+	echoUsage    = "pipetest echo-server [--addr host:port]"
+	healthUsage  = "pipetest health <program.pt> [--format pretty|json] [--timeout duration] [--indent tabs|spaces]"
+	requestUsage = "pipetest request <program.pt> <request-name> [--format pretty|json] [--timeout duration] [--verbose] [--hide-passing-assertions] [--default-accept value] [--var-file vars.json|vars.yaml] [--indent tabs|spaces] [--explain] [--max-assertions n] [--warn-as-error] [--program-dir dir] [--record dir|--replay dir]"
 )
 
 type cliExitError struct {
@@ -81,12 +96,19 @@ func newRootCmd(stdout, stderr io.Writer) *cobra.Command {
 	}
 	root.SetOut(stdout)
 	root.SetErr(stderr)
-	root.AddCommand(newEvalCmd(stdout), newRunCmd(stdout), newRequestCmd(stdout))
+	root.AddCommand(newEvalCmd(stdout), newAssertionsCmd(stdout), newRunCmd(stdout, stderr), newRequestCmd(stdout), newDiffCmd(stdout), newDebugCmd(stdout, stderr), newHealthCmd(stdout), newImportPostmanCmd(stdout, stderr), newEchoServerCmd(stdout))
 	return root
 }
 
 func newEvalCmd(stdout io.Writer) *cobra.Command {
-	var format string
+	var (
+		format            string
+		requireAssertions bool
+		strictJSON        bool
+		indent            string
+		warnAsError       bool
+		programDir        string
+	)
 	evalCmd := &cobra.Command{
 		Use:   "eval <program.pt>",
 		Short: "Static analysis only",
@@ -100,28 +122,83 @@ func newEvalCmd(stdout io.Writer) *cobra.Command {
 			if err := validateFormat(format); err != nil {
 				return &cliExitError{code: 2, msg: err.Error()}
 			}
-			_, _, allDiags := compileProgram(args[0])
+			lexOpt, err := parseIndent(indent)
+			if err != nil {
+				return &cliExitError{code: 2, msg: err.Error()}
+			}
+			entry, err := readProgramArg(args[0], programDir, cmd.InOrStdin())
+			if err != nil {
+				return &cliExitError{code: 2, msg: err.Error()}
+			}
+			_, _, allDiags := compileProgram(entry, lexOpt, compiler.Options{RequireAssertions: requireAssertions, StrictJSON: strictJSON})
 			allDiags = diagnostics.SortAndDedupe(allDiags)
-			if err := printCommandResult(stdout, "eval", format, allDiags, nil); err != nil {
+			if err := printCommandResult(stdout, "eval", format, false, warnAsError, allDiags, nil); err != nil {
 				return &cliExitError{code: 1, msg: fmt.Sprintf("failed to write output: %v", err)}
 			}
-			if len(allDiags) > 0 {
+			if hasFatalDiags(allDiags, warnAsError) {
 				return &cliExitError{code: 1}
 			}
 			return nil
 		},
 	}
 	evalCmd.Flags().StringVar(&format, "format", "pretty", "stdout format: pretty|json")
+	evalCmd.Flags().BoolVar(&requireAssertions, "require-assertions", false, "report requests used in flows that have no assertions")
+	evalCmd.Flags().BoolVar(&strictJSON, "strict-json", false, "report duplicate keys in json body object literals")
+	evalCmd.Flags().StringVar(&indent, "indent", "tabs", "block indentation: tabs|spaces")
+	evalCmd.Flags().BoolVar(&warnAsError, "warn-as-error", false, "exit nonzero when only warnings are reported")
+	evalCmd.Flags().StringVar(&programDir, "program-dir", "", "resolve relative imports of a program read from stdin (-) against this directory")
 	return evalCmd
 }
 
-func newRunCmd(stdout io.Writer) *cobra.Command {
+func newRunCmd(stdout, stderr io.Writer) *cobra.Command {
 	var (
 		format                string
 		reportDir             string
 		timeout               string
 		verbose               bool
 		hidePassingAssertions bool
+		logFile               string
+		logTo                 string
+		validateOnly          bool
+		reportStdout          bool
+		parallelRequests      int
+		grep                  string
+		summaryOnly           bool
+		noReport              bool
+		defaultAccept         string
+		onlyChanged           string
+		varFile               string
+		requireAssertions     bool
+		noProgress            bool
+		printConfig           bool
+		tags                  []string
+		transportRetries      int
+		transportRetryDelay   time.Duration
+		strictJSON            bool
+		baselineReport        string
+		failOnEmptySuite      bool
+		preflight             bool
+		jitter                string
+		seed                  int64
+		suiteName             string
+		prefixSuiteNames      bool
+		bundleSources         bool
+		indent                string
+		explain               bool
+		maxAssertions         int
+		quietSuccess          bool
+		correlationHeader     string
+		timeoutsAsFailures    bool
+		step                  bool
+		sharedVars            bool
+		captureBodies         bool
+		warnAsError           bool
+		countAssertions       bool
+		programDir            string
+		onlyFlowAsserts       bool
+		onlyRequestAsserts    bool
+		record                string
+		replay                string
 	)
 
 	runCmd := &cobra.Command{
@@ -137,7 +214,36 @@ func newRunCmd(stdout io.Writer) *cobra.Command {
 			if err := validateFormat(format); err != nil {
 				return &cliExitError{code: 2, msg: err.Error()}
 			}
-			runtimeOpt := runtime.Options{Verbose: verbose, LogWriter: stdout, SuppressPassingAssertions: hidePassingAssertions}
+			if summaryOnly && format != "json" {
+				return &cliExitError{code: 2, msg: "--summary-only requires --format json"}
+			}
+			lexOpt, err := parseIndent(indent)
+			if err != nil {
+				return &cliExitError{code: 2, msg: err.Error()}
+			}
+			if parallelRequests < 1 {
+				return &cliExitError{code: 2, msg: fmt.Sprintf("invalid --parallel-requests value %d (must be at least 1)", parallelRequests)}
+			}
+			if transportRetries < 0 {
+				return &cliExitError{code: 2, msg: fmt.Sprintf("invalid --retry-on-transport value %d (must not be negative)", transportRetries)}
+			}
+			if maxAssertions < 0 {
+				return &cliExitError{code: 2, msg: fmt.Sprintf("invalid --max-assertions value %d (must not be negative)", maxAssertions)}
+			}
+			if onlyFlowAsserts && onlyRequestAsserts {
+				return &cliExitError{code: 2, msg: "--only-flow-asserts and --only-request-asserts cannot be combined"}
+			}
+			runtimeOpt := runtime.Options{Verbose: verbose, SuppressPassingAssertions: hidePassingAssertions, ParallelRequests: parallelRequests, DefaultAccept: defaultAccept, TransportRetries: transportRetries, TransportRetryDelay: transportRetryDelay, JitterSeed: seed, Explain: explain, MaxAssertions: maxAssertions, CorrelationHeader: correlationHeader, TimeoutsAsFailures: timeoutsAsFailures, SharedVars: sharedVars, CaptureBodies: captureBodies, SkipRequestAsserts: onlyFlowAsserts, SkipFlowAsserts: onlyRequestAsserts}
+			if runtimeOpt.Client, err = recordReplayClient(record, replay); err != nil {
+				return &cliExitError{code: 2, msg: err.Error()}
+			}
+			if jitter != "" {
+				minDelay, maxDelay, err := parseJitter(jitter)
+				if err != nil {
+					return &cliExitError{code: 2, msg: err.Error()}
+				}
+				runtimeOpt.JitterMin, runtimeOpt.JitterMax = minDelay, maxDelay
+			}
 			if timeout != "" {
 				d, err := time.ParseDuration(timeout)
 				if err != nil {
@@ -145,31 +251,218 @@ func newRunCmd(stdout io.Writer) *cobra.Command {
 				}
 				runtimeOpt.TimeoutOverride = &d
 			}
+			if varFile != "" {
+				vars, err := loadVarFile(varFile)
+				if err != nil {
+					return &cliExitError{code: 2, msg: err.Error()}
+				}
+				runtimeOpt.Vars = vars
+			}
+			writeFiles := !noReport && (!reportStdout || cmd.Flags().Changed("report-dir"))
+			if printConfig {
+				cfg := runConfig{
+					Program:               args[0],
+					Format:                format,
+					ReportDir:             reportDir,
+					WriteReports:          writeFiles,
+					ReportStdout:          reportStdout,
+					SummaryOnly:           summaryOnly,
+					Verbose:               verbose,
+					HidePassingAssertions: hidePassingAssertions,
+					LogFile:               logFile,
+					LogTo:                 logTo,
+					ValidateOnly:          validateOnly,
+					ParallelRequests:      parallelRequests,
+					Grep:                  grep,
+					DefaultAccept:         defaultAccept,
+					OnlyChanged:           onlyChanged,
+					VarFile:               varFile,
+					Vars:                  runtimeOpt.Vars,
+					RequireAssertions:     requireAssertions,
+					Progress:              !noProgress && isTerminal(stderr),
+					Tags:                  tags,
+					TransportRetries:      transportRetries,
+					TransportRetryDelay:   transportRetryDelay.String(),
+					StrictJSON:            strictJSON,
+					BaselineReport:        baselineReport,
+					FailOnEmptySuite:      failOnEmptySuite,
+					Preflight:             preflight,
+					Jitter:                jitter,
+					Seed:                  seed,
+					SuiteName:             suiteName,
+					PrefixSuiteNames:      prefixSuiteNames,
+					BundleSources:         bundleSources,
+					Indent:                indent,
+					Explain:               explain,
+					MaxAssertions:         maxAssertions,
+					QuietSuccess:          quietSuccess,
+					CorrelationHeader:     correlationHeader,
+					TimeoutsAsFailures:    timeoutsAsFailures,
+					Step:                  step,
+					SharedVars:            sharedVars,
+					CaptureBodies:         captureBodies,
+					WarnAsError:           warnAsError,
+					CountAssertions:       countAssertions,
+					ProgramDir:            programDir,
+					OnlyFlowAsserts:       onlyFlowAsserts,
+					OnlyRequestAsserts:    onlyRequestAsserts,
+					Record:                record,
+					Replay:                replay,
+				}
+				if runtimeOpt.TimeoutOverride != nil {
+					cfg.Timeout = runtimeOpt.TimeoutOverride.String()
+				}
+				enc := json.NewEncoder(stdout)
+				enc.SetIndent("", "  ")
+				if err := enc.Encode(cfg); err != nil {
+					return &cliExitError{code: 1, msg: fmt.Sprintf("failed to write output: %v", err)}
+				}
+				return nil
+			}
+			var baseline *report.Model
+			if baselineReport != "" {
+				m, err := report.ReadJSONFile(baselineReport)
+				if err != nil {
+					return &cliExitError{code: 2, msg: err.Error()}
+				}
+				baseline = &m
+			}
+			logStdout := stdout
+			if reportStdout {
+				logStdout = stderr
+			}
+			// With --quiet-success the terminal log is held back until the
+			// run result is known; --log-file still receives everything.
+			var quietLog bytes.Buffer
+			logTerminal := logStdout
+			if quietSuccess {
+				logTerminal = &quietLog
+			}
+			logWriter, closeLog, err := openLogWriter(logTerminal, logFile, logTo)
+			if err != nil {
+				return &cliExitError{code: 2, msg: err.Error()}
+			}
+			defer func() { _ = closeLog() }()
+			runtimeOpt.LogWriter = logWriter
 
-			plan, _, allDiags := compileProgram(args[0])
+			entry, err := readProgramArg(args[0], programDir, cmd.InOrStdin())
+			if err != nil {
+				return &cliExitError{code: 2, msg: err.Error()}
+			}
+			plan, mods, allDiags := compileProgram(entry, lexOpt, compiler.Options{Vars: varNames(runtimeOpt.Vars), RequireAssertions: requireAssertions, StrictJSON: strictJSON, SharedVars: sharedVars})
 			allDiags = diagnostics.SortAndDedupe(allDiags)
-			if len(allDiags) > 0 {
-				if err := printCommandResult(stdout, "run", format, allDiags, nil); err != nil {
+			if hasFatalDiags(allDiags, warnAsError) {
+				if err := printCommandResult(stdout, "run", format, summaryOnly, warnAsError, allDiags, nil); err != nil {
 					return &cliExitError{code: 1, msg: fmt.Sprintf("failed to write output: %v", err)}
 				}
 				return &cliExitError{code: 1}
 			}
+			// Only warnings are left; they are printed with the run's
+			// diagnostics but stay out of the report.
+			warnings := allDiags
+			if grep != "" {
+				plan.Flows = grepFlows(plan.Flows, grep)
+			}
+			if len(tags) > 0 {
+				plan.Flows = tagFlows(plan, tags)
+			}
+			if onlyChanged != "" {
+				changed, err := changedFiles(filepath.Dir(entry.path), onlyChanged)
+				if err != nil {
+					_, _ = fmt.Fprintf(stderr, "warning: --only-changed ignored: %v\n", err)
+				} else if !programChanged(mods, changed) {
+					plan.Flows = nil
+				}
+			}
+			if failOnEmptySuite && len(plan.Flows) == 0 {
+				return &cliExitError{code: 1, msg: "no flows selected to run (--fail-on-empty-suite)"}
+			}
 
-			if err := os.MkdirAll(reportDir, 0o755); err != nil {
-				return &cliExitError{code: 1, msg: fmt.Sprintf("failed to create report directory: %v", err)}
+			if validateOnly {
+				diags := diagnostics.SortAndDedupe(runtime.Validate(plan))
+				if err := printCommandResult(stdout, "run", format, summaryOnly, warnAsError, diags, nil); err != nil {
+					return &cliExitError{code: 1, msg: fmt.Sprintf("failed to write output: %v", err)}
+				}
+				if len(diags) > 0 {
+					return &cliExitError{code: 1}
+				}
+				if format == "pretty" {
+					_, _ = fmt.Fprintln(stdout, "OK")
+				}
+				return nil
 			}
 
+			if preflight && len(plan.Flows) > 0 {
+				if d := runtime.Preflight(context.Background(), plan, runtimeOpt); d != nil {
+					if err := printCommandResult(stdout, "run", format, summaryOnly, warnAsError, []diagnostics.Diagnostic{*d}, nil); err != nil {
+						return &cliExitError{code: 1, msg: fmt.Sprintf("failed to write output: %v", err)}
+					}
+					return &cliExitError{code: 1}
+				}
+			}
+			if writeFiles {
+				if err := os.MkdirAll(reportDir, 0o755); err != nil {
+					return &cliExitError{code: 1, msg: fmt.Sprintf("failed to create report directory: %v", err)}
+				}
+			}
+
+			if !noProgress && isTerminal(stderr) {
+				runtimeOpt.OnFlowDone = progressReporter(stderr, len(plan.Flows))
+			}
+			if step && isTerminal(stdout) {
+				runtimeOpt.StepPause = stepPauser(cmd.InOrStdin(), stderr)
+			}
 			result := runtime.Execute(context.Background(), plan, runtimeOpt)
 			result.Diags = diagnostics.SortAndDedupe(result.Diags)
 			model := report.Build(plan, result)
+			if countAssertions {
+				model.Assertions = &report.AssertionSummary{Total: result.Assertions.Passed + result.Assertions.Failed, Passed: result.Assertions.Passed, Failed: result.Assertions.Failed, Skipped: result.Assertions.Skipped}
+			}
+			quiet := quietSuccess && len(result.Diags) == 0
+			if quietSuccess && !quiet {
+				_, _ = quietLog.WriteTo(logStdout)
+			}
 
-			if err := writeRunReports(reportDir, model); err != nil {
-				return &cliExitError{code: 1, msg: fmt.Sprintf("failed to write reports: %v", err)}
+			if writeFiles {
+				if err := writeRunReports(reportDir, model, report.JUnitOptions{SuiteName: suiteName, PrefixSuites: prefixSuiteNames}); err != nil {
+					return &cliExitError{code: 1, msg: fmt.Sprintf("failed to write reports: %v", err)}
+				}
+				if bundleSources {
+					if err := bundleProgramSources(reportDir, entry, mods); err != nil {
+						return &cliExitError{code: 1, msg: fmt.Sprintf("failed to bundle sources: %v", err)}
+					}
+				}
+				if err := writeCapturedBodies(reportDir, result.Bodies); err != nil {
+					return &cliExitError{code: 1, msg: fmt.Sprintf("failed to write response bodies: %v", err)}
+				}
 			}
 
-			if err := printCommandResult(stdout, "run", format, result.Diags, &model); err != nil {
+			if reportStdout {
+				if err := report.WriteJSON(stdout, model); err != nil {
+					return &cliExitError{code: 1, msg: fmt.Sprintf("failed to write output: %v", err)}
+				}
+			} else if quiet && format == "pretty" {
+				// A passing run prints nothing with --quiet-success.
+			} else if err := printCommandResult(stdout, "run", format, summaryOnly, warnAsError, diagnostics.SortAndDedupe(append(warnings, result.Diags...)), &model); err != nil {
 				return &cliExitError{code: 1, msg: fmt.Sprintf("failed to write output: %v", err)}
 			}
+			if result.Stopped {
+				return &cliExitError{code: 1, msg: fmt.Sprintf("run stopped: %d step(s) not run", len(result.NotRun))}
+			}
+			if baseline != nil {
+				regressions := baselineRegressions(*baseline, model)
+				for _, c := range regressions {
+					before := c.Old
+					if before == "" {
+						before = "-"
+					}
+					_, _ = fmt.Fprintf(stderr, "regression %s :: %s (%s -> %s)\n", c.Suite, c.Testcase, before, c.New)
+				}
+				if len(regressions) > 0 {
+					return &cliExitError{code: 1}
+				}
+				return nil
+			}
 			if len(result.Diags) > 0 {
 				return &cliExitError{code: 1}
 			}
@@ -181,15 +474,550 @@ func newRunCmd(stdout io.Writer) *cobra.Command {
 	runCmd.Flags().StringVar(&timeout, "timeout", "", "override timeout setting, e.g. 2s")
 	runCmd.Flags().BoolVar(&verbose, "verbose", false, "print verbose execution logs")
 	runCmd.Flags().BoolVar(&hidePassingAssertions, "hide-passing-assertions", false, "suppress printing successful assertions")
+	runCmd.Flags().StringVar(&logFile, "log-file", "", "also write assertion and verbose logs to this file")
+	runCmd.Flags().StringVar(&logTo, "log-to", "both", "log destination when --log-file is set: stdout|file|both")
+	runCmd.Flags().BoolVar(&validateOnly, "validate-only", false, "compile and dry-run request rendering without sending HTTP requests")
+	runCmd.Flags().BoolVar(&reportStdout, "report-stdout", false, "write the JSON report to stdout instead of report files (logs go to stderr)")
+	runCmd.Flags().IntVar(&parallelRequests, "parallel-requests", 1, "max concurrent steps per flow; steps with depends_on may overlap")
+	runCmd.Flags().StringVar(&grep, "grep", "", "only run flows whose name, request, or binding contains this text (case-insensitive)")
+	runCmd.Flags().BoolVar(&summaryOnly, "summary-only", false, "with --format json, print only ok/tests/failures/errors/flows")
+	runCmd.Flags().BoolVar(&noReport, "no-report", false, "skip writing report artifacts")
+	runCmd.Flags().StringVar(&defaultAccept, "default-accept", "application/json", "Accept header sent when a request sets none; empty disables it")
+	runCmd.Flags().StringVar(&onlyChanged, "only-changed", "", "skip all flows unless the program or its imports changed since this git ref")
+	runCmd.Flags().StringVar(&varFile, "var-file", "", "JSON or YAML file whose top-level keys are defined as global variables")
+	runCmd.Flags().BoolVar(&requireAssertions, "require-assertions", false, "report requests used in flows that have no assertions")
+	runCmd.Flags().BoolVar(&noProgress, "no-progress", false, "do not print per-flow progress to stderr")
+	runCmd.Flags().BoolVar(&printConfig, "print-config", false, "print the resolved run options as JSON and exit without running")
+	runCmd.Flags().StringArrayVar(&tags, "tag", nil, "only run flows tagged with this tag or containing a tagged request (repeatable)")
+	runCmd.Flags().IntVar(&transportRetries, "retry-on-transport", 0, "resend a request up to n times after a transport error")
+	runCmd.Flags().DurationVar(&transportRetryDelay, "retry-on-transport-delay", 500*time.Millisecond, "wait between --retry-on-transport attempts")
+	runCmd.Flags().BoolVar(&strictJSON, "strict-json", false, "report duplicate keys in json body object literals")
+	runCmd.Flags().BoolVar(&failOnEmptySuite, "fail-on-empty-suite", false, "exit non-zero when no flows are left to run after filtering")
+	runCmd.Flags().BoolVar(&preflight, "preflight", false, "check that the base URL is reachable before running flows")
+	runCmd.Flags().StringVar(&jitter, "jitter", "", "sleep a random duration in this range before each request, e.g. 100ms-500ms")
+	runCmd.Flags().Int64Var(&seed, "seed", 0, "seed for --jitter delays; 0 picks a random seed")
+	runCmd.Flags().StringVar(&suiteName, "suite-name", "", "name attribute for the root testsuites element of JUnit reports")
+	runCmd.Flags().BoolVar(&prefixSuiteNames, "prefix-suite-names", false, "with --suite-name, prefix every JUnit suite name with it")
+	runCmd.Flags().BoolVar(&bundleSources, "bundle-sources", false, "copy the entry program and its imports into <report-dir>/sources")
+	runCmd.Flags().StringVar(&indent, "indent", "tabs", "block indentation: tabs|spaces")
+	runCmd.Flags().BoolVar(&explain, "explain", false, "show a structural diff when == fails between objects or arrays")
+	runCmd.Flags().IntVar(&maxAssertions, "max-assertions", 0, "cap printed assertion lines per request; 0 prints all")
+	runCmd.Flags().BoolVar(&timeoutsAsFailures, "timeouts-as-failures", false, "report request timeouts as E_RUNTIME_TIMEOUT test failures instead of errors")
+	runCmd.Flags().BoolVar(&captureBodies, "capture-bodies-on-failure", false, "write the raw response of each failing request to <report-dir>/bodies")
+	runCmd.Flags().BoolVar(&warnAsError, "warn-as-error", false, "exit nonzero when only warnings are reported")
+	runCmd.Flags().BoolVar(&countAssertions, "count-assertions", false, "add evaluated, passed, and failed assertion counts to the summary")
+	runCmd.Flags().BoolVar(&onlyFlowAsserts, "only-flow-asserts", false, "evaluate only flow assertions; request assertions are reported as skipped")
+	runCmd.Flags().BoolVar(&onlyRequestAsserts, "only-request-asserts", false, "evaluate only request assertions; flow assertions are reported as skipped")
+	runCmd.Flags().StringVar(&record, "record", "", "save every response under this directory for --replay")
+	runCmd.Flags().StringVar(&replay, "replay", "", "answer requests from responses saved by --record instead of the network")
+	runCmd.Flags().StringVar(&programDir, "program-dir", "", "resolve relative imports of a program read from stdin (-) against this directory")
+	runCmd.Flags().BoolVar(&sharedVars, "shared-vars", false, "carry variables set in one flow into the flows after it, in name order")
+	runCmd.Flags().BoolVar(&step, "step", false, "pause after each request until Enter is pressed (q quits); ignored when stdout is not a terminal")
+	runCmd.Flags().StringVar(&correlationHeader, "correlation-header", "", "send the run id in this header on every request")
+	runCmd.Flags().BoolVar(&quietSuccess, "quiet-success", false, "print nothing when every flow passes; print the full output on failure")
+	runCmd.Flags().StringVar(&baselineReport, "baseline-report", "", "JSON report of known results; exit non-zero only for testcases that newly fail")
 	return runCmd
 }
 
+// runConfig is the effective run configuration printed by --print-config.
+type runConfig struct {
+	Program               string         `json:"program"`
+	Format                string         `json:"format"`
+	ReportDir             string         `json:"report_dir"`
+	WriteReports          bool           `json:"write_reports"`
+	ReportStdout          bool           `json:"report_stdout"`
+	SummaryOnly           bool           `json:"summary_only"`
+	Timeout               string         `json:"timeout,omitempty"`
+	Verbose               bool           `json:"verbose"`
+	HidePassingAssertions bool           `json:"hide_passing_assertions"`
+	LogFile               string         `json:"log_file,omitempty"`
+	LogTo                 string         `json:"log_to"`
+	ValidateOnly          bool           `json:"validate_only"`
+	ParallelRequests      int            `json:"parallel_requests"`
+	Grep                  string         `json:"grep,omitempty"`
+	DefaultAccept         string         `json:"default_accept"`
+	OnlyChanged           string         `json:"only_changed,omitempty"`
+	VarFile               string         `json:"var_file,omitempty"`
+	Vars                  map[string]any `json:"vars,omitempty"`
+	RequireAssertions     bool           `json:"require_assertions"`
+	Progress              bool           `json:"progress"`
+	Tags                  []string       `json:"tags,omitempty"`
+	TransportRetries      int            `json:"retry_on_transport"`
+	TransportRetryDelay   string         `json:"retry_on_transport_delay"`
+	StrictJSON            bool           `json:"strict_json"`
+	BaselineReport        string         `json:"baseline_report,omitempty"`
+	FailOnEmptySuite      bool           `json:"fail_on_empty_suite"`
+	Preflight             bool           `json:"preflight"`
+	Jitter                string         `json:"jitter,omitempty"`
+	Seed                  int64          `json:"seed,omitempty"`
+	SuiteName             string         `json:"suite_name,omitempty"`
+	PrefixSuiteNames      bool           `json:"prefix_suite_names"`
+	BundleSources         bool           `json:"bundle_sources"`
+	Indent                string         `json:"indent"`
+	Explain               bool           `json:"explain"`
+	MaxAssertions         int            `json:"max_assertions,omitempty"`
+	QuietSuccess          bool           `json:"quiet_success"`
+	CorrelationHeader     string         `json:"correlation_header,omitempty"`
+	TimeoutsAsFailures    bool           `json:"timeouts_as_failures"`
+	Step                  bool           `json:"step"`
+	SharedVars            bool           `json:"shared_vars"`
+	CaptureBodies         bool           `json:"capture_bodies_on_failure"`
+	WarnAsError           bool           `json:"warn_as_error"`
+	CountAssertions       bool           `json:"count_assertions"`
+	ProgramDir            string         `json:"program_dir,omitempty"`
+	OnlyFlowAsserts       bool           `json:"only_flow_asserts"`
+	OnlyRequestAsserts    bool           `json:"only_request_asserts"`
+	Record                string         `json:"record,omitempty"`
+	Replay                string         `json:"replay,omitempty"`
+}
+
+func newAssertionsCmd(stdout io.Writer) *cobra.Command {
+	var (
+		format string
+		indent string
+	)
+	assertionsCmd := &cobra.Command{
+		Use:   "assertions <program.pt>",
+		Short: "List every assertion in a program without running it",
+		Args: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return &cliExitError{code: 2, msg: "usage: " + assertsUsage}
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := validateFormat(format); err != nil {
+				return &cliExitError{code: 2, msg: err.Error()}
+			}
+			lexOpt, err := parseIndent(indent)
+			if err != nil {
+				return &cliExitError{code: 2, msg: err.Error()}
+			}
+			plan, mods, allDiags := compileProgram(programEntry{path: args[0]}, lexOpt, compiler.Options{})
+			allDiags = diagnostics.SortAndDedupe(allDiags)
+			if hasFatalDiags(allDiags, false) {
+				if err := printCommandResult(stdout, "assertions", format, false, false, allDiags, nil); err != nil {
+					return &cliExitError{code: 1, msg: fmt.Sprintf("failed to write output: %v", err)}
+				}
+				return &cliExitError{code: 1}
+			}
+			if err := printAssertions(stdout, format, compiler.Assertions(plan, mods)); err != nil {
+				return &cliExitError{code: 1, msg: fmt.Sprintf("failed to write output: %v", err)}
+			}
+			return nil
+		},
+	}
+	assertionsCmd.Flags().StringVar(&format, "format", "pretty", "stdout format: pretty|json")
+	assertionsCmd.Flags().StringVar(&indent, "indent", "tabs", "block indentation: tabs|spaces")
+	return assertionsCmd
+}
+
+func printAssertions(stdout io.Writer, format string, asserts []compiler.Assertion) error {
+	if format == "json" {
+		if asserts == nil {
+			asserts = []compiler.Assertion{}
+		}
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(struct {
+			Count      int                  `json:"count"`
+			Assertions []compiler.Assertion `json:"assertions"`
+		}{len(asserts), asserts})
+	}
+	for _, a := range asserts {
+		var owner []string
+		if a.Flow != "" {
+			owner = append(owner, fmt.Sprintf("flow %q", a.Flow))
+		}
+		if a.Request != "" {
+			owner = append(owner, "request "+a.Request)
+		}
+		if _, err := fmt.Fprintf(stdout, "%s:%d:%d %s ? %s\n", a.File, a.Line, a.Column, strings.Join(owner, " "), a.Expr); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(stdout, "assertions=%d\n", len(asserts))
+	return err
+}
+
+func newDiffCmd(stdout io.Writer) *cobra.Command {
+	var format string
+	diffCmd := &cobra.Command{
+		Use:   "diff <old-report.json> <new-report.json>",
+		Short: "Compare two JSON reports",
+		Args: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 2 {
+				return &cliExitError{code: 2, msg: "usage: " + diffUsage}
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := validateFormat(format); err != nil {
+				return &cliExitError{code: 2, msg: err.Error()}
+			}
+			oldModel, err := report.ReadJSONFile(args[0])
+			if err != nil {
+				return &cliExitError{code: 2, msg: err.Error()}
+			}
+			newModel, err := report.ReadJSONFile(args[1])
+			if err != nil {
+				return &cliExitError{code: 2, msg: err.Error()}
+			}
+			changes := report.Diff(oldModel, newModel)
+			newFailures := 0
+			for _, c := range changes {
+				if c.NewFailure() {
+					newFailures++
+				}
+			}
+			if err := printDiffResult(stdout, format, changes, newFailures); err != nil {
+				return &cliExitError{code: 1, msg: fmt.Sprintf("failed to write output: %v", err)}
+			}
+			if newFailures > 0 {
+				return &cliExitError{code: 1}
+			}
+			return nil
+		},
+	}
+	diffCmd.Flags().StringVar(&format, "format", "pretty", "stdout format: pretty|json")
+	return diffCmd
+}
+
+// baselineRegressions returns testcases that fail now but passed, or did not
+// exist, in the baseline report.
+func baselineRegressions(baseline, current report.Model) []report.Change {
+	var out []report.Change
+	for _, c := range report.Diff(baseline, current) {
+		if c.NewFailure() {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+func printDiffResult(stdout io.Writer, format string, changes []report.Change, newFailures int) error {
+	if format == "json" {
+		if changes == nil {
+			changes = []report.Change{}
+		}
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(struct {
+			Changes     []report.Change `json:"changes"`
+			NewFailures int             `json:"new_failures"`
+		}{changes, newFailures})
+	}
+	if len(changes) == 0 {
+		_, err := fmt.Fprintln(stdout, "no changes")
+		return err
+	}
+	for _, c := range changes {
+		before, after := c.Old, c.New
+		if before == "" {
+			before = "-"
+		}
+		if after == "" {
+			after = "-"
+		}
+		if _, err := fmt.Fprintf(stdout, "%s %s :: %s (%s -> %s)\n", c.Kind, c.Suite, c.Testcase, before, after); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(stdout, "changes=%d new_failures=%d\n", len(changes), newFailures)
+	return err
+}
+
+func newHealthCmd(stdout io.Writer) *cobra.Command {
+	var (
+		format  string
+		timeout time.Duration
+		indent  string
+	)
+	healthCmd := &cobra.Command{
+		Use:   "health <program.pt>",
+		Short: "Compile a program and check that its targets are reachable",
+		Args: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return &cliExitError{code: 2, msg: "usage: " + healthUsage}
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := validateFormat(format); err != nil {
+				return &cliExitError{code: 2, msg: err.Error()}
+			}
+			if timeout <= 0 {
+				return &cliExitError{code: 2, msg: fmt.Sprintf("invalid --timeout value %s (must be positive)", timeout)}
+			}
+			lexOpt, err := parseIndent(indent)
+			if err != nil {
+				return &cliExitError{code: 2, msg: err.Error()}
+			}
+			plan, _, allDiags := compileProgram(programEntry{path: args[0]}, lexOpt, compiler.Options{})
+			allDiags = diagnostics.SortAndDedupe(allDiags)
+			if hasFatalDiags(allDiags, false) {
+				if err := printCommandResult(stdout, "health", format, false, false, allDiags, nil); err != nil {
+					return &cliExitError{code: 1, msg: fmt.Sprintf("failed to write output: %v", err)}
+				}
+				return &cliExitError{code: 1}
+			}
+			results := runtime.CheckHealth(context.Background(), runtime.Targets(plan, runtime.Options{}), nil, timeout)
+			if err := printHealth(stdout, format, results); err != nil {
+				return &cliExitError{code: 1, msg: fmt.Sprintf("failed to write output: %v", err)}
+			}
+			if countUnreachable(results) > 0 {
+				return &cliExitError{code: 1}
+			}
+			return nil
+		},
+	}
+	healthCmd.Flags().StringVar(&format, "format", "pretty", "stdout format: pretty|json")
+	healthCmd.Flags().DurationVar(&timeout, "timeout", 3*time.Second, "timeout for each reachability check")
+	healthCmd.Flags().StringVar(&indent, "indent", "tabs", "block indentation: tabs|spaces")
+	return healthCmd
+}
+
+func printHealth(stdout io.Writer, format string, results []runtime.TargetHealth) error {
+	if format == "json" {
+		if results == nil {
+			results = []runtime.TargetHealth{}
+		}
+		return json.NewEncoder(stdout).Encode(struct {
+			OK      bool                   `json:"ok"`
+			Targets []runtime.TargetHealth `json:"targets"`
+		}{countUnreachable(results) == 0, results})
+	}
+	for _, r := range results {
+		if r.Reachable {
+			if _, err := fmt.Fprintf(stdout, "reachable   %s\n", r.Target); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := fmt.Fprintf(stdout, "unreachable %s (%s)\n", r.Target, r.Error); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(stdout, "summary: targets=%d unreachable=%d\n", len(results), countUnreachable(results))
+	return err
+}
+
+func countUnreachable(results []runtime.TargetHealth) int {
+	n := 0
+	for _, r := range results {
+		if !r.Reachable {
+			n++
+		}
+	}
+	return n
+}
+
+func newImportPostmanCmd(stdout, stderr io.Writer) *cobra.Command {
+	var (
+		output string
+		flows  bool
+	)
+	importCmd := &cobra.Command{
+		Use:   "import-postman <collection.json>",
+		Short: "Convert a Postman v2.1 collection into a pipetest program",
+		Args: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return &cliExitError{code: 2, msg: "usage: " + importUsage}
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			data, err := os.ReadFile(args[0])
+			if err != nil {
+				return &cliExitError{code: 2, msg: err.Error()}
+			}
+			program, warnings, err := postman.Convert(data, postman.Options{FoldersAsFlows: flows})
+			if err != nil {
+				return &cliExitError{code: 1, msg: err.Error()}
+			}
+			for _, w := range warnings {
+				_, _ = fmt.Fprintf(stderr, "warning: %s\n", w)
+			}
+			if output == "" {
+				if _, err := io.WriteString(stdout, program); err != nil {
+					return &cliExitError{code: 1, msg: fmt.Sprintf("failed to write output: %v", err)}
+				}
+				return nil
+			}
+			if err := os.WriteFile(output, []byte(program), 0o644); err != nil {
+				return &cliExitError{code: 1, msg: fmt.Sprintf("failed to write output: %v", err)}
+			}
+			return nil
+		},
+	}
+	importCmd.Flags().StringVarP(&output, "output", "o", "", "write the program to this file instead of stdout")
+	importCmd.Flags().BoolVar(&flows, "flows", false, "emit a flow per folder chaining its requests")
+	return importCmd
+}
+
+func newEchoServerCmd(stdout io.Writer) *cobra.Command {
+	var addr string
+	echoCmd := &cobra.Command{
+		Use:   "echo-server",
+		Short: "Serve an endpoint that echoes each request back as JSON",
+		Args: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 0 {
+				return &cliExitError{code: 2, msg: "usage: " + echoUsage}
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ln, err := net.Listen("tcp", addr)
+			if err != nil {
+				return &cliExitError{code: 1, msg: fmt.Sprintf("failed to listen: %v", err)}
+			}
+			if err := serveEcho(ln, stdout); err != nil {
+				return &cliExitError{code: 1, msg: err.Error()}
+			}
+			return nil
+		},
+	}
+	echoCmd.Flags().StringVar(&addr, "addr", ":8080", "address to listen on")
+	return echoCmd
+}
+
+// serveEcho answers every request on ln with its method, path, headers,
+// query, and body until ln is closed.
+func serveEcho(ln net.Listener, stdout io.Writer) error {
+	_, _ = fmt.Fprintf(stdout, "echo server listening on http://%s\n", ln.Addr())
+	err := http.Serve(ln, http.HandlerFunc(echoRequest))
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+func echoRequest(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	headers := map[string]any{}
+	for k, vals := range r.Header {
+		headers[k] = echoValues(vals)
+	}
+	query := map[string]any{}
+	for k, vals := range r.URL.Query() {
+		query[k] = echoValues(vals)
+	}
+	out := map[string]any{
+		"method":  r.Method,
+		"path":    r.URL.Path,
+		"headers": headers,
+		"query":   query,
+		"body":    string(body),
+	}
+	// A JSON body is also echoed as JSON so # paths can reach into it. It is
+	// copied verbatim, so large integers come back exactly as they were sent.
+	if json.Valid(body) {
+		out["json"] = json.RawMessage(body)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(out)
+}
+
+// echoValues collapses single-valued headers and query parameters to a
+// string, matching how header values are exposed to assertions.
+func echoValues(vals []string) any {
+	if len(vals) == 1 {
+		return vals[0]
+	}
+	return vals
+}
+
+func newDebugCmd(stdout, stderr io.Writer) *cobra.Command {
+	debugCmd := &cobra.Command{
+		Use:   "debug",
+		Short: "Print lexer and parser output for bug reports",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return &cliExitError{code: 2, msg: "usage: " + debugUsage}
+		},
+	}
+	args := func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return &cliExitError{code: 2, msg: "usage: " + debugUsage}
+		}
+		return nil
+	}
+	debugCmd.AddCommand(&cobra.Command{
+		Use:   "tokens <program.pt>",
+		Short: "Print the lexer token stream as JSON",
+		Args:  args,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			src, err := os.ReadFile(args[0])
+			if err != nil {
+				return &cliExitError{code: 2, msg: err.Error()}
+			}
+			tokens, lexErrs := lexer.Lex(args[0], string(src))
+			var errs []diagnostics.Diagnostic
+			for _, e := range lexErrs {
+				errs = append(errs, diagnostics.Diagnostic{Severity: "error", Code: e.Code, Message: e.Message, File: e.File, Line: e.Span.Start.Line, Column: e.Span.Start.Column, Hint: e.Hint})
+			}
+			return printDebugOutput(stdout, stderr, lexer.SnapshotTokens(tokens), errs)
+		},
+	}, &cobra.Command{
+		Use:   "ast <program.pt>",
+		Short: "Print the parsed AST as JSON",
+		Args:  args,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			src, err := os.ReadFile(args[0])
+			if err != nil {
+				return &cliExitError{code: 2, msg: err.Error()}
+			}
+			prog, lexErrs, parseErrs := parser.Parse(args[0], string(src))
+			var errs []diagnostics.Diagnostic
+			for _, e := range lexErrs {
+				errs = append(errs, diagnostics.Diagnostic{Severity: "error", Code: e.Code, Message: e.Message, File: e.File, Line: e.Span.Start.Line, Column: e.Span.Start.Column, Hint: e.Hint})
+			}
+			for _, e := range parseErrs {
+				errs = append(errs, diagnostics.Diagnostic{Severity: "error", Code: e.Code, Message: e.Message, File: e.File, Line: e.Span.Start.Line, Column: e.Span.Start.Column, Hint: e.Hint})
+			}
+			return printDebugOutput(stdout, stderr, parser.Snapshot(prog), errs)
+		},
+	})
+	return debugCmd
+}
+
+// printDebugOutput writes a snapshot as indented JSON even when there were
+// errors, so partial output can be attached to bug reports.
+func printDebugOutput(stdout, stderr io.Writer, snapshot any, errs []diagnostics.Diagnostic) error {
+	enc := json.NewEncoder(stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(snapshot); err != nil {
+		return &cliExitError{code: 1, msg: fmt.Sprintf("failed to write output: %v", err)}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	if err := printCommandResult(stderr, "debug", "pretty", false, false, errs, nil); err != nil {
+		return &cliExitError{code: 1, msg: fmt.Sprintf("failed to write output: %v", err)}
+	}
+	return &cliExitError{code: 1}
+}
+
 func newRequestCmd(stdout io.Writer) *cobra.Command {
 	var (
 		format                string
 		timeout               string
 		verbose               bool
 		hidePassingAssertions bool
+		defaultAccept         string
+		varFile               string
+		indent                string
+		explain               bool
+		maxAssertions         int
+		warnAsError           bool
+		programDir            string
+		record                string
+		replay                string
 	)
 
 	requestCmd := &cobra.Command{
@@ -205,7 +1033,17 @@ func newRequestCmd(stdout io.Writer) *cobra.Command {
 			if err := validateFormat(format); err != nil {
 				return &cliExitError{code: 2, msg: err.Error()}
 			}
-			runtimeOpt := runtime.Options{Verbose: verbose, LogWriter: stdout, SuppressPassingAssertions: hidePassingAssertions}
+			lexOpt, err := parseIndent(indent)
+			if err != nil {
+				return &cliExitError{code: 2, msg: err.Error()}
+			}
+			if maxAssertions < 0 {
+				return &cliExitError{code: 2, msg: fmt.Sprintf("invalid --max-assertions value %d (must not be negative)", maxAssertions)}
+			}
+			runtimeOpt := runtime.Options{Verbose: verbose, LogWriter: stdout, SuppressPassingAssertions: hidePassingAssertions, DefaultAccept: defaultAccept, Explain: explain, MaxAssertions: maxAssertions}
+			if runtimeOpt.Client, err = recordReplayClient(record, replay); err != nil {
+				return &cliExitError{code: 2, msg: err.Error()}
+			}
 			if timeout != "" {
 				d, err := time.ParseDuration(timeout)
 				if err != nil {
@@ -213,15 +1051,27 @@ func newRequestCmd(stdout io.Writer) *cobra.Command {
 				}
 				runtimeOpt.TimeoutOverride = &d
 			}
+			if varFile != "" {
+				vars, err := loadVarFile(varFile)
+				if err != nil {
+					return &cliExitError{code: 2, msg: err.Error()}
+				}
+				runtimeOpt.Vars = vars
+			}
 
-			plan, _, allDiags := compileProgram(args[0])
+			entry, err := readProgramArg(args[0], programDir, cmd.InOrStdin())
+			if err != nil {
+				return &cliExitError{code: 2, msg: err.Error()}
+			}
+			plan, _, allDiags := compileProgram(entry, lexOpt, compiler.Options{Vars: varNames(runtimeOpt.Vars)})
 			allDiags = diagnostics.SortAndDedupe(allDiags)
-			if len(allDiags) > 0 {
-				if err := printCommandResult(stdout, "request", format, allDiags, nil); err != nil {
+			if hasFatalDiags(allDiags, warnAsError) {
+				if err := printCommandResult(stdout, "request", format, false, warnAsError, allDiags, nil); err != nil {
 					return &cliExitError{code: 1, msg: fmt.Sprintf("failed to write output: %v", err)}
 				}
 				return &cliExitError{code: 1}
 			}
+			warnings := allDiags
 
 			requestName := args[1]
 			found := false
@@ -244,7 +1094,7 @@ func newRequestCmd(stdout io.Writer) *cobra.Command {
 
 			result := runtime.Execute(context.Background(), &single, runtimeOpt)
 			result.Diags = diagnostics.SortAndDedupe(result.Diags)
-			if err := printCommandResult(stdout, "request", format, result.Diags, nil); err != nil {
+			if err := printCommandResult(stdout, "request", format, false, warnAsError, diagnostics.SortAndDedupe(append(warnings, result.Diags...)), nil); err != nil {
 				return &cliExitError{code: 1, msg: fmt.Sprintf("failed to write output: %v", err)}
 			}
 			if len(result.Diags) > 0 {
@@ -257,24 +1107,208 @@ func newRequestCmd(stdout io.Writer) *cobra.Command {
 	requestCmd.Flags().StringVar(&timeout, "timeout", "", "override timeout setting, e.g. 2s")
 	requestCmd.Flags().BoolVar(&verbose, "verbose", false, "print verbose execution logs")
 	requestCmd.Flags().BoolVar(&hidePassingAssertions, "hide-passing-assertions", false, "suppress printing successful assertions")
+	requestCmd.Flags().StringVar(&defaultAccept, "default-accept", "application/json", "Accept header sent when a request sets none; empty disables it")
+	requestCmd.Flags().StringVar(&varFile, "var-file", "", "JSON or YAML file whose top-level keys are defined as global variables")
+	requestCmd.Flags().StringVar(&indent, "indent", "tabs", "block indentation: tabs|spaces")
+	requestCmd.Flags().BoolVar(&explain, "explain", false, "show a structural diff when == fails between objects or arrays")
+	requestCmd.Flags().IntVar(&maxAssertions, "max-assertions", 0, "cap printed assertion lines per request; 0 prints all")
+	requestCmd.Flags().BoolVar(&warnAsError, "warn-as-error", false, "exit nonzero when only warnings are reported")
+	requestCmd.Flags().StringVar(&programDir, "program-dir", "", "resolve relative imports of a program read from stdin (-) against this directory")
+	requestCmd.Flags().StringVar(&record, "record", "", "save every response under this directory for --replay")
+	requestCmd.Flags().StringVar(&replay, "replay", "", "answer requests from responses saved by --record instead of the network")
 	return requestCmd
 }
 
+func parseIndent(value string) (lexer.Options, error) {
+	switch value {
+	case "tabs":
+		return lexer.Options{Indent: lexer.IndentTabs}, nil
+	case "spaces":
+		return lexer.Options{Indent: lexer.IndentSpaces}, nil
+	}
+	return lexer.Options{}, fmt.Errorf("unknown --indent %q (expected tabs|spaces)", value)
+}
+
 func validateFormat(format string) error {
-	if format != "pretty" && format != "json" {
-		return fmt.Errorf("unknown --format %q (expected pretty|json)", format)
+	if _, ok := formatters[format]; !ok {
+		return fmt.Errorf("unknown --format %q (expected %s)", format, strings.Join(formatterNames, "|"))
 	}
 	return nil
 }
 
-func writeRunReports(reportDir string, model report.Model) error {
+func openLogWriter(stdout io.Writer, logFile, logTo string) (io.Writer, func() error, error) {
+	noop := func() error { return nil }
+	switch logTo {
+	case "stdout", "file", "both":
+	default:
+		return nil, noop, fmt.Errorf("unknown --log-to %q (expected stdout|file|both)", logTo)
+	}
+	if logFile == "" {
+		if logTo == "file" {
+			return nil, noop, errors.New("--log-to file requires --log-file")
+		}
+		return stdout, noop, nil
+	}
+	if logTo == "stdout" {
+		return stdout, noop, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(logFile), 0o755); err != nil {
+		return nil, noop, fmt.Errorf("failed to create log directory: %w", err)
+	}
+	f, err := os.Create(logFile)
+	if err != nil {
+		return nil, noop, fmt.Errorf("failed to open --log-file: %w", err)
+	}
+	if logTo == "file" {
+		return f, f.Close, nil
+	}
+	return io.MultiWriter(stdout, f), f.Close, nil
+}
+
+// isTerminal reports whether w is an interactive terminal. It is a variable so
+// tests can force progress output on.
+var isTerminal = func(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func progressReporter(w io.Writer, total int) func(runtime.FlowResult) {
+	done := 0
+	return func(fr runtime.FlowResult) {
+		done++
+		status := "ok"
+		if fr.Failed {
+			status = "failed"
+		}
+		_, _ = fmt.Fprintf(w, "[%d/%d] flow %q ... %s\n", done, total, fr.Name, status)
+	}
+}
+
+// stepPauser prints a summary of each finished request to w and waits for a
+// line on in. Entering q, or reaching the end of in, stops the run.
+func stepPauser(in io.Reader, w io.Writer) func(runtime.FlowResult, runtime.StepResult) bool {
+	lines := bufio.NewScanner(in)
+	return func(fr runtime.FlowResult, sr runtime.StepResult) bool {
+		name := sr.Request
+		if sr.Binding != sr.Request {
+			name = fmt.Sprintf("%s as %s", sr.Request, sr.Binding)
+		}
+		_, _ = fmt.Fprintf(w, "flow %q step %d: %s -> %d\n", fr.Name, len(fr.Steps), name, sr.Status)
+		_, _ = fmt.Fprint(w, "press Enter to continue, q to quit: ")
+		if !lines.Scan() {
+			_, _ = fmt.Fprintln(w)
+			return false
+		}
+		return !strings.EqualFold(strings.TrimSpace(lines.Text()), "q")
+	}
+}
+
+func grepFlows(flows []compiler.PlanFlow, text string) []compiler.PlanFlow {
+	needle := strings.ToLower(text)
+	matches := func(s string) bool { return strings.Contains(strings.ToLower(s), needle) }
+	var out []compiler.PlanFlow
+	for _, flow := range flows {
+		keep := matches(flow.Name)
+		for _, step := range flow.Steps {
+			keep = keep || matches(step.Request) || matches(step.Binding)
+		}
+		if keep {
+			out = append(out, flow)
+		}
+	}
+	return out
+}
+
+// changedFiles lists absolute paths of files that differ from ref in the git
+// repository containing dir. It is a variable so tests can stub git out.
+var changedFiles = func(dir, ref string) ([]string, error) {
+	top, err := exec.Command("git", "-C", dir, "rev-parse", "--show-toplevel").Output()
+	if err != nil {
+		return nil, fmt.Errorf("not a git repository: %s", dir)
+	}
+	root := strings.TrimSpace(string(top))
+	out, err := exec.Command("git", "-C", root, "diff", "--name-only", ref).Output()
+	if err != nil {
+		return nil, fmt.Errorf("git diff against %q failed: %w", ref, err)
+	}
+	var files []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			files = append(files, filepath.Join(root, line))
+		}
+	}
+	return files, nil
+}
+
+// programChanged reports whether the entry program or any module it imports
+// appears in changed.
+func programChanged(mods []compiler.Module, changed []string) bool {
+	set := map[string]struct{}{}
+	for _, path := range changed {
+		set[canonicalPath(path)] = struct{}{}
+	}
+	for _, m := range mods {
+		if _, ok := set[canonicalPath(m.Path)]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func canonicalPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	return path
+}
+
+// tagFlows keeps flows that carry any of tags themselves or through one of
+// their steps' requests.
+func tagFlows(plan *compiler.Plan, tags []string) []compiler.PlanFlow {
+	want := map[string]struct{}{}
+	for _, tag := range tags {
+		want[tag] = struct{}{}
+	}
+	hasTag := func(names []string) bool {
+		for _, name := range names {
+			if _, ok := want[name]; ok {
+				return true
+			}
+		}
+		return false
+	}
+	reqTags := map[string][]string{}
+	for _, req := range plan.Requests {
+		reqTags[req.Name] = req.Tags
+	}
+	var out []compiler.PlanFlow
+	for _, flow := range plan.Flows {
+		keep := hasTag(flow.Tags)
+		for _, step := range flow.Steps {
+			keep = keep || hasTag(reqTags[step.Request])
+		}
+		if keep {
+			out = append(out, flow)
+		}
+	}
+	return out
+}
+
+func writeRunReports(reportDir string, model report.Model, junitOpt report.JUnitOptions) error {
 	junitPath := filepath.Join(reportDir, "pipetest-junit.xml")
 	legacyXMLPath := filepath.Join(reportDir, "pipetest-report.xml")
 	jsonPath := filepath.Join(reportDir, "pipetest-report.json")
-	if err := report.WriteJUnitFile(junitPath, model); err != nil {
+	if err := report.WriteJUnitFileWithOptions(junitPath, model, junitOpt); err != nil {
 		return err
 	}
-	if err := report.WriteJUnitFile(legacyXMLPath, model); err != nil {
+	if err := report.WriteJUnitFileWithOptions(legacyXMLPath, model, junitOpt); err != nil {
 		return err
 	}
 	if err := report.WriteJSONFile(jsonPath, model); err != nil {
@@ -283,20 +1317,223 @@ func writeRunReports(reportDir string, model report.Model) error {
 	return nil
 }
 
-func compileProgram(entryPath string) (*compiler.Plan, []compiler.Module, []diagnostics.Diagnostic) {
-	mods, parseDiags := loadModules(entryPath)
+// writeCapturedBodies writes each body to bodies/<flow>-<request>.txt under
+// reportDir. Names are reduced to safe characters, and the first unused
+// numeric suffix keeps names that collide after that apart.
+func writeCapturedBodies(reportDir string, bodies []runtime.CapturedBody) error {
+	if len(bodies) == 0 {
+		return nil
+	}
+	dir := filepath.Join(reportDir, "bodies")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	used := map[string]bool{}
+	for _, b := range bodies {
+		base := sanitizeFileName(b.Flow) + "-" + sanitizeFileName(b.Request)
+		name := base
+		for n := 2; used[name]; n++ {
+			name = fmt.Sprintf("%s-%d", base, n)
+		}
+		used[name] = true
+		if err := os.WriteFile(filepath.Join(dir, name+".txt"), b.Body, 0o644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sanitizeFileName replaces every character other than ASCII letters,
+// digits, '.', '_' and '-' with '_'.
+func sanitizeFileName(name string) string {
+	out := []byte(name)
+	for i, c := range out {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '_' || c == '-') {
+			out[i] = '_'
+		}
+	}
+	return string(out)
+}
+
+// bundleProgramSources copies every loaded module into reportDir/sources,
+// keeping their layout relative to the deepest directory containing them all.
+func bundleProgramSources(reportDir string, entry programEntry, mods []compiler.Module) error {
+	paths := make([]string, 0, len(mods))
+	root := ""
+	for _, m := range mods {
+		abs, err := filepath.Abs(m.Path)
+		if err != nil {
+			return err
+		}
+		paths = append(paths, abs)
+		if root == "" {
+			root = filepath.Dir(abs)
+		}
+		for !isWithinDir(abs, root) && filepath.Dir(root) != root {
+			root = filepath.Dir(root)
+		}
+	}
+	for i, path := range paths {
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		data, err := entry.source(mods[i].Path)
+		if err != nil {
+			return err
+		}
+		dest := filepath.Join(reportDir, "sources", rel)
+		if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(dest, data, 0o644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isWithinDir(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// parseJitter parses a --jitter range like "100ms-500ms"; a single duration
+// sleeps exactly that long.
+func parseJitter(value string) (time.Duration, time.Duration, error) {
+	lo, hi, isRange := strings.Cut(value, "-")
+	if !isRange {
+		hi = lo
+	}
+	minDelay, err := time.ParseDuration(strings.TrimSpace(lo))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid --jitter value %q: %w", value, err)
+	}
+	maxDelay, err := time.ParseDuration(strings.TrimSpace(hi))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid --jitter value %q: %w", value, err)
+	}
+	if minDelay < 0 || maxDelay < minDelay {
+		return 0, 0, fmt.Errorf("invalid --jitter value %q (expected min-max with 0 <= min <= max)", value)
+	}
+	return minDelay, maxDelay, nil
+}
+
+// loadVarFile reads a JSON object, or a YAML mapping when path ends in
+// .yaml or .yml.
+func loadVarFile(path string) (map[string]any, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read --var-file: %w", err)
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		v, err := yaml.Unmarshal(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --var-file %s: %w", path, err)
+		}
+		vars, ok := v.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("invalid --var-file %s: expected a YAML mapping", path)
+		}
+		return vars, nil
+	}
+	var vars map[string]any
+	if err := json.Unmarshal(data, &vars); err != nil {
+		return nil, fmt.Errorf("invalid --var-file %s: expected a JSON object: %w", path, err)
+	}
+	return vars, nil
+}
+
+var envTemplateRE = regexp.MustCompile(`\{\{([A-Za-z_][A-Za-z0-9_]*)\}\}`)
+
+// interpolateEnv replaces {{NAME}} placeholders in an import path with
+// environment variables.
+func interpolateEnv(in string) (string, error) {
+	var missing string
+	out := envTemplateRE.ReplaceAllStringFunc(in, func(m string) string {
+		name := envTemplateRE.FindStringSubmatch(m)[1]
+		v, ok := os.LookupEnv(name)
+		if !ok && missing == "" {
+			missing = name
+		}
+		return v
+	})
+	if missing != "" {
+		return "", fmt.Errorf("undefined environment variable in import path: %s", missing)
+	}
+	return out, nil
+}
+
+func varNames(vars map[string]any) []string {
+	names := make([]string, 0, len(vars))
+	for name := range vars {
+		names = append(names, name)
+	}
+	return names
+}
+
+// recordReplayClient returns the HTTP client for --record or --replay, or
+// nil when neither is set.
+func recordReplayClient(record, replay string) (*http.Client, error) {
+	switch {
+	case record != "" && replay != "":
+		return nil, fmt.Errorf("--record and --replay cannot be combined")
+	case record != "":
+		return &http.Client{Transport: runtime.NewRecordingTransport(record, nil)}, nil
+	case replay != "":
+		return &http.Client{Transport: runtime.NewReplayTransport(replay)}, nil
+	}
+	return nil, nil
+}
+
+// stdinProgramName is the module name given to a program read from stdin.
+const stdinProgramName = "<stdin>"
+
+// programEntry is the entry module of a program: a file on disk, or source
+// read from stdin and named as if it lived in --program-dir.
+type programEntry struct {
+	path string
+	src  []byte // nil when path is read from disk
+}
+
+// source returns the contents of module path, which is the entry's own
+// source when the entry came from stdin.
+func (e programEntry) source(path string) ([]byte, error) {
+	if e.src != nil && path == filepath.Clean(e.path) {
+		return e.src, nil
+	}
+	return os.ReadFile(path)
+}
+
+// readProgramArg resolves a program argument. "-" reads the program from
+// stdin, and programDir becomes the base for its relative imports and
+// file() paths (the working directory when empty).
+func readProgramArg(arg, programDir string, stdin io.Reader) (programEntry, error) {
+	if arg != "-" {
+		if programDir != "" {
+			return programEntry{}, fmt.Errorf("--program-dir requires reading the program from stdin (-)")
+		}
+		return programEntry{path: arg}, nil
+	}
+	src, err := io.ReadAll(stdin)
+	if err != nil {
+		return programEntry{}, fmt.Errorf("failed to read program from stdin: %w", err)
+	}
+	return programEntry{path: filepath.Join(programDir, stdinProgramName), src: src}, nil
+}
+
+func compileProgram(entry programEntry, lexOpt lexer.Options, opt compiler.Options) (*compiler.Plan, []compiler.Module, []diagnostics.Diagnostic) {
+	mods, parseDiags := loadModules(entry, lexOpt)
 	if len(parseDiags) > 0 {
 		return nil, mods, parseDiags
 	}
-	plan, compDiags := compiler.Compile(entryPath, mods)
-	if len(compDiags) > 0 {
-		return nil, mods, compDiags
-	}
-	return plan, mods, nil
+	plan, compDiags := compiler.CompileWithOptions(entry.path, mods, opt)
+	return plan, mods, compDiags
 }
 
-func loadModules(entryPath string) ([]compiler.Module, []diagnostics.Diagnostic) {
-	entryPath = filepath.Clean(entryPath)
+func loadModules(entry programEntry, lexOpt lexer.Options) ([]compiler.Module, []diagnostics.Diagnostic) {
+	entryPath := filepath.Clean(entry.path)
 	loaded := map[string]compiler.Module{}
 	var diags []diagnostics.Diagnostic
 	var visit func(string)
@@ -305,7 +1542,7 @@ func loadModules(entryPath string) ([]compiler.Module, []diagnostics.Diagnostic)
 		if _, ok := loaded[path]; ok {
 			return
 		}
-		src, err := os.ReadFile(path)
+		src, err := entry.source(path)
 		if err != nil {
 			if errors.Is(err, os.ErrNotExist) {
 				diags = append(diags, diagnostics.Diagnostic{Severity: "error", Code: "E_IMPORT_NOT_FOUND", Message: fmt.Sprintf("import not found: %s", path), File: path, Line: 1, Column: 1, Hint: "load the imported file"})
@@ -314,7 +1551,7 @@ func loadModules(entryPath string) ([]compiler.Module, []diagnostics.Diagnostic)
 			diags = append(diags, diagnostics.Diagnostic{Severity: "error", Code: "E_IMPORT_READ", Message: err.Error(), File: path, Line: 1, Column: 1, Hint: "check file permissions and path"})
 			return
 		}
-		prog, lexErrs, parseErrs := parser.Parse(path, string(src))
+		prog, lexErrs, parseErrs := parser.ParseWithOptions(path, string(src), lexOpt)
 		for _, e := range lexErrs {
 			diags = append(diags, diagnostics.Diagnostic{Severity: "error", Code: e.Code, Message: e.Message, File: e.File, Line: e.Span.Start.Line, Column: e.Span.Start.Column, Hint: e.Hint})
 		}
@@ -330,6 +1567,14 @@ func loadModules(entryPath string) ([]compiler.Module, []diagnostics.Diagnostic)
 			if !ok {
 				continue
 			}
+			resolved, err := interpolateEnv(imp.Path.Value)
+			if err != nil {
+				diags = append(diags, diagnostics.Diagnostic{Severity: "error", Code: "E_IMPORT_UNDEFINED_VARIABLE", Message: err.Error(), File: path, Line: imp.Span.Start.Line, Column: imp.Span.Start.Column, Hint: "export the environment variable before running pipetest"})
+				continue
+			}
+			// The compiler resolves imports from the same AST, so store the
+			// interpolated path back on the statement.
+			imp.Path.Value = resolved
 			visit(filepath.Join(filepath.Dir(path), imp.Path.Value))
 		}
 	}
@@ -343,39 +1588,134 @@ func loadModules(entryPath string) ([]compiler.Module, []diagnostics.Diagnostic)
 	return modules, diagnostics.SortAndDedupe(diags)
 }
 
-func printCommandResult(stdout io.Writer, cmd, format string, diags []diagnostics.Diagnostic, model *report.Model) error {
-	switch format {
-	case "pretty":
-		for _, d := range diags {
-			if isHiddenPrettyDiagnostic(d) {
-				continue
-			}
-			_, _ = fmt.Fprintf(stdout, "ERROR %s %s:%d:%d %s\n", d.Code, d.File, d.Line, d.Column, d.Message)
-			if d.Hint != "" {
-				_, _ = fmt.Fprintf(stdout, "  hint: %s\n", d.Hint)
-			}
-			if d.Related != nil {
-				_, _ = fmt.Fprintf(stdout, "  related: %s:%d:%d %s\n", d.Related.File, d.Related.Line, d.Related.Column, d.Related.Message)
-			}
+type jsonSummary struct {
+	OK       bool `json:"ok"`
+	Tests    int  `json:"tests"`
+	Failures int  `json:"failures"`
+	Errors   int  `json:"errors"`
+	Skipped  int  `json:"skipped,omitempty"`
+	Flows    int  `json:"flows"`
+
+	Assertions *report.AssertionSummary `json:"assertions,omitempty"`
+}
+
+// Formatter renders a command's diagnostics and, for run, its report in
+// one --format. warnAsError tells it whether warnings fail the command.
+type Formatter interface {
+	Format(w io.Writer, cmd string, diags []diagnostics.Diagnostic, model *report.Model, warnAsError bool) error
+}
+
+var (
+	formatters     = map[string]Formatter{}
+	formatterNames []string // registration order, for messages
+)
+
+func init() {
+	registerFormatter("pretty", prettyFormatter{})
+	registerFormatter("json", jsonFormatter{})
+}
+
+// registerFormatter makes f available as --format name.
+func registerFormatter(name string, f Formatter) {
+	if _, ok := formatters[name]; !ok {
+		formatterNames = append(formatterNames, name)
+	}
+	formatters[name] = f
+}
+
+func printCommandResult(stdout io.Writer, cmd, format string, summaryOnly, warnAsError bool, diags []diagnostics.Diagnostic, model *report.Model) error {
+	if err := validateFormat(format); err != nil {
+		return err
+	}
+	f := formatters[format]
+	if summaryOnly {
+		f = jsonSummaryFormatter{}
+	}
+	return f.Format(stdout, cmd, diags, model, warnAsError)
+}
+
+type prettyFormatter struct{}
+
+func (prettyFormatter) Format(w io.Writer, cmd string, diags []diagnostics.Diagnostic, model *report.Model, warnAsError bool) error {
+	for _, d := range diags {
+		if isHiddenPrettyDiagnostic(d) {
+			continue
 		}
-		if model != nil {
-			_, _ = fmt.Fprintf(stdout, "flows=%d tests=%d failures=%d errors=%d\n", len(model.Suites), model.Summary.Tests, model.Summary.Failures, model.Summary.Errors)
+		_, _ = fmt.Fprintf(w, "%s %s %s:%d:%d %s\n", strings.ToUpper(d.Severity), d.Code, d.File, d.Line, d.Column, d.Message)
+		if d.Hint != "" {
+			_, _ = fmt.Fprintf(w, "  hint: %s\n", d.Hint)
 		}
-		if len(diags) == 0 && cmd == "eval" {
-			_, _ = fmt.Fprintln(stdout, "OK")
+		if d.Related != nil {
+			_, _ = fmt.Fprintf(w, "  related: %s:%d:%d %s\n", d.Related.File, d.Related.Line, d.Related.Column, d.Related.Message)
 		}
-		return nil
-	case "json":
-		payload := map[string]any{"command": cmd, "ok": len(diags) == 0, "diagnostics": diags, "summary": map[string]int{"error_count": len(diags)}}
-		if model != nil {
-			payload["report"] = model
+	}
+	if model != nil {
+		_, _ = fmt.Fprintf(w, "flows=%d tests=%d failures=%d errors=%d", len(model.Suites), model.Summary.Tests, model.Summary.Failures, model.Summary.Errors)
+		if model.Summary.Skipped > 0 {
+			_, _ = fmt.Fprintf(w, " skipped=%d", model.Summary.Skipped)
+		}
+		if a := model.Assertions; a != nil {
+			_, _ = fmt.Fprintf(w, " assertions=%d assertions_passed=%d assertions_failed=%d", a.Total, a.Passed, a.Failed)
+			if a.Skipped > 0 {
+				_, _ = fmt.Fprintf(w, " assertions_skipped=%d", a.Skipped)
+			}
+		}
+		_, _ = fmt.Fprintln(w)
+	}
+	if cmd == "eval" && !hasFatalDiags(diags, warnAsError) {
+		_, _ = fmt.Fprintln(w, "OK")
+	}
+	return nil
+}
+
+type jsonFormatter struct{}
+
+func (jsonFormatter) Format(w io.Writer, cmd string, diags []diagnostics.Diagnostic, model *report.Model, warnAsError bool) error {
+	payload := map[string]any{"command": cmd, "ok": !hasFatalDiags(diags, warnAsError), "diagnostics": diags, "summary": map[string]int{"error_count": errorCount(diags)}}
+	if model != nil {
+		payload["report"] = model
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(payload)
+}
+
+// jsonSummaryFormatter backs --summary-only; it is not a --format of its own.
+type jsonSummaryFormatter struct{}
+
+func (jsonSummaryFormatter) Format(w io.Writer, cmd string, diags []diagnostics.Diagnostic, model *report.Model, warnAsError bool) error {
+	summary := jsonSummary{OK: !hasFatalDiags(diags, warnAsError), Errors: errorCount(diags)}
+	if model != nil {
+		summary.Tests = model.Summary.Tests
+		summary.Failures = model.Summary.Failures
+		summary.Errors = model.Summary.Errors
+		summary.Skipped = model.Summary.Skipped
+		summary.Flows = len(model.Suites)
+		summary.Assertions = model.Assertions
+	}
+	return json.NewEncoder(w).Encode(summary)
+}
+
+// hasFatalDiags reports whether diags should fail the command. Warnings
+// only count when warnAsError is set.
+func hasFatalDiags(diags []diagnostics.Diagnostic, warnAsError bool) bool {
+	for _, d := range diags {
+		if d.Severity != "warning" || warnAsError {
+			return true
+		}
+	}
+	return false
+}
+
+// errorCount counts diags that are not warnings.
+func errorCount(diags []diagnostics.Diagnostic) int {
+	n := 0
+	for _, d := range diags {
+		if d.Severity != "warning" {
+			n++
 		}
-		enc := json.NewEncoder(stdout)
-		enc.SetIndent("", "  ")
-		return enc.Encode(payload)
-	default:
-		return fmt.Errorf("unknown --format %q (expected pretty|json)", format)
 	}
+	return n
 }
 
 func isHiddenPrettyDiagnostic(d diagnostics.Diagnostic) bool {
@@ -389,6 +1729,12 @@ func printUsage(stderr io.Writer) {
 func rootUsage() string {
 	return `Usage:
   ` + evalUsage + `
+  ` + assertsUsage + `
   ` + runUsage + `
-  ` + requestUsage
+  ` + requestUsage + `
+  ` + diffUsage + `
+  ` + debugUsage + `
+  ` + healthUsage + `
+  ` + importUsage + `
+  ` + echoUsage
 }
@@ -1,12 +1,21 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
+
+	"github.com/mehditeymorian/pipetest/internal/diagnostics"
+	"github.com/mehditeymorian/pipetest/internal/report"
+	"github.com/mehditeymorian/pipetest/internal/runtime"
 )
 
 func TestEvalSuccess(t *testing.T) {
@@ -82,6 +91,45 @@ func TestRunSuccessSummary(t *testing.T) {
 	}
 }
 
+func TestRunCountAssertions(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"ok":true,"n":2}`))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	program := "\nreq good:\n\tGET " + srv.URL + "\n\t? status == 200\n\t? #.ok == true\n\nreq bad:\n\tGET " + srv.URL + "\n\t? status == 200\n\t? #.n == 3\n\nflow \"count\":\n\tgood -> bad\n\t? good.status == 200\n"
+	path := filepath.Join(dir, "program.pt")
+	if err := os.WriteFile(path, []byte(program), 0o644); err != nil {
+		t.Fatalf("write program: %v", err)
+	}
+	var out, errOut strings.Builder
+	exitCode := run([]string{"run", "--no-report", "--count-assertions", path}, &out, &errOut)
+	if exitCode != 1 {
+		t.Fatalf("expected exit 1, got %d stderr=%s", exitCode, errOut.String())
+	}
+	if !strings.Contains(out.String(), " assertions=5 assertions_passed=4 assertions_failed=1\n") {
+		t.Fatalf("unexpected output: %q", out.String())
+	}
+
+	out.Reset()
+	run([]string{"run", "--no-report", "--count-assertions", "--format", "json", "--summary-only", "--log-to", "file", "--log-file", filepath.Join(dir, "run.log"), path}, &out, &errOut)
+	var summary jsonSummary
+	if err := json.Unmarshal([]byte(out.String()), &summary); err != nil {
+		t.Fatalf("decode summary: %v", err)
+	}
+	if summary.Assertions == nil || *summary.Assertions != (report.AssertionSummary{Total: 5, Passed: 4, Failed: 1}) {
+		t.Fatalf("unexpected assertion summary: %+v", summary.Assertions)
+	}
+
+	out.Reset()
+	run([]string{"run", "--no-report", path}, &out, &errOut)
+	if strings.Contains(out.String(), "assertions=") {
+		t.Fatalf("expected no assertion counts without --count-assertions: %q", out.String())
+	}
+}
+
 func TestRequestCommandRunsSingleRequest(t *testing.T) {
 	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
@@ -244,3 +292,1275 @@ func TestMissingCommandUsage(t *testing.T) {
 		t.Fatalf("expected usage output, got %q", errOut.String())
 	}
 }
+
+func TestRunLogFileCapturesAssertionTree(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"ok":true}`))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	reportDir := filepath.Join(dir, "artifacts")
+	logPath := filepath.Join(dir, "logs", "run.log")
+	program := "\nreq only:\n\tGET " + srv.URL + "\n\t? status == 200\n\nflow \"ok\":\n\tonly\n"
+	path := filepath.Join(dir, "program.pt")
+	if err := os.WriteFile(path, []byte(program), 0o644); err != nil {
+		t.Fatalf("write program: %v", err)
+	}
+
+	var out, errOut strings.Builder
+	exitCode := run([]string{"run", "--log-file", logPath, "--log-to", "file", "--report-dir", reportDir, path}, &out, &errOut)
+	if exitCode != 0 {
+		t.Fatalf("expected exit 0, got %d stderr=%s", exitCode, errOut.String())
+	}
+	logged, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatalf("read log file: %v", err)
+	}
+	if !strings.Contains(string(logged), "- flow ok") || !strings.Contains(string(logged), "    - assertion status == 200 ✅") {
+		t.Fatalf("expected assertion tree in log file, got %q", string(logged))
+	}
+	if strings.Contains(out.String(), "- flow ok") {
+		t.Fatalf("did not expect assertion tree on stdout with --log-to file, got %q", out.String())
+	}
+	if !strings.Contains(out.String(), "flows=1 tests=1 failures=0 errors=0") {
+		t.Fatalf("expected summary on stdout, got %q", out.String())
+	}
+}
+
+func TestRunValidateOnlyCatchesTemplateVariableWithoutHTTP(t *testing.T) {
+	hits := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	reportDir := filepath.Join(dir, "artifacts")
+	program := "\nreq only:\n\tGET " + srv.URL + "/users/{{user.id}}\n\nflow \"ok\":\n\tonly\n"
+	path := filepath.Join(dir, "program.pt")
+	if err := os.WriteFile(path, []byte(program), 0o644); err != nil {
+		t.Fatalf("write program: %v", err)
+	}
+
+	var out, errOut strings.Builder
+	exitCode := run([]string{"run", "--validate-only", "--report-dir", reportDir, path}, &out, &errOut)
+	if exitCode != 1 {
+		t.Fatalf("expected exit 1, got %d stderr=%s", exitCode, errOut.String())
+	}
+	if !strings.Contains(out.String(), "E_RUNTIME_MISSING_VARIABLE") {
+		t.Fatalf("expected missing variable diagnostic, got %q", out.String())
+	}
+	if hits != 0 {
+		t.Fatalf("expected no HTTP requests, got %d", hits)
+	}
+	if _, err := os.Stat(reportDir); !os.IsNotExist(err) {
+		t.Fatalf("expected no report directory, got err=%v", err)
+	}
+}
+
+func TestRunReportStdoutEmitsJSONModel(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"ok":true}`))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	program := "\nreq only:\n\tGET " + srv.URL + "\n\t? status == 201\n\nflow \"broken\":\n\tonly\n"
+	path := filepath.Join(dir, "program.pt")
+	if err := os.WriteFile(path, []byte(program), 0o644); err != nil {
+		t.Fatalf("write program: %v", err)
+	}
+
+	t.Chdir(dir)
+
+	var out, errOut strings.Builder
+	exitCode := run([]string{"run", "--report-stdout", path}, &out, &errOut)
+	if exitCode != 1 {
+		t.Fatalf("expected exit 1, got %d stderr=%s", exitCode, errOut.String())
+	}
+	var model report.Model
+	if err := json.Unmarshal([]byte(out.String()), &model); err != nil {
+		t.Fatalf("expected JSON report on stdout, got %q: %v", out.String(), err)
+	}
+	if len(model.Suites) != 1 || model.Summary.Failures != 1 {
+		t.Fatalf("unexpected report model: %+v", model)
+	}
+	if !strings.Contains(errOut.String(), "- flow broken") {
+		t.Fatalf("expected assertion tree on stderr, got %q", errOut.String())
+	}
+	if _, err := os.Stat(filepath.Join(dir, "pipetest-report")); !os.IsNotExist(err) {
+		t.Fatalf("expected no default report directory, got err=%v", err)
+	}
+}
+
+func TestRunGrepFiltersFlowsByRequestName(t *testing.T) {
+	var paths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"ok":true}`))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	reportDir := filepath.Join(dir, "artifacts")
+	program := "\nreq createOrder:\n\tPOST " + srv.URL + "/orders\n\nreq listUsers:\n\tGET " + srv.URL + "/users\n\nflow \"checkout\":\n\tcreateOrder\n\nflow \"admin\":\n\tlistUsers\n"
+	path := filepath.Join(dir, "program.pt")
+	if err := os.WriteFile(path, []byte(program), 0o644); err != nil {
+		t.Fatalf("write program: %v", err)
+	}
+
+	var out, errOut strings.Builder
+	exitCode := run([]string{"run", "--grep", "ORDER", "--report-dir", reportDir, path}, &out, &errOut)
+	if exitCode != 0 {
+		t.Fatalf("expected exit 0, got %d stderr=%s", exitCode, errOut.String())
+	}
+	if strings.Join(paths, ",") != "/orders" {
+		t.Fatalf("expected only the checkout flow to run, got %v", paths)
+	}
+	if !strings.Contains(out.String(), "flows=1 tests=1 failures=0 errors=0") {
+		t.Fatalf("unexpected output: %q", out.String())
+	}
+}
+
+func TestRunSummaryOnlyJSON(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"ok":true}`))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	reportDir := filepath.Join(dir, "artifacts")
+	program := "\nreq only:\n\tGET " + srv.URL + "\n\t? status == 500\n\nflow \"broken\":\n\tonly\n"
+	path := filepath.Join(dir, "program.pt")
+	if err := os.WriteFile(path, []byte(program), 0o644); err != nil {
+		t.Fatalf("write program: %v", err)
+	}
+
+	var out, errOut strings.Builder
+	exitCode := run([]string{"run", "--format", "json", "--summary-only", "--hide-passing-assertions", "--log-to", "file", "--log-file", filepath.Join(dir, "run.log"), "--report-dir", reportDir, path}, &out, &errOut)
+	if exitCode != 1 {
+		t.Fatalf("expected exit 1, got %d stderr=%s", exitCode, errOut.String())
+	}
+	var payload map[string]any
+	if err := json.Unmarshal([]byte(out.String()), &payload); err != nil {
+		t.Fatalf("expected JSON summary, got %q: %v", out.String(), err)
+	}
+	want := map[string]any{"ok": false, "tests": float64(1), "failures": float64(1), "errors": float64(0), "flows": float64(1)}
+	if len(payload) != len(want) {
+		t.Fatalf("unexpected summary keys: %v", payload)
+	}
+	for k, v := range want {
+		if payload[k] != v {
+			t.Fatalf("expected %s=%v, got %v", k, v, payload[k])
+		}
+	}
+	if _, ok := payload["diagnostics"]; ok {
+		t.Fatalf("did not expect diagnostics in summary output")
+	}
+}
+
+func TestRunNoReportSkipsArtifacts(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"ok":true}`))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	program := "\nreq only:\n\tGET " + srv.URL + "\n\nflow \"ok\":\n\tonly\n"
+	path := filepath.Join(dir, "program.pt")
+	if err := os.WriteFile(path, []byte(program), 0o644); err != nil {
+		t.Fatalf("write program: %v", err)
+	}
+	t.Chdir(dir)
+
+	var out, errOut strings.Builder
+	exitCode := run([]string{"run", "--no-report", path}, &out, &errOut)
+	if exitCode != 0 {
+		t.Fatalf("expected exit 0, got %d stderr=%s", exitCode, errOut.String())
+	}
+	if !strings.Contains(out.String(), "flows=1 tests=1 failures=0 errors=0") {
+		t.Fatalf("expected summary output, got %q", out.String())
+	}
+	if _, err := os.Stat(filepath.Join(dir, "pipetest-report")); !os.IsNotExist(err) {
+		t.Fatalf("expected no report directory, got err=%v", err)
+	}
+}
+
+func TestRunSendsDefaultAcceptHeader(t *testing.T) {
+	var gotAccept string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAccept = r.Header.Get("Accept")
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"ok":true}`))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	program := "\nreq only:\n\tGET " + srv.URL + "\n\nflow \"ok\":\n\tonly\n"
+	path := filepath.Join(dir, "program.pt")
+	if err := os.WriteFile(path, []byte(program), 0o644); err != nil {
+		t.Fatalf("write program: %v", err)
+	}
+	t.Chdir(dir)
+
+	var out, errOut strings.Builder
+	if exitCode := run([]string{"run", "--no-report", path}, &out, &errOut); exitCode != 0 {
+		t.Fatalf("expected exit 0, got %d stderr=%s", exitCode, errOut.String())
+	}
+	if gotAccept != "application/json" {
+		t.Fatalf("expected default Accept header, got %q", gotAccept)
+	}
+
+	if exitCode := run([]string{"run", "--no-report", "--default-accept", "", path}, &out, &errOut); exitCode != 0 {
+		t.Fatalf("expected exit 0, got %d stderr=%s", exitCode, errOut.String())
+	}
+	if gotAccept != "" {
+		t.Fatalf("expected no Accept header when disabled, got %q", gotAccept)
+	}
+}
+
+func TestRunOnlyChangedSkipsFlowsWhenProgramUnchanged(t *testing.T) {
+	var hits int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"ok":true}`))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "shared.pt"), []byte("\nreq only:\n\tGET "+srv.URL+"\n"), 0o644); err != nil {
+		t.Fatalf("write import: %v", err)
+	}
+	program := "import \"shared.pt\"\n\nflow \"ok\":\n\tonly\n"
+	path := filepath.Join(dir, "program.pt")
+	if err := os.WriteFile(path, []byte(program), 0o644); err != nil {
+		t.Fatalf("write program: %v", err)
+	}
+	t.Chdir(dir)
+
+	var changed []string
+	var diffErr error
+	orig := changedFiles
+	changedFiles = func(string, string) ([]string, error) { return changed, diffErr }
+	t.Cleanup(func() { changedFiles = orig })
+
+	cases := []struct {
+		name    string
+		changed []string
+		err     error
+		hits    int
+	}{
+		{name: "unrelated change", changed: []string{filepath.Join(dir, "README.md")}, hits: 0},
+		{name: "imported file changed", changed: []string{filepath.Join(dir, "shared.pt")}, hits: 1},
+		{name: "not a git repo", err: errors.New("not a git repository"), hits: 1},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			hits = 0
+			changed, diffErr = tc.changed, tc.err
+			var out, errOut strings.Builder
+			if exitCode := run([]string{"run", "--no-report", "--only-changed", "main", path}, &out, &errOut); exitCode != 0 {
+				t.Fatalf("expected exit 0, got %d stderr=%s", exitCode, errOut.String())
+			}
+			if hits != tc.hits {
+				t.Fatalf("expected %d requests, got %d", tc.hits, hits)
+			}
+			if tc.err != nil && !strings.Contains(errOut.String(), "--only-changed ignored") {
+				t.Fatalf("expected fallback warning, got %q", errOut.String())
+			}
+		})
+	}
+}
+
+func TestRunVarFileDefinesNestedGlobals(t *testing.T) {
+	var got map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewDecoder(r.Body).Decode(&got)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"ok":true}`))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	vars := `{"user": {"name": "ada", "roles": ["admin", "ops"]}, "limit": 5, "region": "eu"}`
+	if err := os.WriteFile(filepath.Join(dir, "vars.json"), []byte(vars), 0o644); err != nil {
+		t.Fatalf("write vars: %v", err)
+	}
+	program := "\nlet region = \"us\"\n\nreq create:\n\tPOST " + srv.URL + "\n\tjson { name: user.name, roles: user.roles, limit: limit, region: region }\n\t? status == 200\n\nflow \"ok\":\n\tcreate\n"
+	path := filepath.Join(dir, "program.pt")
+	if err := os.WriteFile(path, []byte(program), 0o644); err != nil {
+		t.Fatalf("write program: %v", err)
+	}
+	t.Chdir(dir)
+
+	var out, errOut strings.Builder
+	if exitCode := run([]string{"run", "--no-report", "--var-file", "vars.json", path}, &out, &errOut); exitCode != 0 {
+		t.Fatalf("expected exit 0, got %d stdout=%s stderr=%s", exitCode, out.String(), errOut.String())
+	}
+	want := map[string]any{"name": "ada", "roles": []any{"admin", "ops"}, "limit": float64(5), "region": "eu"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected body: %#v", got)
+	}
+
+	exitCode := run([]string{"run", "--no-report", path}, &out, &errOut)
+	if exitCode != 1 {
+		t.Fatalf("expected undefined variables without --var-file, got exit %d", exitCode)
+	}
+}
+
+func TestRunVarFileAcceptsYAML(t *testing.T) {
+	var got map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewDecoder(r.Body).Decode(&got)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"ok":true}`))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	vars := "# staging values\nuser:\n  name: ada\n  roles: [admin, ops]\nlimit: 5\n"
+	if err := os.WriteFile(filepath.Join(dir, "vars.yaml"), []byte(vars), 0o644); err != nil {
+		t.Fatalf("write vars: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "list.yml"), []byte("- a\n- b\n"), 0o644); err != nil {
+		t.Fatalf("write vars: %v", err)
+	}
+	program := "\nreq create:\n\tPOST " + srv.URL + "\n\tjson { name: user.name, roles: user.roles, limit: limit }\n\t? status == 200\n\nflow \"ok\":\n\tcreate\n"
+	path := filepath.Join(dir, "program.pt")
+	if err := os.WriteFile(path, []byte(program), 0o644); err != nil {
+		t.Fatalf("write program: %v", err)
+	}
+	t.Chdir(dir)
+
+	var out, errOut strings.Builder
+	if exitCode := run([]string{"run", "--no-report", "--var-file", "vars.yaml", path}, &out, &errOut); exitCode != 0 {
+		t.Fatalf("expected exit 0, got %d stdout=%s stderr=%s", exitCode, out.String(), errOut.String())
+	}
+	want := map[string]any{"name": "ada", "roles": []any{"admin", "ops"}, "limit": float64(5)}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected body: %#v", got)
+	}
+
+	errOut.Reset()
+	if exitCode := run([]string{"run", "--no-report", "--var-file", "list.yml", path}, &out, &errOut); exitCode != 2 {
+		t.Fatalf("expected exit 2 for a YAML sequence, got %d", exitCode)
+	}
+	if !strings.Contains(errOut.String(), "invalid --var-file list.yml: expected a YAML mapping") {
+		t.Fatalf("unexpected error output %q", errOut.String())
+	}
+}
+
+func TestDiffExitsNonZeroOnNewFailures(t *testing.T) {
+	dir := t.TempDir()
+	oldPath := filepath.Join(dir, "old.json")
+	newPath := filepath.Join(dir, "new.json")
+	oldModel := report.Model{Suites: []report.Suite{{Name: "smoke", Testcases: []report.Testcase{{Name: "1 ping", Status: "passed"}}}}}
+	newModel := report.Model{Suites: []report.Suite{{Name: "smoke", Testcases: []report.Testcase{{Name: "1 ping", Status: "failure"}}}}}
+	if err := report.WriteJSONFile(oldPath, oldModel); err != nil {
+		t.Fatalf("write old report: %v", err)
+	}
+	if err := report.WriteJSONFile(newPath, newModel); err != nil {
+		t.Fatalf("write new report: %v", err)
+	}
+
+	var out, errOut strings.Builder
+	if exitCode := run([]string{"diff", oldPath, newPath}, &out, &errOut); exitCode != 1 {
+		t.Fatalf("expected exit 1, got %d stderr=%s", exitCode, errOut.String())
+	}
+	if !strings.Contains(out.String(), "newly_failing smoke :: 1 ping (passed -> failure)") {
+		t.Fatalf("expected newly failing testcase, got %q", out.String())
+	}
+
+	out.Reset()
+	if exitCode := run([]string{"diff", newPath, oldPath}, &out, &errOut); exitCode != 0 {
+		t.Fatalf("expected exit 0 when failures are fixed, got %d", exitCode)
+	}
+	if !strings.Contains(out.String(), "newly_passing smoke :: 1 ping (failure -> passed)") {
+		t.Fatalf("expected newly passing testcase, got %q", out.String())
+	}
+}
+
+func TestRunBaselineReportToleratesKnownFailures(t *testing.T) {
+	healthy := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/broken" || !healthy {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	program := "base \"" + srv.URL + "\"\n\nreq ping:\n\tGET /ping\n\t? status == 200\n\nreq broken:\n\tGET /broken\n\t? status == 200\n\nflow \"ping\":\n\tping\n\nflow \"known\":\n\tbroken\n"
+	path := filepath.Join(dir, "program.pt")
+	if err := os.WriteFile(path, []byte(program), 0o644); err != nil {
+		t.Fatalf("write program: %v", err)
+	}
+	reportDir := filepath.Join(dir, "baseline")
+
+	var out, errOut strings.Builder
+	if exitCode := run([]string{"run", "--report-dir", reportDir, path}, &out, &errOut); exitCode != 1 {
+		t.Fatalf("expected exit 1 without baseline, got %d", exitCode)
+	}
+	baseline := filepath.Join(reportDir, "pipetest-report.json")
+
+	out.Reset()
+	errOut.Reset()
+	if exitCode := run([]string{"run", "--no-report", "--baseline-report", baseline, path}, &out, &errOut); exitCode != 0 {
+		t.Fatalf("expected exit 0 for known failure, got %d stderr=%s", exitCode, errOut.String())
+	}
+
+	healthy = false
+	out.Reset()
+	errOut.Reset()
+	if exitCode := run([]string{"run", "--no-report", "--baseline-report", baseline, path}, &out, &errOut); exitCode != 1 {
+		t.Fatalf("expected exit 1 for regression, got %d", exitCode)
+	}
+	if !strings.Contains(errOut.String(), "regression ping :: ") || strings.Contains(errOut.String(), "regression known") {
+		t.Fatalf("expected only ping regression, got %q", errOut.String())
+	}
+
+	if exitCode := run([]string{"run", "--no-report", "--baseline-report", filepath.Join(dir, "missing.json"), path}, &out, &errOut); exitCode != 2 {
+		t.Fatalf("expected exit 2 for unreadable baseline, got %d", exitCode)
+	}
+}
+
+func TestDebugPrintsTokensAndAST(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "program.pt")
+	if err := os.WriteFile(path, []byte("req ping:\n\tGET /ping\n\t? status == 200\n\nflow \"smoke\":\n\tping\n"), 0o644); err != nil {
+		t.Fatalf("write program: %v", err)
+	}
+
+	var out, errOut strings.Builder
+	if exitCode := run([]string{"debug", "tokens", path}, &out, &errOut); exitCode != 0 {
+		t.Fatalf("expected exit 0, got %d stderr=%s", exitCode, errOut.String())
+	}
+	var tokens []struct {
+		Kind string `json:"kind"`
+		Lit  string `json:"lit"`
+	}
+	if err := json.Unmarshal([]byte(out.String()), &tokens); err != nil {
+		t.Fatalf("tokens output is not JSON: %v", err)
+	}
+	if len(tokens) == 0 || tokens[0].Kind != "KW_REQ" || tokens[0].Lit != "req" {
+		t.Fatalf("unexpected tokens: %+v", tokens)
+	}
+
+	out.Reset()
+	if exitCode := run([]string{"debug", "ast", path}, &out, &errOut); exitCode != 0 {
+		t.Fatalf("expected exit 0, got %d stderr=%s", exitCode, errOut.String())
+	}
+	var program struct {
+		Type   string `json:"type"`
+		Fields struct {
+			Stmts []struct {
+				Type string `json:"type"`
+			} `json:"stmts"`
+		} `json:"fields"`
+	}
+	if err := json.Unmarshal([]byte(out.String()), &program); err != nil {
+		t.Fatalf("ast output is not JSON: %v", err)
+	}
+	if program.Type != "Program" || len(program.Fields.Stmts) != 2 || program.Fields.Stmts[0].Type != "ReqDecl" {
+		t.Fatalf("unexpected ast: %+v", program)
+	}
+
+	if err := os.WriteFile(path, []byte("req ping:\n\tGET /ping\n\t? status ==\n"), 0o644); err != nil {
+		t.Fatalf("write program: %v", err)
+	}
+	out.Reset()
+	errOut.Reset()
+	if exitCode := run([]string{"debug", "ast", path}, &out, &errOut); exitCode != 1 {
+		t.Fatalf("expected exit 1 for parse error, got %d", exitCode)
+	}
+	if !strings.Contains(errOut.String(), "ERROR E_PARSE_") {
+		t.Fatalf("expected parse diagnostics on stderr, got %q", errOut.String())
+	}
+}
+
+func TestRunFailOnEmptySuite(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "program.pt")
+	if err := os.WriteFile(path, []byte("req ping:\n\tGET http://127.0.0.1:1/ping\n\nflow \"smoke\":\n\tping\n"), 0o644); err != nil {
+		t.Fatalf("write program: %v", err)
+	}
+
+	var out, errOut strings.Builder
+	if exitCode := run([]string{"run", "--no-report", "--grep", "chekout", path}, &out, &errOut); exitCode != 0 {
+		t.Fatalf("expected exit 0 without the flag, got %d stderr=%s", exitCode, errOut.String())
+	}
+
+	out.Reset()
+	errOut.Reset()
+	if exitCode := run([]string{"run", "--no-report", "--grep", "chekout", "--fail-on-empty-suite", path}, &out, &errOut); exitCode != 1 {
+		t.Fatalf("expected exit 1 for empty suite, got %d", exitCode)
+	}
+	if !strings.Contains(errOut.String(), "no flows selected to run") {
+		t.Fatalf("expected empty suite message, got %q", errOut.String())
+	}
+}
+
+func TestRunPreflightStopsOnUnreachableBase(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "program.pt")
+	if err := os.WriteFile(path, []byte("base \"http://127.0.0.1:1\"\n\nreq ping:\n\tGET /ping\n\nflow \"smoke\":\n\tping\n"), 0o644); err != nil {
+		t.Fatalf("write program: %v", err)
+	}
+	reportDir := filepath.Join(dir, "reports")
+
+	var out, errOut strings.Builder
+	if exitCode := run([]string{"run", "--preflight", "--report-dir", reportDir, path}, &out, &errOut); exitCode != 1 {
+		t.Fatalf("expected exit 1, got %d", exitCode)
+	}
+	if !strings.Contains(out.String(), "E_RUNTIME_PREFLIGHT") {
+		t.Fatalf("expected preflight diagnostic, got %q", out.String())
+	}
+	if strings.Contains(out.String(), "E_RUNTIME_TRANSPORT") || strings.Contains(out.String(), "flows=") {
+		t.Fatalf("expected no flows to run, got %q", out.String())
+	}
+	if _, err := os.Stat(reportDir); !os.IsNotExist(err) {
+		t.Fatalf("expected no report directory, got err=%v", err)
+	}
+}
+
+func TestRunBundleSourcesCopiesProgramAndImports(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	imported := "\nreq only:\n\tGET " + srv.URL + "\n"
+	if err := os.MkdirAll(filepath.Join(dir, "lib"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "lib", "requests.pt"), []byte(imported), 0o644); err != nil {
+		t.Fatalf("write import: %v", err)
+	}
+	program := "import \"lib/requests.pt\"\n\nflow \"ok\":\n\tonly\n"
+	path := filepath.Join(dir, "program.pt")
+	if err := os.WriteFile(path, []byte(program), 0o644); err != nil {
+		t.Fatalf("write program: %v", err)
+	}
+	reportDir := filepath.Join(dir, "reports")
+
+	var out, errOut strings.Builder
+	if exitCode := run([]string{"run", "--bundle-sources", "--report-dir", reportDir, path}, &out, &errOut); exitCode != 0 {
+		t.Fatalf("expected exit 0, got %d stdout=%s stderr=%s", exitCode, out.String(), errOut.String())
+	}
+	for rel, want := range map[string]string{"program.pt": program, filepath.Join("lib", "requests.pt"): imported} {
+		got, err := os.ReadFile(filepath.Join(reportDir, "sources", rel))
+		if err != nil {
+			t.Fatalf("read bundled %s: %v", rel, err)
+		}
+		if string(got) != want {
+			t.Fatalf("bundled %s differs: %q", rel, got)
+		}
+	}
+}
+
+func TestHealthReportsReachableAndUnreachableTargets(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+	dead := httptest.NewServer(http.NotFoundHandler())
+	deadURL := dead.URL
+	dead.Close()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "program.pt")
+	program := "base \"" + srv.URL + "/v1\"\n\nreq ping:\n\tGET /ping\n\nreq other:\n\tGET " + deadURL + "/x\n\nflow \"f\":\n\tping -> other\n"
+	if err := os.WriteFile(path, []byte(program), 0o644); err != nil {
+		t.Fatalf("write program: %v", err)
+	}
+
+	var out, errOut strings.Builder
+	if exitCode := run([]string{"health", "--format", "json", path}, &out, &errOut); exitCode != 1 {
+		t.Fatalf("expected exit 1, got %d stdout=%s stderr=%s", exitCode, out.String(), errOut.String())
+	}
+	var got struct {
+		OK      bool `json:"ok"`
+		Targets []struct {
+			Target    string `json:"target"`
+			Reachable bool   `json:"reachable"`
+		} `json:"targets"`
+	}
+	if err := json.Unmarshal([]byte(out.String()), &got); err != nil {
+		t.Fatalf("health output is not JSON: %v", err)
+	}
+	reachable := map[string]bool{}
+	for _, target := range got.Targets {
+		reachable[target.Target] = target.Reachable
+	}
+	if got.OK || !reflect.DeepEqual(reachable, map[string]bool{srv.URL: true, deadURL: false}) {
+		t.Fatalf("unexpected health result: %s", out.String())
+	}
+
+	program = "base \"" + srv.URL + "\"\n\nreq ping:\n\tGET /ping\n\nflow \"f\":\n\tping\n"
+	if err := os.WriteFile(path, []byte(program), 0o644); err != nil {
+		t.Fatalf("write program: %v", err)
+	}
+	out.Reset()
+	if exitCode := run([]string{"health", path}, &out, &errOut); exitCode != 0 {
+		t.Fatalf("expected exit 0, got %d stdout=%s", exitCode, out.String())
+	}
+	if !strings.Contains(out.String(), "reachable   "+srv.URL) {
+		t.Fatalf("expected reachable target in output, got %q", out.String())
+	}
+}
+
+func TestImportPostmanWritesProgram(t *testing.T) {
+	dir := t.TempDir()
+	collection := filepath.Join(dir, "collection.json")
+	src := `{"info":{"name":"c"},"item":[{"name":"Ping","request":{"method":"GET","auth":{"type":"apikey"},"url":"https://example.com/ping"}}]}`
+	if err := os.WriteFile(collection, []byte(src), 0o644); err != nil {
+		t.Fatalf("write collection: %v", err)
+	}
+	out := filepath.Join(dir, "out.pt")
+
+	var stdout, stderr strings.Builder
+	if exitCode := run([]string{"import-postman", collection, "-o", out, "--flows"}, &stdout, &stderr); exitCode != 0 {
+		t.Fatalf("expected exit 0, got %d stderr=%s", exitCode, stderr.String())
+	}
+	if !strings.Contains(stderr.String(), `warning: request "Ping" uses unsupported apikey auth; skipped`) {
+		t.Fatalf("expected auth warning, got %q", stderr.String())
+	}
+	stdout.Reset()
+	if exitCode := run([]string{"eval", out}, &stdout, &stderr); exitCode != 0 {
+		t.Fatalf("expected imported program to compile, got %d: %s", exitCode, stdout.String())
+	}
+}
+
+func TestRunMaxAssertionsSummarizesOverflow(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"a":1,"b":2,"c":3}`))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	reportDir := filepath.Join(dir, "artifacts")
+	program := "\nreq only:\n\tGET " + srv.URL + "\n\t? status == 200\n\t? #.a == 1\n\t? #.b == 2\n\t? #.c == 3\n\t? #.c == 4\n\nflow \"capped\":\n\tonly\n"
+	path := filepath.Join(dir, "program.pt")
+	if err := os.WriteFile(path, []byte(program), 0o644); err != nil {
+		t.Fatalf("write program: %v", err)
+	}
+
+	var out, errOut strings.Builder
+	exitCode := run([]string{"run", "--max-assertions", "2", "--report-dir", reportDir, path}, &out, &errOut)
+	if exitCode != 1 {
+		t.Fatalf("expected exit 1, got %d stderr=%s", exitCode, errOut.String())
+	}
+	if got := strings.Count(out.String(), "- assertion "); got != 2 {
+		t.Fatalf("expected 2 printed assertions, got %d in %q", got, out.String())
+	}
+	if !strings.Contains(out.String(), "    ... (+3 more)\n") {
+		t.Fatalf("expected overflow summary, got %q", out.String())
+	}
+	report, err := os.ReadFile(filepath.Join(reportDir, "pipetest-report.json"))
+	if err != nil {
+		t.Fatalf("read report: %v", err)
+	}
+	if !strings.Contains(string(report), "program.pt:8:2") {
+		t.Fatalf("expected hidden failure in report, got %s", report)
+	}
+
+	out.Reset()
+	if exitCode := run([]string{"run", "--max-assertions", "-1", path}, &out, &errOut); exitCode != 2 {
+		t.Fatalf("expected exit 2 for negative cap, got %d", exitCode)
+	}
+}
+
+func TestRunQuietSuccess(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"ok":true}`))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "program.pt")
+	writeProgram := func(want string) {
+		t.Helper()
+		program := "\nreq only:\n\tGET " + srv.URL + "\n\t? #.ok == " + want + "\n\nflow \"quiet\":\n\tonly\n"
+		if err := os.WriteFile(path, []byte(program), 0o644); err != nil {
+			t.Fatalf("write program: %v", err)
+		}
+	}
+
+	writeProgram("true")
+	var out, errOut strings.Builder
+	if exitCode := run([]string{"run", "--quiet-success", "--no-report", path}, &out, &errOut); exitCode != 0 {
+		t.Fatalf("expected exit 0, got %d stdout=%s stderr=%s", exitCode, out.String(), errOut.String())
+	}
+	if out.Len() != 0 {
+		t.Fatalf("expected no output for a passing run, got %q", out.String())
+	}
+
+	writeProgram("false")
+	out.Reset()
+	if exitCode := run([]string{"run", "--quiet-success", "--no-report", path}, &out, &errOut); exitCode != 1 {
+		t.Fatalf("expected exit 1, got %d stdout=%s", exitCode, out.String())
+	}
+	for _, want := range []string{"- flow quiet\n", "  - only\n", "    - assertion #.ok == false ❌\n", "flows=1 tests=1 failures=1 errors=0\n"} {
+		if !strings.Contains(out.String(), want) {
+			t.Fatalf("expected %q in failing run output, got %q", want, out.String())
+		}
+	}
+}
+
+func TestEchoServerEchoesPost(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	var out strings.Builder
+	done := make(chan error, 1)
+	go func() { done <- serveEcho(ln, &out) }()
+
+	req, err := http.NewRequest(http.MethodPost, "http://"+ln.Addr().String()+"/users?page=2&tag=a&tag=b", strings.NewReader(`{"name":"alice","id":9007199254740993}`))
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	req.Header.Set("X-Trace", "t1")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("post: %v", err)
+	}
+	var got map[string]any
+	dec := json.NewDecoder(res.Body)
+	dec.UseNumber()
+	err = dec.Decode(&got)
+	_ = res.Body.Close()
+	if err != nil {
+		t.Fatalf("decode echo: %v", err)
+	}
+	_ = ln.Close()
+	if err := <-done; err != nil {
+		t.Fatalf("serve: %v", err)
+	}
+
+	if got["method"] != "POST" || got["path"] != "/users" || got["body"] != `{"name":"alice","id":9007199254740993}` {
+		t.Fatalf("unexpected echo: %v", got)
+	}
+	if headers := got["headers"].(map[string]any); headers["X-Trace"] != "t1" {
+		t.Fatalf("expected echoed header, got %v", headers)
+	}
+	if !reflect.DeepEqual(got["query"], map[string]any{"page": "2", "tag": []any{"a", "b"}}) {
+		t.Fatalf("unexpected echoed query: %v", got["query"])
+	}
+	if !reflect.DeepEqual(got["json"], map[string]any{"name": "alice", "id": json.Number("9007199254740993")}) {
+		t.Fatalf("unexpected decoded body: %v", got["json"])
+	}
+	if !strings.Contains(out.String(), "echo server listening on http://"+ln.Addr().String()) {
+		t.Fatalf("expected listening message, got %q", out.String())
+	}
+}
+
+func TestStepPauserReadsLines(t *testing.T) {
+	var out strings.Builder
+	pause := stepPauser(strings.NewReader("\nq\n"), &out)
+	fr := runtime.FlowResult{Name: "checkout", Steps: []runtime.StepResult{{Request: "login", Binding: "login", Status: 200}}}
+	if !pause(fr, fr.Steps[0]) {
+		t.Fatal("expected Enter to continue")
+	}
+	fr.Steps = append(fr.Steps, runtime.StepResult{Request: "cart", Binding: "c", Status: 404})
+	if pause(fr, fr.Steps[1]) {
+		t.Fatal("expected q to stop the run")
+	}
+	if pause(fr, fr.Steps[1]) {
+		t.Fatal("expected end of input to stop the run")
+	}
+	if !strings.Contains(out.String(), `flow "checkout" step 1: login -> 200`) || !strings.Contains(out.String(), `flow "checkout" step 2: cart as c -> 404`) {
+		t.Fatalf("unexpected step output:\n%s", out.String())
+	}
+}
+
+func TestWarnAsErrorDecidesExitForWarnings(t *testing.T) {
+	warn := diagnostics.Diagnostic{Severity: "warning", Code: "W_TEST", Message: "just a warning", File: "main.pt", Line: 3, Column: 2}
+	if hasFatalDiags([]diagnostics.Diagnostic{warn}, false) {
+		t.Fatal("expected warnings alone to pass without --warn-as-error")
+	}
+	if !hasFatalDiags([]diagnostics.Diagnostic{warn}, true) {
+		t.Fatal("expected warnings to fail with --warn-as-error")
+	}
+	if !hasFatalDiags([]diagnostics.Diagnostic{warn, {Severity: "error", Code: "E_TEST"}}, false) {
+		t.Fatal("expected errors to fail regardless of --warn-as-error")
+	}
+
+	var out strings.Builder
+	if err := printCommandResult(&out, "eval", "pretty", false, false, []diagnostics.Diagnostic{warn}, nil); err != nil {
+		t.Fatalf("print: %v", err)
+	}
+	if got := out.String(); got != "WARNING W_TEST main.pt:3:2 just a warning\nOK\n" {
+		t.Fatalf("unexpected pretty output %q", got)
+	}
+	out.Reset()
+	if err := printCommandResult(&out, "eval", "pretty", false, true, []diagnostics.Diagnostic{warn}, nil); err != nil {
+		t.Fatalf("print: %v", err)
+	}
+	if got := out.String(); got != "WARNING W_TEST main.pt:3:2 just a warning\n" {
+		t.Fatalf("unexpected pretty output with --warn-as-error %q", got)
+	}
+
+	for _, warnAsError := range []bool{false, true} {
+		out.Reset()
+		if err := printCommandResult(&out, "eval", "json", false, warnAsError, []diagnostics.Diagnostic{warn}, nil); err != nil {
+			t.Fatalf("print: %v", err)
+		}
+		var payload struct {
+			OK      bool           `json:"ok"`
+			Summary map[string]int `json:"summary"`
+		}
+		if err := json.Unmarshal([]byte(out.String()), &payload); err != nil {
+			t.Fatalf("decode json output: %v", err)
+		}
+		if payload.OK == warnAsError || payload.Summary["error_count"] != 0 {
+			t.Fatalf("warnAsError=%v: unexpected json output %s", warnAsError, out.String())
+		}
+
+		out.Reset()
+		if err := printCommandResult(&out, "run", "json", true, warnAsError, []diagnostics.Diagnostic{warn}, nil); err != nil {
+			t.Fatalf("print: %v", err)
+		}
+		var summary jsonSummary
+		if err := json.Unmarshal([]byte(out.String()), &summary); err != nil {
+			t.Fatalf("decode summary output: %v", err)
+		}
+		if summary.OK == warnAsError || summary.Errors != 0 {
+			t.Fatalf("warnAsError=%v: unexpected summary output %s", warnAsError, out.String())
+		}
+	}
+}
+
+func TestWarnAsErrorFailsWarningOnlyProgram(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "program.pt")
+	program := "\nreq search:\n\tGET " + srv.URL + "\n\tjson { q: \"shoes\" }\n\t? status == 200\n\nflow \"search\":\n\tsearch\n"
+	if err := os.WriteFile(path, []byte(program), 0o644); err != nil {
+		t.Fatalf("write program: %v", err)
+	}
+	for _, args := range [][]string{{"eval", path}, {"run", "--no-report", path}, {"request", path, "search"}} {
+		var out, errOut strings.Builder
+		if code := run(args, &out, &errOut); code != 0 {
+			t.Fatalf("%s: expected exit 0 with only warnings, got %d stdout=%s stderr=%s", args[0], code, out.String(), errOut.String())
+		}
+		if !strings.Contains(out.String(), "WARNING W_SEM_BODY_ON_GET") {
+			t.Fatalf("%s: expected the warning to be printed, got %q", args[0], out.String())
+		}
+	}
+	for _, args := range [][]string{{"eval", "--warn-as-error", path}, {"run", "--no-report", "--warn-as-error", path}, {"request", "--warn-as-error", path, "search"}} {
+		var out, errOut strings.Builder
+		if code := run(args, &out, &errOut); code != 1 {
+			t.Fatalf("%s: expected exit 1 with --warn-as-error, got %d", args[0], code)
+		}
+	}
+}
+
+func TestProgramDirResolvesImportsOfStdinProgram(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "lib"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	imported := "\nreq only:\n\tGET " + srv.URL + "\n\t? status == 200\n"
+	if err := os.WriteFile(filepath.Join(dir, "lib", "requests.pt"), []byte(imported), 0o644); err != nil {
+		t.Fatalf("write import: %v", err)
+	}
+	program := "import \"lib/requests.pt\"\n\nflow \"ok\":\n\tonly\n"
+
+	runWithStdin := func(args ...string) (int, string) {
+		var out, errOut strings.Builder
+		cmd := newRootCmd(&out, &errOut)
+		cmd.SetIn(strings.NewReader(program))
+		cmd.SetArgs(args)
+		if err := cmd.Execute(); err != nil {
+			var exitErr *cliExitError
+			if !errors.As(err, &exitErr) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			return exitErr.code, out.String() + exitErr.msg
+		}
+		return 0, out.String()
+	}
+
+	if code, out := runWithStdin("run", "--no-report", "--program-dir", dir, "-"); code != 0 {
+		t.Fatalf("expected exit 0, got %d: %s", code, out)
+	}
+	if code, out := runWithStdin("eval", "-"); code != 1 || !strings.Contains(out, "E_IMPORT_NOT_FOUND") {
+		t.Fatalf("expected the import to be missing without --program-dir, got %d: %s", code, out)
+	}
+	if code, out := runWithStdin("eval", "--program-dir", dir, filepath.Join(dir, "lib", "requests.pt")); code != 2 || !strings.Contains(out, "--program-dir requires") {
+		t.Fatalf("expected a usage error for --program-dir with a file, got %d: %s", code, out)
+	}
+}
+
+func TestRunRecordThenReplay(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"ok":true}`))
+	}))
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "program.pt")
+	program := "\nreq ping:\n\tGET " + srv.URL + "/ping\n\t? #.ok == true\n\nflow \"ping\":\n\tping\n"
+	if err := os.WriteFile(path, []byte(program), 0o644); err != nil {
+		t.Fatalf("write program: %v", err)
+	}
+	recordings := filepath.Join(dir, "recordings")
+	var out, errOut strings.Builder
+	if code := run([]string{"run", "--no-report", "--record", recordings, path}, &out, &errOut); code != 0 {
+		t.Fatalf("record: expected exit 0, got %d stdout=%s stderr=%s", code, out.String(), errOut.String())
+	}
+	srv.Close()
+
+	for _, args := range [][]string{{"run", "--no-report", "--replay", recordings, path}, {"request", "--replay", recordings, path, "ping"}} {
+		out.Reset()
+		if code := run(args, &out, &errOut); code != 0 {
+			t.Fatalf("%s: expected replay to pass offline, got %d stdout=%s", args[0], code, out.String())
+		}
+	}
+
+	errOut.Reset()
+	if code := run([]string{"run", "--record", recordings, "--replay", recordings, path}, &out, &errOut); code != 2 || !strings.Contains(errOut.String(), "cannot be combined") {
+		t.Fatalf("expected a usage error, got %d stderr=%s", code, errOut.String())
+	}
+}
+
+func TestRegisteredFormattersRenderSampleResult(t *testing.T) {
+	diags := []diagnostics.Diagnostic{
+		{Severity: "error", Code: "E_RUNTIME_TRANSPORT", Message: "http request failed", File: "main.pt", Line: 4, Column: 2, Hint: "connection refused"},
+		{Severity: "warning", Code: "W_SEM_BODY_ON_GET", Message: "GET request has a body", File: "main.pt", Line: 6, Column: 2},
+	}
+	model := &report.Model{
+		Suites:     []report.Suite{{Name: "checkout", Testcases: []report.Testcase{{Name: "1 login", Status: "error"}}, Summary: report.Summary{Tests: 1, Errors: 1}}},
+		Summary:    report.Summary{Tests: 1, Errors: 1},
+		Assertions: &report.AssertionSummary{Total: 2, Passed: 1, Failed: 1},
+	}
+	if len(formatterNames) == 0 || len(formatterNames) != len(formatters) {
+		t.Fatalf("formatter names %v do not match the registry", formatterNames)
+	}
+	for _, name := range formatterNames {
+		if err := validateFormat(name); err != nil {
+			t.Fatalf("registered format %q rejected: %v", name, err)
+		}
+		for _, m := range []*report.Model{nil, model} {
+			var out strings.Builder
+			if err := printCommandResult(&out, "run", name, false, false, diags, m); err != nil {
+				t.Fatalf("format %q: %v", name, err)
+			}
+			if out.Len() == 0 {
+				t.Fatalf("format %q printed nothing", name)
+			}
+			if name == "json" {
+				var payload struct {
+					Diagnostics []diagnostics.Diagnostic `json:"diagnostics"`
+					Report      *report.Model            `json:"report"`
+				}
+				if err := json.Unmarshal([]byte(out.String()), &payload); err != nil {
+					t.Fatalf("decode json output: %v", err)
+				}
+				if !reflect.DeepEqual(payload.Diagnostics, diags) || !reflect.DeepEqual(payload.Report, m) {
+					t.Fatalf("json output did not round-trip: %+v", payload)
+				}
+			}
+		}
+	}
+	var out strings.Builder
+	if err := printCommandResult(&out, "run", "json", true, false, diags, model); err != nil || !json.Valid([]byte(out.String())) {
+		t.Fatalf("unexpected summary output %q: %v", out.String(), err)
+	}
+	if err := validateFormat("sarif"); err == nil || err.Error() != `unknown --format "sarif" (expected pretty|json)` {
+		t.Fatalf("unexpected error for unknown format: %v", err)
+	}
+}
+
+func TestAssertionsListsInventory(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "base.pt"), []byte(`
+req parent:
+	GET https://example.com/parent
+	? status == 200
+`), 0o644); err != nil {
+		t.Fatalf("write import: %v", err)
+	}
+	path := filepath.Join(dir, "main.pt")
+	program := `import "base.pt"
+
+req child(parent):
+	GET https://example.com/child
+
+req list:
+	GET https://example.com/list
+	? #.items contains "a" and len(#.items) > 1
+
+flow "checkout":
+	child:c -> list
+	assert_eventually timeout 1s interval 100ms:
+		child:poll
+		? not poll.res.pending
+	? c.status in [200, 201]
+`
+	if err := os.WriteFile(path, []byte(program), 0o644); err != nil {
+		t.Fatalf("write program: %v", err)
+	}
+
+	var out, errOut strings.Builder
+	if exitCode := run([]string{"assertions", "--format", "json", path}, &out, &errOut); exitCode != 0 {
+		t.Fatalf("expected exit 0, got %d stdout=%s stderr=%s", exitCode, out.String(), errOut.String())
+	}
+	var got struct {
+		Count      int `json:"count"`
+		Assertions []struct {
+			File    string `json:"file"`
+			Line    int    `json:"line"`
+			Request string `json:"request"`
+			Flow    string `json:"flow"`
+			Expr    string `json:"expr"`
+		} `json:"assertions"`
+	}
+	if err := json.Unmarshal([]byte(out.String()), &got); err != nil {
+		t.Fatalf("decode inventory: %v\n%s", err, out.String())
+	}
+	if got.Count != 5 || len(got.Assertions) != 5 {
+		t.Fatalf("expected 5 assertions, got %s", out.String())
+	}
+	exprs := make([]string, 0, len(got.Assertions))
+	for _, a := range got.Assertions {
+		exprs = append(exprs, a.Request+"|"+a.Flow+"|"+a.Expr)
+	}
+	want := []string{
+		"child||status == 200",
+		`list||#.items contains "a" and len(#.items) > 1`,
+		"parent||status == 200",
+		"child|checkout|not poll.res.pending",
+		"|checkout|c.status in [200, 201]",
+	}
+	if !reflect.DeepEqual(exprs, want) {
+		t.Fatalf("unexpected inventory:\n%s", strings.Join(exprs, "\n"))
+	}
+	if got.Assertions[0].File != filepath.Join(dir, "base.pt") || got.Assertions[0].Line != 4 || got.Assertions[1].File != path || got.Assertions[1].Line != 8 {
+		t.Fatalf("unexpected locations: %+v", got.Assertions)
+	}
+
+	out.Reset()
+	if exitCode := run([]string{"assertions", path}, &out, &errOut); exitCode != 0 {
+		t.Fatalf("expected exit 0, got %d", exitCode)
+	}
+	if !strings.HasSuffix(out.String(), "assertions=5\n") || !strings.Contains(out.String(), path+`:15:2 flow "checkout" ? c.status in [200, 201]`) {
+		t.Fatalf("unexpected pretty output:\n%s", out.String())
+	}
+}
+
+func TestRunCapturesBodiesOnFailure(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"path":"` + r.URL.Path + `"}`))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "bodies.pt")
+	program := `
+base "` + srv.URL + `"
+
+req good:
+	GET /good
+	? #.path == "/good"
+
+req bad:
+	GET /bad
+	? #.path == "/good"
+
+flow "orders/v1 check":
+	good -> bad:broken
+`
+	if err := os.WriteFile(path, []byte(program), 0o644); err != nil {
+		t.Fatalf("write program: %v", err)
+	}
+	reportDir := filepath.Join(dir, "out")
+
+	var out, errOut strings.Builder
+	if exitCode := run([]string{"run", "--report-dir", reportDir, "--capture-bodies-on-failure", path}, &out, &errOut); exitCode != 1 {
+		t.Fatalf("expected exit 1, got %d stderr=%s", exitCode, errOut.String())
+	}
+	entries, err := os.ReadDir(filepath.Join(reportDir, "bodies"))
+	if err != nil {
+		t.Fatalf("read bodies dir: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "orders_v1_check-bad_broken.txt" {
+		t.Fatalf("expected one body file for the failing request, got %v", entries)
+	}
+	body, err := os.ReadFile(filepath.Join(reportDir, "bodies", entries[0].Name()))
+	if err != nil || string(body) != `{"path":"/bad"}` {
+		t.Fatalf("unexpected captured body %q (%v)", body, err)
+	}
+
+	reportDir = filepath.Join(dir, "plain")
+	run([]string{"run", "--report-dir", reportDir, path}, &out, &errOut)
+	if _, err := os.Stat(filepath.Join(reportDir, "bodies")); !os.IsNotExist(err) {
+		t.Fatalf("expected no bodies without the flag, got %v", err)
+	}
+}
+
+func TestWriteCapturedBodiesNeverReusesAName(t *testing.T) {
+	dir := t.TempDir()
+	bodies := []runtime.CapturedBody{
+		{Flow: "a", Request: "b", Body: []byte("first")},
+		{Flow: "a", Request: "b", Body: []byte("second")},
+		{Flow: "a", Request: "b-2", Body: []byte("third")},
+	}
+	if err := writeCapturedBodies(dir, bodies); err != nil {
+		t.Fatalf("write bodies: %v", err)
+	}
+	for name, want := range map[string]string{"a-b.txt": "first", "a-b-2.txt": "second", "a-b-2-2.txt": "third"} {
+		got, err := os.ReadFile(filepath.Join(dir, "bodies", name))
+		if err != nil || string(got) != want {
+			t.Fatalf("expected %s to hold %q, got %q (%v)", name, want, got, err)
+		}
+	}
+}
+
+func TestRunTemplatedImportPath(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"ok":true}`))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "staging"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "staging", "requests.pt"), []byte("\nreq only:\n\tGET "+srv.URL+"\n"), 0o644); err != nil {
+		t.Fatalf("write import: %v", err)
+	}
+	program := "import \"{{PIPETEST_ENV}}/requests.pt\"\n\nflow \"ok\":\n\tonly\n"
+	path := filepath.Join(dir, "program.pt")
+	if err := os.WriteFile(path, []byte(program), 0o644); err != nil {
+		t.Fatalf("write program: %v", err)
+	}
+	t.Chdir(dir)
+
+	t.Setenv("PIPETEST_ENV", "staging")
+	var out, errOut strings.Builder
+	if exitCode := run([]string{"run", "--no-report", path}, &out, &errOut); exitCode != 0 {
+		t.Fatalf("expected exit 0, got %d stdout=%s stderr=%s", exitCode, out.String(), errOut.String())
+	}
+
+	os.Unsetenv("PIPETEST_ENV")
+	out.Reset()
+	if exitCode := run([]string{"eval", path}, &out, &errOut); exitCode != 1 {
+		t.Fatalf("expected exit 1 for unset variable, got %d", exitCode)
+	}
+	if !strings.Contains(out.String(), "E_IMPORT_UNDEFINED_VARIABLE") {
+		t.Fatalf("expected undefined variable diagnostic, got %q", out.String())
+	}
+}
+
+func TestRunPrintsFlowProgressOnTerminal(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"ok":true}`))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	program := "\nreq ok:\n\tGET " + srv.URL + "\n\t? status == 200\n\nreq bad:\n\tGET " + srv.URL + "\n\t? status == 201\n\nflow \"a\":\n\tok\n\nflow \"b\":\n\tbad\n"
+	path := filepath.Join(dir, "program.pt")
+	if err := os.WriteFile(path, []byte(program), 0o644); err != nil {
+		t.Fatalf("write program: %v", err)
+	}
+	t.Chdir(dir)
+
+	orig := isTerminal
+	isTerminal = func(io.Writer) bool { return true }
+	t.Cleanup(func() { isTerminal = orig })
+
+	var out, errOut strings.Builder
+	run([]string{"run", "--no-report", path}, &out, &errOut)
+	want := "[1/2] flow \"a\" ... ok\n[2/2] flow \"b\" ... failed\n"
+	if errOut.String() != want {
+		t.Fatalf("unexpected progress output:\n%s", errOut.String())
+	}
+
+	errOut.Reset()
+	run([]string{"run", "--no-report", "--no-progress", path}, &out, &errOut)
+	if errOut.String() != "" {
+		t.Fatalf("expected no progress with --no-progress, got %q", errOut.String())
+	}
+}
+
+func TestRunPrintConfigReflectsOverrides(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "vars.json"), []byte(`{"tenant":"acme"}`), 0o644); err != nil {
+		t.Fatalf("write vars: %v", err)
+	}
+	t.Chdir(dir)
+
+	var out, errOut strings.Builder
+	args := []string{"run", "--print-config", "--format", "json", "--timeout", "1500ms", "--report-dir", "out", "--parallel-requests", "4", "--default-accept", "text/plain", "--var-file", "vars.json", "missing.pt"}
+	if exitCode := run(args, &out, &errOut); exitCode != 0 {
+		t.Fatalf("expected exit 0, got %d stderr=%s", exitCode, errOut.String())
+	}
+	var cfg runConfig
+	if err := json.Unmarshal([]byte(out.String()), &cfg); err != nil {
+		t.Fatalf("decode config: %v\n%s", err, out.String())
+	}
+	if cfg.Program != "missing.pt" || cfg.Format != "json" || cfg.Timeout != "1.5s" || cfg.ReportDir != "out" || !cfg.WriteReports {
+		t.Fatalf("unexpected config: %+v", cfg)
+	}
+	if cfg.ParallelRequests != 4 || cfg.DefaultAccept != "text/plain" || cfg.Vars["tenant"] != "acme" {
+		t.Fatalf("unexpected config: %+v", cfg)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "out")); !os.IsNotExist(err) {
+		t.Fatalf("expected --print-config not to create the report directory, got err=%v", err)
+	}
+}
+
+func TestRunTagFiltersFlows(t *testing.T) {
+	var hits []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits = append(hits, r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"ok":true}`))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	program := "\nbase \"" + srv.URL + "\"\n\nreq login:\n\ttag \"auth\"\n\tGET /login\n\nreq orders:\n\tGET /orders\n\nreq report:\n\tGET /report\n\nflow \"auth\":\n\tlogin\n\nflow \"orders\":\n\ttag \"smoke\"\n\torders\n\nflow \"report\":\n\treport\n"
+	path := filepath.Join(dir, "program.pt")
+	if err := os.WriteFile(path, []byte(program), 0o644); err != nil {
+		t.Fatalf("write program: %v", err)
+	}
+	t.Chdir(dir)
+
+	var out, errOut strings.Builder
+	if exitCode := run([]string{"run", "--no-report", "--tag", "auth", "--tag", "smoke", path}, &out, &errOut); exitCode != 0 {
+		t.Fatalf("expected exit 0, got %d stdout=%s stderr=%s", exitCode, out.String(), errOut.String())
+	}
+	if !reflect.DeepEqual(hits, []string{"/login", "/orders"}) {
+		t.Fatalf("unexpected requests: %v", hits)
+	}
+}
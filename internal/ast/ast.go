@@ -73,11 +73,23 @@ type ImportStmt struct {
 
 func (*ImportStmt) stmtNode() {}
 
+// ServiceBaseStmt registers a named base URL: base_for "name" "url".
+// Request paths starting with @name resolve against it.
+type ServiceBaseStmt struct {
+	Name *StringLit
+	URL  *StringLit
+	Span Span
+}
+
+func (*ServiceBaseStmt) stmtNode() {}
+
 // LetStmt binds a name to an expression.
 type LetStmt struct {
-	Name  string
-	Value Expr
-	Span  Span
+	Name     string
+	Value    Expr
+	Dynamic  bool // top-level let re-evaluated before every request
+	Exported bool // `export let`: visible to importers of the file
+	Span     Span
 }
 
 func (*LetStmt) stmtNode()     {}
@@ -97,14 +109,28 @@ func (*ReqDecl) stmtNode() {}
 // FlowDecl declares a flow block.
 type FlowDecl struct {
 	Name    *StringLit
+	Tags    []*TagDirective
 	Prelude []*LetStmt
 	Chain   []FlowStep
 	Asserts []*AssertStmt
-	Span    Span
+	// Eventually holds assert_eventually blocks that poll a request after
+	// the chain completes.
+	Eventually []*EventuallyBlock
+	Span       Span
 }
 
 func (*FlowDecl) stmtNode() {}
 
+// EventuallyBlock re-sends a request until its assertions hold or the
+// timeout elapses.
+type EventuallyBlock struct {
+	Step     FlowStep
+	Timeout  *DurationLit
+	Interval *DurationLit
+	Asserts  []*AssertStmt
+	Span     Span
+}
+
 // FlowStep references a request with an optional alias.
 type FlowStep struct {
 	ReqName string
@@ -134,6 +160,16 @@ type HttpLine struct {
 
 func (*HttpLine) reqLineNode() {}
 
+// MethodDirective overrides the HTTP line's method with a value computed at
+// runtime.
+type MethodDirective struct {
+	Value Expr
+	Span  Span
+}
+
+func (*MethodDirective) reqLineNode()   {}
+func (*MethodDirective) directiveNode() {}
+
 // Directive marks request directives.
 type Directive interface {
 	ReqLine
@@ -149,6 +185,51 @@ type JsonDirective struct {
 func (*JsonDirective) reqLineNode()   {}
 func (*JsonDirective) directiveNode() {}
 
+// XmlDirective sets a raw XML body.
+type XmlDirective struct {
+	Value Expr
+	Span  Span
+}
+
+func (*XmlDirective) reqLineNode()   {}
+func (*XmlDirective) directiveNode() {}
+
+// TextDirective sets a raw text/plain body.
+type TextDirective struct {
+	Value Expr
+	Span  Span
+}
+
+func (*TextDirective) reqLineNode()   {}
+func (*TextDirective) directiveNode() {}
+
+// FormDirective sets an application/x-www-form-urlencoded body.
+type FormDirective struct {
+	Value *ObjectLit
+	Span  Span
+}
+
+func (*FormDirective) reqLineNode()   {}
+func (*FormDirective) directiveNode() {}
+
+// MultipartDirective sets a multipart/form-data body.
+type MultipartDirective struct {
+	Parts []MultipartPart
+	Span  Span
+}
+
+func (*MultipartDirective) reqLineNode()   {}
+func (*MultipartDirective) directiveNode() {}
+
+// MultipartPart is one form field. When File is true, Value evaluates to the
+// path of a file to upload (written as @"path" in source).
+type MultipartPart struct {
+	Key   ObjectKey
+	Value Expr
+	File  bool
+	Span  Span
+}
+
 // HeaderDirective sets a header.
 type HeaderDirective struct {
 	Key   Key
@@ -174,18 +255,67 @@ type AuthScheme int
 
 const (
 	AuthBearer AuthScheme = iota
+	AuthBasic
 )
 
-// AuthDirective sets authorization configuration.
+// AuthDirective sets authorization configuration. For basic auth Value is
+// the user name and Password the password; Password is nil for bearer.
 type AuthDirective struct {
-	Scheme AuthScheme
-	Value  Expr
-	Span   Span
+	Scheme   AuthScheme
+	Value    Expr
+	Password Expr
+	Span     Span
 }
 
 func (*AuthDirective) reqLineNode()   {}
 func (*AuthDirective) directiveNode() {}
 
+// SharedDirective marks a request whose result is reused across flows.
+type SharedDirective struct {
+	Span Span
+}
+
+func (*SharedDirective) reqLineNode()   {}
+func (*SharedDirective) directiveNode() {}
+
+// ExpectBodyDirective fails the request when the response body is empty.
+type ExpectBodyDirective struct {
+	Span Span
+}
+
+func (*ExpectBodyDirective) reqLineNode()   {}
+func (*ExpectBodyDirective) directiveNode() {}
+
+// RetryDirective re-issues a request up to Count more times, waiting Every
+// between attempts, while its assertions fail.
+type RetryDirective struct {
+	Count *NumberLit
+	Every *DurationLit
+	Span  Span
+}
+
+func (*RetryDirective) reqLineNode()   {}
+func (*RetryDirective) directiveNode() {}
+
+// TagDirective labels a request or flow for selection with run --tag.
+type TagDirective struct {
+	Name string
+	Span Span
+}
+
+func (*TagDirective) reqLineNode()   {}
+func (*TagDirective) directiveNode() {}
+
+// DependsOnDirective lists the requests a flow step must wait for when
+// steps run concurrently. An empty list marks the step as independent.
+type DependsOnDirective struct {
+	Requests []string
+	Span     Span
+}
+
+func (*DependsOnDirective) reqLineNode()   {}
+func (*DependsOnDirective) directiveNode() {}
+
 // HookKind identifies hook type.
 type HookKind int
 
@@ -471,7 +601,10 @@ func (*CallExpr) exprNode() {}
 type FieldExpr struct {
 	X    Expr
 	Name string
-	Span Span
+	// Optional marks x?.name, which yields null instead of failing when x
+	// is null.
+	Optional bool
+	Span     Span
 }
 
 func (*FieldExpr) exprNode() {}
@@ -0,0 +1,118 @@
+package ast
+
+import (
+	"strconv"
+	"strings"
+)
+
+// FormatExpr renders expr back into pipetest source syntax. Spacing and
+// quoting are normalized, so the result need not match the original text.
+func FormatExpr(expr Expr) string {
+	switch e := expr.(type) {
+	case *StringLit:
+		return strconv.Quote(e.Value)
+	case *NumberLit:
+		return e.Raw
+	case *BoolLit:
+		if e.Value {
+			return "true"
+		}
+		return "false"
+	case *NullLit:
+		return "null"
+	case *ArrayLit:
+		parts := make([]string, 0, len(e.Elements))
+		for _, el := range e.Elements {
+			parts = append(parts, FormatExpr(el))
+		}
+		return "[" + strings.Join(parts, ", ") + "]"
+	case *ObjectLit:
+		parts := make([]string, 0, len(e.Pairs))
+		for _, pair := range e.Pairs {
+			parts = append(parts, pair.Key.Name+": "+FormatExpr(pair.Value))
+		}
+		return "{" + strings.Join(parts, ", ") + "}"
+	case *DollarExpr:
+		return "$"
+	case *HashExpr:
+		return "#"
+	case *IdentExpr:
+		return e.Name
+	case *ParenExpr:
+		return "(" + FormatExpr(e.X) + ")"
+	case *UnaryExpr:
+		if e.Op == UnaryNot {
+			return "not " + FormatExpr(e.X)
+		}
+		return e.Op.String() + FormatExpr(e.X)
+	case *BinaryExpr:
+		return FormatExpr(e.Left) + " " + e.Op.String() + " " + FormatExpr(e.Right)
+	case *FieldExpr:
+		if e.Optional {
+			return FormatExpr(e.X) + "?." + e.Name
+		}
+		return FormatExpr(e.X) + "." + e.Name
+	case *IndexExpr:
+		return FormatExpr(e.X) + "[" + FormatExpr(e.Index) + "]"
+	case *CallExpr:
+		parts := make([]string, 0, len(e.Args))
+		for _, arg := range e.Args {
+			parts = append(parts, FormatExpr(arg))
+		}
+		return FormatExpr(e.Callee) + "(" + strings.Join(parts, ", ") + ")"
+	default:
+		return "<expr>"
+	}
+}
+
+func (op UnaryOp) String() string {
+	switch op {
+	case UnaryNot:
+		return "not"
+	case UnaryMinus:
+		return "-"
+	case UnaryPlus:
+		return "+"
+	default:
+		return ""
+	}
+}
+
+func (op BinaryOp) String() string {
+	switch op {
+	case BinaryEq:
+		return "=="
+	case BinaryNe:
+		return "!="
+	case BinaryGt:
+		return ">"
+	case BinaryGte:
+		return ">="
+	case BinaryLt:
+		return "<"
+	case BinaryLte:
+		return "<="
+	case BinaryAnd:
+		return "and"
+	case BinaryOr:
+		return "or"
+	case BinaryContains:
+		return "contains"
+	case BinaryIn:
+		return "in"
+	case BinaryMatch:
+		return "~"
+	case BinaryAdd:
+		return "+"
+	case BinarySub:
+		return "-"
+	case BinaryMul:
+		return "*"
+	case BinaryDiv:
+		return "/"
+	case BinaryMod:
+		return "%"
+	default:
+		return "?"
+	}
+}
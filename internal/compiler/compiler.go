@@ -5,6 +5,9 @@ import (
 	"path/filepath"
 	"regexp"
 	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/mehditeymorian/pipetest/internal/ast"
 	"github.com/mehditeymorian/pipetest/internal/diagnostics"
@@ -13,12 +16,24 @@ import (
 var pathParamRE = regexp.MustCompile(`:([A-Za-z_][A-Za-z0-9_]*)`)
 var templateVarRE = regexp.MustCompile(`\{\{([A-Za-z_][A-Za-z0-9_]*)\}\}`)
 
+// envTemplateRE matches {{env:NAME}} placeholders, which read environment
+// variables at run time and never name program variables.
+var envTemplateRE = regexp.MustCompile(`\{\{env:[A-Za-z_][A-Za-z0-9_]*\}\}`)
+
 var builtins = map[string]struct{}{
 	"env": {}, "uuid": {}, "len": {}, "jsonpath": {}, "regex": {}, "now": {}, "urlencode": {},
+	"icontains": {}, "secret": {}, "isBefore": {}, "isAfter": {}, "within": {},
+	"length": {}, "allEqual": {}, "anyEqual": {}, "matches": {}, "headerNum": {},
+	"regexExtract": {}, "numEq": {},
+	"notContains": {}, "notIn": {}, "calls": {},
+	"isSorted": {}, "isSortedDesc": {}, "unique": {}, "isInt": {}, "resolveURL": {}, "file": {}, "conforms": {},
+	"status_class": {}, "isEmptyArray": {}, "isMissing": {}, "default": {},
+	"humanBytes": {}, "parseBytes": {}, "upper": {}, "lower": {}, "trim": {},
+	"split": {}, "join": {}, "keys": {}, "contains_key": {},
 }
 
 var reservedNames = map[string]struct{}{
-	"req": {}, "res": {}, "status": {}, "header": {}, "$": {}, "#": {},
+	"req": {}, "res": {}, "status": {}, "header": {}, "body": {}, "elapsed_ms": {}, "status_text": {}, "$": {}, "#": {},
 }
 
 var requestTemplateSymbols = map[string]struct{}{
@@ -51,6 +66,19 @@ type Plan struct {
 	Base      *string        `json:"-"`
 	Timeout   *string        `json:"-"`
 	Globals   []*ast.LetStmt `json:"-"`
+	// Imports holds the lets of imported files, dependencies first. They
+	// are evaluated before Globals and only exported ones become global.
+	Imports []PlanModule `json:"-"`
+	// Services maps base_for names to their base URLs.
+	Services map[string]string `json:"-"`
+	// Vars names the globals supplied at run time rather than by let.
+	Vars []string `json:"-"`
+}
+
+// PlanModule is the top-level lets of one imported file.
+type PlanModule struct {
+	Path string
+	Lets []*ast.LetStmt
 }
 
 // PlanRequest is a semantically validated request.
@@ -58,13 +86,20 @@ type PlanRequest struct {
 	Name   string        `json:"name"`
 	Parent *string       `json:"parent,omitempty"`
 	HTTP   *ast.HttpLine `json:"http,omitempty"`
-	Lines  []ast.ReqLine `json:"-"`
-	Decl   *ast.ReqDecl  `json:"-"`
+	Shared bool          `json:"shared,omitempty"`
+	Tags   []string      `json:"tags,omitempty"`
+	// File is the program file that declares the request.
+	File string `json:"-"`
+	// DependsOn is nil when the request declares no depends_on directive.
+	DependsOn *ast.DependsOnDirective `json:"-"`
+	Lines     []ast.ReqLine           `json:"-"`
+	Decl      *ast.ReqDecl            `json:"-"`
 }
 
 // PlanFlow is a semantically validated flow.
 type PlanFlow struct {
 	Name  string        `json:"name"`
+	Tags  []string      `json:"tags,omitempty"`
 	Steps []PlanStep    `json:"steps"`
 	Lets  []string      `json:"lets"`
 	Check []ast.Expr    `json:"-"`
@@ -78,32 +113,56 @@ type PlanStep struct {
 	Binding string `json:"binding"`
 }
 
-// Compile validates a module graph and returns a deterministic plan and diagnostics.
+// Compile validates a module graph and returns a deterministic plan and
+// diagnostics. The plan is nil unless every diagnostic is a warning.
 func Compile(entryPath string, modules []Module) (*Plan, []diagnostics.Diagnostic) {
+	return CompileWithOptions(entryPath, modules, Options{})
+}
+
+// Options tunes compilation beyond the program itself.
+type Options struct {
+	// Vars names globals supplied at run time (for example from a --var-file).
+	Vars []string
+	// RequireAssertions reports requests used in flows that have no assertions.
+	RequireAssertions bool
+	// StrictJSON reports object literals in json bodies that repeat a key.
+	StrictJSON bool
+	// SharedVars lets a flow use variables defined by flows whose names sort
+	// before it, matching runtime.Options.SharedVars.
+	SharedVars bool
+}
+
+// CompileWithOptions is like Compile but applies opt.
+func CompileWithOptions(entryPath string, modules []Module, opt Options) (*Plan, []diagnostics.Diagnostic) {
 	c := &compiler{
 		entryPath: normalizePath(entryPath),
 		modules:   map[string]*ast.Program{},
+		opt:       opt,
 	}
 	for _, m := range modules {
 		c.modules[normalizePath(m.Path)] = m.Program
 	}
 	c.run()
-	if len(c.diags) > 0 {
+	if c.hasErrors() {
 		return nil, diagnostics.SortAndDedupe(c.diags)
 	}
-	return c.plan, nil
+	// Warnings alone still produce a plan.
+	return c.plan, diagnostics.SortAndDedupe(c.diags)
 }
 
 type compiler struct {
 	entryPath string
 	modules   map[string]*ast.Program
 	ordered   []string
+	loadOrder []string // imported modules before their importers
 	diags     []diagnostics.Diagnostic
 	plan      *Plan
 
-	reqs    map[string]*reqInfo
-	effReqs map[string][]ast.ReqLine
-	globals map[string]struct{}
+	reqs     map[string]*reqInfo
+	effReqs  map[string][]ast.ReqLine
+	globals  map[string]struct{}
+	services map[string]*serviceInfo
+	opt      Options
 }
 
 type reqInfo struct {
@@ -111,18 +170,32 @@ type reqInfo struct {
 	File string
 }
 
+type serviceInfo struct {
+	Stmt *ast.ServiceBaseStmt
+	File string
+}
+
 func (c *compiler) run() {
 	c.passImports()
 	c.passSymbols()
 	c.passRequestInheritance()
 	c.passRequests()
 	c.passFlows()
-	if len(c.diags) > 0 {
+	if c.hasErrors() {
 		return
 	}
 	c.buildPlan()
 }
 
+func (c *compiler) hasErrors() bool {
+	for _, d := range c.diags {
+		if d.Severity != "warning" {
+			return true
+		}
+	}
+	return false
+}
+
 func (c *compiler) passRequestInheritance() {
 	c.effReqs = map[string][]ast.ReqLine{}
 	state := map[string]int{}
@@ -203,13 +276,18 @@ func (c *compiler) passImports() {
 		c.ordered = append(c.ordered, path)
 	}
 	dfs(c.entryPath)
+	c.loadOrder = append([]string(nil), c.ordered...)
 	sort.Strings(c.ordered)
 }
 
 func (c *compiler) passSymbols() {
 	c.reqs = map[string]*reqInfo{}
 	flowNames := map[string]ast.Span{}
-	c.globals = map[string]struct{}{}
+	c.globals = map[string]struct{}{"runId": {}}
+	c.services = map[string]*serviceInfo{}
+	for _, name := range c.opt.Vars {
+		c.globals[name] = struct{}{}
+	}
 	for _, path := range c.ordered {
 		prog := c.modules[path]
 		for _, stmt := range prog.Stmts {
@@ -230,7 +308,16 @@ func (c *compiler) passSymbols() {
 					c.reqs[s.Name] = &reqInfo{Decl: s, File: path}
 				}
 			case *ast.LetStmt:
-				c.globals[s.Name] = struct{}{}
+				// Lets of imported files stay private unless exported.
+				if path == c.entryPath || s.Exported {
+					c.globals[s.Name] = struct{}{}
+				}
+			case *ast.ServiceBaseStmt:
+				if prev, ok := c.services[s.Name.Value]; ok {
+					c.addRelatedDiag("E_SEM_DUPLICATE_SERVICE", fmt.Sprintf("duplicate base_for service: %s", s.Name.Value), path, s.Span, prev.File, prev.Stmt.Span, "register each service name once")
+				} else {
+					c.services[s.Name.Value] = &serviceInfo{Stmt: s, File: path}
+				}
 			}
 		}
 	}
@@ -245,15 +332,30 @@ func (c *compiler) passSymbols() {
 
 func (c *compiler) passRequests() {
 	for _, req := range c.reqs {
-		httpCount, jsonCount := 0, 0
+		httpCount, bodyCount, retryCount := 0, 0, 0
 		preHook, postHook := 0, 0
 		lines := c.effReqs[req.Decl.Name]
 		for _, line := range lines {
 			switch l := line.(type) {
 			case *ast.HttpLine:
 				httpCount++
-			case *ast.JsonDirective:
-				jsonCount++
+				if name, ok := ServiceName(l.Path); ok {
+					if _, known := c.services[name]; !known {
+						c.addDiagAt("E_SEM_UNKNOWN_SERVICE", fmt.Sprintf("unknown service: @%s", name), req.File, l.Span, "register it with base_for \""+name+"\" \"https://...\"")
+					}
+				}
+			case *ast.MethodDirective:
+				if lit, ok := l.Value.(*ast.StringLit); ok && !strings.Contains(lit.Value, "{{") {
+					if _, valid := HTTPMethod(lit.Value); !valid {
+						c.addDiagAt("E_SEM_INVALID_METHOD", fmt.Sprintf("invalid http method: %s", lit.Value), req.File, l.Span, "use GET, POST, PUT, PATCH, DELETE, HEAD, or OPTIONS")
+					}
+				}
+			case *ast.DependsOnDirective:
+				for _, name := range l.Requests {
+					if _, ok := c.reqs[name]; !ok {
+						c.addDiagAt("E_SEM_UNKNOWN_DEPENDENCY", fmt.Sprintf("unknown request in depends_on: %s", name), req.File, l.Span, "reference an existing request")
+					}
+				}
 			case *ast.HookBlock:
 				if l.Kind == ast.HookPre {
 					preHook++
@@ -274,6 +376,32 @@ func (c *compiler) passRequests() {
 				}
 			}
 		}
+		// Merged lines keep a single body, so count the request's own lines:
+		// a child may replace an inherited body but not declare two.
+		for _, line := range req.Decl.Lines {
+			switch l := line.(type) {
+			case *ast.JsonDirective:
+				bodyCount++
+				if c.opt.StrictJSON {
+					forEachDuplicateKey(l.Value, func(key ast.ObjectKey) {
+						c.addDiagAt("E_SEM_DUPLICATE_JSON_KEY", fmt.Sprintf("duplicate key in json body: %s", key.Name), req.File, key.Span, "remove one of the duplicate keys; the last one would win")
+					})
+				}
+			case *ast.XmlDirective, *ast.TextDirective, *ast.FormDirective, *ast.MultipartDirective:
+				bodyCount++
+			case *ast.RetryDirective:
+				retryCount++
+				if retryCount > 1 {
+					c.addDiagAt("E_SEM_DUPLICATE_RETRY", "request has multiple retry directives", req.File, l.Span, "keep only one retry directive")
+				}
+				if n, err := strconv.Atoi(l.Count.Raw); err != nil || n < 1 {
+					c.addDiagAt("E_SEM_INVALID_RETRY", fmt.Sprintf("invalid retry count: %s", l.Count.Raw), req.File, l.Count.Span, "use a whole number of retries of at least 1")
+				}
+				if d, err := time.ParseDuration(l.Every.Raw); err != nil || d <= 0 {
+					c.addDiagAt("E_SEM_INVALID_RETRY", fmt.Sprintf("invalid retry interval: %s", l.Every.Raw), req.File, l.Every.Span, "use a positive duration like 500ms")
+				}
+			}
+		}
 		if httpCount == 0 {
 			c.addDiagAt("E_SEM_REQ_MISSING_HTTP_LINE", "request must include exactly one HTTP line", req.File, req.Decl.Span, "add GET/POST/etc line")
 		}
@@ -286,18 +414,68 @@ func (c *compiler) passRequests() {
 		if postHook > 1 {
 			c.addDiagAt("E_SEM_DUPLICATE_POST_HOOK", "request has multiple post hooks", req.File, req.Decl.Span, "keep only one post hook")
 		}
-		if jsonCount > 1 {
-			c.addDiagAt("E_SEM_MULTIPLE_BODIES", "request has multiple body directives", req.File, req.Decl.Span, "keep only one json body directive")
+		if bodyCount > 1 {
+			c.addDiagAt("E_SEM_MULTIPLE_BODIES", "request has multiple body directives", req.File, req.Decl.Span, "keep only one json, xml, text, form, or multipart body directive")
+		}
+		if method, span, ok := bodyOnGet(lines); ok {
+			c.addWarnAt("W_SEM_BODY_ON_GET", fmt.Sprintf("%s request has a body", method), req.File, span, "servers usually ignore a body on GET and HEAD; use POST or another method")
 		}
 	}
 }
 
+// bodyOnGet reports the body directive of a request whose method is GET or
+// HEAD. A method directive decides the method only when it is a literal.
+func bodyOnGet(lines []ast.ReqLine) (string, ast.Span, bool) {
+	method := ""
+	var body ast.Span
+	hasBody := false
+	for _, line := range lines {
+		switch l := line.(type) {
+		case *ast.HttpLine:
+			switch l.Method {
+			case ast.MethodGet:
+				method = "GET"
+			case ast.MethodHead:
+				method = "HEAD"
+			}
+		case *ast.MethodDirective:
+			method = ""
+			if lit, ok := l.Value.(*ast.StringLit); ok {
+				if m, valid := HTTPMethod(lit.Value); valid {
+					method = m
+				}
+			}
+		case *ast.JsonDirective:
+			body, hasBody = l.Span, true
+		case *ast.XmlDirective:
+			body, hasBody = l.Span, true
+		case *ast.TextDirective:
+			body, hasBody = l.Span, true
+		case *ast.FormDirective:
+			body, hasBody = l.Span, true
+		case *ast.MultipartDirective:
+			body, hasBody = l.Span, true
+		}
+	}
+	if !hasBody || method != "GET" && method != "HEAD" {
+		return "", ast.Span{}, false
+	}
+	return method, body, true
+}
+
 func (c *compiler) passFlows() {
+	unasserted := map[string]struct{}{}
+	var flows []*ast.FlowDecl
 	for _, stmt := range c.modules[c.entryPath].Stmts {
-		flow, ok := stmt.(*ast.FlowDecl)
-		if !ok {
-			continue
+		if flow, ok := stmt.(*ast.FlowDecl); ok {
+			flows = append(flows, flow)
 		}
+	}
+	shared := map[string]struct{}{}
+	if c.opt.SharedVars {
+		sort.SliceStable(flows, func(i, j int) bool { return flows[i].Name.Value < flows[j].Name.Value })
+	}
+	for _, flow := range flows {
 		if len(flow.Chain) == 0 {
 			c.addDiagAt("E_SEM_FLOW_MISSING_CHAIN", "flow must contain a chain", c.entryPath, flow.Span, "add a chain line using ->")
 			continue
@@ -307,6 +485,9 @@ func (c *compiler) passFlows() {
 		for name := range c.globals {
 			defined[name] = struct{}{}
 		}
+		for name := range shared {
+			defined[name] = struct{}{}
+		}
 		for _, pre := range flow.Prelude {
 			defined[pre.Name] = struct{}{}
 		}
@@ -325,6 +506,12 @@ func (c *compiler) passFlows() {
 			} else {
 				bindings[binding] = struct{}{}
 			}
+			if c.opt.RequireAssertions && !hasAssertion(c.effReqs[step.ReqName]) {
+				if _, seen := unasserted[step.ReqName]; !seen {
+					unasserted[step.ReqName] = struct{}{}
+					c.addDiagAt("E_SEM_REQUEST_NO_ASSERTIONS", fmt.Sprintf("request has no assertions: %s", step.ReqName), req.File, req.Decl.Span, "add a ? assertion to the request or one of its parents")
+				}
+			}
 			required := c.requiredVars(c.effReqs[step.ReqName])
 			for _, name := range required {
 				if _, ok := defined[name]; !ok {
@@ -341,6 +528,9 @@ func (c *compiler) passFlows() {
 				}
 			}
 		}
+		for _, block := range flow.Eventually {
+			c.checkEventuallyBlock(block, bindings, defined)
+		}
 		for _, as := range flow.Asserts {
 			for _, ident := range collectExprIdents(as.Expr) {
 				if _, ok := defined[ident]; ok {
@@ -352,11 +542,113 @@ func (c *compiler) passFlows() {
 				c.addDiagAt("E_SEM_UNKNOWN_FLOW_BINDING", fmt.Sprintf("unknown flow binding or variable: %s", ident), c.entryPath, as.Span, "use a binding from the chain or a defined variable")
 			}
 		}
+		if c.opt.SharedVars {
+			shared = defined
+		}
+	}
+}
+
+// checkEventuallyBlock validates an assert_eventually block and registers
+// its binding so that later flow assertions can reference it.
+func (c *compiler) checkEventuallyBlock(block *ast.EventuallyBlock, bindings, defined map[string]struct{}) {
+	for _, lit := range []*ast.DurationLit{block.Timeout, block.Interval} {
+		if d, err := time.ParseDuration(lit.Raw); err != nil || d <= 0 {
+			c.addDiagAt("E_SEM_INVALID_EVENTUALLY", fmt.Sprintf("invalid assert_eventually duration: %s", lit.Raw), c.entryPath, lit.Span, "use a positive duration like 500ms or 5s")
+		}
+	}
+	step := block.Step
+	req, ok := c.reqs[step.ReqName]
+	if !ok {
+		c.addDiagAt("E_SEM_UNKNOWN_REQ_IN_FLOW", fmt.Sprintf("unknown request in flow: %s", step.ReqName), c.entryPath, step.Span, "reference an existing request")
+		return
+	}
+	binding := step.ReqName
+	if step.Alias != nil {
+		binding = *step.Alias
+	}
+	if _, ok := bindings[binding]; ok {
+		c.addDiagAt("E_SEM_DUPLICATE_FLOW_BINDING", fmt.Sprintf("duplicate flow binding: %s", binding), c.entryPath, step.Span, "alias the polled request, e.g. getJob:job")
+	} else {
+		bindings[binding] = struct{}{}
+	}
+	for _, name := range c.requiredVars(c.effReqs[step.ReqName]) {
+		if _, ok := defined[name]; !ok {
+			code := "E_SEM_UNDEFINED_VARIABLE"
+			if reqUsesPathParam(c.effReqs[step.ReqName], name) {
+				code = "E_SEM_MISSING_PATH_PARAM_VAR"
+			}
+			c.addDiagAt(code, fmt.Sprintf("undefined variable: %s", name), req.File, req.Decl.Span, "define variable globally, in flow prelude, or in prior request lets")
+		}
+	}
+	for _, line := range c.effReqs[step.ReqName] {
+		if l, ok := line.(*ast.LetStmt); ok {
+			defined[l.Name] = struct{}{}
+		}
+	}
+	for _, as := range block.Asserts {
+		for _, ident := range collectExprIdents(as.Expr) {
+			if _, ok := defined[ident]; ok {
+				continue
+			}
+			if _, ok := bindings[ident]; ok {
+				continue
+			}
+			c.addDiagAt("E_SEM_UNKNOWN_FLOW_BINDING", fmt.Sprintf("unknown flow binding or variable: %s", ident), c.entryPath, as.Span, "use a binding from the chain or a defined variable")
+		}
+	}
+}
+
+// forEachDuplicateKey calls fn for every key that repeats an earlier key in
+// the same object literal, including nested literals.
+func forEachDuplicateKey(expr ast.Expr, fn func(ast.ObjectKey)) {
+	switch e := expr.(type) {
+	case *ast.ObjectLit:
+		seen := map[string]struct{}{}
+		for _, pair := range e.Pairs {
+			if _, ok := seen[pair.Key.Name]; ok {
+				fn(pair.Key)
+			}
+			seen[pair.Key.Name] = struct{}{}
+			forEachDuplicateKey(pair.Value, fn)
+		}
+	case *ast.ArrayLit:
+		for _, el := range e.Elements {
+			forEachDuplicateKey(el, fn)
+		}
+	case *ast.ParenExpr:
+		forEachDuplicateKey(e.X, fn)
 	}
 }
 
+func hasAssertion(lines []ast.ReqLine) bool {
+	for _, line := range lines {
+		if _, ok := line.(*ast.AssertStmt); ok {
+			return true
+		}
+	}
+	return false
+}
+
 func (c *compiler) buildPlan() {
-	plan := &Plan{EntryPath: c.entryPath}
+	plan := &Plan{EntryPath: c.entryPath, Vars: append([]string(nil), c.opt.Vars...), Services: map[string]string{}}
+	sort.Strings(plan.Vars)
+	for name, s := range c.services {
+		plan.Services[name] = s.Stmt.URL.Value
+	}
+	for _, path := range c.loadOrder {
+		if path == c.entryPath {
+			continue
+		}
+		mod := PlanModule{Path: path}
+		for _, stmt := range c.modules[path].Stmts {
+			if s, ok := stmt.(*ast.LetStmt); ok {
+				mod.Lets = append(mod.Lets, s)
+			}
+		}
+		if len(mod.Lets) > 0 {
+			plan.Imports = append(plan.Imports, mod)
+		}
+	}
 	for _, stmt := range c.modules[c.entryPath].Stmts {
 		switch s := stmt.(type) {
 		case *ast.SettingStmt:
@@ -378,11 +670,17 @@ func (c *compiler) buildPlan() {
 	}
 	for name, req := range c.reqs {
 		lines := c.effReqs[name]
-		pr := PlanRequest{Name: name, Parent: req.Decl.Parent, Decl: req.Decl, Lines: lines}
+		pr := PlanRequest{Name: name, Parent: req.Decl.Parent, File: req.File, Decl: req.Decl, Lines: lines}
 		for _, line := range lines {
-			if http, ok := line.(*ast.HttpLine); ok {
-				pr.HTTP = http
-				break
+			switch l := line.(type) {
+			case *ast.HttpLine:
+				pr.HTTP = l
+			case *ast.SharedDirective:
+				pr.Shared = true
+			case *ast.DependsOnDirective:
+				pr.DependsOn = l
+			case *ast.TagDirective:
+				pr.Tags = append(pr.Tags, l.Name)
 			}
 		}
 		plan.Requests = append(plan.Requests, pr)
@@ -394,6 +692,9 @@ func (c *compiler) buildPlan() {
 			continue
 		}
 		pf := PlanFlow{Name: flow.Name.Value, Span: flow.Span, Decl: flow}
+		for _, tag := range flow.Tags {
+			pf.Tags = append(pf.Tags, tag.Name)
+		}
 		for _, let := range flow.Prelude {
 			pf.Lets = append(pf.Lets, let.Name)
 		}
@@ -413,6 +714,65 @@ func (c *compiler) buildPlan() {
 	c.plan = plan
 }
 
+// Assertion is one assertion found by Assertions.
+type Assertion struct {
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	Column  int    `json:"column"`
+	Request string `json:"request,omitempty"`
+	Flow    string `json:"flow,omitempty"`
+	Expr    string `json:"expr"`
+}
+
+// Assertions lists every assertion of a compiled plan without running it:
+// each request's effective assertions, including inherited ones, then each
+// flow's assert_eventually and flow-level assertions. modules locates the
+// file each assertion was written in.
+func Assertions(plan *Plan, modules []Module) []Assertion {
+	files := map[*ast.AssertStmt]string{}
+	for _, mod := range modules {
+		for _, stmt := range mod.Program.Stmts {
+			req, ok := stmt.(*ast.ReqDecl)
+			if !ok {
+				continue
+			}
+			for _, line := range req.Lines {
+				if as, ok := line.(*ast.AssertStmt); ok {
+					files[as] = mod.Path
+				}
+			}
+		}
+	}
+	var out []Assertion
+	add := func(as *ast.AssertStmt, file, request, flow string) {
+		if f, ok := files[as]; ok {
+			file = f
+		}
+		out = append(out, Assertion{File: file, Line: as.Span.Start.Line, Column: as.Span.Start.Column, Request: request, Flow: flow, Expr: ast.FormatExpr(as.Expr)})
+	}
+	for _, req := range plan.Requests {
+		for _, line := range req.Lines {
+			if as, ok := line.(*ast.AssertStmt); ok {
+				add(as, plan.EntryPath, req.Name, "")
+			}
+		}
+	}
+	for _, flow := range plan.Flows {
+		if flow.Decl == nil {
+			continue
+		}
+		for _, block := range flow.Decl.Eventually {
+			for _, as := range block.Asserts {
+				add(as, plan.EntryPath, block.Step.ReqName, flow.Name)
+			}
+		}
+		for _, as := range flow.Decl.Asserts {
+			add(as, plan.EntryPath, "", flow.Name)
+		}
+	}
+	return out
+}
+
 func (c *compiler) addDiag(code, msg, file string, span ast.Span, hint string) {
 	c.addDiagAt(code, msg, file, span, hint)
 }
@@ -421,6 +781,10 @@ func (c *compiler) addDiagAt(code, msg, file string, span ast.Span, hint string)
 	c.diags = append(c.diags, diagnostics.Diagnostic{Severity: "error", Code: code, Message: msg, File: file, Line: span.Start.Line, Column: span.Start.Column, Hint: hint})
 }
 
+func (c *compiler) addWarnAt(code, msg, file string, span ast.Span, hint string) {
+	c.diags = append(c.diags, diagnostics.Diagnostic{Severity: "warning", Code: code, Message: msg, File: file, Line: span.Start.Line, Column: span.Start.Column, Hint: hint})
+}
+
 func (c *compiler) addRelatedDiag(code, msg, file string, span ast.Span, relatedFile string, related ast.Span, hint string) {
 	c.diags = append(c.diags, diagnostics.Diagnostic{Severity: "error", Code: code, Message: msg, File: file, Line: span.Start.Line, Column: span.Start.Column, Hint: hint, Related: &diagnostics.Related{File: relatedFile, Line: related.Start.Line, Column: related.Start.Column, Message: "first declaration"}})
 }
@@ -518,7 +882,7 @@ func (c *compiler) requiredVars(lines []ast.ReqLine) []string {
 	for _, line := range lines {
 		switch l := line.(type) {
 		case *ast.HttpLine:
-			for _, m := range pathParamRE.FindAllStringSubmatch(l.Path, -1) {
+			for _, m := range pathParamRE.FindAllStringSubmatch(envTemplateRE.ReplaceAllString(l.Path, ""), -1) {
 				add(m[1])
 			}
 			addTemplateVars(collectTemplateVarsInString(l.Path), nil)
@@ -533,15 +897,47 @@ func (c *compiler) requiredVars(lines []ast.ReqLine) []string {
 				add(id)
 			}
 		case *ast.AuthDirective:
+			for _, expr := range []ast.Expr{l.Value, l.Password} {
+				if expr == nil {
+					continue
+				}
+				addTemplateVars(collectTemplateVarsInExpr(expr), nil)
+				for _, id := range collectExprIdents(expr) {
+					add(id)
+				}
+			}
+		case *ast.JsonDirective:
 			addTemplateVars(collectTemplateVarsInExpr(l.Value), nil)
 			for _, id := range collectExprIdents(l.Value) {
 				add(id)
 			}
-		case *ast.JsonDirective:
+		case *ast.XmlDirective:
+			addTemplateVars(collectTemplateVarsInExpr(l.Value), nil)
+			for _, id := range collectExprIdents(l.Value) {
+				add(id)
+			}
+		case *ast.MethodDirective:
 			addTemplateVars(collectTemplateVarsInExpr(l.Value), nil)
 			for _, id := range collectExprIdents(l.Value) {
 				add(id)
 			}
+		case *ast.TextDirective:
+			addTemplateVars(collectTemplateVarsInExpr(l.Value), nil)
+			for _, id := range collectExprIdents(l.Value) {
+				add(id)
+			}
+		case *ast.FormDirective:
+			addTemplateVars(collectTemplateVarsInExpr(l.Value), nil)
+			for _, id := range collectExprIdents(l.Value) {
+				add(id)
+			}
+		case *ast.MultipartDirective:
+			for _, part := range l.Parts {
+				addTemplateVars(collectTemplateVarsInExpr(part.Value), nil)
+				for _, id := range collectExprIdents(part.Value) {
+					add(id)
+				}
+			}
 		case *ast.AssertStmt:
 			addTemplateVars(collectTemplateVarsInExpr(l.Expr), postHookTemplateSymbols)
 			for _, id := range collectExprIdents(l.Expr) {
@@ -584,13 +980,35 @@ func (c *compiler) requiredVars(lines []ast.ReqLine) []string {
 	return out
 }
 
+// HTTPMethod returns the canonical form of a method name accepted by the
+// method directive, matched case-insensitively.
+func HTTPMethod(name string) (string, bool) {
+	switch m := strings.ToUpper(name); m {
+	case "GET", "POST", "PUT", "PATCH", "DELETE", "HEAD", "OPTIONS":
+		return m, true
+	}
+	return "", false
+}
+
+// ServiceName returns the service of a path written as @name/rest.
+func ServiceName(path string) (string, bool) {
+	if !strings.HasPrefix(path, "@") {
+		return "", false
+	}
+	name := path[1:]
+	if i := strings.IndexAny(name, "/?#"); i >= 0 {
+		name = name[:i]
+	}
+	return name, true
+}
+
 func reqUsesPathParam(lines []ast.ReqLine, name string) bool {
 	for _, line := range lines {
 		http, ok := line.(*ast.HttpLine)
 		if !ok {
 			continue
 		}
-		for _, m := range pathParamRE.FindAllStringSubmatch(http.Path, -1) {
+		for _, m := range pathParamRE.FindAllStringSubmatch(envTemplateRE.ReplaceAllString(http.Path, ""), -1) {
 			if m[1] == name {
 				return true
 			}
@@ -602,8 +1020,15 @@ func reqUsesPathParam(lines []ast.ReqLine, name string) bool {
 func mergeRequestLines(parent, child []ast.ReqLine) []ast.ReqLine {
 	type shape struct {
 		http    *ast.HttpLine
+		method  *ast.MethodDirective
+		retry   *ast.RetryDirective
 		auth    *ast.AuthDirective
-		json    *ast.JsonDirective
+		body    ast.ReqLine
+		shared  *ast.SharedDirective
+		expect  *ast.ExpectBodyDirective
+		tags    []*ast.TagDirective
+		tagSet  map[string]struct{}
+		deps    *ast.DependsOnDirective
 		pre     *ast.HookBlock
 		post    *ast.HookBlock
 		headers map[string]*ast.HeaderDirective
@@ -614,7 +1039,7 @@ func mergeRequestLines(parent, child []ast.ReqLine) []ast.ReqLine {
 		lets    map[string]*ast.LetStmt
 		letK    []string
 	}
-	s := shape{headers: map[string]*ast.HeaderDirective{}, queries: map[string]*ast.QueryDirective{}, lets: map[string]*ast.LetStmt{}}
+	s := shape{headers: map[string]*ast.HeaderDirective{}, queries: map[string]*ast.QueryDirective{}, lets: map[string]*ast.LetStmt{}, tagSet: map[string]struct{}{}}
 
 	applyLines := func(lines []ast.ReqLine, isChild bool) {
 		childAsserts := []*ast.AssertStmt{}
@@ -622,10 +1047,25 @@ func mergeRequestLines(parent, child []ast.ReqLine) []ast.ReqLine {
 			switch l := line.(type) {
 			case *ast.HttpLine:
 				s.http = l
+			case *ast.MethodDirective:
+				s.method = l
+			case *ast.RetryDirective:
+				s.retry = l
 			case *ast.AuthDirective:
 				s.auth = l
-			case *ast.JsonDirective:
-				s.json = l
+			case *ast.JsonDirective, *ast.XmlDirective, *ast.TextDirective, *ast.FormDirective, *ast.MultipartDirective:
+				s.body = l
+			case *ast.SharedDirective:
+				s.shared = l
+			case *ast.ExpectBodyDirective:
+				s.expect = l
+			case *ast.TagDirective:
+				if _, ok := s.tagSet[l.Name]; !ok {
+					s.tagSet[l.Name] = struct{}{}
+					s.tags = append(s.tags, l)
+				}
+			case *ast.DependsOnDirective:
+				s.deps = l
 			case *ast.HookBlock:
 				if l.Kind == ast.HookPre {
 					s.pre = l
@@ -670,6 +1110,24 @@ func mergeRequestLines(parent, child []ast.ReqLine) []ast.ReqLine {
 	if s.http != nil {
 		out = append(out, s.http)
 	}
+	if s.method != nil {
+		out = append(out, s.method)
+	}
+	if s.retry != nil {
+		out = append(out, s.retry)
+	}
+	if s.shared != nil {
+		out = append(out, s.shared)
+	}
+	if s.expect != nil {
+		out = append(out, s.expect)
+	}
+	for _, tag := range s.tags {
+		out = append(out, tag)
+	}
+	if s.deps != nil {
+		out = append(out, s.deps)
+	}
 	if s.auth != nil {
 		out = append(out, s.auth)
 	}
@@ -679,8 +1137,8 @@ func mergeRequestLines(parent, child []ast.ReqLine) []ast.ReqLine {
 	for _, key := range s.queryK {
 		out = append(out, s.queries[key])
 	}
-	if s.json != nil {
-		out = append(out, s.json)
+	if s.body != nil {
+		out = append(out, s.body)
 	}
 	if s.pre != nil {
 		out = append(out, s.pre)
@@ -4,9 +4,12 @@ import (
 	"bytes"
 	"encoding/json"
 	"flag"
+	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
 	"sort"
+	"strings"
 	"testing"
 
 	"github.com/mehditeymorian/pipetest/internal/ast"
@@ -56,6 +59,7 @@ func TestCompileInvalidDiagnostics(t *testing.T) {
 		{name: "import-cycle", entry: "../../testdata/compiler/invalid/import-cycle-a.pt", files: []string{"../../testdata/compiler/invalid/import-cycle-a.pt", "../../testdata/compiler/invalid/import-cycle-b.pt"}, golden: "../../testdata/compiler/golden/import-cycle.errors.json"},
 		{name: "inheritance-cycle", entry: "../../testdata/compiler/invalid/inheritance-cycle.pt", files: []string{"../../testdata/compiler/invalid/inheritance-cycle.pt"}, golden: "../../testdata/compiler/golden/inheritance-cycle.errors.json"},
 		{name: "undefined-inherited-path-var", entry: "../../testdata/compiler/invalid/undefined-variable-in-inherited-path.pt", files: []string{"../../testdata/compiler/invalid/undefined-variable-in-inherited-path.pt"}, golden: "../../testdata/compiler/golden/undefined-variable-in-inherited-path.errors.json"},
+		{name: "unknown-dependency", entry: "../../testdata/compiler/invalid/unknown-dependency.pt", files: []string{"../../testdata/compiler/invalid/unknown-dependency.pt"}, golden: "../../testdata/compiler/golden/unknown-dependency.errors.json"},
 	}
 	for _, tc := range cases {
 		t.Run(tc.name, func(t *testing.T) {
@@ -127,3 +131,344 @@ func TestDiagnosticsSortAndDedup(t *testing.T) {
 		t.Fatalf("unexpected sort order: %+v", out)
 	}
 }
+
+func TestCompileRequireAssertions(t *testing.T) {
+	src := `
+req base_check:
+	GET /health
+	? status == 200
+
+req inherited(base_check):
+	GET /ready
+
+req asserted:
+	GET /items
+	? status == 200
+
+req unasserted:
+	GET /orders
+
+flow "checks":
+	inherited -> asserted -> unasserted -> unasserted:again
+`
+	mods := []Module{{Path: "require-assertions.pt", Program: parseProgram(t, "require-assertions.pt", src)}}
+
+	if _, diags := Compile("require-assertions.pt", mods); len(diags) != 0 {
+		t.Fatalf("expected no diagnostics without RequireAssertions, got %+v", diags)
+	}
+
+	_, diags := CompileWithOptions("require-assertions.pt", mods, Options{RequireAssertions: true})
+	if len(diags) != 1 {
+		t.Fatalf("expected one diagnostic, got %+v", diags)
+	}
+	if diags[0].Code != "E_SEM_REQUEST_NO_ASSERTIONS" || diags[0].Message != "request has no assertions: unasserted" {
+		t.Fatalf("unexpected diagnostic: %+v", diags[0])
+	}
+}
+
+func TestCompileTagsOnRequestsAndFlows(t *testing.T) {
+	src := `
+req base_req:
+	tag "auth"
+	GET /base
+
+req child(base_req):
+	tag "smoke"
+	tag "auth"
+	GET /child
+
+flow "tagged":
+	tag "nightly"
+	child
+`
+	mods := []Module{{Path: "tags.pt", Program: parseProgram(t, "tags.pt", src)}}
+	plan, diags := Compile("tags.pt", mods)
+	if len(diags) != 0 {
+		t.Fatalf("expected no diagnostics, got %+v", diags)
+	}
+	var child PlanRequest
+	for _, req := range plan.Requests {
+		if req.Name == "child" {
+			child = req
+		}
+	}
+	if !reflect.DeepEqual(child.Tags, []string{"auth", "smoke"}) {
+		t.Fatalf("expected inherited and own tags, got %v", child.Tags)
+	}
+	if !reflect.DeepEqual(plan.Flows[0].Tags, []string{"nightly"}) {
+		t.Fatalf("unexpected flow tags: %v", plan.Flows[0].Tags)
+	}
+}
+
+func TestCompileServiceBases(t *testing.T) {
+	services := `
+base_for "orders" "https://orders.example.com"
+`
+	src := `
+import "services.pt"
+
+req listOrders:
+	GET @orders/v1/list
+
+req listUsers:
+	GET @users/v1/list
+
+flow "orders":
+	listOrders
+`
+	mods := []Module{
+		{Path: "main.pt", Program: parseProgram(t, "main.pt", src)},
+		{Path: "services.pt", Program: parseProgram(t, "services.pt", services)},
+	}
+	_, diags := Compile("main.pt", mods)
+	if len(diags) != 1 || diags[0].Code != "E_SEM_UNKNOWN_SERVICE" || diags[0].Message != "unknown service: @users" {
+		t.Fatalf("expected unknown service diagnostic, got %+v", diags)
+	}
+
+	mods[0].Program = parseProgram(t, "main.pt", strings.Replace(src, "@users", "@orders", 1))
+	plan, diags := Compile("main.pt", mods)
+	if len(diags) != 0 {
+		t.Fatalf("expected no diagnostics, got %+v", diags)
+	}
+	if !reflect.DeepEqual(plan.Services, map[string]string{"orders": "https://orders.example.com"}) {
+		t.Fatalf("unexpected services: %v", plan.Services)
+	}
+}
+
+func TestCompileSharedVarsUsesEarlierFlows(t *testing.T) {
+	src := `
+req login:
+	POST https://api.example.com/login
+	let token = #.token
+
+req me:
+	GET https://api.example.com/me
+	header Authorization = "Bearer {{token}}"
+
+flow "b profile":
+	me
+
+flow "a login":
+	login
+`
+	mods := []Module{{Path: "shared-vars.pt", Program: parseProgram(t, "shared-vars.pt", src)}}
+	_, diags := Compile("shared-vars.pt", mods)
+	if len(diags) != 1 || diags[0].Code != "E_SEM_UNDEFINED_VARIABLE" {
+		t.Fatalf("expected token to be undefined without shared vars, got %+v", diags)
+	}
+	if _, diags := CompileWithOptions("shared-vars.pt", mods, Options{SharedVars: true}); len(diags) != 0 {
+		t.Fatalf("expected no diagnostics with shared vars, got %+v", diags)
+	}
+
+	mods[0].Program = parseProgram(t, "shared-vars.pt", strings.Replace(src, `"a login"`, `"z login"`, 1))
+	if _, diags := CompileWithOptions("shared-vars.pt", mods, Options{SharedVars: true}); len(diags) != 1 {
+		t.Fatalf("expected flows sorting after the login flow only to see token, got %+v", diags)
+	}
+}
+
+func TestCompileBasicAuthRequiresBothVariables(t *testing.T) {
+	src := `
+req legacy:
+	GET https://legacy.example.com/reports
+	auth basic user "{{password}}"
+
+flow "legacy":
+	legacy
+`
+	mods := []Module{{Path: "basic-auth.pt", Program: parseProgram(t, "basic-auth.pt", src)}}
+	_, diags := Compile("basic-auth.pt", mods)
+	var got []string
+	for _, d := range diags {
+		got = append(got, d.Code+" "+d.Message)
+	}
+	want := []string{"E_SEM_UNDEFINED_VARIABLE undefined variable: user", "E_SEM_UNDEFINED_VARIABLE undefined variable: password"}
+	sort.Strings(got)
+	sort.Strings(want)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected diagnostics: %v", got)
+	}
+}
+
+func TestCompileWarnsOnBodyWithGet(t *testing.T) {
+	src := `
+req search:
+	GET https://api.example.com/search
+	json { q: "shoes" }
+
+req peek(search):
+	HEAD https://api.example.com/search
+
+req remove:
+	DELETE https://api.example.com/items/1
+	json { reason: "dup" }
+
+req dynamic(search):
+	method "{{verb}}"
+
+req posted(search):
+	method "post"
+
+flow "search":
+	let verb = "POST"
+	search -> peek -> remove -> dynamic -> posted
+`
+	mods := []Module{{Path: "get-body.pt", Program: parseProgram(t, "get-body.pt", src)}}
+	plan, diags := Compile("get-body.pt", mods)
+	if plan == nil {
+		t.Fatalf("expected warnings to still produce a plan, got %+v", diags)
+	}
+	var got []string
+	for _, d := range diags {
+		got = append(got, fmt.Sprintf("%s %s %s:%d", d.Severity, d.Code, d.Message, d.Line))
+	}
+	want := []string{"warning W_SEM_BODY_ON_GET GET request has a body:4", "warning W_SEM_BODY_ON_GET HEAD request has a body:4"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected diagnostics: %v", got)
+	}
+}
+
+func TestCompileValidatesRetryDirective(t *testing.T) {
+	src := `
+req job:
+	GET https://api.example.com/job
+	retry 3 every 1s
+	retry 0 every 1s
+	? status == 200
+
+req check(job):
+	retry 2 every 500ms
+
+req spin(job):
+	retry 2 every 0s
+
+flow "poll":
+	job -> check -> spin
+`
+	mods := []Module{{Path: "retry.pt", Program: parseProgram(t, "retry.pt", src)}}
+	_, diags := Compile("retry.pt", mods)
+	var got []string
+	for _, d := range diags {
+		got = append(got, fmt.Sprintf("%s %d:%d", d.Code, d.Line, d.Column))
+	}
+	want := []string{"E_SEM_DUPLICATE_RETRY 5:2", "E_SEM_INVALID_RETRY 5:8", "E_SEM_INVALID_RETRY 12:16"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected diagnostics: %v", got)
+	}
+}
+
+func TestCompileValidatesEventuallyDurations(t *testing.T) {
+	src := `
+req job:
+	GET https://api.example.com/job
+
+flow "poll":
+	job
+	assert_eventually timeout 1d interval 0s:
+		job:again
+		? again.status == 200
+	assert_eventually timeout 5s interval 500ms:
+		job:later
+		? later.status == 200
+`
+	mods := []Module{{Path: "eventually.pt", Program: parseProgram(t, "eventually.pt", src)}}
+	_, diags := Compile("eventually.pt", mods)
+	var got []string
+	for _, d := range diags {
+		got = append(got, fmt.Sprintf("%s %d:%d", d.Code, d.Line, d.Column))
+	}
+	want := []string{"E_SEM_INVALID_EVENTUALLY 7:28", "E_SEM_INVALID_EVENTUALLY 7:40"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected diagnostics: %v", got)
+	}
+}
+
+func TestCompileImportedLetsRequireExport(t *testing.T) {
+	shared := `
+let host = "https://api.example.com"
+export let api_url = host + "/v1"
+`
+	src := `
+import "shared.pt"
+
+req ping:
+	GET /ping
+	header X-Api-Url = api_url
+	header X-Host = host
+
+flow "ping":
+	ping
+`
+	mods := []Module{
+		{Path: "main.pt", Program: parseProgram(t, "main.pt", src)},
+		{Path: "shared.pt", Program: parseProgram(t, "shared.pt", shared)},
+	}
+	_, diags := Compile("main.pt", mods)
+	if len(diags) != 1 || diags[0].Code != "E_SEM_UNDEFINED_VARIABLE" || diags[0].Message != "undefined variable: host" {
+		t.Fatalf("expected only the unexported let to be undefined, got %+v", diags)
+	}
+
+	mods[0].Program = parseProgram(t, "main.pt", strings.Replace(src, "\theader X-Host = host\n", "", 1))
+	plan, diags := Compile("main.pt", mods)
+	if len(diags) != 0 {
+		t.Fatalf("expected no diagnostics, got %+v", diags)
+	}
+	if len(plan.Imports) != 1 || plan.Imports[0].Path != "shared.pt" || len(plan.Imports[0].Lets) != 2 || !plan.Imports[0].Lets[1].Exported {
+		t.Fatalf("unexpected imported lets: %+v", plan.Imports)
+	}
+}
+
+func TestCompileAssertEventuallyBindings(t *testing.T) {
+	src := `
+req getJob:
+	GET /jobs
+
+flow "poll":
+	getJob
+	assert_eventually timeout 5s interval 500ms:
+		getJob
+		? getJob.res.status == "done"
+	assert_eventually timeout 5s interval 500ms:
+		getJob:later
+		? other.res.status == "done"
+	? later.status == 200
+`
+	_, diags := Compile("main.pt", []Module{{Path: "main.pt", Program: parseProgram(t, "main.pt", src)}})
+	var codes []string
+	for _, d := range diags {
+		codes = append(codes, d.Code)
+	}
+	want := []string{"E_SEM_DUPLICATE_FLOW_BINDING", "E_SEM_UNKNOWN_FLOW_BINDING"}
+	if !reflect.DeepEqual(codes, want) {
+		t.Fatalf("unexpected diagnostics: %+v", diags)
+	}
+}
+
+func TestCompileStrictJSONDuplicateKeys(t *testing.T) {
+	src := `
+req clean:
+	POST /clean
+	json { a: 1, b: { a: 2 }, items: [{ id: 1 }, { id: 2 }] }
+
+req dupe:
+	POST /dupe
+	json { a: 1, nested: { id: 1, "id": 2 }, a: 3 }
+
+flow "bodies":
+	clean -> dupe
+`
+	mods := []Module{{Path: "strict-json.pt", Program: parseProgram(t, "strict-json.pt", src)}}
+
+	if _, diags := Compile("strict-json.pt", mods); len(diags) != 0 {
+		t.Fatalf("expected no diagnostics without StrictJSON, got %+v", diags)
+	}
+
+	_, diags := CompileWithOptions("strict-json.pt", mods, Options{StrictJSON: true})
+	if len(diags) != 2 {
+		t.Fatalf("expected two diagnostics, got %+v", diags)
+	}
+	for i, want := range []string{"duplicate key in json body: id", "duplicate key in json body: a"} {
+		if diags[i].Code != "E_SEM_DUPLICATE_JSON_KEY" || diags[i].Message != want || diags[i].Line != 8 {
+			t.Fatalf("unexpected diagnostic %d: %+v", i, diags[i])
+		}
+	}
+}
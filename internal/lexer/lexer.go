@@ -1,6 +1,7 @@
 package lexer
 
 import (
+	"fmt"
 	"strings"
 	"unicode"
 	"unicode/utf8"
@@ -17,6 +18,9 @@ type Lexer struct {
 
 	lineStart    bool
 	lineStartPos Position
+	// lineHasToken is set once a line produced a token, so a '?' after it
+	// is part of '?.' rather than an assertion prefix.
+	lineHasToken bool
 
 	indentStack  []int
 	expectIndent bool
@@ -37,10 +41,36 @@ type Lexer struct {
 	errs  []LexError
 
 	eofProcessed bool
+
+	indentMode IndentMode
+	// spaceUnit is the width of the first space-indented line, which every
+	// later indentation must be a multiple of.
+	spaceUnit int
+}
+
+// IndentMode selects the character used for block indentation.
+type IndentMode int
+
+const (
+	// IndentTabs requires tabs and rejects space indentation.
+	IndentTabs IndentMode = iota
+	// IndentSpaces requires spaces in a uniform multiple of the first
+	// indented line's width and rejects tab indentation.
+	IndentSpaces
+)
+
+// Options configures a Lexer.
+type Options struct {
+	Indent IndentMode
 }
 
 // NewLexer returns a new lexer for the provided source.
 func NewLexer(path, src string) *Lexer {
+	return NewLexerWithOptions(path, src, Options{})
+}
+
+// NewLexerWithOptions is like NewLexer but applies opt.
+func NewLexerWithOptions(path, src string, opt Options) *Lexer {
 	return &Lexer{
 		path:         path,
 		src:          src,
@@ -49,12 +79,18 @@ func NewLexer(path, src string) *Lexer {
 		lineStart:    true,
 		lineStartPos: Position{Offset: 0, Line: 1, Column: 1},
 		indentStack:  []int{0},
+		indentMode:   opt.Indent,
 	}
 }
 
 // Lex returns all tokens and lexer errors for the provided source.
 func Lex(path, src string) ([]Token, []LexError) {
-	lx := NewLexer(path, src)
+	return LexWithOptions(path, src, Options{})
+}
+
+// LexWithOptions is like Lex but applies opt.
+func LexWithOptions(path, src string, opt Options) ([]Token, []LexError) {
+	lx := NewLexerWithOptions(path, src, opt)
 	var toks []Token
 	for {
 		tok := lx.Next()
@@ -168,13 +204,22 @@ func (l *Lexer) handleLineStart() {
 		r := l.peek()
 		if r == '\t' {
 			if l.hookDepth == 0 && l.exprDepth() == 0 {
-				indent++
+				if l.indentMode == IndentSpaces {
+					l.addError(ErrTab, "tab indentation is not allowed in spaces mode", "replace tabs with spaces", spanAt(l.position()))
+				} else {
+					indent++
+				}
 			}
 			l.advance()
 			continue
 		}
 		if r == ' ' {
 			if l.hookDepth == 0 && l.exprDepth() == 0 {
+				if l.indentMode == IndentSpaces {
+					indent++
+					l.advance()
+					continue
+				}
 				l.addError(ErrTab, "space indentation is not allowed", "replace spaces with tabs", spanAt(l.position()))
 				for l.peek() == ' ' {
 					l.advance()
@@ -197,6 +242,13 @@ func (l *Lexer) handleLineStart() {
 	}
 
 	if l.hookDepth == 0 && l.exprDepth() == 0 {
+		if l.indentMode == IndentSpaces && indent > 0 {
+			if l.spaceUnit == 0 {
+				l.spaceUnit = indent
+			} else if indent%l.spaceUnit != 0 {
+				l.addError(ErrIndent, fmt.Sprintf("indentation of %d spaces is not a multiple of %d", indent, l.spaceUnit), fmt.Sprintf("indent blocks with multiples of %d spaces", l.spaceUnit), spanAt(l.indentPos(indent)))
+			}
+		}
 		l.processIndent(indent)
 		l.expectIndent = false
 	}
@@ -241,6 +293,7 @@ func (l *Lexer) handleNewline() {
 	l.allowBareKey = false
 	l.hookCandidate = 0
 	l.pendingHookBrace = false
+	l.lineHasToken = false
 
 	if l.exprDepth() == 0 {
 		l.queue = append(l.queue, Token{Kind: NL, Span: Span{Start: start, End: l.position()}})
@@ -364,6 +417,10 @@ func (l *Lexer) scanOperatorOrPunct() (Token, bool) {
 		l.advanceN(2)
 		return l.token(OP_NE, "!=", start), true
 	}
+	if strings.HasPrefix(rest, "?.") && l.lineHasToken {
+		l.advanceN(2)
+		return l.token(QDOT, "?.", start), true
+	}
 
 	switch l.peek() {
 	case '<':
@@ -457,6 +514,9 @@ func (l *Lexer) scanOperatorOrPunct() (Token, bool) {
 	case '~':
 		l.advance()
 		return l.token(OP_TILDE, "~", start), true
+	case '@':
+		l.advance()
+		return l.token(AT, "@", start), true
 	default:
 		return Token{}, false
 	}
@@ -464,6 +524,9 @@ func (l *Lexer) scanOperatorOrPunct() (Token, bool) {
 
 func (l *Lexer) scanString() Token {
 	start := l.position()
+	if strings.HasPrefix(l.remaining(), `"""`) {
+		return l.scanTripleQuoted(start)
+	}
 	quote := l.peek()
 	l.advance()
 
@@ -507,6 +570,26 @@ func (l *Lexer) scanString() Token {
 	return l.token(STRING, l.src[start.Offset:l.pos], start)
 }
 
+// scanTripleQuoted scans a """...""" raw string that may span lines. The
+// contents are kept verbatim, without escape processing.
+func (l *Lexer) scanTripleQuoted(start Position) Token {
+	l.advanceN(3)
+	for {
+		if l.pos >= len(l.src) {
+			l.addError(ErrUnterminatedRaw, "unterminated raw string", `close the string with """`, Span{Start: start, End: l.position()})
+			break
+		}
+		if strings.HasPrefix(l.remaining(), `"""`) {
+			l.advanceN(3)
+			break
+		}
+		l.advance()
+	}
+	// Newlines inside the literal are not line starts for layout purposes.
+	l.lineStart = false
+	return l.token(STRING, l.src[start.Offset:l.pos], start)
+}
+
 func (l *Lexer) scanNumberOrDuration() Token {
 	start := l.position()
 	for unicode.IsDigit(l.peek()) {
@@ -633,6 +716,7 @@ func (l *Lexer) afterToken(tok Token) {
 	case NL, INDENT, DEDENT:
 		// ignore
 	default:
+		l.lineHasToken = true
 		if l.pendingHookBrace && tok.Kind != LBRACE {
 			l.pendingHookBrace = false
 		}
@@ -770,6 +854,7 @@ var keywordKinds = map[string]Kind{
 	"query":    KW_QUERY,
 	"auth":     KW_AUTH,
 	"bearer":   KW_BEARER,
+	"basic":    KW_BASIC,
 	"pre":      KW_PRE,
 	"post":     KW_POST,
 	"hook":     KW_HOOK,
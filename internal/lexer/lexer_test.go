@@ -6,45 +6,12 @@ import (
 	"os"
 	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 )
 
 var updateGolden = flag.Bool("update", false, "update golden files")
 
-type tokenSnapshot struct {
-	Kind  string           `json:"kind"`
-	Lit   string           `json:"lit"`
-	Start positionSnapshot `json:"start"`
-	End   positionSnapshot `json:"end"`
-}
-
-type positionSnapshot struct {
-	Offset int `json:"offset"`
-	Line   int `json:"line"`
-	Column int `json:"column"`
-}
-
-func snapshotTokens(tokens []Token) []tokenSnapshot {
-	out := make([]tokenSnapshot, 0, len(tokens))
-	for _, tok := range tokens {
-		out = append(out, tokenSnapshot{
-			Kind: tok.Kind.String(),
-			Lit:  tok.Lit,
-			Start: positionSnapshot{
-				Offset: tok.Span.Start.Offset,
-				Line:   tok.Span.Start.Line,
-				Column: tok.Span.Start.Column,
-			},
-			End: positionSnapshot{
-				Offset: tok.Span.End.Offset,
-				Line:   tok.Span.End.Line,
-				Column: tok.Span.End.Column,
-			},
-		})
-	}
-	return out
-}
-
 func TestLexerValidFiles(t *testing.T) {
 	root := filepath.Join("..", "..", "testdata", "lexer")
 	paths, err := filepath.Glob(filepath.Join(root, "valid", "*.pt"))
@@ -136,7 +103,7 @@ func TestLexerGolden(t *testing.T) {
 				t.Fatalf("unexpected lexer errors: %v", errs)
 			}
 
-			got := snapshotTokens(tokens)
+			got := SnapshotTokens(tokens)
 			if *updateGolden {
 				data, err := json.MarshalIndent(got, "", "  ")
 				if err != nil {
@@ -152,7 +119,7 @@ func TestLexerGolden(t *testing.T) {
 			if err != nil {
 				t.Fatalf("read golden: %v", err)
 			}
-			var want []tokenSnapshot
+			var want []TokenSnapshot
 			if err := json.Unmarshal(data, &want); err != nil {
 				t.Fatalf("unmarshal golden: %v", err)
 			}
@@ -165,3 +132,89 @@ func TestLexerGolden(t *testing.T) {
 		})
 	}
 }
+
+func TestLexerMultiLineRawString(t *testing.T) {
+	src := "req a:\n\tPOST /a\n\tjson `{\n\t\t\"a\": {\"b\": [1, 2]},\n\t\t\"c\": \"}\"\n\t}`\n\t? status == 200\n"
+	toks, errs := Lex("raw.pt", src)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	var kinds []string
+	for _, tok := range toks {
+		kinds = append(kinds, tok.Kind.String())
+		if tok.Kind == STRING {
+			if want := "`{\n\t\t\"a\": {\"b\": [1, 2]},\n\t\t\"c\": \"}\"\n\t}`"; tok.Lit != want {
+				t.Fatalf("unexpected raw string %q", tok.Lit)
+			}
+			if tok.Span.Start.Line != 3 || tok.Span.End.Line != 6 {
+				t.Fatalf("unexpected raw string span %+v", tok.Span)
+			}
+		}
+	}
+	want := "KW_REQ IDENT COLON NL INDENT KW_POST_M PATH NL KW_JSON STRING NL QUESTION IDENT OP_EQ NUMBER NL DEDENT EOF"
+	if got := strings.Join(kinds, " "); got != want {
+		t.Fatalf("unexpected tokens:\n got %s\nwant %s", got, want)
+	}
+}
+
+func TestLexerOptionalChaining(t *testing.T) {
+	src := "req a:\n\tGET /a\n\t?.5 < #?.b\n"
+	toks, errs := Lex("optional.pt", src)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	var kinds []string
+	for _, tok := range toks {
+		kinds = append(kinds, tok.Kind.String())
+	}
+	want := "KW_REQ IDENT COLON NL INDENT KW_GET PATH NL QUESTION DOT NUMBER OP_LT HASH QDOT IDENT NL DEDENT EOF"
+	if got := strings.Join(kinds, " "); got != want {
+		t.Fatalf("unexpected tokens:\n got %s\nwant %s", got, want)
+	}
+}
+
+func TestLexerSpaceIndentation(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("..", "..", "testdata", "lexer", "valid", "*.pt"))
+	if err != nil {
+		t.Fatalf("glob valid: %v", err)
+	}
+	for _, path := range paths {
+		src, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("read %s: %v", path, err)
+		}
+		lines := strings.Split(string(src), "\n")
+		for i, line := range lines {
+			trimmed := strings.TrimLeft(line, "\t")
+			lines[i] = strings.Repeat("    ", len(line)-len(trimmed)) + trimmed
+		}
+		want, _ := Lex(path, string(src))
+		got, errs := LexWithOptions(path, strings.Join(lines, "\n"), Options{Indent: IndentSpaces})
+		if len(errs) > 0 {
+			t.Fatalf("expected no errors for space-indented %s, got %v", path, errs)
+		}
+		if len(got) != len(want) {
+			t.Fatalf("token count mismatch for %s: %d vs %d", path, len(got), len(want))
+		}
+		for i := range want {
+			if got[i].Kind != want[i].Kind || got[i].Lit != want[i].Lit {
+				t.Fatalf("token %d mismatch for %s: %v %q vs %v %q", i, path, got[i].Kind, got[i].Lit, want[i].Kind, want[i].Lit)
+			}
+		}
+	}
+
+	cases := map[string]string{
+		"req a:\n  GET /a\n   ? status == 200\n": ErrIndent,
+		"req a:\n\tGET /a\n":                     ErrTab,
+	}
+	for src, code := range cases {
+		_, errs := LexWithOptions("spaces.pt", src, Options{Indent: IndentSpaces})
+		found := false
+		for _, le := range errs {
+			found = found || le.Code == code
+		}
+		if !found {
+			t.Fatalf("expected %s for %q, got %v", code, src, errs)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package lexer
+
+// TokenSnapshot is the JSON form of a token.
+type TokenSnapshot struct {
+	Kind  string           `json:"kind"`
+	Lit   string           `json:"lit"`
+	Start positionSnapshot `json:"start"`
+	End   positionSnapshot `json:"end"`
+}
+
+type positionSnapshot struct {
+	Offset int `json:"offset"`
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+// SnapshotTokens converts tokens into JSON-friendly records. It backs the
+// lexer golden files and `pipetest debug tokens`.
+func SnapshotTokens(tokens []Token) []TokenSnapshot {
+	out := make([]TokenSnapshot, 0, len(tokens))
+	for _, tok := range tokens {
+		out = append(out, TokenSnapshot{
+			Kind: tok.Kind.String(),
+			Lit:  tok.Lit,
+			Start: positionSnapshot{
+				Offset: tok.Span.Start.Offset,
+				Line:   tok.Span.Start.Line,
+				Column: tok.Span.Start.Column,
+			},
+			End: positionSnapshot{
+				Offset: tok.Span.End.Offset,
+				Line:   tok.Span.End.Line,
+				Column: tok.Span.End.Column,
+			},
+		})
+	}
+	return out
+}
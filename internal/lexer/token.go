@@ -33,6 +33,7 @@ const (
 	KW_QUERY
 	KW_AUTH
 	KW_BEARER
+	KW_BASIC
 	KW_PRE
 	KW_POST
 	KW_HOOK
@@ -60,6 +61,7 @@ const (
 	COLON     // :
 	COMMA     // ,
 	DOT       // .
+	QDOT      // ?.
 	ASSIGN    // =
 	SEMICOLON // ;
 	LPAREN    // (
@@ -68,6 +70,7 @@ const (
 	RBRACE    // }
 	LBRACK    // [
 	RBRACK    // ]
+	AT        // @
 
 	// expr operators
 	OP_OR
@@ -112,6 +115,7 @@ var kindNames = [...]string{
 	KW_QUERY:    "KW_QUERY",
 	KW_AUTH:     "KW_AUTH",
 	KW_BEARER:   "KW_BEARER",
+	KW_BASIC:    "KW_BASIC",
 	KW_PRE:      "KW_PRE",
 	KW_POST:     "KW_POST",
 	KW_HOOK:     "KW_HOOK",
@@ -135,6 +139,7 @@ var kindNames = [...]string{
 	COLON:       "COLON",
 	COMMA:       "COMMA",
 	DOT:         "DOT",
+	QDOT:        "QDOT",
 	ASSIGN:      "ASSIGN",
 	SEMICOLON:   "SEMICOLON",
 	LPAREN:      "LPAREN",
@@ -143,6 +148,7 @@ var kindNames = [...]string{
 	RBRACE:      "RBRACE",
 	LBRACK:      "LBRACK",
 	RBRACK:      "RBRACK",
+	AT:          "AT",
 	OP_OR:       "OP_OR",
 	OP_AND:      "OP_AND",
 	OP_NOT:      "OP_NOT",
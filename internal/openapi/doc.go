@@ -0,0 +1,3 @@
+// Package openapi reads response schemas from OpenAPI 3 documents and
+// validates decoded JSON values against them.
+package openapi
@@ -0,0 +1,381 @@
+package openapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/mehditeymorian/pipetest/internal/yaml"
+)
+
+// maxRefDepth bounds $ref chains that do not consume any of the value, so
+// a schema referring to itself cannot recurse forever.
+const maxRefDepth = 32
+
+var methods = []string{"get", "put", "post", "delete", "options", "head", "patch", "trace"}
+
+// Spec is a parsed OpenAPI document.
+type Spec struct {
+	doc map[string]any
+}
+
+// Load reads an OpenAPI document, as YAML when path ends in .yaml or .yml
+// and as JSON otherwise.
+func Load(path string) (*Spec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	parse := Parse
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		parse = ParseYAML
+	}
+	spec, err := parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return spec, nil
+}
+
+// Parse decodes a JSON OpenAPI document.
+func Parse(data []byte) (*Spec, error) {
+	var doc map[string]any
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+	return newSpec(doc)
+}
+
+// ParseYAML decodes a YAML OpenAPI document.
+func ParseYAML(data []byte) (*Spec, error) {
+	v, err := yaml.Unmarshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid YAML: %w", err)
+	}
+	doc, _ := v.(map[string]any)
+	return newSpec(doc)
+}
+
+func newSpec(doc map[string]any) (*Spec, error) {
+	if _, ok := doc["paths"].(map[string]any); !ok {
+		return nil, errors.New("not an OpenAPI document: missing paths")
+	}
+	return &Spec{doc: doc}, nil
+}
+
+// ResponseSchema returns the JSON schema of the response an operation
+// documents for status. An exact status wins over a range such as "2XX",
+// which wins over "default".
+func (s *Spec) ResponseSchema(operationID string, status int) (map[string]any, error) {
+	op, err := s.operation(operationID)
+	if err != nil {
+		return nil, err
+	}
+	responses, _ := op["responses"].(map[string]any)
+	code := strconv.Itoa(status)
+	var resp any
+	for _, key := range []string{code, code[:1] + "XX", code[:1] + "xx", "default"} {
+		if r, ok := responses[key]; ok {
+			resp = r
+			break
+		}
+	}
+	if resp == nil {
+		return nil, fmt.Errorf("operation %q documents no %d response", operationID, status)
+	}
+	respObj, err := s.resolve(resp)
+	if err != nil {
+		return nil, err
+	}
+	content, _ := respObj["content"].(map[string]any)
+	keys := make([]string, 0, len(content))
+	for k := range content {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, mediaType := range keys {
+		base, _, _ := strings.Cut(mediaType, ";")
+		base = strings.TrimSpace(base)
+		if base != "application/json" && !strings.HasSuffix(base, "+json") {
+			continue
+		}
+		media, _ := content[mediaType].(map[string]any)
+		if schema, ok := media["schema"].(map[string]any); ok {
+			return schema, nil
+		}
+	}
+	return nil, fmt.Errorf("response %d of operation %q has no JSON schema", status, operationID)
+}
+
+func (s *Spec) operation(operationID string) (map[string]any, error) {
+	paths, _ := s.doc["paths"].(map[string]any)
+	for _, item := range paths {
+		itemObj, _ := item.(map[string]any)
+		for _, method := range methods {
+			op, ok := itemObj[method].(map[string]any)
+			if ok && op["operationId"] == operationID {
+				return op, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("operation %q not found", operationID)
+}
+
+// resolve follows local $ref pointers such as "#/components/schemas/User".
+func (s *Spec) resolve(v any) (map[string]any, error) {
+	obj, _ := v.(map[string]any)
+	for depth := 0; obj != nil; depth++ {
+		ref, ok := obj["$ref"].(string)
+		if !ok {
+			return obj, nil
+		}
+		if depth == maxRefDepth {
+			return nil, fmt.Errorf("$ref %s: too many nested references", ref)
+		}
+		target, err := s.pointer(ref)
+		if err != nil {
+			return nil, err
+		}
+		obj = target
+	}
+	return map[string]any{}, nil
+}
+
+func (s *Spec) pointer(ref string) (map[string]any, error) {
+	if !strings.HasPrefix(ref, "#/") {
+		return nil, fmt.Errorf("$ref %s: only local references are supported", ref)
+	}
+	var cur any = s.doc
+	for _, part := range strings.Split(ref[2:], "/") {
+		part = strings.ReplaceAll(strings.ReplaceAll(part, "~1", "/"), "~0", "~")
+		obj, ok := cur.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("$ref %s: not found", ref)
+		}
+		if cur, ok = obj[part]; !ok {
+			return nil, fmt.Errorf("$ref %s: not found", ref)
+		}
+	}
+	obj, ok := cur.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("$ref %s: not a schema object", ref)
+	}
+	return obj, nil
+}
+
+// Validate checks value against schema and returns one message per
+// violation, each prefixed with the JSONPath of the offending value. It
+// supports type (with nullable), enum, properties, required,
+// additionalProperties, items, allOf, anyOf, oneOf, minimum, maximum,
+// minLength, maxLength, pattern, minItems, and maxItems. Other keywords,
+// including format, are ignored.
+func (s *Spec) Validate(schema map[string]any, value any) []string {
+	var out []string
+	s.validate(schema, value, "$", &out)
+	return out
+}
+
+func (s *Spec) validate(schema map[string]any, value any, path string, out *[]string) {
+	schema, err := s.resolve(schema)
+	if err != nil {
+		*out = append(*out, fmt.Sprintf("%s: %v", path, err))
+		return
+	}
+	if value == nil && schema["nullable"] == true {
+		return
+	}
+	if t, ok := schema["type"]; ok && !matchesType(t, value) {
+		*out = append(*out, fmt.Sprintf("%s: expected %s, got %s", path, typeNames(t), kindOf(value)))
+		return
+	}
+	if enum, ok := schema["enum"].([]any); ok && !slices.ContainsFunc(enum, func(e any) bool { return reflect.DeepEqual(e, value) }) {
+		*out = append(*out, fmt.Sprintf("%s: %s is not one of the enum values", path, format(value)))
+	}
+	for _, sub := range asSchemas(schema["allOf"]) {
+		s.validate(sub, value, path, out)
+	}
+	if subs := asSchemas(schema["anyOf"]); len(subs) > 0 && s.countMatches(subs, value) == 0 {
+		*out = append(*out, fmt.Sprintf("%s: does not match any anyOf schema", path))
+	}
+	if subs := asSchemas(schema["oneOf"]); len(subs) > 0 {
+		if n := s.countMatches(subs, value); n != 1 {
+			*out = append(*out, fmt.Sprintf("%s: matches %d oneOf schemas, expected exactly 1", path, n))
+		}
+	}
+	switch v := value.(type) {
+	case map[string]any:
+		s.validateObject(schema, v, path, out)
+	case []any:
+		if n, ok := number(schema["minItems"]); ok && float64(len(v)) < n {
+			*out = append(*out, fmt.Sprintf("%s: expected at least %v items, got %d", path, n, len(v)))
+		}
+		if n, ok := number(schema["maxItems"]); ok && float64(len(v)) > n {
+			*out = append(*out, fmt.Sprintf("%s: expected at most %v items, got %d", path, n, len(v)))
+		}
+		if items, ok := schema["items"].(map[string]any); ok {
+			for i, item := range v {
+				s.validate(items, item, fmt.Sprintf("%s[%d]", path, i), out)
+			}
+		}
+	case string:
+		length := float64(len([]rune(v)))
+		if n, ok := number(schema["minLength"]); ok && length < n {
+			*out = append(*out, fmt.Sprintf("%s: expected at least %v characters, got %v", path, n, length))
+		}
+		if n, ok := number(schema["maxLength"]); ok && length > n {
+			*out = append(*out, fmt.Sprintf("%s: expected at most %v characters, got %v", path, n, length))
+		}
+		if pattern, ok := schema["pattern"].(string); ok {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				*out = append(*out, fmt.Sprintf("%s: invalid pattern %q: %v", path, pattern, err))
+			} else if !re.MatchString(v) {
+				*out = append(*out, fmt.Sprintf("%s: %q does not match pattern %q", path, v, pattern))
+			}
+		}
+	default:
+		if n, isNum := number(value); isNum {
+			if min, ok := number(schema["minimum"]); ok && n < min {
+				*out = append(*out, fmt.Sprintf("%s: expected a value >= %v, got %v", path, min, n))
+			}
+			if max, ok := number(schema["maximum"]); ok && n > max {
+				*out = append(*out, fmt.Sprintf("%s: expected a value <= %v, got %v", path, max, n))
+			}
+		}
+	}
+}
+
+func (s *Spec) validateObject(schema, obj map[string]any, path string, out *[]string) {
+	props, _ := schema["properties"].(map[string]any)
+	if required, ok := schema["required"].([]any); ok {
+		for _, name := range required {
+			key, _ := name.(string)
+			if _, ok := obj[key]; !ok {
+				*out = append(*out, fmt.Sprintf("%s: missing required property %q", path, key))
+			}
+		}
+	}
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		child := path + "." + key
+		if prop, ok := props[key].(map[string]any); ok {
+			s.validate(prop, obj[key], child, out)
+			continue
+		}
+		switch extra := schema["additionalProperties"].(type) {
+		case bool:
+			if !extra {
+				*out = append(*out, fmt.Sprintf("%s: unexpected property", child))
+			}
+		case map[string]any:
+			s.validate(extra, obj[key], child, out)
+		}
+	}
+}
+
+func (s *Spec) countMatches(schemas []map[string]any, value any) int {
+	n := 0
+	for _, sub := range schemas {
+		var violations []string
+		s.validate(sub, value, "$", &violations)
+		if len(violations) == 0 {
+			n++
+		}
+	}
+	return n
+}
+
+func asSchemas(v any) []map[string]any {
+	list, _ := v.([]any)
+	var out []map[string]any
+	for _, item := range list {
+		if obj, ok := item.(map[string]any); ok {
+			out = append(out, obj)
+		}
+	}
+	return out
+}
+
+// matchesType reports whether value has the schema type t, which is a
+// name or, in OpenAPI 3.1, a list of names.
+func matchesType(t, value any) bool {
+	if list, ok := t.([]any); ok {
+		return slices.ContainsFunc(list, func(name any) bool { return matchesType(name, value) })
+	}
+	switch t {
+	case "integer":
+		n, ok := number(value)
+		return ok && n == math.Trunc(n) && !math.IsInf(n, 0)
+	case "number":
+		_, ok := number(value)
+		return ok
+	default:
+		return kindOf(value) == t
+	}
+}
+
+func typeNames(t any) string {
+	if list, ok := t.([]any); ok {
+		names := make([]string, len(list))
+		for i, name := range list {
+			names[i] = fmt.Sprint(name)
+		}
+		return strings.Join(names, " or ")
+	}
+	return fmt.Sprint(t)
+}
+
+func kindOf(v any) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	if _, ok := number(v); ok {
+		return "number"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func number(v any) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func format(v any) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(data)
+}
@@ -0,0 +1,137 @@
+package openapi
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func loadUsers(t *testing.T) *Spec {
+	t.Helper()
+	spec, err := Load(filepath.Join("..", "..", "testdata", "openapi", "users.json"))
+	if err != nil {
+		t.Fatalf("load spec: %v", err)
+	}
+	return spec
+}
+
+func decode(t *testing.T, src string) any {
+	t.Helper()
+	var v any
+	if err := json.Unmarshal([]byte(src), &v); err != nil {
+		t.Fatalf("decode %s: %v", src, err)
+	}
+	return v
+}
+
+func TestResponseSchemaLookup(t *testing.T) {
+	spec := loadUsers(t)
+	for _, tc := range []struct {
+		op      string
+		status  int
+		wantErr string
+	}{
+		{op: "getUser", status: 200},
+		{op: "getUser", status: 404},
+		{op: "listUsers", status: 200},
+		{op: "getUser", status: 500, wantErr: `operation "getUser" documents no 500 response`},
+		{op: "deleteUser", status: 204, wantErr: `response 204 of operation "deleteUser" has no JSON schema`},
+		{op: "createUser", status: 201, wantErr: `operation "createUser" not found`},
+	} {
+		_, err := spec.ResponseSchema(tc.op, tc.status)
+		if tc.wantErr == "" && err != nil {
+			t.Fatalf("%s %d: unexpected error: %v", tc.op, tc.status, err)
+		}
+		if tc.wantErr != "" && (err == nil || err.Error() != tc.wantErr) {
+			t.Fatalf("%s %d: expected error %q, got %v", tc.op, tc.status, tc.wantErr, err)
+		}
+	}
+}
+
+func TestLoadYAMLMatchesJSON(t *testing.T) {
+	fromYAML, err := Load(filepath.Join("..", "..", "testdata", "openapi", "users.yaml"))
+	if err != nil {
+		t.Fatalf("load yaml spec: %v", err)
+	}
+	if !reflect.DeepEqual(fromYAML.doc, loadUsers(t).doc) {
+		t.Fatalf("YAML spec differs from its JSON copy:\n%s", format(fromYAML.doc))
+	}
+	if _, err := ParseYAML([]byte("openapi: 3.0.3\ninfo: {title: x}\n")); err == nil || err.Error() != "not an OpenAPI document: missing paths" {
+		t.Fatalf("expected missing paths error, got %v", err)
+	}
+	if _, err := ParseYAML([]byte("paths:\n\t/x: {}\n")); err == nil || !strings.Contains(err.Error(), "invalid YAML: line 2") {
+		t.Fatalf("expected YAML syntax error, got %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	spec := loadUsers(t)
+	user, err := spec.ResponseSchema("getUser", 200)
+	if err != nil {
+		t.Fatalf("schema: %v", err)
+	}
+	list, err := spec.ResponseSchema("listUsers", 200)
+	if err != nil {
+		t.Fatalf("schema: %v", err)
+	}
+	for _, tc := range []struct {
+		name   string
+		schema map[string]any
+		value  string
+		want   []string
+	}{
+		{name: "conforming", schema: user, value: `{"id":1,"name":"ada","email":null,"role":"admin","tags":["x"]}`},
+		{name: "wrong types", schema: user, value: `{"id":1.5,"name":"ada","role":"admin","tags":[1]}`, want: []string{
+			"$.id: expected integer, got number",
+			"$.tags[0]: expected string, got number",
+		}},
+		{name: "constraints", schema: user, value: `{"id":0,"name":"","email":"nope","role":"owner","extra":true}`, want: []string{
+			"$.email: \"nope\" does not match pattern \"@\"",
+			"$.extra: unexpected property",
+			"$.id: expected a value >= 1, got 0",
+			"$.name: expected at least 1 characters, got 0",
+			"$.role: \"owner\" is not one of the enum values",
+		}},
+		{name: "missing required", schema: user, value: `{"id":2}`, want: []string{
+			`$: missing required property "name"`,
+			`$: missing required property "role"`,
+		}},
+		{name: "array", schema: list, value: `[{"id":1,"name":"a","role":"admin"},{"id":2,"name":"b","role":"member"},{"id":3,"name":"c","role":"x"}]`, want: []string{
+			"$: expected at most 2 items, got 3",
+			"$[2].role: \"x\" is not one of the enum values",
+		}},
+		{name: "not an object", schema: user, value: `"ada"`, want: []string{"$: expected object, got string"}},
+	} {
+		got := spec.Validate(tc.schema, decode(t, tc.value))
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Fatalf("%s: expected %q, got %q", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestValidateCombinators(t *testing.T) {
+	spec, err := Parse([]byte(`{"paths":{},"components":{"schemas":{"Loop":{"$ref":"#/components/schemas/Loop"}}}}`))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	oneOf := decode(t, `{"oneOf":[{"type":"integer"},{"type":"number"}]}`).(map[string]any)
+	if got := spec.Validate(oneOf, 1.5); len(got) != 0 {
+		t.Fatalf("expected 1.5 to match one schema, got %q", got)
+	}
+	if got := spec.Validate(oneOf, float64(2)); !reflect.DeepEqual(got, []string{"$: matches 2 oneOf schemas, expected exactly 1"}) {
+		t.Fatalf("unexpected oneOf result %q", got)
+	}
+	anyOf := decode(t, `{"anyOf":[{"type":"string"},{"type":["null","boolean"]}]}`).(map[string]any)
+	if got := spec.Validate(anyOf, nil); len(got) != 0 {
+		t.Fatalf("expected null to match anyOf, got %q", got)
+	}
+	if got := spec.Validate(anyOf, float64(1)); !reflect.DeepEqual(got, []string{"$: does not match any anyOf schema"}) {
+		t.Fatalf("unexpected anyOf result %q", got)
+	}
+	loop := decode(t, `{"$ref":"#/components/schemas/Loop"}`).(map[string]any)
+	if got := spec.Validate(loop, nil); len(got) != 1 || !strings.Contains(got[0], "too many nested references") {
+		t.Fatalf("expected a reference loop error, got %q", got)
+	}
+}
@@ -12,6 +12,7 @@ const (
 	ErrInvalidLine     = "E_PARSE_INVALID_LINE"
 	ErrInvalidExpr     = "E_PARSE_INVALID_EXPR"
 	ErrInvalidFlow     = "E_PARSE_FLOW_SHAPE"
+	ErrInvalidJSON     = "E_PARSE_INVALID_JSON"
 )
 
 // ParseError captures a parser diagnostic.
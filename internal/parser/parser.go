@@ -2,6 +2,7 @@ package parser
 
 import (
 	"strconv"
+	"strings"
 
 	"github.com/mehditeymorian/pipetest/internal/ast"
 	"github.com/mehditeymorian/pipetest/internal/lexer"
@@ -17,7 +18,12 @@ type Parser struct {
 
 // Parse parses the provided source into an AST.
 func Parse(path, src string) (*ast.Program, []lexer.LexError, []ParseError) {
-	lx := lexer.NewLexer(path, src)
+	return ParseWithOptions(path, src, lexer.Options{})
+}
+
+// ParseWithOptions is like Parse but lexes the source with opt.
+func ParseWithOptions(path, src string, opt lexer.Options) (*ast.Program, []lexer.LexError, []ParseError) {
+	lx := lexer.NewLexerWithOptions(path, src, opt)
 	p := NewParser(lx)
 	program := p.ParseProgram()
 	return program, lx.Errors(), p.Errors()
@@ -104,6 +110,8 @@ func stmtSpan(stmt ast.Stmt) ast.Span {
 		return s.Span
 	case *ast.ImportStmt:
 		return s.Span
+	case *ast.ServiceBaseStmt:
+		return s.Span
 	case *ast.LetStmt:
 		return s.Span
 	case *ast.ReqDecl:
@@ -130,13 +138,30 @@ func (p *Parser) parseTopStmt() ast.Stmt {
 		p.expect(lexer.NL, "expected newline after import", "add a newline after the import")
 		return stmt
 	case lexer.KW_LET:
-		stmt := p.parseLet()
+		stmt := p.parseLet(true)
 		p.expect(lexer.NL, "expected newline after let", "add a newline after the let")
 		return stmt
 	case lexer.KW_REQ:
 		return p.parseReqDecl()
 	case lexer.KW_FLOW:
 		return p.parseFlowDecl()
+	case lexer.IDENT:
+		if p.cur.Lit == "export" && p.peek.Kind == lexer.KW_LET {
+			startTok := p.cur
+			p.advance()
+			stmt := p.parseLet(true)
+			stmt.Exported = true
+			stmt.Span = joinSpan(toASTSpan(startTok.Span), stmt.Span)
+			p.expect(lexer.NL, "expected newline after let", "add a newline after the let")
+			return stmt
+		}
+		if p.cur.Lit == "base_for" {
+			stmt := p.parseServiceBase()
+			p.expect(lexer.NL, "expected newline after base_for", "add a newline after the base_for")
+			return stmt
+		}
+		p.addError(ErrUnexpectedToken, "unexpected token at top level", "start with a declaration", p.cur.Span)
+		return nil
 	default:
 		p.addError(ErrUnexpectedToken, "unexpected token at top level", "start with a declaration", p.cur.Span)
 		return nil
@@ -172,16 +197,33 @@ func (p *Parser) parseImport() *ast.ImportStmt {
 	return &ast.ImportStmt{Path: lit, Span: joinSpan(toASTSpan(startTok.Span), lit.Span)}
 }
 
-func (p *Parser) parseLet() *ast.LetStmt {
+func (p *Parser) parseServiceBase() *ast.ServiceBaseStmt {
+	startTok := p.cur
+	p.advance()
+	nameTok := p.expect(lexer.STRING, "expected service name string after base_for", "use base_for \"name\" \"https://...\"")
+	urlTok := p.expect(lexer.STRING, "expected base URL string after service name", "use base_for \"name\" \"https://...\"")
+	name, u := p.stringLit(nameTok), p.stringLit(urlTok)
+	return &ast.ServiceBaseStmt{Name: name, URL: u, Span: joinSpan(toASTSpan(startTok.Span), u.Span)}
+}
+
+// parseLet parses `let name = expr`. Top-level lets may be written
+// `let dynamic name = expr`.
+func (p *Parser) parseLet(allowDynamic bool) *ast.LetStmt {
 	startTok := p.expect(lexer.KW_LET, "expected let", "use let name = expr")
+	dynamic := false
+	if allowDynamic && p.cur.Kind == lexer.IDENT && p.cur.Lit == "dynamic" && p.peek.Kind == lexer.IDENT {
+		dynamic = true
+		p.advance()
+	}
 	nameTok := p.expect(lexer.IDENT, "expected identifier after let", "provide a variable name")
 	p.expect(lexer.ASSIGN, "expected '=' in let statement", "assign a value to the variable")
 	val := p.parseExpr(precLowest)
 	valSpan := exprSpan(val)
 	return &ast.LetStmt{
-		Name:  nameTok.Lit,
-		Value: val,
-		Span:  joinSpan(toASTSpan(startTok.Span), valSpan),
+		Name:    nameTok.Lit,
+		Value:   val,
+		Dynamic: dynamic,
+		Span:    joinSpan(toASTSpan(startTok.Span), valSpan),
 	}
 }
 
@@ -208,22 +250,72 @@ func (p *Parser) parseReqDecl() *ast.ReqDecl {
 		case lexer.KW_GET, lexer.KW_POST_M, lexer.KW_PUT, lexer.KW_PATCH, lexer.KW_DELETE, lexer.KW_HEAD, lexer.KW_OPTIONS:
 			line := p.parseHttpLine()
 			lines = append(lines, line)
-			p.expect(lexer.NL, "expected newline after http line", "add a newline after the HTTP line")
+			p.expectLineEnd("expected newline after http line", "add a newline after the HTTP line")
 		case lexer.KW_JSON, lexer.KW_HEADER, lexer.KW_QUERY, lexer.KW_AUTH:
 			line := p.parseDirective()
 			lines = append(lines, line)
-			p.expect(lexer.NL, "expected newline after directive", "add a newline after the directive")
+			p.expectLineEnd("expected newline after directive", "add a newline after the directive")
 		case lexer.KW_PRE, lexer.KW_POST:
 			line := p.parseHookBlock()
 			lines = append(lines, line)
 		case lexer.QUESTION:
 			line := p.parseAssertLine()
 			lines = append(lines, line)
-			p.expect(lexer.NL, "expected newline after assertion", "add a newline after the assertion")
+			p.expectLineEnd("expected newline after assertion", "add a newline after the assertion")
 		case lexer.KW_LET:
-			line := p.parseLet()
+			line := p.parseLet(false)
 			lines = append(lines, line)
-			p.expect(lexer.NL, "expected newline after let", "add a newline after the let")
+			p.expectLineEnd("expected newline after let", "add a newline after the let")
+		case lexer.IDENT:
+			switch p.cur.Lit {
+			case "shared":
+				lines = append(lines, &ast.SharedDirective{Span: toASTSpan(p.cur.Span)})
+				p.advance()
+				p.expectLineEnd("expected newline after shared", "add a newline after shared")
+			case "expect_body":
+				lines = append(lines, &ast.ExpectBodyDirective{Span: toASTSpan(p.cur.Span)})
+				p.advance()
+				p.expectLineEnd("expected newline after expect_body", "add a newline after expect_body")
+			case "form":
+				startTok := p.cur
+				p.advance()
+				obj := p.parseObjectLit()
+				lines = append(lines, &ast.FormDirective{Value: obj, Span: joinSpan(toASTSpan(startTok.Span), obj.Span)})
+				p.expectLineEnd("expected newline after form directive", "add a newline after the directive")
+			case "multipart":
+				lines = append(lines, p.parseMultipart())
+				p.expectLineEnd("expected newline after multipart directive", "add a newline after the directive")
+			case "tag":
+				lines = append(lines, p.parseTag())
+				p.expectLineEnd("expected newline after tag", "add a newline after the tag")
+			case "retry":
+				lines = append(lines, p.parseRetry())
+				p.expectLineEnd("expected newline after retry", "add a newline after the retry directive")
+			case "depends_on":
+				lines = append(lines, p.parseDependsOn())
+				p.expectLineEnd("expected newline after depends_on", "add a newline after depends_on")
+			case "xml":
+				startTok := p.cur
+				p.advance()
+				val := p.parseExpr(precLowest)
+				lines = append(lines, &ast.XmlDirective{Value: val, Span: joinSpan(toASTSpan(startTok.Span), exprSpan(val))})
+				p.expectLineEnd("expected newline after xml directive", "add a newline after the directive")
+			case "method":
+				startTok := p.cur
+				p.advance()
+				val := p.parseExpr(precLowest)
+				lines = append(lines, &ast.MethodDirective{Value: val, Span: joinSpan(toASTSpan(startTok.Span), exprSpan(val))})
+				p.expectLineEnd("expected newline after method directive", "add a newline after the directive")
+			case "text":
+				startTok := p.cur
+				p.advance()
+				val := p.parseExpr(precLowest)
+				lines = append(lines, &ast.TextDirective{Value: val, Span: joinSpan(toASTSpan(startTok.Span), exprSpan(val))})
+				p.expectLineEnd("expected newline after text directive", "add a newline after the directive")
+			default:
+				p.addError(ErrInvalidLine, "invalid request line", "use an http line, directive, hook, assertion, or let", p.cur.Span)
+				p.syncLine()
+			}
 		default:
 			p.addError(ErrInvalidLine, "invalid request line", "use an http line, directive, hook, assertion, or let", p.cur.Span)
 			p.syncLine()
@@ -272,6 +364,17 @@ func (p *Parser) parseDirective() ast.ReqLine {
 	switch p.cur.Kind {
 	case lexer.KW_JSON:
 		startTok := p.expect(lexer.KW_JSON, "expected json", "use json { ... }")
+		if p.cur.Kind == lexer.STRING {
+			tok := p.cur
+			p.advance()
+			lit := p.stringLit(tok)
+			obj, err := rawJSONObject(lit)
+			if err != nil {
+				p.addError(ErrInvalidJSON, "invalid JSON in json body: "+err.Error(), "write a JSON object, or use an object literal", tok.Span)
+				obj = &ast.ObjectLit{Span: lit.Span}
+			}
+			return &ast.JsonDirective{Value: obj, Span: joinSpan(toASTSpan(startTok.Span), lit.Span)}
+		}
 		obj := p.parseObjectLit()
 		return &ast.JsonDirective{Value: obj, Span: joinSpan(toASTSpan(startTok.Span), obj.Span)}
 	case lexer.KW_HEADER:
@@ -288,7 +391,13 @@ func (p *Parser) parseDirective() ast.ReqLine {
 		return &ast.QueryDirective{Key: key, Value: val, Span: joinSpan(toASTSpan(startTok.Span), exprSpan(val))}
 	case lexer.KW_AUTH:
 		startTok := p.expect(lexer.KW_AUTH, "expected auth", "use auth bearer expr")
-		p.expect(lexer.KW_BEARER, "expected bearer auth", "use bearer auth")
+		if p.cur.Kind == lexer.KW_BASIC {
+			p.advance()
+			user := p.parseExpr(precLowest)
+			pass := p.parseExpr(precLowest)
+			return &ast.AuthDirective{Scheme: ast.AuthBasic, Value: user, Password: pass, Span: joinSpan(toASTSpan(startTok.Span), exprSpan(pass))}
+		}
+		p.expect(lexer.KW_BEARER, "expected bearer or basic auth", "use auth bearer expr or auth basic user password")
 		val := p.parseExpr(precLowest)
 		return &ast.AuthDirective{Scheme: ast.AuthBearer, Value: val, Span: joinSpan(toASTSpan(startTok.Span), exprSpan(val))}
 	default:
@@ -297,6 +406,72 @@ func (p *Parser) parseDirective() ast.ReqLine {
 	}
 }
 
+// parseRetry parses retry <count> every <duration>.
+func (p *Parser) parseRetry() *ast.RetryDirective {
+	startTok := p.cur
+	p.advance()
+	countTok := p.expect(lexer.NUMBER, "expected retry count", "use retry 3 every 500ms")
+	if p.cur.Kind != lexer.IDENT || p.cur.Lit != "every" {
+		p.addError(ErrInvalidLine, "expected every after retry count", "use retry 3 every 500ms", p.cur.Span)
+	} else {
+		p.advance()
+	}
+	everyTok := p.expect(lexer.DURATION, "expected duration literal after every", "provide a duration like 500ms")
+	return &ast.RetryDirective{
+		Count: &ast.NumberLit{Raw: countTok.Lit, Span: toASTSpan(countTok.Span)},
+		Every: &ast.DurationLit{Raw: everyTok.Lit, Span: toASTSpan(everyTok.Span)},
+		Span:  joinSpan(toASTSpan(startTok.Span), toASTSpan(everyTok.Span)),
+	}
+}
+
+func (p *Parser) parseDependsOn() *ast.DependsOnDirective {
+	startTok := p.cur
+	p.advance()
+	dir := &ast.DependsOnDirective{Requests: []string{}, Span: toASTSpan(startTok.Span)}
+	if p.cur.Kind != lexer.IDENT {
+		return dir
+	}
+	for {
+		nameTok := p.expect(lexer.IDENT, "expected request name in depends_on", "list request names separated by commas")
+		dir.Requests = append(dir.Requests, nameTok.Lit)
+		dir.Span = joinSpan(dir.Span, toASTSpan(nameTok.Span))
+		if !p.match(lexer.COMMA) {
+			return dir
+		}
+	}
+}
+
+func (p *Parser) parseMultipart() *ast.MultipartDirective {
+	startTok := p.cur
+	p.advance()
+	p.expect(lexer.LBRACE, "expected '{' after multipart", "use multipart { field: \"value\", file: @\"path\" }")
+	dir := &ast.MultipartDirective{}
+	if p.cur.Kind != lexer.RBRACE {
+		for {
+			key, ok := p.parseObjectKey()
+			p.expect(lexer.COLON, "expected ':' after multipart field", "separate field and value with ':'")
+			file := p.match(lexer.AT)
+			val := p.parseExpr(precLowest)
+			if ok {
+				dir.Parts = append(dir.Parts, ast.MultipartPart{Key: key, Value: val, File: file, Span: joinSpan(key.Span, exprSpan(val))})
+			}
+			if !p.match(lexer.COMMA) || p.cur.Kind == lexer.RBRACE {
+				break
+			}
+		}
+	}
+	endTok := p.expect(lexer.RBRACE, "expected '}' to close multipart", "close the multipart directive with '}'")
+	dir.Span = joinSpan(toASTSpan(startTok.Span), toASTSpan(endTok.Span))
+	return dir
+}
+
+func (p *Parser) parseTag() *ast.TagDirective {
+	startTok := p.cur
+	p.advance()
+	nameTok := p.expect(lexer.STRING, "expected tag name string", "use tag \"name\"")
+	return &ast.TagDirective{Name: p.stringLit(nameTok).Value, Span: joinSpan(toASTSpan(startTok.Span), toASTSpan(nameTok.Span))}
+}
+
 func (p *Parser) parseHookBlock() *ast.HookBlock {
 	startTok := p.cur
 	kind := ast.HookPre
@@ -332,7 +507,7 @@ func (p *Parser) parseHookBlock() *ast.HookBlock {
 
 func (p *Parser) parseHookStmt() ast.HookStmt {
 	if p.cur.Kind == lexer.KW_LET {
-		return p.parseLet()
+		return p.parseLet(false)
 	}
 	if p.cur.Kind == lexer.KW_PRINT || p.cur.Kind == lexer.KW_PRINTLN || p.cur.Kind == lexer.KW_PRINTF {
 		return p.parsePrintStmt()
@@ -405,12 +580,18 @@ func (p *Parser) parseFlowDecl() *ast.FlowDecl {
 	p.expect(lexer.NL, "expected newline after flow header", "add a newline after the header")
 	p.expect(lexer.INDENT, "expected indented flow block", "indent flow lines")
 
+	var tags []*ast.TagDirective
 	var prelude []*ast.LetStmt
-	for p.cur.Kind == lexer.KW_LET || p.cur.Kind == lexer.NL {
+	for p.cur.Kind == lexer.KW_LET || p.cur.Kind == lexer.NL || p.isFlowTag() {
 		if p.match(lexer.NL) {
 			continue
 		}
-		ls := p.parseLet()
+		if p.cur.Kind == lexer.IDENT {
+			tags = append(tags, p.parseTag())
+			p.expect(lexer.NL, "expected newline after tag", "add a newline after the tag")
+			continue
+		}
+		ls := p.parseLet(false)
 		prelude = append(prelude, ls)
 		p.expect(lexer.NL, "expected newline after let", "add a newline after the let")
 	}
@@ -427,10 +608,15 @@ func (p *Parser) parseFlowDecl() *ast.FlowDecl {
 	}
 
 	var asserts []*ast.AssertStmt
+	var eventually []*ast.EventuallyBlock
 	for p.cur.Kind != lexer.DEDENT && p.cur.Kind != lexer.EOF {
 		if p.match(lexer.NL) {
 			continue
 		}
+		if p.cur.Kind == lexer.IDENT && p.cur.Lit == "assert_eventually" {
+			eventually = append(eventually, p.parseEventuallyBlock())
+			continue
+		}
 		if p.cur.Kind != lexer.QUESTION {
 			p.addError(ErrInvalidFlow, "only assertions allowed after flow chain", "move non-assert lines before the chain", p.cur.Span)
 			p.syncLine()
@@ -443,12 +629,67 @@ func (p *Parser) parseFlowDecl() *ast.FlowDecl {
 	endTok := p.expect(lexer.DEDENT, "expected end of flow block", "dedent to close the flow block")
 
 	return &ast.FlowDecl{
-		Name:    name,
-		Prelude: prelude,
-		Chain:   chain,
-		Asserts: asserts,
-		Span:    joinSpan(toASTSpan(startTok.Span), toASTSpan(endTok.Span)),
+		Name:       name,
+		Tags:       tags,
+		Prelude:    prelude,
+		Chain:      chain,
+		Asserts:    asserts,
+		Eventually: eventually,
+		Span:       joinSpan(toASTSpan(startTok.Span), toASTSpan(endTok.Span)),
+	}
+}
+
+// parseEventuallyBlock parses
+//
+//	assert_eventually timeout <duration> interval <duration>:
+//		step
+//		? assertion
+func (p *Parser) parseEventuallyBlock() *ast.EventuallyBlock {
+	startTok := p.expect(lexer.IDENT, "expected assert_eventually", "use assert_eventually timeout 5s interval 500ms:")
+	p.expect(lexer.KW_TIMEOUT, "expected timeout after assert_eventually", "use assert_eventually timeout 5s interval 500ms:")
+	timeoutTok := p.expect(lexer.DURATION, "expected duration literal after timeout", "provide a duration like 5s")
+	if p.cur.Kind != lexer.IDENT || p.cur.Lit != "interval" {
+		p.addError(ErrInvalidFlow, "expected interval after timeout duration", "use assert_eventually timeout 5s interval 500ms:", p.cur.Span)
+	} else {
+		p.advance()
+	}
+	intervalTok := p.expect(lexer.DURATION, "expected duration literal after interval", "provide a duration like 500ms")
+	p.expect(lexer.COLON, "expected ':' after assert_eventually header", "add ':' to start the block")
+	p.expect(lexer.NL, "expected newline after assert_eventually header", "add a newline after the header")
+	p.expect(lexer.INDENT, "expected indented assert_eventually block", "indent the request and assertions")
+
+	block := &ast.EventuallyBlock{
+		Timeout:  &ast.DurationLit{Raw: timeoutTok.Lit, Span: toASTSpan(timeoutTok.Span)},
+		Interval: &ast.DurationLit{Raw: intervalTok.Lit, Span: toASTSpan(intervalTok.Span)},
+	}
+	for p.match(lexer.NL) {
 	}
+	block.Step = p.parseFlowStepRef()
+	p.expect(lexer.NL, "expected newline after assert_eventually request", "add a newline after the request")
+	for p.cur.Kind != lexer.DEDENT && p.cur.Kind != lexer.EOF {
+		if p.match(lexer.NL) {
+			continue
+		}
+		if p.cur.Kind != lexer.QUESTION {
+			p.addError(ErrInvalidFlow, "only assertions allowed in assert_eventually block", "poll a single request followed by ? assertions", p.cur.Span)
+			p.syncLine()
+			continue
+		}
+		block.Asserts = append(block.Asserts, p.parseAssertLine())
+		p.expect(lexer.NL, "expected newline after assertion", "add a newline after the assertion")
+	}
+	endTok := p.expect(lexer.DEDENT, "expected end of assert_eventually block", "dedent to close the block")
+	if len(block.Asserts) == 0 {
+		p.addError(ErrInvalidFlow, "assert_eventually block has no assertions", "add at least one ? assertion", startTok.Span)
+	}
+	block.Span = joinSpan(toASTSpan(startTok.Span), toASTSpan(endTok.Span))
+	return block
+}
+
+// isFlowTag distinguishes a tag line from a chain that starts with a request
+// named tag.
+func (p *Parser) isFlowTag() bool {
+	return p.cur.Kind == lexer.IDENT && p.cur.Lit == "tag" && p.peek.Kind == lexer.STRING
 }
 
 func (p *Parser) parseFlowChainLine() []ast.FlowStep {
@@ -498,7 +739,7 @@ func (p *Parser) parseKey() ast.Key {
 
 func (p *Parser) expectFieldName() lexer.Token {
 	switch p.cur.Kind {
-	case lexer.IDENT, lexer.KW_REQ, lexer.KW_HEADER, lexer.KW_QUERY:
+	case lexer.IDENT, lexer.KW_REQ, lexer.KW_HEADER, lexer.KW_QUERY, lexer.KW_JSON:
 		tok := p.cur
 		p.advance()
 		return tok
@@ -558,7 +799,7 @@ func (p *Parser) parsePostfix(left ast.Expr) ast.Expr {
 		switch p.cur.Kind {
 		case lexer.LPAREN:
 			left = p.parseCall(left)
-		case lexer.DOT:
+		case lexer.DOT, lexer.QDOT:
 			left = p.parseField(left)
 		case lexer.LBRACK:
 			left = p.parseIndex(left)
@@ -662,6 +903,9 @@ func (p *Parser) exprToLValue(expr ast.Expr) (*ast.LValue, bool) {
 		root := ast.LValueRoot{Kind: ast.LValueRes, Name: "#", Span: e.Span}
 		return &ast.LValue{Root: root, Span: e.Span}, true
 	case *ast.FieldExpr:
+		if e.Optional {
+			return nil, false
+		}
 		base, ok := p.exprToLValue(e.X)
 		if !ok {
 			return nil, false
@@ -713,9 +957,14 @@ func (p *Parser) parseCall(callee ast.Expr) ast.Expr {
 }
 
 func (p *Parser) parseField(left ast.Expr) ast.Expr {
-	p.expect(lexer.DOT, "expected '.'", "use .field to access a field")
+	optional := p.cur.Kind == lexer.QDOT
+	if optional {
+		p.advance()
+	} else {
+		p.expect(lexer.DOT, "expected '.'", "use .field to access a field")
+	}
 	nameTok := p.expectFieldName()
-	return &ast.FieldExpr{X: left, Name: nameTok.Lit, Span: joinSpan(exprSpan(left), toASTSpan(nameTok.Span))}
+	return &ast.FieldExpr{X: left, Name: nameTok.Lit, Optional: optional, Span: joinSpan(exprSpan(left), toASTSpan(nameTok.Span))}
 }
 
 func (p *Parser) parseIndex(left ast.Expr) ast.Expr {
@@ -770,6 +1019,9 @@ func (p *Parser) parseObjectLit() *ast.ObjectLit {
 }
 
 func (p *Parser) stringLit(tok lexer.Token) *ast.StringLit {
+	if len(tok.Lit) >= 6 && strings.HasPrefix(tok.Lit, `"""`) && strings.HasSuffix(tok.Lit, `"""`) {
+		return &ast.StringLit{Raw: tok.Lit, Value: tok.Lit[3 : len(tok.Lit)-3], Span: toASTSpan(tok.Span)}
+	}
 	val, err := strconv.Unquote(tok.Lit)
 	if err != nil {
 		val = tok.Lit
@@ -777,6 +1029,17 @@ func (p *Parser) stringLit(tok lexer.Token) *ast.StringLit {
 	return &ast.StringLit{Raw: tok.Lit, Value: val, Span: toASTSpan(tok.Span)}
 }
 
+// expectLineEnd consumes the newline ending a request line. Anything else
+// left on the line is reported once and skipped, so a second directive
+// written on the same line does not cascade into more errors.
+func (p *Parser) expectLineEnd(msg, hint string) {
+	if p.match(lexer.NL) {
+		return
+	}
+	p.addError(ErrExpectedToken, msg, hint, p.cur.Span)
+	p.syncLine()
+}
+
 func (p *Parser) syncLine() {
 	for p.cur.Kind != lexer.NL && p.cur.Kind != lexer.DEDENT && p.cur.Kind != lexer.EOF {
 		p.advance()
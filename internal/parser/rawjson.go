@@ -0,0 +1,93 @@
+package parser
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/mehditeymorian/pipetest/internal/ast"
+)
+
+// rawJSONObject converts the JSON text of a string literal into an object
+// literal, so json "{...}" bodies behave exactly like json {...}. Key order
+// and duplicate keys are kept; every node carries the string's span.
+func rawJSONObject(lit *ast.StringLit) (*ast.ObjectLit, error) {
+	dec := json.NewDecoder(strings.NewReader(lit.Value))
+	dec.UseNumber()
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '{' {
+		return nil, errors.New("body must be a JSON object")
+	}
+	obj, err := rawJSONPairs(dec, lit.Span)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("unexpected content after the JSON object")
+	}
+	return obj, nil
+}
+
+func rawJSONPairs(dec *json.Decoder, span ast.Span) (*ast.ObjectLit, error) {
+	obj := &ast.ObjectLit{Pairs: []ast.ObjectPair{}, Span: span}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		key := tok.(string)
+		val, err := rawJSONValue(dec, span)
+		if err != nil {
+			return nil, err
+		}
+		obj.Pairs = append(obj.Pairs, ast.ObjectPair{
+			Key:   ast.ObjectKey{Kind: ast.ObjectKeyString, Name: key, Raw: strconv.Quote(key), Span: span},
+			Value: val,
+			Span:  span,
+		})
+	}
+	if _, err := dec.Token(); err != nil { // closing '}'
+		return nil, err
+	}
+	return obj, nil
+}
+
+func rawJSONValue(dec *json.Decoder, span ast.Span) (ast.Expr, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch v := tok.(type) {
+	case json.Delim:
+		if v == '{' {
+			return rawJSONPairs(dec, span)
+		}
+		arr := &ast.ArrayLit{Elements: []ast.Expr{}, Span: span}
+		for dec.More() {
+			elem, err := rawJSONValue(dec, span)
+			if err != nil {
+				return nil, err
+			}
+			arr.Elements = append(arr.Elements, elem)
+		}
+		if _, err := dec.Token(); err != nil { // closing ']'
+			return nil, err
+		}
+		return arr, nil
+	case string:
+		return &ast.StringLit{Raw: strconv.Quote(v), Value: v, Span: span}, nil
+	case json.Number:
+		return &ast.NumberLit{Raw: v.String(), Span: span}, nil
+	case bool:
+		return &ast.BoolLit{Value: v, Span: span}, nil
+	case nil:
+		return &ast.NullLit{Span: span}, nil
+	}
+	return nil, fmt.Errorf("unexpected JSON token %v", tok)
+}
@@ -0,0 +1,727 @@
+package parser
+
+import "github.com/mehditeymorian/pipetest/internal/ast"
+
+// Snapshot converts a parsed node into a JSON-friendly tree of node types,
+// spans, and fields. It backs the parser golden files and `pipetest debug ast`.
+func Snapshot(node interface{}) interface{} {
+	return snapshotNode(node)
+}
+
+type nodeSnapshot struct {
+	Type   string                 `json:"type"`
+	Span   spanSnapshot           `json:"span"`
+	Fields map[string]interface{} `json:"fields,omitempty"`
+}
+
+type spanSnapshot struct {
+	Start positionSnapshot `json:"start"`
+	End   positionSnapshot `json:"end"`
+}
+
+type positionSnapshot struct {
+	Offset int `json:"offset"`
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+func snapshotSpan(span ast.Span) spanSnapshot {
+	return spanSnapshot{
+		Start: positionSnapshot{Offset: span.Start.Offset, Line: span.Start.Line, Column: span.Start.Column},
+		End:   positionSnapshot{Offset: span.End.Offset, Line: span.End.Line, Column: span.End.Column},
+	}
+}
+
+func snapshotNode(node interface{}) interface{} {
+	switch n := node.(type) {
+	case *ast.Program:
+		return nodeSnapshot{
+			Type: "Program",
+			Span: snapshotSpan(n.Span),
+			Fields: map[string]interface{}{
+				"stmts": snapshotStmtList(n.Stmts),
+			},
+		}
+	case *ast.SettingStmt:
+		return nodeSnapshot{
+			Type: "SettingStmt",
+			Span: snapshotSpan(n.Span),
+			Fields: map[string]interface{}{
+				"kind":  settingKindString(n.Kind),
+				"value": snapshotNode(n.Value),
+			},
+		}
+	case *ast.ImportStmt:
+		return nodeSnapshot{
+			Type: "ImportStmt",
+			Span: snapshotSpan(n.Span),
+			Fields: map[string]interface{}{
+				"path": snapshotNode(n.Path),
+			},
+		}
+	case *ast.ServiceBaseStmt:
+		return nodeSnapshot{
+			Type: "ServiceBaseStmt",
+			Span: snapshotSpan(n.Span),
+			Fields: map[string]interface{}{
+				"name": snapshotNode(n.Name),
+				"url":  snapshotNode(n.URL),
+			},
+		}
+	case *ast.LetStmt:
+		fields := map[string]interface{}{
+			"name":  n.Name,
+			"value": snapshotNode(n.Value),
+		}
+		if n.Dynamic {
+			fields["dynamic"] = true
+		}
+		return nodeSnapshot{
+			Type:   "LetStmt",
+			Span:   snapshotSpan(n.Span),
+			Fields: fields,
+		}
+	case *ast.ReqDecl:
+		return nodeSnapshot{
+			Type: "ReqDecl",
+			Span: snapshotSpan(n.Span),
+			Fields: map[string]interface{}{
+				"name":   n.Name,
+				"parent": n.Parent,
+				"lines":  snapshotReqLines(n.Lines),
+			},
+		}
+	case *ast.FlowDecl:
+		fields := map[string]interface{}{
+			"name":    snapshotNode(n.Name),
+			"prelude": snapshotLetList(n.Prelude),
+			"chain":   snapshotFlowSteps(n.Chain),
+			"asserts": snapshotAssertList(n.Asserts),
+		}
+		if len(n.Tags) > 0 {
+			tags := make([]interface{}, 0, len(n.Tags))
+			for _, tag := range n.Tags {
+				tags = append(tags, snapshotNode(tag))
+			}
+			fields["tags"] = tags
+		}
+		if len(n.Eventually) > 0 {
+			blocks := make([]interface{}, 0, len(n.Eventually))
+			for _, block := range n.Eventually {
+				blocks = append(blocks, snapshotNode(block))
+			}
+			fields["eventually"] = blocks
+		}
+		return nodeSnapshot{
+			Type:   "FlowDecl",
+			Span:   snapshotSpan(n.Span),
+			Fields: fields,
+		}
+	case *ast.EventuallyBlock:
+		return nodeSnapshot{
+			Type: "EventuallyBlock",
+			Span: snapshotSpan(n.Span),
+			Fields: map[string]interface{}{
+				"step":     snapshotFlowSteps([]ast.FlowStep{n.Step})[0],
+				"timeout":  snapshotNode(n.Timeout),
+				"interval": snapshotNode(n.Interval),
+				"asserts":  snapshotAssertList(n.Asserts),
+			},
+		}
+	case *ast.HttpLine:
+		return nodeSnapshot{
+			Type: "HttpLine",
+			Span: snapshotSpan(n.Span),
+			Fields: map[string]interface{}{
+				"method": httpMethodString(n.Method),
+				"path":   n.Path,
+			},
+		}
+	case *ast.JsonDirective:
+		return nodeSnapshot{
+			Type: "JsonDirective",
+			Span: snapshotSpan(n.Span),
+			Fields: map[string]interface{}{
+				"value": snapshotNode(n.Value),
+			},
+		}
+	case *ast.XmlDirective:
+		return nodeSnapshot{
+			Type: "XmlDirective",
+			Span: snapshotSpan(n.Span),
+			Fields: map[string]interface{}{
+				"value": snapshotNode(n.Value),
+			},
+		}
+	case *ast.MethodDirective:
+		return nodeSnapshot{
+			Type: "MethodDirective",
+			Span: snapshotSpan(n.Span),
+			Fields: map[string]interface{}{
+				"value": snapshotNode(n.Value),
+			},
+		}
+	case *ast.TextDirective:
+		return nodeSnapshot{
+			Type: "TextDirective",
+			Span: snapshotSpan(n.Span),
+			Fields: map[string]interface{}{
+				"value": snapshotNode(n.Value),
+			},
+		}
+	case *ast.FormDirective:
+		return nodeSnapshot{
+			Type: "FormDirective",
+			Span: snapshotSpan(n.Span),
+			Fields: map[string]interface{}{
+				"value": snapshotNode(n.Value),
+			},
+		}
+	case *ast.MultipartDirective:
+		parts := make([]interface{}, 0, len(n.Parts))
+		for _, part := range n.Parts {
+			parts = append(parts, map[string]interface{}{
+				"key":   part.Key.Name,
+				"value": snapshotNode(part.Value),
+				"file":  part.File,
+			})
+		}
+		return nodeSnapshot{
+			Type: "MultipartDirective",
+			Span: snapshotSpan(n.Span),
+			Fields: map[string]interface{}{
+				"parts": parts,
+			},
+		}
+	case *ast.HeaderDirective:
+		return nodeSnapshot{
+			Type: "HeaderDirective",
+			Span: snapshotSpan(n.Span),
+			Fields: map[string]interface{}{
+				"key":   snapshotKey(n.Key),
+				"value": snapshotNode(n.Value),
+			},
+		}
+	case *ast.QueryDirective:
+		return nodeSnapshot{
+			Type: "QueryDirective",
+			Span: snapshotSpan(n.Span),
+			Fields: map[string]interface{}{
+				"key":   snapshotKey(n.Key),
+				"value": snapshotNode(n.Value),
+			},
+		}
+	case *ast.AuthDirective:
+		fields := map[string]interface{}{
+			"scheme": authSchemeString(n.Scheme),
+			"value":  snapshotNode(n.Value),
+		}
+		if n.Password != nil {
+			fields["password"] = snapshotNode(n.Password)
+		}
+		return nodeSnapshot{
+			Type:   "AuthDirective",
+			Span:   snapshotSpan(n.Span),
+			Fields: fields,
+		}
+	case *ast.SharedDirective:
+		return nodeSnapshot{
+			Type: "SharedDirective",
+			Span: snapshotSpan(n.Span),
+		}
+	case *ast.ExpectBodyDirective:
+		return nodeSnapshot{
+			Type: "ExpectBodyDirective",
+			Span: snapshotSpan(n.Span),
+		}
+	case *ast.TagDirective:
+		return nodeSnapshot{
+			Type: "TagDirective",
+			Span: snapshotSpan(n.Span),
+			Fields: map[string]interface{}{
+				"name": n.Name,
+			},
+		}
+	case *ast.RetryDirective:
+		return nodeSnapshot{
+			Type: "RetryDirective",
+			Span: snapshotSpan(n.Span),
+			Fields: map[string]interface{}{
+				"count": snapshotNode(n.Count),
+				"every": snapshotNode(n.Every),
+			},
+		}
+	case *ast.DependsOnDirective:
+		return nodeSnapshot{
+			Type: "DependsOnDirective",
+			Span: snapshotSpan(n.Span),
+			Fields: map[string]interface{}{
+				"requests": n.Requests,
+			},
+		}
+	case *ast.HookBlock:
+		return nodeSnapshot{
+			Type: "HookBlock",
+			Span: snapshotSpan(n.Span),
+			Fields: map[string]interface{}{
+				"kind":  hookKindString(n.Kind),
+				"stmts": snapshotHookStmts(n.Stmts),
+			},
+		}
+	case *ast.AssertStmt:
+		return nodeSnapshot{
+			Type: "AssertStmt",
+			Span: snapshotSpan(n.Span),
+			Fields: map[string]interface{}{
+				"expr": snapshotNode(n.Expr),
+			},
+		}
+	case *ast.AssignStmt:
+		return nodeSnapshot{
+			Type: "AssignStmt",
+			Span: snapshotSpan(n.Span),
+			Fields: map[string]interface{}{
+				"target": snapshotLValue(n.Target),
+				"value":  snapshotNode(n.Value),
+			},
+		}
+	case *ast.ExprStmt:
+		return nodeSnapshot{
+			Type: "ExprStmt",
+			Span: snapshotSpan(n.Span),
+			Fields: map[string]interface{}{
+				"expr": snapshotNode(n.Expr),
+			},
+		}
+	case *ast.PrintStmt:
+		return nodeSnapshot{
+			Type: "PrintStmt",
+			Span: snapshotSpan(n.Span),
+			Fields: map[string]interface{}{
+				"kind": printKindString(n.Kind),
+				"args": snapshotExprList(n.Args),
+			},
+		}
+	case *ast.IdentExpr:
+		return nodeSnapshot{
+			Type: "IdentExpr",
+			Span: snapshotSpan(n.Span),
+			Fields: map[string]interface{}{
+				"name": n.Name,
+			},
+		}
+	case *ast.StringLit:
+		return nodeSnapshot{
+			Type: "StringLit",
+			Span: snapshotSpan(n.Span),
+			Fields: map[string]interface{}{
+				"raw":   n.Raw,
+				"value": n.Value,
+			},
+		}
+	case *ast.NumberLit:
+		return nodeSnapshot{
+			Type: "NumberLit",
+			Span: snapshotSpan(n.Span),
+			Fields: map[string]interface{}{
+				"raw": n.Raw,
+			},
+		}
+	case *ast.DurationLit:
+		return nodeSnapshot{
+			Type: "DurationLit",
+			Span: snapshotSpan(n.Span),
+			Fields: map[string]interface{}{
+				"raw": n.Raw,
+			},
+		}
+	case *ast.BoolLit:
+		return nodeSnapshot{
+			Type: "BoolLit",
+			Span: snapshotSpan(n.Span),
+			Fields: map[string]interface{}{
+				"value": n.Value,
+			},
+		}
+	case *ast.NullLit:
+		return nodeSnapshot{
+			Type: "NullLit",
+			Span: snapshotSpan(n.Span),
+		}
+	case *ast.DollarExpr:
+		return nodeSnapshot{
+			Type: "DollarExpr",
+			Span: snapshotSpan(n.Span),
+		}
+	case *ast.HashExpr:
+		return nodeSnapshot{
+			Type: "HashExpr",
+			Span: snapshotSpan(n.Span),
+		}
+	case *ast.ArrayLit:
+		return nodeSnapshot{
+			Type: "ArrayLit",
+			Span: snapshotSpan(n.Span),
+			Fields: map[string]interface{}{
+				"elements": snapshotExprList(n.Elements),
+			},
+		}
+	case *ast.ObjectLit:
+		return nodeSnapshot{
+			Type: "ObjectLit",
+			Span: snapshotSpan(n.Span),
+			Fields: map[string]interface{}{
+				"pairs": snapshotObjectPairs(n.Pairs),
+			},
+		}
+	case *ast.UnaryExpr:
+		return nodeSnapshot{
+			Type: "UnaryExpr",
+			Span: snapshotSpan(n.Span),
+			Fields: map[string]interface{}{
+				"op":   unaryOpString(n.Op),
+				"expr": snapshotNode(n.X),
+			},
+		}
+	case *ast.BinaryExpr:
+		return nodeSnapshot{
+			Type: "BinaryExpr",
+			Span: snapshotSpan(n.Span),
+			Fields: map[string]interface{}{
+				"op":    binaryOpString(n.Op),
+				"left":  snapshotNode(n.Left),
+				"right": snapshotNode(n.Right),
+			},
+		}
+	case *ast.CallExpr:
+		return nodeSnapshot{
+			Type: "CallExpr",
+			Span: snapshotSpan(n.Span),
+			Fields: map[string]interface{}{
+				"callee": snapshotNode(n.Callee),
+				"args":   snapshotExprList(n.Args),
+			},
+		}
+	case *ast.FieldExpr:
+		fields := map[string]interface{}{
+			"expr": snapshotNode(n.X),
+			"name": n.Name,
+		}
+		if n.Optional {
+			fields["optional"] = true
+		}
+		return nodeSnapshot{
+			Type:   "FieldExpr",
+			Span:   snapshotSpan(n.Span),
+			Fields: fields,
+		}
+	case *ast.IndexExpr:
+		return nodeSnapshot{
+			Type: "IndexExpr",
+			Span: snapshotSpan(n.Span),
+			Fields: map[string]interface{}{
+				"expr":  snapshotNode(n.X),
+				"index": snapshotNode(n.Index),
+			},
+		}
+	case *ast.ParenExpr:
+		return nodeSnapshot{
+			Type: "ParenExpr",
+			Span: snapshotSpan(n.Span),
+			Fields: map[string]interface{}{
+				"expr": snapshotNode(n.X),
+			},
+		}
+	case *ast.BadExpr:
+		return nodeSnapshot{
+			Type: "BadExpr",
+			Span: snapshotSpan(n.Span),
+		}
+	default:
+		return nil
+	}
+}
+
+func snapshotStmtList(stmts []ast.Stmt) []interface{} {
+	out := make([]interface{}, 0, len(stmts))
+	for _, stmt := range stmts {
+		out = append(out, snapshotNode(stmt))
+	}
+	return out
+}
+
+func snapshotReqLines(lines []ast.ReqLine) []interface{} {
+	out := make([]interface{}, 0, len(lines))
+	for _, line := range lines {
+		out = append(out, snapshotNode(line))
+	}
+	return out
+}
+
+func snapshotHookStmts(stmts []ast.HookStmt) []interface{} {
+	out := make([]interface{}, 0, len(stmts))
+	for _, stmt := range stmts {
+		out = append(out, snapshotNode(stmt))
+	}
+	return out
+}
+
+func snapshotExprList(exprs []ast.Expr) []interface{} {
+	out := make([]interface{}, 0, len(exprs))
+	for _, expr := range exprs {
+		out = append(out, snapshotNode(expr))
+	}
+	return out
+}
+
+func snapshotLetList(stmts []*ast.LetStmt) []interface{} {
+	out := make([]interface{}, 0, len(stmts))
+	for _, stmt := range stmts {
+		out = append(out, snapshotNode(stmt))
+	}
+	return out
+}
+
+func snapshotAssertList(stmts []*ast.AssertStmt) []interface{} {
+	out := make([]interface{}, 0, len(stmts))
+	for _, stmt := range stmts {
+		out = append(out, snapshotNode(stmt))
+	}
+	return out
+}
+
+func snapshotFlowSteps(steps []ast.FlowStep) []interface{} {
+	out := make([]interface{}, 0, len(steps))
+	for _, step := range steps {
+		out = append(out, map[string]interface{}{
+			"req_name": step.ReqName,
+			"alias":    step.Alias,
+			"span":     snapshotSpan(step.Span),
+		})
+	}
+	return out
+}
+
+func snapshotKey(key ast.Key) map[string]interface{} {
+	return map[string]interface{}{
+		"kind": keyKindString(key.Kind),
+		"name": key.Name,
+		"raw":  key.Raw,
+		"span": snapshotSpan(key.Span),
+	}
+}
+
+func snapshotObjectPairs(pairs []ast.ObjectPair) []interface{} {
+	out := make([]interface{}, 0, len(pairs))
+	for _, pair := range pairs {
+		out = append(out, map[string]interface{}{
+			"key":   snapshotObjectKey(pair.Key),
+			"value": snapshotNode(pair.Value),
+			"span":  snapshotSpan(pair.Span),
+		})
+	}
+	return out
+}
+
+func snapshotObjectKey(key ast.ObjectKey) map[string]interface{} {
+	return map[string]interface{}{
+		"kind": objectKeyKindString(key.Kind),
+		"name": key.Name,
+		"raw":  key.Raw,
+		"span": snapshotSpan(key.Span),
+	}
+}
+
+func snapshotLValue(lv *ast.LValue) map[string]interface{} {
+	postfix := make([]interface{}, 0, len(lv.Postfix))
+	for _, post := range lv.Postfix {
+		entry := map[string]interface{}{
+			"kind": lvaluePostfixKindString(post.Kind),
+			"span": snapshotSpan(post.Span),
+		}
+		if post.Kind == ast.LValueField {
+			entry["name"] = post.Name
+		}
+		if post.Kind == ast.LValueIndex {
+			entry["index"] = snapshotNode(post.Index)
+		}
+		postfix = append(postfix, entry)
+	}
+	return map[string]interface{}{
+		"root": map[string]interface{}{
+			"kind": lvalueRootKindString(lv.Root.Kind),
+			"name": lv.Root.Name,
+			"span": snapshotSpan(lv.Root.Span),
+		},
+		"postfix": postfix,
+		"span":    snapshotSpan(lv.Span),
+	}
+}
+
+func settingKindString(kind ast.SettingKind) string {
+	switch kind {
+	case ast.SettingBase:
+		return "base"
+	case ast.SettingTimeout:
+		return "timeout"
+	default:
+		return "unknown"
+	}
+}
+
+func httpMethodString(method ast.HttpMethod) string {
+	switch method {
+	case ast.MethodGet:
+		return "GET"
+	case ast.MethodPost:
+		return "POST"
+	case ast.MethodPut:
+		return "PUT"
+	case ast.MethodPatch:
+		return "PATCH"
+	case ast.MethodDelete:
+		return "DELETE"
+	case ast.MethodHead:
+		return "HEAD"
+	case ast.MethodOptions:
+		return "OPTIONS"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+func authSchemeString(scheme ast.AuthScheme) string {
+	switch scheme {
+	case ast.AuthBearer:
+		return "bearer"
+	case ast.AuthBasic:
+		return "basic"
+	default:
+		return "unknown"
+	}
+}
+
+func hookKindString(kind ast.HookKind) string {
+	switch kind {
+	case ast.HookPre:
+		return "pre"
+	case ast.HookPost:
+		return "post"
+	default:
+		return "unknown"
+	}
+}
+
+func printKindString(kind ast.PrintKind) string {
+	switch kind {
+	case ast.Print:
+		return "print"
+	case ast.Println:
+		return "println"
+	case ast.Printf:
+		return "printf"
+	default:
+		return "unknown"
+	}
+}
+func unaryOpString(op ast.UnaryOp) string {
+	switch op {
+	case ast.UnaryNot:
+		return "not"
+	case ast.UnaryPlus:
+		return "+"
+	case ast.UnaryMinus:
+		return "-"
+	default:
+		return "unknown"
+	}
+}
+
+func binaryOpString(op ast.BinaryOp) string {
+	switch op {
+	case ast.BinaryOr:
+		return "or"
+	case ast.BinaryAnd:
+		return "and"
+	case ast.BinaryEq:
+		return "=="
+	case ast.BinaryNe:
+		return "!="
+	case ast.BinaryLt:
+		return "<"
+	case ast.BinaryLte:
+		return "<="
+	case ast.BinaryGt:
+		return ">"
+	case ast.BinaryGte:
+		return ">="
+	case ast.BinaryIn:
+		return "in"
+	case ast.BinaryContains:
+		return "contains"
+	case ast.BinaryMatch:
+		return "~"
+	case ast.BinaryAdd:
+		return "+"
+	case ast.BinarySub:
+		return "-"
+	case ast.BinaryMul:
+		return "*"
+	case ast.BinaryDiv:
+		return "/"
+	case ast.BinaryMod:
+		return "%"
+	default:
+		return "unknown"
+	}
+}
+
+func keyKindString(kind ast.KeyKind) string {
+	switch kind {
+	case ast.KeyIdent:
+		return "ident"
+	case ast.KeyBare:
+		return "bare"
+	case ast.KeyString:
+		return "string"
+	default:
+		return "unknown"
+	}
+}
+
+func lvalueRootKindString(kind ast.LValueRootKind) string {
+	switch kind {
+	case ast.LValueIdent:
+		return "ident"
+	case ast.LValueReq:
+		return "req"
+	case ast.LValueRes:
+		return "res"
+	case ast.LValueDollar:
+		return "dollar"
+	default:
+		return "unknown"
+	}
+}
+
+func lvaluePostfixKindString(kind ast.LValuePostfixKind) string {
+	switch kind {
+	case ast.LValueField:
+		return "field"
+	case ast.LValueIndex:
+		return "index"
+	default:
+		return "unknown"
+	}
+}
+
+func objectKeyKindString(kind ast.ObjectKeyKind) string {
+	switch kind {
+	case ast.ObjectKeyIdent:
+		return "ident"
+	case ast.ObjectKeyString:
+		return "string"
+	default:
+		return "unknown"
+	}
+}
@@ -0,0 +1,2 @@
+// Package postman converts Postman v2.1 collections into pipetest programs.
+package postman
@@ -0,0 +1,562 @@
+package postman
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/mehditeymorian/pipetest/internal/lexer"
+)
+
+// Options configures Convert.
+type Options struct {
+	// FoldersAsFlows emits one flow per folder that chains its requests in
+	// collection order, plus one named after the collection for requests at
+	// its root.
+	FoldersAsFlows bool
+}
+
+type collection struct {
+	Info struct {
+		Name   string `json:"name"`
+		Schema string `json:"schema"`
+	} `json:"info"`
+	Item     []item     `json:"item"`
+	Auth     *auth      `json:"auth"`
+	Variable []keyValue `json:"variable"`
+}
+
+type item struct {
+	Name    string            `json:"name"`
+	Item    []item            `json:"item"`
+	Request json.RawMessage   `json:"request"`
+	Auth    *auth             `json:"auth"`
+	Event   []json.RawMessage `json:"event"`
+}
+
+type request struct {
+	Method string          `json:"method"`
+	Header []keyValue      `json:"header"`
+	URL    json.RawMessage `json:"url"`
+	Body   *body           `json:"body"`
+	Auth   *auth           `json:"auth"`
+}
+
+type requestURL struct {
+	Raw      string     `json:"raw"`
+	Query    []keyValue `json:"query"`
+	Variable []keyValue `json:"variable"`
+}
+
+type keyValue struct {
+	Key      string `json:"key"`
+	Value    any    `json:"value"`
+	Disabled bool   `json:"disabled"`
+	Type     string `json:"type"`
+	Src      any    `json:"src"`
+}
+
+type auth struct {
+	Type   string     `json:"type"`
+	Bearer []keyValue `json:"bearer"`
+}
+
+type body struct {
+	Mode     string     `json:"mode"`
+	Raw      string     `json:"raw"`
+	Formdata []keyValue `json:"formdata"`
+	Options  struct {
+		Raw struct {
+			Language string `json:"language"`
+		} `json:"raw"`
+	} `json:"options"`
+}
+
+type flow struct {
+	name  string
+	steps []string
+}
+
+type converter struct {
+	opt      Options
+	warnings []string
+	reqs     strings.Builder
+	reqNames map[string]struct{}
+	flows    []flow
+	// values holds variable values from the collection and from request URL
+	// variables; refs holds every variable the emitted program needs.
+	values   map[string]any
+	refs     map[string]struct{}
+	baseVar  string
+	services map[string]struct{}
+}
+
+var (
+	identRE       = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	bareKeyRE     = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_-]*$`)
+	templateRE    = regexp.MustCompile(`\{\{([^{}]*)\}\}`)
+	leadingVarRE  = regexp.MustCompile(`^\{\{([A-Za-z_][A-Za-z0-9_]*)\}\}`)
+	pathParamRE   = regexp.MustCompile(`:([A-Za-z_][A-Za-z0-9_]*)`)
+	wordSplitRE   = regexp.MustCompile(`[^A-Za-z0-9]+`)
+	schemeRE      = regexp.MustCompile(`^https?://`)
+	supportedVerb = map[string]bool{"GET": true, "POST": true, "PUT": true, "PATCH": true, "DELETE": true, "HEAD": true, "OPTIONS": true}
+)
+
+// Convert translates a Postman v2.1 collection into pipetest source.
+// Warnings describe parts of the collection that were skipped or need
+// attention, such as unsupported auth types and scripts.
+func Convert(data []byte, opt Options) (string, []string, error) {
+	var col collection
+	if err := json.Unmarshal(data, &col); err != nil {
+		return "", nil, fmt.Errorf("invalid Postman collection: %w", err)
+	}
+	if col.Info.Schema != "" && !strings.Contains(col.Info.Schema, "/v2.") {
+		return "", nil, fmt.Errorf("unsupported collection schema %s (expected Postman v2.1)", col.Info.Schema)
+	}
+	c := &converter{
+		opt:      opt,
+		reqNames: map[string]struct{}{},
+		values:   map[string]any{},
+		refs:     map[string]struct{}{},
+		services: map[string]struct{}{},
+	}
+	for _, v := range col.Variable {
+		if !identRE.MatchString(v.Key) {
+			c.warnf("collection variable %q is not a valid pipetest name; skipped", v.Key)
+			continue
+		}
+		c.values[v.Key] = v.Value
+		c.refs[v.Key] = struct{}{}
+	}
+	c.walk(col.Item, "", col.Info.Name, col.Auth)
+	return c.render(col.Info.Name), c.warnings, nil
+}
+
+func (c *converter) warnf(format string, args ...any) {
+	c.warnings = append(c.warnings, fmt.Sprintf(format, args...))
+}
+
+func (c *converter) walk(items []item, folder, flowName string, inherited *auth) {
+	var steps []string
+	for _, it := range items {
+		if isNull(it.Request) {
+			name := it.Name
+			if folder != "" {
+				name = folder + " / " + it.Name
+			}
+			folderAuth := inherited
+			if it.Auth != nil {
+				folderAuth = it.Auth
+			}
+			c.walk(it.Item, name, name, folderAuth)
+			continue
+		}
+		if name := c.convertRequest(it, inherited); name != "" {
+			steps = append(steps, name)
+		}
+	}
+	if c.opt.FoldersAsFlows && len(steps) > 0 {
+		c.flows = append(c.flows, flow{name: c.flowName(flowName), steps: steps})
+	}
+}
+
+func (c *converter) convertRequest(it item, inherited *auth) string {
+	var req request
+	if it.Request[0] == '"' {
+		req.Method = "GET"
+		req.URL = it.Request
+	} else if err := json.Unmarshal(it.Request, &req); err != nil {
+		c.warnf("request %q is not a valid Postman request; skipped", it.Name)
+		return ""
+	}
+	method := strings.ToUpper(req.Method)
+	if method == "" {
+		method = "GET"
+	}
+	if !supportedVerb[method] {
+		c.warnf("request %q uses unsupported method %s; skipped", it.Name, method)
+		return ""
+	}
+	var u requestURL
+	if !isNull(req.URL) {
+		if req.URL[0] == '"' {
+			_ = json.Unmarshal(req.URL, &u.Raw)
+		} else if err := json.Unmarshal(req.URL, &u); err != nil {
+			c.warnf("request %q has an invalid URL; skipped", it.Name)
+			return ""
+		}
+	}
+	if u.Raw == "" {
+		c.warnf("request %q has no URL; skipped", it.Name)
+		return ""
+	}
+	path, rawQuery, _ := strings.Cut(strings.SplitN(u.Raw, "#", 2)[0], "?")
+	path = c.convertPath(path)
+	query := u.Query
+	if query == nil && rawQuery != "" {
+		query = parseQuery(rawQuery)
+	}
+	for _, v := range u.Variable {
+		if _, ok := c.values[v.Key]; !ok && identRE.MatchString(v.Key) && v.Value != nil && v.Value != "" {
+			c.values[v.Key] = v.Value
+		}
+	}
+
+	name := c.requestName(it.Name)
+	var b strings.Builder
+	fmt.Fprintf(&b, "req %s:\n\t%s %s\n", name, method, path)
+	for _, h := range req.Header {
+		if h.Disabled {
+			continue
+		}
+		if !bareKeyRE.MatchString(h.Key) {
+			c.warnf("request %q header %q is not a valid pipetest header name; skipped", it.Name, h.Key)
+			continue
+		}
+		fmt.Fprintf(&b, "\theader %s = %s\n", h.Key, c.stringLit(valueString(h.Value)))
+	}
+	for _, q := range query {
+		if q.Disabled {
+			continue
+		}
+		if !bareKeyRE.MatchString(q.Key) {
+			c.warnf("request %q query param %q is not a valid pipetest query name; skipped", it.Name, q.Key)
+			continue
+		}
+		fmt.Fprintf(&b, "\tquery %s = %s\n", q.Key, c.stringLit(valueString(q.Value)))
+	}
+	a := inherited
+	if req.Auth != nil {
+		a = req.Auth
+	}
+	if a != nil {
+		switch a.Type {
+		case "", "noauth":
+		case "bearer":
+			token := ""
+			for _, kv := range a.Bearer {
+				if kv.Key == "token" {
+					token = valueString(kv.Value)
+				}
+			}
+			fmt.Fprintf(&b, "\tauth bearer %s\n", c.stringLit(token))
+		default:
+			c.warnf("request %q uses unsupported %s auth; skipped", it.Name, a.Type)
+		}
+	}
+	c.writeBody(&b, it.Name, req.Body)
+	if len(it.Event) > 0 {
+		c.warnf("request %q has scripts; they are not converted", it.Name)
+	}
+	b.WriteString("\n")
+	c.reqs.WriteString(b.String())
+	return name
+}
+
+// convertPath turns a Postman URL into a pipetest request path. A leading
+// {{var}} becomes the program base (the first one seen) or a base_for
+// service, and a URL without a scheme gets http://, as Postman assumes.
+func (c *converter) convertPath(path string) string {
+	if m := leadingVarRE.FindStringSubmatch(path); m != nil {
+		rest := path[len(m[0]):]
+		if !strings.HasPrefix(rest, "/") {
+			rest = "/" + rest
+		}
+		c.refs[m[1]] = struct{}{}
+		if c.baseVar == "" {
+			c.baseVar = m[1]
+		}
+		if m[1] != c.baseVar {
+			c.services[m[1]] = struct{}{}
+			rest = "@" + m[1] + rest
+		}
+		c.addRefs(rest)
+		return rest
+	}
+	if !schemeRE.MatchString(path) {
+		path = "http://" + path
+	}
+	c.addRefs(path)
+	return path
+}
+
+// addRefs records the {{templates}} in s and the :params in its URL path.
+func (c *converter) addRefs(s string) {
+	c.addTemplateRefs(s)
+	if loc := schemeRE.FindStringIndex(s); loc != nil {
+		rest := s[loc[1]:]
+		if i := strings.Index(rest, "/"); i >= 0 {
+			s = rest[i:]
+		} else {
+			s = ""
+		}
+	}
+	for _, m := range pathParamRE.FindAllStringSubmatch(s, -1) {
+		c.refs[m[1]] = struct{}{}
+	}
+}
+
+func (c *converter) addTemplateRefs(s string) {
+	for _, m := range templateRE.FindAllStringSubmatch(s, -1) {
+		name := strings.TrimSpace(m[1])
+		if root, _, _ := strings.Cut(name, "."); identRE.MatchString(root) {
+			c.refs[root] = struct{}{}
+			continue
+		}
+		c.warnf("variable {{%s}} is not a valid pipetest name; left as is", name)
+	}
+}
+
+func (c *converter) writeBody(b *strings.Builder, reqName string, bd *body) {
+	if bd == nil {
+		return
+	}
+	switch bd.Mode {
+	case "":
+	case "raw":
+		if strings.TrimSpace(bd.Raw) == "" {
+			return
+		}
+		lang := bd.Options.Raw.Language
+		if lang == "json" || (lang == "" && json.Valid([]byte(bd.Raw))) {
+			dec := json.NewDecoder(bytes.NewReader([]byte(bd.Raw)))
+			dec.UseNumber()
+			var v any
+			if err := dec.Decode(&v); err != nil {
+				c.warnf("request %q has a raw JSON body that is not valid JSON; skipped", reqName)
+				return
+			}
+			fmt.Fprintf(b, "\tjson %s\n", c.literal(v))
+			return
+		}
+		if lang == "xml" {
+			if strings.Contains(bd.Raw, `"""`) {
+				c.warnf("request %q has an XML body containing \"\"\"; skipped", reqName)
+				return
+			}
+			c.addTemplateRefs(bd.Raw)
+			fmt.Fprintf(b, "\txml \"\"\"%s\"\"\"\n", bd.Raw)
+			return
+		}
+		if lang == "" {
+			lang = "text"
+		}
+		c.warnf("request %q has a raw %s body; only json and xml bodies are converted", reqName, lang)
+	case "formdata":
+		var fields []string
+		for _, f := range bd.Formdata {
+			if f.Disabled {
+				continue
+			}
+			key := c.objectKey(f.Key)
+			if f.Type == "file" {
+				src := f.Src
+				if list, ok := src.([]any); ok && len(list) > 0 {
+					src = list[0]
+				}
+				fields = append(fields, fmt.Sprintf("%s: @%s", key, strconv.Quote(valueString(src))))
+				continue
+			}
+			fields = append(fields, fmt.Sprintf("%s: %s", key, c.stringLit(valueString(f.Value))))
+		}
+		if len(fields) > 0 {
+			fmt.Fprintf(b, "\tmultipart { %s }\n", strings.Join(fields, ", "))
+		}
+	default:
+		c.warnf("request %q uses a %s body; skipped", reqName, bd.Mode)
+	}
+}
+
+// literal renders a decoded JSON value as a pipetest expression.
+func (c *converter) literal(v any) string {
+	switch x := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return strconv.FormatBool(x)
+	case json.Number:
+		if strings.ContainsAny(x.String(), "eE") {
+			f, _ := x.Float64()
+			return strconv.FormatFloat(f, 'f', -1, 64)
+		}
+		return x.String()
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	case string:
+		return c.stringLit(x)
+	case []any:
+		parts := make([]string, 0, len(x))
+		for _, el := range x {
+			parts = append(parts, c.literal(el))
+		}
+		return "[" + strings.Join(parts, ", ") + "]"
+	case map[string]any:
+		if len(x) == 0 {
+			return "{}"
+		}
+		keys := make([]string, 0, len(x))
+		for k := range x {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+		parts := make([]string, 0, len(keys))
+		for _, k := range keys {
+			parts = append(parts, c.objectKey(k)+": "+c.literal(x[k]))
+		}
+		return "{ " + strings.Join(parts, ", ") + " }"
+	}
+	return c.stringLit(fmt.Sprint(v))
+}
+
+func (c *converter) stringLit(s string) string {
+	c.addTemplateRefs(s)
+	return strconv.Quote(s)
+}
+
+func (c *converter) objectKey(k string) string {
+	if isIdent(k) {
+		return k
+	}
+	return strconv.Quote(k)
+}
+
+// requestName turns a Postman item name into a unique request identifier,
+// e.g. "Get user by ID" becomes getUserByID.
+func (c *converter) requestName(display string) string {
+	var name strings.Builder
+	for _, word := range wordSplitRE.Split(display, -1) {
+		if word == "" {
+			continue
+		}
+		if name.Len() == 0 {
+			if strings.ToUpper(word) == word {
+				word = strings.ToLower(word)
+			} else {
+				word = strings.ToLower(word[:1]) + word[1:]
+			}
+		} else {
+			word = strings.ToUpper(word[:1]) + word[1:]
+		}
+		name.WriteString(word)
+	}
+	base := name.String()
+	switch {
+	case base == "":
+		base = "request"
+	case base[0] >= '0' && base[0] <= '9':
+		base = "req" + base
+	case !isIdent(base):
+		base += "Req"
+	}
+	unique := base
+	for i := 2; ; i++ {
+		if _, ok := c.reqNames[unique]; !ok {
+			break
+		}
+		unique = base + strconv.Itoa(i)
+	}
+	c.reqNames[unique] = struct{}{}
+	return unique
+}
+
+func (c *converter) flowName(name string) string {
+	if name == "" {
+		name = "collection"
+	}
+	unique := name
+	for i := 2; slices.ContainsFunc(c.flows, func(f flow) bool { return f.name == unique }); i++ {
+		unique = fmt.Sprintf("%s (%d)", name, i)
+	}
+	return unique
+}
+
+func (c *converter) render(collectionName string) string {
+	var out strings.Builder
+	fmt.Fprintf(&out, "# Imported from Postman collection %s.\n\n", strconv.Quote(collectionName))
+	for _, v := range c.values {
+		if s, ok := v.(string); ok {
+			c.addTemplateRefs(s)
+		}
+	}
+	names := make([]string, 0, len(c.refs))
+	for name := range c.refs {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		v, ok := c.values[name]
+		if !ok || v == nil {
+			c.warnf("variable %q has no value in the collection; it is read from the environment", name)
+			fmt.Fprintf(&out, "let %s = env(%s)\n", name, strconv.Quote(name))
+			continue
+		}
+		fmt.Fprintf(&out, "let %s = %s\n", name, c.literal(v))
+	}
+	if len(names) > 0 {
+		out.WriteString("\n")
+	}
+	if c.baseVar != "" {
+		fmt.Fprintf(&out, "base \"{{%s}}\"\n", c.baseVar)
+		services := make([]string, 0, len(c.services))
+		for name := range c.services {
+			services = append(services, name)
+		}
+		slices.Sort(services)
+		for _, name := range services {
+			fmt.Fprintf(&out, "base_for %q \"{{%s}}\"\n", name, name)
+		}
+		out.WriteString("\n")
+	}
+	out.WriteString(c.reqs.String())
+	for _, f := range c.flows {
+		fmt.Fprintf(&out, "flow %s:\n\t%s\n\n", strconv.Quote(f.name), strings.Join(f.steps, " -> "))
+	}
+	return strings.TrimRight(out.String(), "\n") + "\n"
+}
+
+func parseQuery(raw string) []keyValue {
+	var out []keyValue
+	for _, pair := range strings.Split(raw, "&") {
+		if pair == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(pair, "=")
+		if k, err := url.QueryUnescape(key); err == nil {
+			key = k
+		}
+		if v, err := url.QueryUnescape(value); err == nil {
+			value = v
+		}
+		out = append(out, keyValue{Key: key, Value: value})
+	}
+	return out
+}
+
+func valueString(v any) string {
+	if v == nil {
+		return ""
+	}
+	if s, ok := v.(string); ok {
+		return s
+	}
+	return fmt.Sprint(v)
+}
+
+func isNull(raw json.RawMessage) bool {
+	return len(raw) == 0 || string(raw) == "null"
+}
+
+// isIdent reports whether s lexes as a single identifier, which rules out
+// keywords such as json or query.
+func isIdent(s string) bool {
+	if !identRE.MatchString(s) {
+		return false
+	}
+	tokens, errs := lexer.Lex("", s)
+	return len(errs) == 0 && len(tokens) > 0 && tokens[0].Kind == lexer.IDENT && tokens[0].Lit == s
+}
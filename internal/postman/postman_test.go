@@ -0,0 +1,79 @@
+package postman
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mehditeymorian/pipetest/internal/compiler"
+	"github.com/mehditeymorian/pipetest/internal/parser"
+)
+
+var updateGolden = flag.Bool("update", false, "update golden files")
+
+func TestConvertCollection(t *testing.T) {
+	root := filepath.Join("..", "..", "testdata", "postman")
+	data, err := os.ReadFile(filepath.Join(root, "collection.json"))
+	if err != nil {
+		t.Fatalf("read collection: %v", err)
+	}
+	got, warnings, err := Convert(data, Options{FoldersAsFlows: true})
+	if err != nil {
+		t.Fatalf("convert: %v", err)
+	}
+	goldenPath := filepath.Join(root, "collection.pt")
+	if *updateGolden {
+		if err := os.WriteFile(goldenPath, []byte(got), 0o644); err != nil {
+			t.Fatalf("write golden: %v", err)
+		}
+	}
+	want, err := os.ReadFile(goldenPath)
+	if err != nil {
+		t.Fatalf("read golden: %v", err)
+	}
+	if got != string(want) {
+		t.Fatalf("converted program mismatch (re-run with -update to refresh):\n%s", got)
+	}
+	wantWarnings := []string{
+		`request "Create user" has scripts; they are not converted`,
+		`request "Health" uses unsupported basic auth; skipped`,
+		`variable "token" has no value in the collection; it is read from the environment`,
+	}
+	if !reflect.DeepEqual(warnings, wantWarnings) {
+		t.Fatalf("unexpected warnings: %q", warnings)
+	}
+
+	prog, lexErrs, parseErrs := parser.Parse("collection.pt", got)
+	if len(lexErrs) > 0 || len(parseErrs) > 0 {
+		t.Fatalf("converted program does not parse: lex=%v parse=%v", lexErrs, parseErrs)
+	}
+	if _, diags := compiler.Compile("collection.pt", []compiler.Module{{Path: "collection.pt", Program: prog}}); len(diags) > 0 {
+		t.Fatalf("converted program does not compile: %+v", diags)
+	}
+}
+
+func TestConvertWithoutFlows(t *testing.T) {
+	src := `{"info":{"name":"c"},"item":[{"name":"query","request":{"method":"GET","url":"example.com/q"}},{"name":"Query","request":"{{host}}/q"}]}`
+	got, _, err := Convert([]byte(src), Options{})
+	if err != nil {
+		t.Fatalf("convert: %v", err)
+	}
+	for _, want := range []string{"req queryReq:\n\tGET http://example.com/q\n", "req queryReq2:\n\tGET /q\n", `let host = env("host")`} {
+		if !strings.Contains(got, want) {
+			t.Fatalf("expected %q in output:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "flow ") {
+		t.Fatalf("expected no flows without FoldersAsFlows:\n%s", got)
+	}
+}
+
+func TestConvertRejectsOtherSchemas(t *testing.T) {
+	_, _, err := Convert([]byte(`{"info":{"schema":"https://schema.getpostman.com/json/collection/v1.0.0/collection.json"}}`), Options{})
+	if err == nil || !strings.Contains(err.Error(), "unsupported collection schema") {
+		t.Fatalf("expected schema error, got %v", err)
+	}
+}
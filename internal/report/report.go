@@ -4,10 +4,13 @@ import (
 	"encoding/json"
 	"encoding/xml"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 
+	"github.com/mehditeymorian/pipetest/internal/ast"
 	"github.com/mehditeymorian/pipetest/internal/compiler"
 	"github.com/mehditeymorian/pipetest/internal/diagnostics"
 	"github.com/mehditeymorian/pipetest/internal/runtime"
@@ -17,12 +20,24 @@ import (
 type Model struct {
 	Suites  []Suite `json:"suites"`
 	Summary Summary `json:"summary"`
+	// Assertions is only set by run --count-assertions.
+	Assertions *AssertionSummary `json:"assertions,omitempty"`
+}
+
+type AssertionSummary struct {
+	Total  int `json:"total"`
+	Passed int `json:"passed"`
+	Failed int `json:"failed"`
+	// Skipped counts assertions left unevaluated by run
+	// --only-flow-asserts or --only-request-asserts.
+	Skipped int `json:"skipped,omitempty"`
 }
 
 type Summary struct {
 	Tests    int `json:"tests"`
 	Failures int `json:"failures"`
 	Errors   int `json:"errors"`
+	Skipped  int `json:"skipped,omitempty"`
 }
 
 type Suite struct {
@@ -56,6 +71,16 @@ func Build(plan *compiler.Plan, result runtime.Result) Model {
 		byFlow[flow] = append(byFlow[flow], d)
 	}
 
+	skipsByFlow := map[string][]runtime.SkippedAssertion{}
+	for _, sk := range result.Skipped {
+		skipsByFlow[sk.Flow] = append(skipsByFlow[sk.Flow], sk)
+	}
+
+	notRun := map[runtime.NotRunStep]bool{}
+	for _, nr := range result.NotRun {
+		notRun[nr] = true
+	}
+
 	model := Model{}
 	for _, flow := range plan.Flows {
 		suite := Suite{Name: flow.Name}
@@ -69,9 +94,34 @@ func Build(plan *compiler.Plan, result runtime.Result) Model {
 				canonical = display
 			}
 			tc := Testcase{Name: fmt.Sprintf("%d %s", stepIndex, display), Flow: flow.Name, Request: canonical, Status: "passed"}
-			if d := firstDiagFor(byFlow[flow.Name], canonical); d != nil {
+			if notRun[runtime.NotRunStep{Flow: flow.Name, Index: stepIndex - 1}] {
+				tc.Status = "skipped"
+				tc.Message = notRunMessage
+			} else if d := firstDiagFor(byFlow[flow.Name], canonical); d != nil {
+				tc.Status = statusForCode(d.Code)
+				tc.Message = diagMessage(*d)
+			} else if n := countSkipped(skipsByFlow[flow.Name], canonical, false); n > 0 {
+				tc.Status = "skipped"
+				tc.Message = skippedMessage(n)
+			}
+			suite.Testcases = append(suite.Testcases, tc)
+		}
+
+		for i, block := range flow.Decl.Eventually {
+			display := block.Step.ReqName
+			if block.Step.Alias != nil {
+				display = fmt.Sprintf("%s:%s", block.Step.ReqName, *block.Step.Alias)
+			}
+			tc := Testcase{Name: fmt.Sprintf("eventually %d %s", i+1, display), Flow: flow.Name, Request: display, Status: "passed"}
+			if notRun[runtime.NotRunStep{Flow: flow.Name, Index: i, Eventually: true}] {
+				tc.Status = "skipped"
+				tc.Message = notRunMessage
+			} else if d := eventuallyDiagFor(byFlow[flow.Name], block); d != nil {
 				tc.Status = statusForCode(d.Code)
 				tc.Message = diagMessage(*d)
+			} else if n := countSkipped(skipsByFlow[flow.Name], display, true); n > 0 {
+				tc.Status = "skipped"
+				tc.Message = skippedMessage(n)
 			}
 			suite.Testcases = append(suite.Testcases, tc)
 		}
@@ -90,6 +140,18 @@ func Build(plan *compiler.Plan, result runtime.Result) Model {
 			}
 			suite.Testcases = append(suite.Testcases, tc)
 		}
+		for _, sk := range skipsByFlow[flow.Name] {
+			if !sk.FlowLevel || sk.Request != "" {
+				continue
+			}
+			flowAssertIndex++
+			suite.Testcases = append(suite.Testcases, Testcase{
+				Name:    fmt.Sprintf("flow :: assert %d", flowAssertIndex),
+				Flow:    flow.Name,
+				Status:  "skipped",
+				Message: skippedMessage(1),
+			})
+		}
 		suite.Summary = summarize(suite.Testcases)
 		model.Suites = append(model.Suites, suite)
 	}
@@ -99,7 +161,43 @@ func Build(plan *compiler.Plan, result runtime.Result) Model {
 
 func firstDiagFor(diags []diagnostics.Diagnostic, request string) *diagnostics.Diagnostic {
 	for _, d := range diags {
-		if d.Request != nil && *d.Request == request {
+		if d.Request != nil && *d.Request == request && d.Code != eventuallyTimeoutCode {
+			copyD := d
+			return &copyD
+		}
+	}
+	return nil
+}
+
+// countSkipped counts the skipped assertions of request, either its own or,
+// with flowLevel, those of an assert_eventually block polling it.
+func countSkipped(skips []runtime.SkippedAssertion, request string, flowLevel bool) int {
+	n := 0
+	for _, sk := range skips {
+		if sk.Request == request && sk.FlowLevel == flowLevel {
+			n++
+		}
+	}
+	return n
+}
+
+// notRunMessage marks the steps a run stopped under --step never reached.
+const notRunMessage = "not run: the run was stopped"
+
+func skippedMessage(n int) string {
+	if n == 1 {
+		return "1 assertion skipped"
+	}
+	return fmt.Sprintf("%d assertions skipped", n)
+}
+
+const eventuallyTimeoutCode = "E_ASSERT_EVENTUALLY_TIMEOUT"
+
+// eventuallyDiagFor finds the timeout of an assert_eventually block. Blocks
+// may poll the same request, so they are told apart by position.
+func eventuallyDiagFor(diags []diagnostics.Diagnostic, block *ast.EventuallyBlock) *diagnostics.Diagnostic {
+	for _, d := range diags {
+		if d.Code == eventuallyTimeoutCode && d.Line == block.Span.Start.Line && d.Column == block.Span.Start.Column {
 			copyD := d
 			return &copyD
 		}
@@ -108,7 +206,8 @@ func firstDiagFor(diags []diagnostics.Diagnostic, request string) *diagnostics.D
 }
 
 func statusForCode(code string) string {
-	if strings.HasPrefix(code, "E_ASSERT_") {
+	// E_RUNTIME_TIMEOUT is only produced with --timeouts-as-failures.
+	if strings.HasPrefix(code, "E_ASSERT_") || code == "E_RUNTIME_TIMEOUT" {
 		return "failure"
 	}
 	return "error"
@@ -126,6 +225,8 @@ func summarize(cases []Testcase) Summary {
 			s.Failures++
 		case "error":
 			s.Errors++
+		case "skipped":
+			s.Skipped++
 		}
 	}
 	return s
@@ -137,6 +238,7 @@ func summarizeSuites(suites []Suite) Summary {
 		s.Tests += suite.Summary.Tests
 		s.Failures += suite.Summary.Failures
 		s.Errors += suite.Summary.Errors
+		s.Skipped += suite.Summary.Skipped
 	}
 	return s
 }
@@ -150,12 +252,118 @@ func WriteJSONFile(path string, model Model) error {
 		return err
 	}
 	defer func() { _ = f.Close() }()
-	enc := json.NewEncoder(f)
+	return WriteJSON(f, model)
+}
+
+func WriteJSON(w io.Writer, model Model) error {
+	enc := json.NewEncoder(w)
 	enc.SetIndent("", "  ")
 	return enc.Encode(model)
 }
 
+// ReadJSONFile loads a model previously written by WriteJSONFile.
+func ReadJSONFile(path string) (Model, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Model{}, err
+	}
+	var model Model
+	if err := json.Unmarshal(data, &model); err != nil {
+		return Model{}, fmt.Errorf("invalid report %s: %w", path, err)
+	}
+	return model, nil
+}
+
+const (
+	ChangeAdded        = "added"
+	ChangeRemoved      = "removed"
+	ChangeNewlyFailing = "newly_failing"
+	ChangeNewlyPassing = "newly_passing"
+	ChangeStatus       = "status_changed"
+)
+
+// Change is a testcase whose status differs between two reports. Old is empty
+// for added testcases and New is empty for removed ones.
+type Change struct {
+	Kind     string `json:"kind"`
+	Suite    string `json:"suite"`
+	Testcase string `json:"testcase"`
+	Old      string `json:"old,omitempty"`
+	New      string `json:"new,omitempty"`
+}
+
+// NewFailure reports whether the testcase fails in the new report but did not
+// in the old one.
+func (c Change) NewFailure() bool {
+	return failing(c.New) && !failing(c.Old)
+}
+
+// failing reports whether a testcase status is a failure or an error;
+// passed and skipped testcases are not failing.
+func failing(status string) bool {
+	return status == "failure" || status == "error"
+}
+
+// Diff compares testcases keyed by suite and testcase name and returns the
+// ones that were added, removed, or changed status, sorted by suite then name.
+func Diff(oldModel, newModel Model) []Change {
+	type key struct{ suite, testcase string }
+	statuses := func(m Model) map[key]string {
+		out := map[key]string{}
+		for _, suite := range m.Suites {
+			for _, tc := range suite.Testcases {
+				out[key{suite.Name, tc.Name}] = tc.Status
+			}
+		}
+		return out
+	}
+	before, after := statuses(oldModel), statuses(newModel)
+
+	var changes []Change
+	for k, newStatus := range after {
+		oldStatus, ok := before[k]
+		c := Change{Suite: k.suite, Testcase: k.testcase, Old: oldStatus, New: newStatus}
+		switch {
+		case !ok:
+			c.Kind = ChangeAdded
+		case oldStatus == newStatus:
+			continue
+		case !failing(oldStatus) && failing(newStatus):
+			c.Kind = ChangeNewlyFailing
+		case failing(oldStatus) && newStatus == "passed":
+			c.Kind = ChangeNewlyPassing
+		default:
+			c.Kind = ChangeStatus
+		}
+		changes = append(changes, c)
+	}
+	for k, oldStatus := range before {
+		if _, ok := after[k]; !ok {
+			changes = append(changes, Change{Kind: ChangeRemoved, Suite: k.suite, Testcase: k.testcase, Old: oldStatus})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].Suite != changes[j].Suite {
+			return changes[i].Suite < changes[j].Suite
+		}
+		return changes[i].Testcase < changes[j].Testcase
+	})
+	return changes
+}
+
+// JUnitOptions customizes JUnit output.
+type JUnitOptions struct {
+	// SuiteName sets the name attribute of the root testsuites element.
+	SuiteName string
+	// PrefixSuites prepends SuiteName to every per-flow suite name.
+	PrefixSuites bool
+}
+
 func WriteJUnitFile(path string, model Model) error {
+	return WriteJUnitFileWithOptions(path, model, JUnitOptions{})
+}
+
+func WriteJUnitFileWithOptions(path string, model Model, opt JUnitOptions) error {
 	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
 		return err
 	}
@@ -165,9 +373,13 @@ func WriteJUnitFile(path string, model Model) error {
 	}
 	defer func() { _ = f.Close() }()
 
-	top := junitSuites{Suites: make([]junitSuite, 0, len(model.Suites))}
+	top := junitSuites{Name: opt.SuiteName, Suites: make([]junitSuite, 0, len(model.Suites))}
 	for _, s := range model.Suites {
-		js := junitSuite{Name: s.Name, Tests: s.Summary.Tests, Failures: s.Summary.Failures, Errors: s.Summary.Errors}
+		name := s.Name
+		if opt.PrefixSuites && opt.SuiteName != "" {
+			name = opt.SuiteName + " / " + name
+		}
+		js := junitSuite{Name: name, Tests: s.Summary.Tests, Failures: s.Summary.Failures, Errors: s.Summary.Errors, Skipped: s.Summary.Skipped}
 		for _, tc := range s.Testcases {
 			jtc := junitCase{Name: tc.Name}
 			if tc.Status == "failure" {
@@ -176,6 +388,9 @@ func WriteJUnitFile(path string, model Model) error {
 			if tc.Status == "error" {
 				jtc.Error = &junitError{Message: tc.Message}
 			}
+			if tc.Status == "skipped" {
+				jtc.Skipped = &junitSkipped{Message: tc.Message}
+			}
 			js.Cases = append(js.Cases, jtc)
 		}
 		top.Suites = append(top.Suites, js)
@@ -190,6 +405,7 @@ func WriteJUnitFile(path string, model Model) error {
 
 type junitSuites struct {
 	XMLName xml.Name     `xml:"testsuites"`
+	Name    string       `xml:"name,attr,omitempty"`
 	Suites  []junitSuite `xml:"testsuite"`
 }
 
@@ -198,6 +414,7 @@ type junitSuite struct {
 	Tests    int         `xml:"tests,attr"`
 	Failures int         `xml:"failures,attr"`
 	Errors   int         `xml:"errors,attr"`
+	Skipped  int         `xml:"skipped,attr,omitempty"`
 	Cases    []junitCase `xml:"testcase"`
 }
 
@@ -205,6 +422,7 @@ type junitCase struct {
 	Name    string        `xml:"name,attr"`
 	Failure *junitFailure `xml:"failure,omitempty"`
 	Error   *junitError   `xml:"error,omitempty"`
+	Skipped *junitSkipped `xml:"skipped,omitempty"`
 }
 
 type junitFailure struct {
@@ -214,3 +432,7 @@ type junitFailure struct {
 type junitError struct {
 	Message string `xml:"message,attr"`
 }
+
+type junitSkipped struct {
+	Message string `xml:"message,attr,omitempty"`
+}
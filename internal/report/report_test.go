@@ -5,6 +5,8 @@ import (
 	"encoding/xml"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/mehditeymorian/pipetest/internal/ast"
@@ -57,6 +59,152 @@ func TestBuildMapsRequestAndFlowDiagnostics(t *testing.T) {
 	}
 }
 
+func TestBuildClassifiesTimeoutsAsFailures(t *testing.T) {
+	flow := "slow"
+	plan := &compiler.Plan{
+		Flows: []compiler.PlanFlow{{Name: flow, Decl: &ast.FlowDecl{Chain: []ast.FlowStep{{ReqName: "a"}, {ReqName: "b"}}}}},
+	}
+	diags := []diagnostics.Diagnostic{
+		{Code: "E_RUNTIME_TIMEOUT", Message: "failed to send request", File: "a.pt", Line: 1, Column: 1, Flow: &flow, Request: strPtr("a")},
+		{Code: "E_RUNTIME_TRANSPORT", Message: "failed to send request", File: "a.pt", Line: 4, Column: 1, Flow: &flow, Request: strPtr("b")},
+	}
+	model := Build(plan, runtime.Result{Diags: diags})
+	cases := model.Suites[0].Testcases
+	if len(cases) != 2 || cases[0].Status != "failure" || cases[1].Status != "error" {
+		t.Fatalf("expected timeout failure and transport error, got %+v", cases)
+	}
+	if model.Summary.Failures != 1 || model.Summary.Errors != 1 {
+		t.Fatalf("unexpected summary: %+v", model.Summary)
+	}
+}
+
+func TestBuildReportsTimedOutEventuallyBlocks(t *testing.T) {
+	flow := "async"
+	alias := "again"
+	plan := &compiler.Plan{
+		Flows: []compiler.PlanFlow{{Name: flow, Decl: &ast.FlowDecl{
+			Chain: []ast.FlowStep{{ReqName: "status"}},
+			Eventually: []*ast.EventuallyBlock{
+				{Step: ast.FlowStep{ReqName: "status"}, Span: ast.Span{Start: ast.Position{Line: 8, Column: 2}}},
+				{Step: ast.FlowStep{ReqName: "status", Alias: &alias}, Span: ast.Span{Start: ast.Position{Line: 11, Column: 2}}},
+			},
+		}}},
+	}
+	diags := []diagnostics.Diagnostic{
+		{Code: "E_ASSERT_EVENTUALLY_TIMEOUT", Message: "assert_eventually did not hold within 1s (3 attempts)", File: "a.pt", Line: 11, Column: 2, Flow: &flow, Request: strPtr("status:again")},
+	}
+	model := Build(plan, runtime.Result{Diags: diags})
+	cases := model.Suites[0].Testcases
+	if len(cases) != 3 {
+		t.Fatalf("expected the chain step and both eventually blocks, got %+v", cases)
+	}
+	if cases[0].Status != "passed" || cases[1].Name != "eventually 1 status" || cases[1].Status != "passed" {
+		t.Fatalf("expected the chain step and first block to pass, got %+v", cases)
+	}
+	if cases[2].Name != "eventually 2 status:again" || cases[2].Status != "failure" || !strings.Contains(cases[2].Message, "did not hold within 1s") {
+		t.Fatalf("expected the timed-out block to fail, got %+v", cases[2])
+	}
+	if model.Summary != (Summary{Tests: 3, Failures: 1}) {
+		t.Fatalf("unexpected summary: %+v", model.Summary)
+	}
+}
+
+func TestBuildMarksSkippedAssertions(t *testing.T) {
+	flow := "focus"
+	plan := &compiler.Plan{
+		Flows: []compiler.PlanFlow{{Name: flow, Decl: &ast.FlowDecl{
+			Chain:      []ast.FlowStep{{ReqName: "login"}, {ReqName: "cart"}, {ReqName: "pay"}},
+			Eventually: []*ast.EventuallyBlock{{Step: ast.FlowStep{ReqName: "pay"}}},
+		}}},
+	}
+	result := runtime.Result{
+		Diags: []diagnostics.Diagnostic{{Code: "E_RUNTIME_TRANSPORT", Message: "failed to send request", File: "a.pt", Line: 4, Column: 1, Flow: &flow, Request: strPtr("cart")}},
+		Skipped: []runtime.SkippedAssertion{
+			{Flow: flow, Request: "login"},
+			{Flow: flow, Request: "login"},
+			{Flow: flow, Request: "cart"},
+			{Flow: flow, Request: "pay", FlowLevel: true},
+			{Flow: flow, FlowLevel: true},
+		},
+	}
+	model := Build(plan, result)
+	var got []string
+	for _, tc := range model.Suites[0].Testcases {
+		got = append(got, tc.Name+" "+tc.Status+" "+tc.Message)
+	}
+	want := []string{
+		"1 login skipped 2 assertions skipped",
+		"2 cart error failed to send request @ a.pt:4:1",
+		"3 pay passed ",
+		"eventually 1 pay skipped 1 assertion skipped",
+		"flow :: assert 1 skipped 1 assertion skipped",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected testcases:\n got %q\nwant %q", got, want)
+	}
+	if model.Summary != (Summary{Tests: 5, Errors: 1, Skipped: 3}) {
+		t.Fatalf("unexpected summary: %+v", model.Summary)
+	}
+
+	path := filepath.Join(t.TempDir(), "junit.xml")
+	if err := WriteJUnitFile(path, model); err != nil {
+		t.Fatalf("write junit: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read junit: %v", err)
+	}
+	for _, part := range []string{`skipped="3"`, `<testcase name="1 login">`, `<skipped message="2 assertions skipped"></skipped>`} {
+		if !strings.Contains(string(data), part) {
+			t.Fatalf("expected %s in junit output:\n%s", part, data)
+		}
+	}
+
+	changes := Diff(Model{Suites: []Suite{{Name: flow, Testcases: []Testcase{{Name: "1 login", Status: "passed"}}}}}, Model{Suites: []Suite{{Name: flow, Testcases: []Testcase{{Name: "1 login", Status: "skipped"}}}}})
+	if len(changes) != 1 || changes[0].Kind != ChangeStatus || changes[0].NewFailure() {
+		t.Fatalf("expected a skipped testcase to be a status change, not a failure: %+v", changes)
+	}
+}
+
+func TestBuildMarksStepsAStoppedRunNeverReached(t *testing.T) {
+	plan := &compiler.Plan{
+		Flows: []compiler.PlanFlow{
+			{Name: "one", Decl: &ast.FlowDecl{
+				Chain:      []ast.FlowStep{{ReqName: "login"}, {ReqName: "cart"}},
+				Eventually: []*ast.EventuallyBlock{{Step: ast.FlowStep{ReqName: "cart"}}},
+			}},
+			{Name: "two", Decl: &ast.FlowDecl{Chain: []ast.FlowStep{{ReqName: "pay"}}}},
+		},
+	}
+	result := runtime.Result{
+		Stopped: true,
+		NotRun: []runtime.NotRunStep{
+			{Flow: "one", Index: 1},
+			{Flow: "one", Index: 0, Eventually: true},
+			{Flow: "two", Index: 0},
+		},
+	}
+	model := Build(plan, result)
+	var got []string
+	for _, suite := range model.Suites {
+		for _, tc := range suite.Testcases {
+			got = append(got, suite.Name+" "+tc.Name+" "+tc.Status+" "+tc.Message)
+		}
+	}
+	want := []string{
+		"one 1 login passed ",
+		"one 2 cart skipped not run: the run was stopped",
+		"one eventually 1 cart skipped not run: the run was stopped",
+		"two 1 pay skipped not run: the run was stopped",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected testcases:\n got %q\nwant %q", got, want)
+	}
+	if model.Summary != (Summary{Tests: 4, Skipped: 3}) {
+		t.Fatalf("unexpected summary: %+v", model.Summary)
+	}
+}
+
 func TestBuildUsesGlobalBucketForDiagnosticsWithoutFlow(t *testing.T) {
 	plan := &compiler.Plan{
 		Flows: []compiler.PlanFlow{
@@ -125,4 +273,80 @@ func TestWriteJSONAndJUnitFiles(t *testing.T) {
 	}
 }
 
+func TestWriteJUnitFileWithSuiteName(t *testing.T) {
+	model := Model{Suites: []Suite{{Name: "checkout", Testcases: []Testcase{{Name: "1 login", Status: "passed"}}}}}
+	path := filepath.Join(t.TempDir(), "junit.xml")
+	if err := WriteJUnitFileWithOptions(path, model, JUnitOptions{SuiteName: "API smoke", PrefixSuites: true}); err != nil {
+		t.Fatalf("WriteJUnitFileWithOptions failed: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read xml failed: %v", err)
+	}
+	if !strings.Contains(string(data), `<testsuites name="API smoke">`) {
+		t.Fatalf("expected root name attribute, got %s", data)
+	}
+	var suites junitSuites
+	if err := xml.Unmarshal(data, &suites); err != nil {
+		t.Fatalf("xml unmarshal failed: %v", err)
+	}
+	if suites.Name != "API smoke" || suites.Suites[0].Name != "API smoke / checkout" {
+		t.Fatalf("unexpected suite names: %+v", suites)
+	}
+
+	if err := WriteJUnitFile(path, model); err != nil {
+		t.Fatalf("WriteJUnitFile failed: %v", err)
+	}
+	data, err = os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read xml failed: %v", err)
+	}
+	if !strings.Contains(string(data), "<testsuites>") {
+		t.Fatalf("expected no root name by default, got %s", data)
+	}
+}
+
+func TestDiffClassifiesStatusChanges(t *testing.T) {
+	oldModel := Model{Suites: []Suite{
+		{Name: "checkout", Testcases: []Testcase{
+			{Name: "1 login", Status: "passed"},
+			{Name: "2 order", Status: "failure"},
+			{Name: "3 pay", Status: "passed"},
+			{Name: "4 ship", Status: "failure"},
+			{Name: "5 legacy", Status: "passed"},
+		}},
+	}}
+	newModel := Model{Suites: []Suite{
+		{Name: "checkout", Testcases: []Testcase{
+			{Name: "1 login", Status: "passed"},
+			{Name: "2 order", Status: "passed"},
+			{Name: "3 pay", Status: "error"},
+			{Name: "4 ship", Status: "error"},
+		}},
+		{Name: "refunds", Testcases: []Testcase{{Name: "1 refund", Status: "failure"}}},
+	}}
+
+	got := Diff(oldModel, newModel)
+	want := []Change{
+		{Kind: ChangeNewlyPassing, Suite: "checkout", Testcase: "2 order", Old: "failure", New: "passed"},
+		{Kind: ChangeNewlyFailing, Suite: "checkout", Testcase: "3 pay", Old: "passed", New: "error"},
+		{Kind: ChangeStatus, Suite: "checkout", Testcase: "4 ship", Old: "failure", New: "error"},
+		{Kind: ChangeRemoved, Suite: "checkout", Testcase: "5 legacy", Old: "passed"},
+		{Kind: ChangeAdded, Suite: "refunds", Testcase: "1 refund", New: "failure"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected changes:\n got %+v\nwant %+v", got, want)
+	}
+
+	var newFailures []string
+	for _, c := range got {
+		if c.NewFailure() {
+			newFailures = append(newFailures, c.Suite+"/"+c.Testcase)
+		}
+	}
+	if !reflect.DeepEqual(newFailures, []string{"checkout/3 pay", "refunds/1 refund"}) {
+		t.Fatalf("unexpected new failures: %v", newFailures)
+	}
+}
+
 func strPtr(s string) *string { return &s }
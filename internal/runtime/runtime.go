@@ -4,27 +4,38 @@ import (
 	"bytes"
 	"context"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"math"
+	"math/big"
+	mathrand "math/rand"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/mehditeymorian/pipetest/internal/ast"
 	"github.com/mehditeymorian/pipetest/internal/compiler"
 	"github.com/mehditeymorian/pipetest/internal/diagnostics"
+	"github.com/mehditeymorian/pipetest/internal/openapi"
 )
 
-var pathParamRuntimeRE = regexp.MustCompile(`:([A-Za-z_][A-Za-z0-9_]*)`)
-var templateVarRuntimeRE = regexp.MustCompile(`\{\{([A-Za-z_][A-Za-z0-9_]*)\}\}`)
+var pathParamRuntimeRE = regexp.MustCompile(`:([A-Za-z_][A-Za-z0-9_]*)(\*?)`)
+var templateVarRuntimeRE = regexp.MustCompile(`\{\{(env:[A-Za-z_][A-Za-z0-9_]*|[A-Za-z_][A-Za-z0-9_]*(?:\.[A-Za-z_][A-Za-z0-9_]*)*)\}\}`)
+var secretEnvNameRE = regexp.MustCompile(`[^A-Za-z0-9]+`)
 
 type Options struct {
 	BaseOverride              *string
@@ -33,16 +44,123 @@ type Options struct {
 	Verbose                   bool
 	LogWriter                 io.Writer
 	SuppressPassingAssertions bool
+	// SecretResolver backs the secret(path) builtin. When nil, secrets are
+	// read from SECRET_<PATH> environment variables.
+	SecretResolver func(path string) (string, error)
+	// ParallelRequests caps how many steps of one flow run at once. Values
+	// above 1 let steps with a depends_on directive start before unrelated
+	// earlier steps finish.
+	ParallelRequests int
+	// DefaultAccept is sent as the Accept header when a request does not set
+	// one through a directive or pre hook. Empty disables the default.
+	DefaultAccept string
+	// Vars seeds globals before the program's own lets run; a let with the
+	// same name is skipped so these values win.
+	Vars map[string]any
+	// OnFlowDone, when set, is called after each flow finishes.
+	OnFlowDone func(FlowResult)
+	// TransportRetries is how many times a request is resent after a
+	// transport error, waiting TransportRetryDelay between attempts.
+	// Assertion failures and HTTP error statuses are never retried.
+	TransportRetries    int
+	TransportRetryDelay time.Duration
+	// JitterMin and JitterMax bound a random sleep before every request.
+	// JitterSeed makes the delays reproducible; 0 picks a random seed.
+	JitterMin  time.Duration
+	JitterMax  time.Duration
+	JitterSeed int64
+	// Explain replaces the hint of failed == assertions between objects or
+	// arrays with a structural diff of the two values.
+	Explain bool
+	// MaxAssertions caps the assertion lines printed per request (or per
+	// flow for flow-level asserts); the rest are summarized as "... (+K
+	// more)". Results are unaffected. 0 prints every line.
+	MaxAssertions int
+	// RunID identifies the run and is exposed as the runId global. Execute
+	// generates one when empty, derived from JitterSeed when that is set.
+	RunID string
+	// CorrelationHeader, when set, sends RunID in this header on every
+	// request that does not set the header itself.
+	CorrelationHeader string
+	// TimeoutsAsFailures reports transport errors caused by a timeout as
+	// E_RUNTIME_TIMEOUT, which reports count as failures, not errors.
+	TimeoutsAsFailures bool
+	// StepPause, when set, is called after each request of a flow completes
+	// with the flow's steps so far and the step that just finished.
+	// Returning false stops the run: the rest of the flow, its asserts and
+	// later flows are skipped. It is not called when ParallelRequests > 1.
+	StepPause func(FlowResult, StepResult) bool
+	// SharedVars carries each flow's variables into the flows after it, in
+	// name order, instead of starting every flow from the globals. Compile
+	// with compiler.Options.SharedVars so later flows may use them.
+	SharedVars bool
+	// CaptureBodies records failing steps' raw responses in Result.Bodies.
+	CaptureBodies bool
+	// SkipRequestAsserts and SkipFlowAsserts leave the ? assertions of
+	// requests, or of flows and their assert_eventually blocks, unevaluated.
+	// Skipped assertions are logged and counted as skipped.
+	SkipRequestAsserts bool
+	SkipFlowAsserts    bool
+
+	jitter func() time.Duration
+	specs  *specCache
 }
 
 type Result struct {
 	Flows []FlowResult
 	Diags []diagnostics.Diagnostic
+	// Bodies holds the raw response of each flow step that failed after
+	// its response arrived. It is only filled with Options.CaptureBodies.
+	Bodies []CapturedBody
+	// Assertions tallies every request and flow assertion evaluated.
+	Assertions AssertionCounts
+	// Skipped lists the assertions left unevaluated by SkipRequestAsserts
+	// or SkipFlowAsserts.
+	Skipped []SkippedAssertion
+	// Stopped is set when StepPause ended the run early; NotRun lists the
+	// steps it never reached.
+	Stopped bool
+	NotRun  []NotRunStep
+}
+
+type SkippedAssertion struct {
+	Flow string
+	// Request is the step the assertion checked; it is empty for flow
+	// assertions after the chain.
+	Request string
+	// FlowLevel is true for flow and assert_eventually assertions.
+	FlowLevel bool
+}
+
+// NotRunStep is a chain step, or with Eventually an assert_eventually
+// block, of Flow that a stopped run never reached. Index counts from 0
+// within the chain or the blocks.
+type NotRunStep struct {
+	Flow       string
+	Index      int
+	Eventually bool
+}
+
+type AssertionCounts struct {
+	Passed  int
+	Failed  int
+	Skipped int
+}
+
+type CapturedBody struct {
+	Flow    string
+	Request string
+	Body    []byte
 }
 
 type FlowResult struct {
 	Name  string
 	Steps []StepResult
+	// Failed is true when the flow produced any diagnostic.
+	Failed bool
+	// Calls counts how many times each request was executed in the flow.
+	// Shared requests reused from an earlier flow are not counted.
+	Calls map[string]int
 }
 
 type StepResult struct {
@@ -52,10 +170,15 @@ type StepResult struct {
 }
 
 type flowBinding struct {
-	Res    any
-	Req    map[string]any
-	Status int
-	Header map[string]any
+	Res         any
+	Req         map[string]any
+	Status      int
+	Header      map[string]any
+	Redirects   int
+	ContentType string
+	Proto       string
+	Body        string
+	ElapsedMs   float64
 }
 
 type invalidJSONResponse struct {
@@ -135,20 +258,55 @@ func normalizeExprValue(v any) any {
 	}
 }
 
+type secretError struct {
+	path  string
+	cause error
+}
+
+func (e secretError) Error() string {
+	return fmt.Sprintf("failed to resolve secret %q: %v", e.path, e.cause)
+}
+
+func (e secretError) Unwrap() error {
+	return e.cause
+}
+
+func envSecretResolver(path string) (string, error) {
+	name := "SECRET_" + strings.ToUpper(secretEnvNameRE.ReplaceAllString(path, "_"))
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	}
+	return v, nil
+}
+
 func expressionDiag(codeFallback, message, file string, span ast.Span, err error, flowName, request string) diagnostics.Diagnostic {
 	if errors.As(err, new(jsonAccessError)) {
 		return runtimeDiag("E_RUNTIME_JSON_UNAVAILABLE", message, file, span, err.Error(), flowName, request)
 	}
+	if errors.As(err, new(secretError)) {
+		return runtimeDiag("E_RUNTIME_SECRET", message, file, span, err.Error(), flowName, request)
+	}
 	return runtimeDiag(codeFallback, message, file, span, err.Error(), flowName, request)
 }
 
 type requestContext struct {
-	reqObj    map[string]any
-	flowVars  map[string]any
-	resJSON   any
-	status    int
-	headers   map[string]any
-	flowViews map[string]flowBinding
+	reqObj      map[string]any
+	flowVars    map[string]any
+	resJSON     any
+	status      int
+	headers     map[string]any
+	redirects   int
+	contentType string
+	proto       string
+	body        string // raw response body, whether or not it is JSON
+	elapsedMs   float64
+	flowViews   map[string]flowBinding
+	calls       map[string]int // request executions; only set for flow assertions
+	secrets     func(string) (string, error)
+	specs       *specCache
+	explain     bool
+	dir         string // directory relative file paths resolve from
 }
 
 func Execute(ctx context.Context, plan *compiler.Plan, opt Options) Result {
@@ -156,7 +314,11 @@ func Execute(ctx context.Context, plan *compiler.Plan, opt Options) Result {
 	if plan == nil {
 		return res
 	}
-	assertionLog := newAssertionLogger(opt)
+	flowNames := make([]string, 0, len(plan.Flows))
+	for _, flow := range plan.Flows {
+		flowNames = append(flowNames, flow.Name)
+	}
+	assertionLog := newAssertionLogger(opt, flowNames)
 	client := opt.Client
 	if client == nil {
 		client = &http.Client{}
@@ -164,32 +326,44 @@ func Execute(ctx context.Context, plan *compiler.Plan, opt Options) Result {
 	if d := resolveTimeout(plan, opt); d > 0 {
 		client.Timeout = d
 	}
+	if opt.SecretResolver == nil {
+		opt.SecretResolver = envSecretResolver
+	}
+	opt.jitter = newJitter(opt)
+	opt.specs = newSpecCache()
+	if opt.RunID == "" {
+		opt.RunID = newRunID(opt.JitterSeed)
+	}
 	requests := map[string]compiler.PlanRequest{}
 	for _, req := range plan.Requests {
 		requests[req.Name] = req
 	}
-	globals := map[string]any{}
-	for _, g := range plan.Globals {
-		val, err := evalExpr(g.Value, requestContext{flowVars: globals})
-		if err != nil {
-			res.Diags = append(res.Diags, expressionDiag("E_RUNTIME_EXPRESSION", fmt.Sprintf("failed to evaluate global let %s", g.Name), plan.EntryPath, g.Span, err, "", ""))
-			continue
-		}
-		globals[g.Name] = val
-	}
+	globals, globalDiags := evalGlobals(plan, opt)
+	res.Diags = append(res.Diags, globalDiags...)
+	shared := newSharedStore()
+	stopped := false
 
-	for _, flow := range plan.Flows {
+	for fi, flow := range plan.Flows {
 		verbosef(opt, "flow %q: start", flow.Name)
-		fr := FlowResult{Name: flow.Name}
+		fr := FlowResult{Name: flow.Name, Calls: map[string]int{}}
+		var callsMu sync.Mutex
+		countCall := func(name string) {
+			callsMu.Lock()
+			fr.Calls[name]++
+			callsMu.Unlock()
+		}
+		diagsBefore := len(res.Diags)
 		flowVars := copyMap(globals)
 		prelude := []*ast.LetStmt{}
 		asserts := []*ast.AssertStmt{}
+		var eventually []*ast.EventuallyBlock
 		if flow.Decl != nil {
 			prelude = flow.Decl.Prelude
 			asserts = flow.Decl.Asserts
+			eventually = flow.Decl.Eventually
 		}
 		for _, pre := range prelude {
-			val, err := evalExpr(pre.Value, requestContext{flowVars: flowVars})
+			val, err := evalExpr(pre.Value, requestContext{flowVars: flowVars, secrets: opt.SecretResolver, specs: opt.specs, dir: filepath.Dir(plan.EntryPath)})
 			if err != nil {
 				res.Diags = append(res.Diags, expressionDiag("E_RUNTIME_EXPRESSION", "failed to evaluate flow prelude let", plan.EntryPath, pre.Span, err, flow.Name, ""))
 				continue
@@ -197,24 +371,152 @@ func Execute(ctx context.Context, plan *compiler.Plan, opt Options) Result {
 			flowVars[pre.Name] = val
 		}
 		flowViews := map[string]flowBinding{}
-		for _, step := range flow.Steps {
+		runStep := func(step compiler.PlanStep, vars map[string]any, views map[string]flowBinding) (*stepExecutionResult, *diagnostics.Diagnostic) {
 			verbosef(opt, "flow %q: request %q (binding=%q) start", flow.Name, step.Request, step.Binding)
 			pr, ok := requests[step.Request]
 			if !ok {
-				res.Diags = append(res.Diags, runtimeDiag("E_RUNTIME_UNKNOWN_REQUEST", "request not found in runtime plan", plan.EntryPath, flow.Span, step.Request, flow.Name, step.Request))
+				return nil, ptr(runtimeDiag("E_RUNTIME_UNKNOWN_REQUEST", "request not found in runtime plan", plan.EntryPath, flow.Span, step.Request, flow.Name, step.Request))
+			}
+			var stepResult *stepExecutionResult
+			var diag *diagnostics.Diagnostic
+			if pr.Shared {
+				var reused bool
+				stepResult, reused, diag = shared.do(pr.Name, func() (*stepExecutionResult, *diagnostics.Diagnostic) {
+					countCall(pr.Name)
+					return executeRequest(ctx, plan, pr, step, flow.Name, vars, views, client, opt, assertionLog)
+				})
+				if reused {
+					verbosef(opt, "flow %q: request %q reused shared result", flow.Name, step.Request)
+					for k, v := range stepResult.lets {
+						vars[k] = v
+					}
+				}
+			} else {
+				countCall(pr.Name)
+				stepResult, diag = executeRequest(ctx, plan, pr, step, flow.Name, vars, views, client, opt, assertionLog)
+			}
+			if diag == nil {
+				verbosef(opt, "flow %q: request %q done (status=%d)", flow.Name, step.Binding, stepResult.status)
+			}
+			return stepResult, diag
+		}
+		var outcomes []stepOutcome
+		if opt.ParallelRequests > 1 {
+			outcomes = runStepsConcurrently(flow.Steps, stepDependencies(flow.Steps, requests), opt.ParallelRequests, flowVars, flowViews, runStep)
+		} else {
+			var done []StepResult
+			for i, step := range flow.Steps {
+				stepResult, diag := runStep(step, flowVars, flowViews)
+				if diag == nil {
+					flowViews[step.Binding] = stepResult.binding()
+				}
+				outcomes = append(outcomes, stepOutcome{result: stepResult, diag: diag})
+				if diag == nil && opt.StepPause != nil {
+					sr := StepResult{Request: step.Request, Binding: step.Binding, Status: stepResult.status}
+					done = append(done, sr)
+					if !opt.StepPause(FlowResult{Name: flow.Name, Steps: done, Calls: fr.Calls}, sr) {
+						stopped = true
+						res.NotRun = append(res.NotRun, notRunSteps(flow, i+1, 0)...)
+						break
+					}
+				}
+			}
+		}
+		for i, out := range outcomes {
+			step := flow.Steps[i]
+			if out.diag != nil {
+				res.Diags = append(res.Diags, *out.diag)
+				if opt.CaptureBodies && out.result != nil {
+					res.Bodies = append(res.Bodies, CapturedBody{Flow: flow.Name, Request: stepDisplayName(step), Body: out.result.body})
+				}
+				continue
+			}
+			fr.Steps = append(fr.Steps, StepResult{Request: step.Request, Binding: step.Binding, Status: out.result.status})
+		}
+		if stopped {
+			fr.Failed = len(res.Diags) > diagsBefore
+			res.Flows = append(res.Flows, fr)
+			verbosef(opt, "flow %q: stopped", flow.Name)
+			res.Stopped = true
+			for _, later := range plan.Flows[fi+1:] {
+				res.NotRun = append(res.NotRun, notRunSteps(later, 0, 0)...)
+			}
+			break
+		}
+		flowCtx := requestContext{flowVars: flowVars, flowViews: flowViews, secrets: opt.SecretResolver, specs: opt.specs, calls: fr.Calls, explain: opt.Explain, dir: filepath.Dir(plan.EntryPath)}
+		for bi, block := range eventually {
+			step := compiler.PlanStep{Request: block.Step.ReqName, Binding: block.Step.ReqName}
+			if block.Step.Alias != nil {
+				step.Binding = *block.Step.Alias
+			}
+			pr, ok := requests[step.Request]
+			if !ok {
+				res.Diags = append(res.Diags, runtimeDiag("E_RUNTIME_UNKNOWN_REQUEST", "request not found in runtime plan", plan.EntryPath, block.Step.Span, step.Request, flow.Name, step.Request))
 				continue
 			}
-			stepResult, diag := executeRequest(ctx, plan, pr, step, flow.Name, flowVars, flowViews, client, opt, assertionLog)
+			var last *stepExecutionResult
+			diag := pollEventually(ctx, plan, flow.Name, step, block, func() (string, bool) {
+				countCall(pr.Name)
+				stepResult, diag := executeRequest(ctx, plan, pr, step, flow.Name, flowVars, flowViews, client, opt, nil)
+				if diag != nil {
+					return diag.Message, false
+				}
+				last = stepResult
+				flowViews[step.Binding] = stepResult.binding()
+				if opt.SkipFlowAsserts {
+					return "", true
+				}
+				for _, as := range block.Asserts {
+					v, err := evalExpr(as.Expr, flowCtx)
+					if err != nil {
+						return err.Error(), false
+					}
+					if ok, cast := asBool(v); cast != nil {
+						return cast.Error(), false
+					} else if !ok {
+						if h := comparisonHint(as.Expr, flowCtx); h != "" {
+							return h, false
+						}
+						return "assertion must evaluate to true", false
+					}
+				}
+				return "", true
+			})
+			for _, as := range block.Asserts {
+				if opt.SkipFlowAsserts && diag == nil {
+					assertionLog.skip(flow.Name, stepDisplayName(step), as.Expr, true)
+					continue
+				}
+				assertionLog.log(flow.Name, stepDisplayName(step), as.Expr, diag == nil)
+			}
+			if last != nil {
+				fr.Steps = append(fr.Steps, StepResult{Request: step.Request, Binding: step.Binding, Status: last.status})
+			}
 			if diag != nil {
 				res.Diags = append(res.Diags, *diag)
-				continue
 			}
-			flowViews[step.Binding] = flowBinding{Res: stepResult.res, Req: stepResult.reqSnapshot, Status: stepResult.status, Header: stepResult.headers}
-			fr.Steps = append(fr.Steps, StepResult{Request: step.Request, Binding: step.Binding, Status: stepResult.status})
-			verbosef(opt, "flow %q: request %q done (status=%d)", flow.Name, step.Binding, stepResult.status)
+			if last != nil && opt.StepPause != nil && opt.ParallelRequests <= 1 && !opt.StepPause(fr, fr.Steps[len(fr.Steps)-1]) {
+				stopped = true
+				res.NotRun = append(res.NotRun, notRunSteps(flow, len(flow.Steps), bi+1)...)
+				break
+			}
+		}
+		if stopped {
+			fr.Failed = len(res.Diags) > diagsBefore
+			res.Flows = append(res.Flows, fr)
+			verbosef(opt, "flow %q: stopped", flow.Name)
+			res.Stopped = true
+			for _, later := range plan.Flows[fi+1:] {
+				res.NotRun = append(res.NotRun, notRunSteps(later, 0, 0)...)
+			}
+			break
 		}
 		for _, as := range asserts {
-			v, err := evalExpr(as.Expr, requestContext{flowVars: flowVars, flowViews: flowViews})
+			if opt.SkipFlowAsserts {
+				assertionLog.skip(flow.Name, "", as.Expr, true)
+				continue
+			}
+			v, err := evalExpr(as.Expr, flowCtx)
 			if err != nil {
 				assertionLog.log(flow.Name, "", as.Expr, false)
 				res.Diags = append(res.Diags, expressionDiag("E_RUNTIME_EXPRESSION", "failed to evaluate flow assertion", plan.EntryPath, as.Span, err, flow.Name, ""))
@@ -226,179 +528,1067 @@ func Execute(ctx context.Context, plan *compiler.Plan, opt Options) Result {
 				hint := "assertion must evaluate to true"
 				if cast != nil {
 					hint = cast.Error()
+				} else if h := comparisonHint(as.Expr, flowCtx); h != "" {
+					hint = h
 				}
 				res.Diags = append(res.Diags, runtimeDiag("E_ASSERT_EXPECTED_TRUE", "flow assertion failed", plan.EntryPath, as.Span, hint, flow.Name, ""))
 			}
 		}
+		if opt.SharedVars {
+			globals = flowVars
+		}
+		fr.Failed = len(res.Diags) > diagsBefore
 		res.Flows = append(res.Flows, fr)
+		assertionLog.flowDone(flow.Name)
 		verbosef(opt, "flow %q: done", flow.Name)
+		if opt.OnFlowDone != nil {
+			opt.OnFlowDone(fr)
+		}
 	}
+	assertionLog.flush()
+	res.Assertions = assertionLog.counts
+	res.Skipped = assertionLog.skipped
 
 	return res
 }
 
-type stepExecutionResult struct {
-	status      int
-	headers     map[string]any
-	res         any
-	reqSnapshot map[string]any
-}
-
-func executeRequest(ctx context.Context, plan *compiler.Plan, req compiler.PlanRequest, step compiler.PlanStep, flowName string, flowVars map[string]any, flowViews map[string]flowBinding, client *http.Client, opt Options, assertionLog *assertionLogger) (*stepExecutionResult, *diagnostics.Diagnostic) {
-	lines := resolveLines(req, plan)
-	requestID := stepDisplayName(step)
-	httpLine := req.HTTP
-	if httpLine == nil {
-		return nil, ptr(runtimeDiag("E_RUNTIME_REQUEST_SHAPE", "missing http line at runtime", plan.EntryPath, req.Decl.Span, "compiler should ensure requests contain one HTTP line", flowName, requestID))
+// notRunSteps lists the chain steps of flow from step on and its
+// assert_eventually blocks from block on.
+func notRunSteps(flow compiler.PlanFlow, step, block int) []NotRunStep {
+	var out []NotRunStep
+	for i := step; i < len(flow.Steps); i++ {
+		out = append(out, NotRunStep{Flow: flow.Name, Index: i})
 	}
-	base := ""
-	if plan.Base != nil {
-		base = *plan.Base
+	if flow.Decl != nil {
+		for i := block; i < len(flow.Decl.Eventually); i++ {
+			out = append(out, NotRunStep{Flow: flow.Name, Index: i, Eventually: true})
+		}
 	}
-	if opt.BaseOverride != nil {
-		base = *opt.BaseOverride
+	return out
+}
+
+// pollEventually calls attempt until it reports success, the block's timeout
+// elapses, or ctx is done, sleeping the block's interval between attempts.
+// attempt returns a hint describing why the latest attempt did not hold.
+func pollEventually(ctx context.Context, plan *compiler.Plan, flowName string, step compiler.PlanStep, block *ast.EventuallyBlock, attempt func() (string, bool)) *diagnostics.Diagnostic {
+	timeout, _ := time.ParseDuration(block.Timeout.Raw)
+	interval, _ := time.ParseDuration(block.Interval.Raw)
+	deadline := time.Now().Add(timeout)
+	for attempts := 1; ; attempts++ {
+		hint, ok := attempt()
+		if ok {
+			return nil
+		}
+		msg := fmt.Sprintf("assert_eventually did not hold within %s (%d attempts)", block.Timeout.Raw, attempts)
+		if time.Now().Add(interval).After(deadline) {
+			return ptr(runtimeDiag("E_ASSERT_EVENTUALLY_TIMEOUT", msg, plan.EntryPath, block.Span, hint, flowName, stepDisplayName(step)))
+		}
+		select {
+		case <-ctx.Done():
+			msg = fmt.Sprintf("assert_eventually canceled after %d attempts: %v", attempts, ctx.Err())
+			return ptr(runtimeDiag("E_ASSERT_EVENTUALLY_TIMEOUT", msg, plan.EntryPath, block.Span, hint, flowName, stepDisplayName(step)))
+		case <-time.After(interval):
+		}
 	}
-	pathWithTemplates, err := interpolateString(httpLine.Path, flowVars)
-	if err != nil {
-		return nil, ptr(runtimeDiag("E_RUNTIME_MISSING_VARIABLE", "failed to render request path", plan.EntryPath, httpLine.Span, err.Error(), flowName, requestID))
+}
+
+// newJitter returns a generator of delays in [JitterMin, JitterMax], or nil
+// when jitter is disabled. It is safe for concurrent steps.
+func newJitter(opt Options) func() time.Duration {
+	if opt.JitterMax <= 0 {
+		return nil
 	}
-	path, err := renderPath(pathWithTemplates, flowVars)
-	if err != nil {
-		return nil, ptr(runtimeDiag("E_RUNTIME_MISSING_PATH_PARAM", err.Error(), plan.EntryPath, httpLine.Span, "define the missing variable in global/flow/request scope", flowName, requestID))
+	seed := opt.JitterSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
 	}
-	urlStr := combineURL(base, path)
-	reqObj := map[string]any{
-		"method": httpMethodString(httpLine.Method),
-		"url":    urlStr,
-		"header": map[string]any{},
-		"query":  map[string]any{},
-		"json":   nil,
+	rng := mathrand.New(mathrand.NewSource(seed))
+	var mu sync.Mutex
+	return func() time.Duration {
+		mu.Lock()
+		defer mu.Unlock()
+		span := opt.JitterMax - opt.JitterMin
+		if span <= 0 {
+			return opt.JitterMin
+		}
+		return opt.JitterMin + time.Duration(rng.Int63n(int64(span)+1))
 	}
-	rctx := requestContext{reqObj: reqObj, flowVars: flowVars, flowViews: flowViews}
+}
 
-	for _, line := range lines {
-		h, ok := line.(*ast.HookBlock)
-		if !ok || h.Kind != ast.HookPre {
-			continue
-		}
-		if err := execHook(h, rctx); err != nil {
-			if isMissingTemplateVariableError(err) {
-				return nil, ptr(runtimeDiag("E_RUNTIME_MISSING_VARIABLE", "failed to render pre hook print statement", plan.EntryPath, h.Span, err.Error(), flowName, requestID))
-			}
-			return nil, ptr(runtimeDiag("E_RUNTIME_HOOK", "pre hook execution failed", plan.EntryPath, h.Span, err.Error(), flowName, requestID))
-		}
+func isTimeout(err error) bool {
+	return errors.Is(err, context.DeadlineExceeded) || os.IsTimeout(err)
+}
+
+// newRunID returns a random run id, or a reproducible one for a non-zero
+// seed.
+func newRunID(seed int64) string {
+	if seed == 0 {
+		return randomID()
 	}
-	for _, line := range lines {
-		switch l := line.(type) {
-		case *ast.HeaderDirective:
-			v, err := evalExpr(l.Value, rctx)
-			if err != nil {
-				return nil, ptr(runtimeDiag("E_RUNTIME_EXPRESSION", "failed to evaluate header directive", plan.EntryPath, l.Span, err.Error(), flowName, requestID))
-			}
-			v, err = interpolateValue(v, flowVars)
-			if err != nil {
-				return nil, ptr(runtimeDiag("E_RUNTIME_MISSING_VARIABLE", "failed to render header directive", plan.EntryPath, l.Span, err.Error(), flowName, requestID))
-			}
-			reqObj["header"].(map[string]any)[l.Key.Name] = fmt.Sprint(v)
-		case *ast.QueryDirective:
-			v, err := evalExpr(l.Value, rctx)
-			if err != nil {
-				return nil, ptr(runtimeDiag("E_RUNTIME_EXPRESSION", "failed to evaluate query directive", plan.EntryPath, l.Span, err.Error(), flowName, requestID))
-			}
-			v, err = interpolateValue(v, flowVars)
-			if err != nil {
-				return nil, ptr(runtimeDiag("E_RUNTIME_MISSING_VARIABLE", "failed to render query directive", plan.EntryPath, l.Span, err.Error(), flowName, requestID))
-			}
-			reqObj["query"].(map[string]any)[l.Key.Name] = fmt.Sprint(v)
-		case *ast.AuthDirective:
-			v, err := evalExpr(l.Value, rctx)
-			if err != nil {
-				return nil, ptr(runtimeDiag("E_RUNTIME_EXPRESSION", "failed to evaluate auth directive", plan.EntryPath, l.Span, err.Error(), flowName, requestID))
-			}
-			v, err = interpolateValue(v, flowVars)
-			if err != nil {
-				return nil, ptr(runtimeDiag("E_RUNTIME_MISSING_VARIABLE", "failed to render auth directive", plan.EntryPath, l.Span, err.Error(), flowName, requestID))
-			}
-			if l.Scheme == ast.AuthBearer {
-				reqObj["header"].(map[string]any)["Authorization"] = "Bearer " + fmt.Sprint(v)
+	b := make([]byte, 16)
+	_, _ = mathrand.New(mathrand.NewSource(seed)).Read(b)
+	return hex.EncodeToString(b)
+}
+
+func evalGlobals(plan *compiler.Plan, opt Options) (map[string]any, []diagnostics.Diagnostic) {
+	var diags []diagnostics.Diagnostic
+	globals := copyMap(opt.Vars)
+	if _, ok := globals["runId"]; !ok {
+		globals["runId"] = opt.RunID
+	}
+	for _, mod := range plan.Imports {
+		// Each imported file sees its own private lets; only exported
+		// ones are copied into the globals.
+		scope := copyMap(globals)
+		for _, g := range mod.Lets {
+			if _, ok := opt.Vars[g.Name]; ok && g.Exported {
+				continue
 			}
-		case *ast.JsonDirective:
-			v, err := evalExpr(l.Value, rctx)
+			val, err := evalExpr(g.Value, requestContext{flowVars: scope, secrets: opt.SecretResolver, specs: opt.specs, dir: filepath.Dir(mod.Path)})
 			if err != nil {
-				return nil, ptr(runtimeDiag("E_RUNTIME_EXPRESSION", "failed to evaluate json directive", plan.EntryPath, l.Span, err.Error(), flowName, requestID))
+				diags = append(diags, expressionDiag("E_RUNTIME_EXPRESSION", fmt.Sprintf("failed to evaluate global let %s", g.Name), mod.Path, g.Span, err, "", ""))
+				continue
 			}
-			v, err = interpolateValue(v, flowVars)
-			if err != nil {
-				return nil, ptr(runtimeDiag("E_RUNTIME_MISSING_VARIABLE", "failed to render json directive", plan.EntryPath, l.Span, err.Error(), flowName, requestID))
+			scope[g.Name] = val
+			if g.Exported {
+				globals[g.Name] = val
 			}
-			reqObj["json"] = v
 		}
 	}
-	finalURL := applyQuery(reqObj["url"].(string), reqObj["query"].(map[string]any))
-	reqObj["url"] = finalURL
-	body := io.Reader(nil)
-	if reqObj["json"] != nil {
-		raw, err := json.Marshal(reqObj["json"])
+	for _, g := range plan.Globals {
+		if _, ok := opt.Vars[g.Name]; ok {
+			continue
+		}
+		val, err := evalExpr(g.Value, requestContext{flowVars: globals, secrets: opt.SecretResolver, specs: opt.specs, dir: filepath.Dir(plan.EntryPath)})
 		if err != nil {
-			return nil, ptr(runtimeDiag("E_RUNTIME_EXPRESSION", "failed to serialize json body", plan.EntryPath, req.Decl.Span, err.Error(), flowName, requestID))
+			diags = append(diags, expressionDiag("E_RUNTIME_EXPRESSION", fmt.Sprintf("failed to evaluate global let %s", g.Name), plan.EntryPath, g.Span, err, "", ""))
+			continue
 		}
-		body = bytes.NewReader(raw)
-		reqObj["header"].(map[string]any)["Content-Type"] = "application/json"
+		globals[g.Name] = val
+	}
+	return globals, diags
+}
+
+// Preflight sends a HEAD request to the program's base URL and reports
+// E_RUNTIME_PREFLIGHT when it cannot be reached. Any HTTP response counts as
+// reachable. It does nothing when no base is set or the base depends on flow
+// variables.
+func Preflight(ctx context.Context, plan *compiler.Plan, opt Options) *diagnostics.Diagnostic {
+	if plan == nil {
+		return nil
+	}
+	base := ""
+	if plan.Base != nil {
+		base = *plan.Base
+	}
+	if opt.BaseOverride != nil {
+		base = *opt.BaseOverride
+	}
+	if base == "" {
+		return nil
 	}
-	httpReq, err := http.NewRequestWithContext(ctx, reqObj["method"].(string), reqObj["url"].(string), body)
+	if opt.SecretResolver == nil {
+		opt.SecretResolver = envSecretResolver
+	}
+	globals, _ := evalGlobals(plan, opt)
+	base, err := interpolateString(base, globals)
 	if err != nil {
-		return nil, ptr(runtimeDiag("E_RUNTIME_TRANSPORT", "failed to build request", plan.EntryPath, req.Decl.Span, err.Error(), flowName, requestID))
+		return nil
+	}
+	client := opt.Client
+	if client == nil {
+		client = &http.Client{}
 	}
-	for k, v := range reqObj["header"].(map[string]any) {
-		httpReq.Header.Set(k, fmt.Sprint(v))
+	if d := resolveTimeout(plan, opt); d > 0 {
+		client.Timeout = d
 	}
-	httpRes, err := client.Do(httpReq)
+	span := ast.Span{Start: ast.Position{Line: 1, Column: 1}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, base, nil)
 	if err != nil {
-		return nil, ptr(runtimeDiag("E_RUNTIME_TRANSPORT", "http request failed", plan.EntryPath, req.Decl.Span, err.Error(), flowName, requestID))
+		return ptr(runtimeDiag("E_RUNTIME_PREFLIGHT", fmt.Sprintf("invalid base URL %s", base), plan.EntryPath, span, err.Error(), "", ""))
 	}
-	defer func() { _ = httpRes.Body.Close() }()
-	respRaw, err := io.ReadAll(httpRes.Body)
+	res, err := client.Do(req)
 	if err != nil {
-		return nil, ptr(runtimeDiag("E_RUNTIME_TRANSPORT", "failed to read response", plan.EntryPath, req.Decl.Span, err.Error(), flowName, requestID))
+		return ptr(runtimeDiag("E_RUNTIME_PREFLIGHT", fmt.Sprintf("base URL %s is unreachable", base), plan.EntryPath, span, err.Error(), "", ""))
 	}
-	var resJSON any
-	if len(bytes.TrimSpace(respRaw)) > 0 {
-		if err := json.Unmarshal(respRaw, &resJSON); err != nil {
-			resJSON = invalidJSONResponse{raw: string(respRaw), err: err}
-		}
+	_ = res.Body.Close()
+	return nil
+}
+
+// TargetHealth is the reachability of one origin a program sends requests to.
+type TargetHealth struct {
+	Target    string `json:"target"`
+	Reachable bool   `json:"reachable"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Targets returns the distinct origins (scheme://host) referenced by the
+// program's base, base_for services, and absolute request URLs, rendered with
+// global variables. URLs that depend on flow variables are skipped.
+func Targets(plan *compiler.Plan, opt Options) []string {
+	if opt.SecretResolver == nil {
+		opt.SecretResolver = envSecretResolver
+	}
+	globals, _ := evalGlobals(plan, opt)
+	base := ""
+	if plan.Base != nil {
+		base = *plan.Base
 	}
-	headers := map[string]any{}
-	for k, vals := range httpRes.Header {
-		if len(vals) == 1 {
-			headers[k] = vals[0]
-		} else {
-			arr := make([]any, 0, len(vals))
-			for _, v := range vals {
-				arr = append(arr, v)
-			}
-			headers[k] = arr
+	if opt.BaseOverride != nil {
+		base = *opt.BaseOverride
+	}
+	urls := []string{base}
+	for _, svc := range plan.Services {
+		urls = append(urls, svc)
+	}
+	for _, req := range plan.Requests {
+		if req.HTTP == nil {
+			continue
 		}
+		reqBase, path := serviceBase(plan, base, req.HTTP.Path)
+		urls = append(urls, combineURL(reqBase, path))
 	}
-	rctx.resJSON = resJSON
-	rctx.status = httpRes.StatusCode
-	rctx.headers = headers
-
-	for _, line := range lines {
-		h, ok := line.(*ast.HookBlock)
-		if !ok || h.Kind != ast.HookPost {
+	seen := map[string]struct{}{}
+	var out []string
+	for _, raw := range urls {
+		rendered, err := interpolateString(raw, globals)
+		if err != nil {
 			continue
 		}
-		if err := execHook(h, rctx); err != nil {
-			if isMissingTemplateVariableError(err) {
-				return nil, ptr(runtimeDiag("E_RUNTIME_MISSING_VARIABLE", "failed to render post hook print statement", plan.EntryPath, h.Span, err.Error(), flowName, requestID))
-			}
-			return nil, ptr(runtimeDiag("E_RUNTIME_HOOK", "post hook execution failed", plan.EntryPath, h.Span, err.Error(), flowName, requestID))
+		u, err := url.Parse(rendered)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			continue
+		}
+		origin := u.Scheme + "://" + u.Host
+		if _, ok := seen[origin]; ok {
+			continue
 		}
+		seen[origin] = struct{}{}
+		out = append(out, origin)
 	}
-	for _, line := range lines {
-		switch l := line.(type) {
-		case *ast.AssertStmt:
-			v, err := evalExpr(l.Expr, rctx)
+	slices.Sort(out)
+	return out
+}
+
+// CheckHealth sends a HEAD request to every target concurrently. Any HTTP
+// response counts as reachable. timeout bounds each check.
+func CheckHealth(ctx context.Context, targets []string, client *http.Client, timeout time.Duration) []TargetHealth {
+	if client == nil {
+		client = &http.Client{}
+	}
+	out := make([]TargetHealth, len(targets))
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			out[i] = TargetHealth{Target: target, Reachable: true}
+			checkCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			req, err := http.NewRequestWithContext(checkCtx, http.MethodHead, target, nil)
+			if err == nil {
+				var res *http.Response
+				if res, err = client.Do(req); err == nil {
+					_ = res.Body.Close()
+				}
+			}
+			if err != nil {
+				out[i].Reachable = false
+				out[i].Error = err.Error()
+			}
+		}()
+	}
+	wg.Wait()
+	return out
+}
+
+// recordedResponse is one response saved by a recording transport.
+type recordedResponse struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Status int         `json:"status"`
+	Proto  string      `json:"proto"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+}
+
+// recordingFile names the file holding the response to method and url.
+// Request bodies are not part of the key.
+func recordingFile(dir, method, url string) string {
+	sum := sha256.Sum256([]byte(method + " " + url))
+	return filepath.Join(dir, hex.EncodeToString(sum[:16])+".json")
+}
+
+type recordingTransport struct {
+	dir  string
+	next http.RoundTripper
+	mu   sync.Mutex
+}
+
+// NewRecordingTransport returns a transport that sends requests through
+// next (http.DefaultTransport when nil) and saves every response under dir,
+// keyed by method and URL. A request sent again, such as a retry,
+// overwrites the earlier response, so dir keeps the final one.
+func NewRecordingTransport(dir string, next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &recordingTransport{dir: dir, next: next}
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(res.Body)
+	_ = res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	res.Body = io.NopCloser(bytes.NewReader(body))
+	data, err := json.MarshalIndent(recordedResponse{Method: req.Method, URL: req.URL.String(), Status: res.StatusCode, Proto: res.Proto, Header: res.Header, Body: body}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := os.MkdirAll(t.dir, 0o755); err != nil {
+		return nil, fmt.Errorf("record response: %w", err)
+	}
+	if err := os.WriteFile(recordingFile(t.dir, req.Method, req.URL.String()), data, 0o644); err != nil {
+		return nil, fmt.Errorf("record response: %w", err)
+	}
+	return res, nil
+}
+
+type replayTransport struct {
+	dir string
+}
+
+// NewReplayTransport returns a transport that answers requests from the
+// responses a recording transport saved in dir without using the network.
+// A request with no recording fails like a transport error.
+func NewReplayTransport(dir string) http.RoundTripper {
+	return &replayTransport{dir: dir}
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		_ = req.Body.Close()
+	}
+	data, err := os.ReadFile(recordingFile(t.dir, req.Method, req.URL.String()))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("no recording for %s %s in %s", req.Method, req.URL, t.dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rec recordedResponse
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, fmt.Errorf("invalid recording for %s %s: %w", req.Method, req.URL, err)
+	}
+	res := &http.Response{
+		Status:        fmt.Sprintf("%d %s", rec.Status, http.StatusText(rec.Status)),
+		StatusCode:    rec.Status,
+		Proto:         rec.Proto,
+		Header:        rec.Header,
+		Body:          io.NopCloser(bytes.NewReader(rec.Body)),
+		ContentLength: int64(len(rec.Body)),
+		Request:       req,
+	}
+	if res.Header == nil {
+		res.Header = http.Header{}
+	}
+	res.ProtoMajor, res.ProtoMinor, _ = http.ParseHTTPVersion(rec.Proto)
+	return res, nil
+}
+
+type stepOutcome struct {
+	result *stepExecutionResult
+	diag   *diagnostics.Diagnostic
+}
+
+func (r *stepExecutionResult) binding() flowBinding {
+	return flowBinding{Res: r.res, Req: r.reqSnapshot, Status: r.status, Header: r.headers, Redirects: r.redirects, ContentType: r.contentType, Proto: r.proto, Body: string(r.body), ElapsedMs: r.elapsedMs}
+}
+
+// stepDependencies returns, for every step, the indexes of earlier steps it
+// must wait for. Steps whose request has no depends_on directive wait for all
+// earlier steps, which keeps flows sequential unless they opt in.
+func stepDependencies(steps []compiler.PlanStep, requests map[string]compiler.PlanRequest) [][]int {
+	deps := make([][]int, len(steps))
+	for i, step := range steps {
+		pr, ok := requests[step.Request]
+		for j := 0; j < i; j++ {
+			if !ok || pr.DependsOn == nil || slices.Contains(pr.DependsOn.Requests, steps[j].Request) {
+				deps[i] = append(deps[i], j)
+			}
+		}
+	}
+	return deps
+}
+
+// runStepsConcurrently runs flow steps as soon as their dependencies finish,
+// at most limit at a time. Each step sees a snapshot of the flow state taken
+// when it starts; its variable changes and binding are merged back when it
+// succeeds. Outcomes are returned in step order.
+func runStepsConcurrently(steps []compiler.PlanStep, deps [][]int, limit int, flowVars map[string]any, flowViews map[string]flowBinding, run func(compiler.PlanStep, map[string]any, map[string]flowBinding) (*stepExecutionResult, *diagnostics.Diagnostic)) []stepOutcome {
+	outcomes := make([]stepOutcome, len(steps))
+	done := make([]chan struct{}, len(steps))
+	for i := range done {
+		done[i] = make(chan struct{})
+	}
+	sem := make(chan struct{}, limit)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i, step := range steps {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(done[i])
+			for _, j := range deps[i] {
+				<-done[j]
+			}
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			mu.Lock()
+			vars := copyMap(flowVars)
+			views := copyMap(flowViews)
+			mu.Unlock()
+
+			result, diag := run(step, vars, views)
+			outcomes[i] = stepOutcome{result: result, diag: diag}
+			if diag != nil {
+				return
+			}
+			mu.Lock()
+			for k, v := range result.lets {
+				flowVars[k] = v
+			}
+			flowViews[step.Binding] = result.binding()
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return outcomes
+}
+
+// templatePlaceholder stands in for a variable whose value is only known at
+// runtime while Validate dry-runs rendering.
+type templatePlaceholder string
+
+func (p templatePlaceholder) String() string {
+	return "<" + string(p) + ">"
+}
+
+// Validate dry-runs path and template rendering for every flow step without
+// sending requests. Variables are bound to placeholders in the order flows
+// define them, so only references to names that are never defined in scope
+// are reported.
+func Validate(plan *compiler.Plan) []diagnostics.Diagnostic {
+	var diags []diagnostics.Diagnostic
+	if plan == nil {
+		return diags
+	}
+	requests := map[string]compiler.PlanRequest{}
+	for _, req := range plan.Requests {
+		requests[req.Name] = req
+	}
+	for _, flow := range plan.Flows {
+		vars := map[string]any{}
+		vars["runId"] = templatePlaceholder("runId")
+		for _, name := range plan.Vars {
+			vars[name] = templatePlaceholder(name)
+		}
+		for _, mod := range plan.Imports {
+			for _, g := range mod.Lets {
+				if g.Exported {
+					vars[g.Name] = templatePlaceholder(g.Name)
+				}
+			}
+		}
+		for _, g := range plan.Globals {
+			vars[g.Name] = templatePlaceholder(g.Name)
+		}
+		if flow.Decl != nil {
+			for _, pre := range flow.Decl.Prelude {
+				vars[pre.Name] = templatePlaceholder(pre.Name)
+			}
+		}
+		for _, step := range flow.Steps {
+			pr, ok := requests[step.Request]
+			if !ok {
+				continue
+			}
+			diags = append(diags, validateRequest(plan, pr, step, flow.Name, vars)...)
+		}
+	}
+	return diags
+}
+
+func validateRequest(plan *compiler.Plan, req compiler.PlanRequest, step compiler.PlanStep, flowName string, vars map[string]any) []diagnostics.Diagnostic {
+	var diags []diagnostics.Diagnostic
+	requestID := stepDisplayName(step)
+	lines := resolveLines(req, plan)
+	if req.HTTP != nil {
+		base := ""
+		if plan.Base != nil {
+			base = *plan.Base
+		}
+		base, rawPath := serviceBase(plan, base, req.HTTP.Path)
+		if _, err := interpolateString(base, vars); err != nil {
+			diags = append(diags, runtimeDiag("E_RUNTIME_MISSING_VARIABLE", "failed to render base URL", plan.EntryPath, req.HTTP.Span, err.Error(), flowName, requestID))
+		}
+		path, err := interpolateString(rawPath, vars)
+		if err != nil {
+			diags = append(diags, runtimeDiag("E_RUNTIME_MISSING_VARIABLE", "failed to render request path", plan.EntryPath, req.HTTP.Span, err.Error(), flowName, requestID))
+		} else if _, err := renderPath(path, vars); err != nil {
+			diags = append(diags, runtimeDiag("E_RUNTIME_MISSING_PATH_PARAM", err.Error(), plan.EntryPath, req.HTTP.Span, "define the missing variable in global/flow/request scope", flowName, requestID))
+		}
+	}
+	checkStrings := func(expr ast.Expr, scope map[string]any, message string, span ast.Span) {
+		for _, lit := range collectStringLits(expr) {
+			if _, err := interpolateString(lit, scope); err != nil {
+				diags = append(diags, runtimeDiag("E_RUNTIME_MISSING_VARIABLE", message, plan.EntryPath, span, err.Error(), flowName, requestID))
+				return
+			}
+		}
+	}
+	checkHook := func(h *ast.HookBlock) {
+		scope := copyMap(vars)
+		scope["req"] = templatePlaceholder("req")
+		label := "pre"
+		if h.Kind == ast.HookPost {
+			scope["res"] = templatePlaceholder("res")
+			scope["status"] = templatePlaceholder("status")
+			label = "post"
+		}
+		for _, stmt := range h.Stmts {
+			switch hs := stmt.(type) {
+			case *ast.PrintStmt:
+				for _, arg := range hs.Args {
+					checkStrings(arg, scope, fmt.Sprintf("failed to render %s hook print statement", label), h.Span)
+				}
+			case *ast.AssignStmt:
+				if hs.Target != nil && hs.Target.Root.Kind == ast.LValueIdent {
+					vars[hs.Target.Root.Name] = templatePlaceholder(hs.Target.Root.Name)
+					scope[hs.Target.Root.Name] = vars[hs.Target.Root.Name]
+				}
+			}
+		}
+	}
+	for _, line := range lines {
+		switch l := line.(type) {
+		case *ast.HeaderDirective:
+			checkStrings(l.Value, vars, "failed to render header directive", l.Span)
+		case *ast.QueryDirective:
+			checkStrings(l.Value, vars, "failed to render query directive", l.Span)
+		case *ast.AuthDirective:
+			checkStrings(l.Value, vars, "failed to render auth directive", l.Span)
+			if l.Password != nil {
+				checkStrings(l.Password, vars, "failed to render auth directive", l.Span)
+			}
+		case *ast.JsonDirective:
+			checkStrings(l.Value, vars, "failed to render json directive", l.Span)
+		case *ast.XmlDirective:
+			checkStrings(l.Value, vars, "failed to render xml directive", l.Span)
+		case *ast.MethodDirective:
+			checkStrings(l.Value, vars, "failed to render method directive", l.Span)
+		case *ast.TextDirective:
+			checkStrings(l.Value, vars, "failed to render text directive", l.Span)
+		case *ast.FormDirective:
+			checkStrings(l.Value, vars, "failed to render form directive", l.Span)
+		case *ast.MultipartDirective:
+			for _, part := range l.Parts {
+				checkStrings(part.Value, vars, "failed to render multipart directive", l.Span)
+			}
+		}
+	}
+	for _, kind := range []ast.HookKind{ast.HookPre, ast.HookPost} {
+		for _, line := range lines {
+			if h, ok := line.(*ast.HookBlock); ok && h.Kind == kind {
+				checkHook(h)
+			}
+		}
+	}
+	for _, line := range lines {
+		if l, ok := line.(*ast.LetStmt); ok {
+			vars[l.Name] = templatePlaceholder(l.Name)
+		}
+	}
+	return diags
+}
+
+func collectStringLits(expr ast.Expr) []string {
+	var out []string
+	var walk func(ast.Expr)
+	walk = func(e ast.Expr) {
+		switch n := e.(type) {
+		case *ast.StringLit:
+			out = append(out, n.Value)
+		case *ast.UnaryExpr:
+			walk(n.X)
+		case *ast.BinaryExpr:
+			walk(n.Left)
+			walk(n.Right)
+		case *ast.CallExpr:
+			for _, a := range n.Args {
+				walk(a)
+			}
+		case *ast.FieldExpr:
+			walk(n.X)
+		case *ast.IndexExpr:
+			walk(n.X)
+			walk(n.Index)
+		case *ast.ParenExpr:
+			walk(n.X)
+		case *ast.ArrayLit:
+			for _, el := range n.Elements {
+				walk(el)
+			}
+		case *ast.ObjectLit:
+			for _, p := range n.Pairs {
+				walk(p.Value)
+			}
+		}
+	}
+	walk(expr)
+	return out
+}
+
+type stepExecutionResult struct {
+	status      int
+	headers     map[string]any
+	res         any
+	redirects   int
+	contentType string
+	proto       string
+	body        []byte
+	elapsedMs   float64
+	reqSnapshot map[string]any
+	lets        map[string]any // flow variables the request set or changed
+}
+
+// sharedStore caches results of shared requests by request name so the
+// first flow to run one serves every later reference.
+type sharedStore struct {
+	mu      sync.Mutex
+	entries map[string]*sharedEntry
+}
+
+type sharedEntry struct {
+	mu     sync.Mutex
+	result *stepExecutionResult
+}
+
+func newSharedStore() *sharedStore {
+	return &sharedStore{entries: map[string]*sharedEntry{}}
+}
+
+func (s *sharedStore) entry(name string) *sharedEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[name]
+	if !ok {
+		e = &sharedEntry{}
+		s.entries[name] = e
+	}
+	return e
+}
+
+// do returns the cached result for name, or runs exec and caches it when it
+// succeeds. Concurrent callers for the same name wait for the first one.
+func (s *sharedStore) do(name string, exec func() (*stepExecutionResult, *diagnostics.Diagnostic)) (*stepExecutionResult, bool, *diagnostics.Diagnostic) {
+	e := s.entry(name)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.result != nil {
+		return e.result, true, nil
+	}
+	result, diag := exec()
+	if diag != nil {
+		return result, false, diag
+	}
+	e.result = result
+	return result, false, nil
+}
+
+// executeRequest runs a request once, or, with a retry directive, re-issues
+// it while an assertion fails. Only the last attempt's assertions are logged
+// and reported, and flow variables are reset before each retry.
+func executeRequest(ctx context.Context, plan *compiler.Plan, req compiler.PlanRequest, step compiler.PlanStep, flowName string, flowVars map[string]any, flowViews map[string]flowBinding, client *http.Client, opt Options, assertionLog *assertionLogger) (*stepExecutionResult, *diagnostics.Diagnostic) {
+	var retry *ast.RetryDirective
+	for _, line := range resolveLines(req, plan) {
+		if r, ok := line.(*ast.RetryDirective); ok {
+			retry = r
+		}
+	}
+	if retry == nil {
+		return executeAttempt(ctx, plan, req, step, flowName, flowVars, flowViews, client, opt, assertionLog)
+	}
+	// The compiler has already rejected counts below 1 and non-positive
+	// intervals, so neither parse can fail here.
+	retries, _ := strconv.Atoi(retry.Count.Raw)
+	every, _ := time.ParseDuration(retry.Every.Raw)
+	varsBefore := copyMap(flowVars)
+	for attempt := 0; ; attempt++ {
+		var attemptLog *assertionLogger
+		if assertionLog != nil {
+			attemptLog = newAssertionLogger(Options{LogWriter: io.Discard, SuppressPassingAssertions: opt.SuppressPassingAssertions}, nil)
+		}
+		result, diag := executeAttempt(ctx, plan, req, step, flowName, flowVars, flowViews, client, opt, attemptLog)
+		if diag == nil || !strings.HasPrefix(diag.Code, "E_ASSERT_") || attempt >= retries || ctx.Err() != nil {
+			assertionLog.absorb(attemptLog)
+			return result, diag
+		}
+		verbosef(opt, "flow %q: request %q assertion failed, retrying (%d/%d)", flowName, stepDisplayName(step), attempt+1, retries)
+		for k := range flowVars {
+			delete(flowVars, k)
+		}
+		for k, v := range varsBefore {
+			flowVars[k] = v
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(every):
+		}
+	}
+}
+
+// executeAttempt sends one request and checks it. When it fails after a
+// response arrived, the returned result carries only the raw body.
+func executeAttempt(ctx context.Context, plan *compiler.Plan, req compiler.PlanRequest, step compiler.PlanStep, flowName string, flowVars map[string]any, flowViews map[string]flowBinding, client *http.Client, opt Options, assertionLog *assertionLogger) (result *stepExecutionResult, diag *diagnostics.Diagnostic) {
+	lines := resolveLines(req, plan)
+	requestID := stepDisplayName(step)
+	for _, g := range plan.Globals {
+		if !g.Dynamic {
+			continue
+		}
+		if _, ok := opt.Vars[g.Name]; ok {
+			continue
+		}
+		val, err := evalExpr(g.Value, requestContext{flowVars: flowVars, secrets: opt.SecretResolver, specs: opt.specs, dir: filepath.Dir(plan.EntryPath)})
+		if err != nil {
+			return nil, ptr(expressionDiag("E_RUNTIME_EXPRESSION", fmt.Sprintf("failed to evaluate dynamic let %s", g.Name), plan.EntryPath, g.Span, err, flowName, requestID))
+		}
+		flowVars[g.Name] = val
+	}
+	httpLine := req.HTTP
+	if httpLine == nil {
+		return nil, ptr(runtimeDiag("E_RUNTIME_REQUEST_SHAPE", "missing http line at runtime", plan.EntryPath, req.Decl.Span, "compiler should ensure requests contain one HTTP line", flowName, requestID))
+	}
+	base := ""
+	if plan.Base != nil {
+		base = *plan.Base
+	}
+	if opt.BaseOverride != nil {
+		base = *opt.BaseOverride
+	}
+	base, rawPath := serviceBase(plan, base, httpLine.Path)
+	base, err := interpolateString(base, flowVars)
+	if err != nil {
+		return nil, ptr(runtimeDiag("E_RUNTIME_MISSING_VARIABLE", "failed to render base URL", plan.EntryPath, httpLine.Span, err.Error(), flowName, requestID))
+	}
+	pathWithTemplates, err := interpolateString(rawPath, flowVars)
+	if err != nil {
+		return nil, ptr(runtimeDiag("E_RUNTIME_MISSING_VARIABLE", "failed to render request path", plan.EntryPath, httpLine.Span, err.Error(), flowName, requestID))
+	}
+	path, err := renderPath(pathWithTemplates, flowVars)
+	if err != nil {
+		return nil, ptr(runtimeDiag("E_RUNTIME_MISSING_PATH_PARAM", err.Error(), plan.EntryPath, httpLine.Span, "define the missing variable in global/flow/request scope", flowName, requestID))
+	}
+	urlStr := combineURL(base, path)
+	reqObj := map[string]any{
+		"method": httpMethodString(httpLine.Method),
+		"url":    urlStr,
+		"header": map[string]any{},
+		"query":  map[string]any{},
+		"json":   nil,
+	}
+	rctx := requestContext{reqObj: reqObj, flowVars: flowVars, flowViews: flowViews, secrets: opt.SecretResolver, specs: opt.specs, explain: opt.Explain, dir: requestDir(plan, req)}
+	varsBefore := copyMap(flowVars)
+
+	for _, line := range lines {
+		switch l := line.(type) {
+		case *ast.HeaderDirective:
+			v, err := evalExpr(l.Value, rctx)
+			if err != nil {
+				return nil, ptr(expressionDiag("E_RUNTIME_EXPRESSION", "failed to evaluate header directive", plan.EntryPath, l.Span, err, flowName, requestID))
+			}
+			v, err = interpolateValue(v, flowVars)
+			if err != nil {
+				return nil, ptr(runtimeDiag("E_RUNTIME_MISSING_VARIABLE", "failed to render header directive", plan.EntryPath, l.Span, err.Error(), flowName, requestID))
+			}
+			reqObj["header"].(map[string]any)[l.Key.Name] = fmt.Sprint(v)
+		case *ast.QueryDirective:
+			v, err := evalExpr(l.Value, rctx)
+			if err != nil {
+				return nil, ptr(expressionDiag("E_RUNTIME_EXPRESSION", "failed to evaluate query directive", plan.EntryPath, l.Span, err, flowName, requestID))
+			}
+			v, err = interpolateValue(v, flowVars)
+			if err != nil {
+				return nil, ptr(runtimeDiag("E_RUNTIME_MISSING_VARIABLE", "failed to render query directive", plan.EntryPath, l.Span, err.Error(), flowName, requestID))
+			}
+			if list, ok := v.([]any); ok {
+				values := make([]any, 0, len(list))
+				for _, item := range list {
+					values = append(values, fmt.Sprint(item))
+				}
+				reqObj["query"].(map[string]any)[l.Key.Name] = values
+			} else {
+				reqObj["query"].(map[string]any)[l.Key.Name] = fmt.Sprint(v)
+			}
+		case *ast.AuthDirective:
+			v, err := evalExpr(l.Value, rctx)
+			if err != nil {
+				return nil, ptr(expressionDiag("E_RUNTIME_EXPRESSION", "failed to evaluate auth directive", plan.EntryPath, l.Span, err, flowName, requestID))
+			}
+			v, err = interpolateValue(v, flowVars)
+			if err != nil {
+				return nil, ptr(runtimeDiag("E_RUNTIME_MISSING_VARIABLE", "failed to render auth directive", plan.EntryPath, l.Span, err.Error(), flowName, requestID))
+			}
+			switch l.Scheme {
+			case ast.AuthBearer:
+				reqObj["header"].(map[string]any)["Authorization"] = "Bearer " + fmt.Sprint(v)
+			case ast.AuthBasic:
+				pass, err := evalExpr(l.Password, rctx)
+				if err != nil {
+					return nil, ptr(expressionDiag("E_RUNTIME_EXPRESSION", "failed to evaluate auth directive", plan.EntryPath, l.Span, err, flowName, requestID))
+				}
+				pass, err = interpolateValue(pass, flowVars)
+				if err != nil {
+					return nil, ptr(runtimeDiag("E_RUNTIME_MISSING_VARIABLE", "failed to render auth directive", plan.EntryPath, l.Span, err.Error(), flowName, requestID))
+				}
+				credentials := fmt.Sprint(v) + ":" + fmt.Sprint(pass)
+				reqObj["header"].(map[string]any)["Authorization"] = "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials))
+			}
+		case *ast.JsonDirective:
+			v, err := evalExpr(l.Value, rctx)
+			if err != nil {
+				return nil, ptr(expressionDiag("E_RUNTIME_EXPRESSION", "failed to evaluate json directive", plan.EntryPath, l.Span, err, flowName, requestID))
+			}
+			v, err = interpolateValue(v, flowVars)
+			if err != nil {
+				return nil, ptr(runtimeDiag("E_RUNTIME_MISSING_VARIABLE", "failed to render json directive", plan.EntryPath, l.Span, err.Error(), flowName, requestID))
+			}
+			reqObj["json"] = v
+		case *ast.XmlDirective:
+			v, err := evalExpr(l.Value, rctx)
+			if err != nil {
+				return nil, ptr(expressionDiag("E_RUNTIME_EXPRESSION", "failed to evaluate xml directive", plan.EntryPath, l.Span, err, flowName, requestID))
+			}
+			v, err = interpolateValue(v, flowVars)
+			if err != nil {
+				return nil, ptr(runtimeDiag("E_RUNTIME_MISSING_VARIABLE", "failed to render xml directive", plan.EntryPath, l.Span, err.Error(), flowName, requestID))
+			}
+			reqObj["body"] = fmt.Sprint(v)
+			if !hasHeader(reqObj["header"].(map[string]any), "Content-Type") {
+				reqObj["header"].(map[string]any)["Content-Type"] = "application/xml"
+			}
+		case *ast.MethodDirective:
+			v, err := evalExpr(l.Value, rctx)
+			if err != nil {
+				return nil, ptr(expressionDiag("E_RUNTIME_EXPRESSION", "failed to evaluate method directive", plan.EntryPath, l.Span, err, flowName, requestID))
+			}
+			v, err = interpolateValue(v, flowVars)
+			if err != nil {
+				return nil, ptr(runtimeDiag("E_RUNTIME_MISSING_VARIABLE", "failed to render method directive", plan.EntryPath, l.Span, err.Error(), flowName, requestID))
+			}
+			method, ok := compiler.HTTPMethod(fmt.Sprint(v))
+			if !ok {
+				return nil, ptr(runtimeDiag("E_RUNTIME_INVALID_METHOD", "invalid http method", plan.EntryPath, l.Span, fmt.Sprintf("method directive evaluated to %q; use GET, POST, PUT, PATCH, DELETE, HEAD, or OPTIONS", fmt.Sprint(v)), flowName, requestID))
+			}
+			reqObj["method"] = method
+		case *ast.TextDirective:
+			v, err := evalExpr(l.Value, rctx)
+			if err != nil {
+				return nil, ptr(expressionDiag("E_RUNTIME_EXPRESSION", "failed to evaluate text directive", plan.EntryPath, l.Span, err, flowName, requestID))
+			}
+			v, err = interpolateValue(v, flowVars)
+			if err != nil {
+				return nil, ptr(runtimeDiag("E_RUNTIME_MISSING_VARIABLE", "failed to render text directive", plan.EntryPath, l.Span, err.Error(), flowName, requestID))
+			}
+			reqObj["body"] = fmt.Sprint(v)
+			if !hasHeader(reqObj["header"].(map[string]any), "Content-Type") {
+				reqObj["header"].(map[string]any)["Content-Type"] = "text/plain"
+			}
+		case *ast.FormDirective:
+			form := url.Values{}
+			for _, pair := range l.Value.Pairs {
+				v, err := evalExpr(pair.Value, rctx)
+				if err != nil {
+					return nil, ptr(expressionDiag("E_RUNTIME_EXPRESSION", "failed to evaluate form directive", plan.EntryPath, pair.Span, err, flowName, requestID))
+				}
+				v, err = interpolateValue(v, flowVars)
+				if err != nil {
+					return nil, ptr(runtimeDiag("E_RUNTIME_MISSING_VARIABLE", "failed to render form directive", plan.EntryPath, pair.Span, err.Error(), flowName, requestID))
+				}
+				form.Set(pair.Key.Name, fmt.Sprint(v))
+			}
+			reqObj["body"] = form.Encode()
+			if !hasHeader(reqObj["header"].(map[string]any), "Content-Type") {
+				reqObj["header"].(map[string]any)["Content-Type"] = "application/x-www-form-urlencoded"
+			}
+		case *ast.MultipartDirective:
+			body, contentType, diag := buildMultipart(plan, l, rctx, flowName, requestID)
+			if diag != nil {
+				return nil, diag
+			}
+			reqObj["body"] = body
+			header := reqObj["header"].(map[string]any)
+			for k := range header {
+				if strings.EqualFold(k, "Content-Type") {
+					delete(header, k)
+				}
+			}
+			header["Content-Type"] = contentType
+		}
+	}
+	if opt.DefaultAccept != "" && !hasHeader(reqObj["header"].(map[string]any), "Accept") {
+		reqObj["header"].(map[string]any)["Accept"] = opt.DefaultAccept
+	}
+	if opt.CorrelationHeader != "" && !hasHeader(reqObj["header"].(map[string]any), opt.CorrelationHeader) {
+		reqObj["header"].(map[string]any)[opt.CorrelationHeader] = opt.RunID
+	}
+	for _, line := range lines {
+		h, ok := line.(*ast.HookBlock)
+		if !ok || h.Kind != ast.HookPre {
+			continue
+		}
+		if err := execHook(h, rctx); err != nil {
+			if isMissingTemplateVariableError(err) {
+				return nil, ptr(runtimeDiag("E_RUNTIME_MISSING_VARIABLE", "failed to render pre hook print statement", plan.EntryPath, h.Span, err.Error(), flowName, requestID))
+			}
+			return nil, ptr(runtimeDiag("E_RUNTIME_HOOK", "pre hook execution failed", plan.EntryPath, h.Span, err.Error(), flowName, requestID))
+		}
+	}
+	finalURL := applyQuery(fmt.Sprint(reqObj["url"]), reqObj["query"].(map[string]any))
+	reqObj["url"] = finalURL
+	reqObj["query"] = effectiveQuery(finalURL)
+	var body []byte
+	if reqObj["json"] != nil {
+		raw, err := json.Marshal(reqObj["json"])
+		if err != nil {
+			return nil, ptr(runtimeDiag("E_RUNTIME_EXPRESSION", "failed to serialize json body", plan.EntryPath, req.Decl.Span, err.Error(), flowName, requestID))
+		}
+		body = raw
+		if !hasHeader(reqObj["header"].(map[string]any), "Content-Type") {
+			reqObj["header"].(map[string]any)["Content-Type"] = "application/json"
+		}
+	} else if raw, ok := reqObj["body"]; ok && raw != nil {
+		body = []byte(fmt.Sprint(raw))
+	}
+	reqObj["header"] = sentHeaders(reqObj["header"].(map[string]any))
+	if opt.jitter != nil {
+		delay := opt.jitter()
+		verbosef(opt, "flow %q: request %q waiting %s", flowName, requestID, delay)
+		select {
+		case <-ctx.Done():
+			return nil, ptr(runtimeDiag("E_RUNTIME_TRANSPORT", "request cancelled", plan.EntryPath, req.Decl.Span, ctx.Err().Error(), flowName, requestID))
+		case <-time.After(delay):
+		}
+	}
+	var httpRes *http.Response
+	var respRaw []byte
+	var elapsed time.Duration
+	defer func() {
+		if diag != nil && result == nil && respRaw != nil {
+			result = &stepExecutionResult{body: respRaw}
+		}
+	}()
+	for attempt := 0; ; attempt++ {
+		var bodyReader io.Reader
+		if body != nil {
+			bodyReader = bytes.NewReader(body)
+		}
+		httpReq, err := http.NewRequestWithContext(ctx, reqObj["method"].(string), reqObj["url"].(string), bodyReader)
+		if err != nil {
+			return nil, ptr(runtimeDiag("E_RUNTIME_TRANSPORT", "failed to build request", plan.EntryPath, req.Decl.Span, err.Error(), flowName, requestID))
+		}
+		for k, v := range reqObj["header"].(map[string]any) {
+			httpReq.Header.Set(k, fmt.Sprint(v))
+		}
+		message := "http request failed"
+		start := time.Now()
+		httpRes, err = client.Do(httpReq)
+		if err == nil {
+			respRaw, err = io.ReadAll(httpRes.Body)
+			_ = httpRes.Body.Close()
+			elapsed = time.Since(start)
+			message = "failed to read response"
+		}
+		if err == nil {
+			break
+		}
+		if attempt >= opt.TransportRetries || ctx.Err() != nil {
+			code := "E_RUNTIME_TRANSPORT"
+			if opt.TimeoutsAsFailures && isTimeout(err) {
+				code = "E_RUNTIME_TIMEOUT"
+			}
+			return nil, ptr(runtimeDiag(code, message, plan.EntryPath, req.Decl.Span, err.Error(), flowName, requestID))
+		}
+		verbosef(opt, "flow %q: request %q transport error, retrying (%d/%d): %v", flowName, requestID, attempt+1, opt.TransportRetries, err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(opt.TransportRetryDelay):
+		}
+	}
+	for _, line := range lines {
+		if l, ok := line.(*ast.ExpectBodyDirective); ok && len(bytes.TrimSpace(respRaw)) == 0 {
+			return nil, ptr(runtimeDiag("E_ASSERT_EMPTY_BODY", "response body is empty", plan.EntryPath, l.Span, fmt.Sprintf("expect_body requires a non-empty response body (status %d)", httpRes.StatusCode), flowName, requestID))
+		}
+	}
+	var resJSON any
+	if len(bytes.TrimSpace(respRaw)) > 0 {
+		if v, err := decodeJSON(respRaw); err != nil {
+			resJSON = invalidJSONResponse{raw: string(respRaw), err: err}
+		} else {
+			resJSON = v
+		}
+	}
+	headers := map[string]any{}
+	for k, vals := range httpRes.Header {
+		if len(vals) == 1 {
+			headers[k] = vals[0]
+		} else {
+			arr := make([]any, 0, len(vals))
+			for _, v := range vals {
+				arr = append(arr, v)
+			}
+			headers[k] = arr
+		}
+	}
+	rctx.resJSON = resJSON
+	rctx.body = string(respRaw)
+	rctx.elapsedMs = float64(elapsed) / float64(time.Millisecond)
+	rctx.status = httpRes.StatusCode
+	rctx.headers = headers
+	rctx.redirects = redirectCount(httpRes)
+	rctx.contentType = mediaType(httpRes.Header.Get("Content-Type"))
+	rctx.proto = httpRes.Proto
+
+	for _, line := range lines {
+		h, ok := line.(*ast.HookBlock)
+		if !ok || h.Kind != ast.HookPost {
+			continue
+		}
+		if err := execHook(h, rctx); err != nil {
+			if isMissingTemplateVariableError(err) {
+				return nil, ptr(runtimeDiag("E_RUNTIME_MISSING_VARIABLE", "failed to render post hook print statement", plan.EntryPath, h.Span, err.Error(), flowName, requestID))
+			}
+			return nil, ptr(runtimeDiag("E_RUNTIME_HOOK", "post hook execution failed", plan.EntryPath, h.Span, err.Error(), flowName, requestID))
+		}
+	}
+	for _, line := range lines {
+		switch l := line.(type) {
+		case *ast.AssertStmt:
+			if opt.SkipRequestAsserts {
+				assertionLog.skip(flowName, requestID, l.Expr, false)
+				continue
+			}
+			v, err := evalExpr(l.Expr, rctx)
 			if err != nil {
 				assertionLog.log(flowName, requestID, l.Expr, false)
 				return nil, ptr(expressionDiag("E_RUNTIME_EXPRESSION", "failed to evaluate request assertion", plan.EntryPath, l.Span, err, flowName, requestID))
@@ -409,6 +1599,8 @@ func executeRequest(ctx context.Context, plan *compiler.Plan, req compiler.PlanR
 				hint := "assertion must evaluate to true"
 				if cast != nil {
 					hint = cast.Error()
+				} else if h := comparisonHint(l.Expr, rctx); h != "" {
+					hint = h
 				}
 				return nil, ptr(runtimeDiag("E_ASSERT_EXPECTED_TRUE", "request assertion failed", plan.EntryPath, l.Span, hint, flowName, requestID))
 			}
@@ -420,7 +1612,22 @@ func executeRequest(ctx context.Context, plan *compiler.Plan, req compiler.PlanR
 			flowVars[l.Name] = v
 		}
 	}
-	return &stepExecutionResult{status: httpRes.StatusCode, headers: headers, res: resJSON, reqSnapshot: copyMap(reqObj)}, nil
+	lets := map[string]any{}
+	for k, v := range flowVars {
+		if prev, ok := varsBefore[k]; !ok || !deepEqual(prev, v) {
+			lets[k] = v
+		}
+	}
+	return &stepExecutionResult{status: httpRes.StatusCode, headers: headers, res: resJSON, redirects: rctx.redirects, contentType: rctx.contentType, proto: rctx.proto, body: respRaw, elapsedMs: rctx.elapsedMs, reqSnapshot: copyMap(reqObj), lets: lets}, nil
+}
+
+func hasHeader(headers map[string]any, name string) bool {
+	for k := range headers {
+		if strings.EqualFold(k, name) {
+			return true
+		}
+	}
+	return false
 }
 
 func verbosef(opt Options, format string, args ...any) {
@@ -430,49 +1637,182 @@ func verbosef(opt Options, format string, args ...any) {
 	_, _ = fmt.Fprintf(opt.LogWriter, "[verbose] "+format+"\n", args...)
 }
 
+// assertionLogger buffers assertion lines per flow and writes each flow in
+// one piece once it and every earlier flow are done, so output from
+// concurrent requests or flows never interleaves. It also tallies every
+// assertion, even when there is no writer.
 type assertionLogger struct {
-	writer               io.Writer
-	suppressPassing      bool
-	currentFlowName      string
-	currentRequestTarget string
+	mu              sync.Mutex
+	counts          AssertionCounts
+	skipped         []SkippedAssertion
+	writer          io.Writer
+	suppressPassing bool
+	maxLines        int
+	order           []string
+	next            int
+	flows           map[string]*flowAssertions
 }
 
-func newAssertionLogger(opt Options) *assertionLogger {
-	if opt.LogWriter == nil {
-		return nil
+// flowAssertions groups a flow's lines by request target in the order each
+// target first logged; flow-level assertions use the empty target.
+type flowAssertions struct {
+	done     bool
+	sections []*assertionSection
+}
+
+type assertionSection struct {
+	target string
+	lines  []string
+}
+
+func newAssertionLogger(opt Options, flows []string) *assertionLogger {
+	l := &assertionLogger{
+		writer:          opt.LogWriter,
+		suppressPassing: opt.SuppressPassingAssertions,
+		maxLines:        opt.MaxAssertions,
+		flows:           map[string]*flowAssertions{},
+	}
+	for _, name := range flows {
+		l.flow(name)
+	}
+	return l
+}
+
+func (l *assertionLogger) flow(name string) *flowAssertions {
+	fl, ok := l.flows[name]
+	if !ok {
+		fl = &flowAssertions{}
+		l.flows[name] = fl
+		l.order = append(l.order, name)
+	}
+	return fl
+}
+
+func (fl *flowAssertions) section(target string) *assertionSection {
+	for _, sec := range fl.sections {
+		if sec.target == target {
+			return sec
+		}
+	}
+	sec := &assertionSection{target: target}
+	fl.sections = append(fl.sections, sec)
+	return sec
+}
+
+func (l *assertionLogger) log(flowName, requestTarget string, expr ast.Expr, ok bool) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if ok {
+		l.counts.Passed++
+	} else {
+		l.counts.Failed++
+	}
+	if l.writer == nil || ok && l.suppressPassing {
+		return
+	}
+	status := "❌"
+	if ok {
+		status = "✅"
+	}
+	section := l.flow(flowName).section(requestTarget)
+	section.lines = append(section.lines, fmt.Sprintf("- assertion %s %s", ast.FormatExpr(expr), status))
+}
+
+// skip records an assertion that was not evaluated.
+func (l *assertionLogger) skip(flowName, requestTarget string, expr ast.Expr, flowLevel bool) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.counts.Skipped++
+	l.skipped = append(l.skipped, SkippedAssertion{Flow: flowName, Request: requestTarget, FlowLevel: flowLevel})
+	if l.writer == nil {
+		return
+	}
+	section := l.flow(flowName).section(requestTarget)
+	section.lines = append(section.lines, fmt.Sprintf("- assertion %s ⏭️ skipped", ast.FormatExpr(expr)))
+}
+
+// absorb adds the assertions another logger collected, which keeps the
+// assertions of abandoned retry attempts out of the output and counts.
+func (l *assertionLogger) absorb(other *assertionLogger) {
+	if l == nil || other == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.counts.Passed += other.counts.Passed
+	l.counts.Failed += other.counts.Failed
+	l.counts.Skipped += other.counts.Skipped
+	l.skipped = append(l.skipped, other.skipped...)
+	if l.writer == nil {
+		return
+	}
+	for _, name := range other.order {
+		fl := l.flow(name)
+		for _, sec := range other.flows[name].sections {
+			section := fl.section(sec.target)
+			section.lines = append(section.lines, sec.lines...)
+		}
+	}
+}
+
+// flowDone marks a flow finished and writes every finished flow that no
+// unfinished flow precedes.
+func (l *assertionLogger) flowDone(flowName string) {
+	if l == nil {
+		return
 	}
-	return &assertionLogger{
-		writer:          opt.LogWriter,
-		suppressPassing: opt.SuppressPassingAssertions,
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.flow(flowName).done = true
+	for l.next < len(l.order) && l.flows[l.order[l.next]].done {
+		l.writeFlow(l.order[l.next])
+		l.next++
 	}
 }
 
-func (l *assertionLogger) log(flowName, requestTarget string, expr ast.Expr, ok bool) {
+// flush writes the flows not written yet, finished or not, in order.
+func (l *assertionLogger) flush() {
 	if l == nil {
 		return
 	}
-	if ok && l.suppressPassing {
-		return
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for ; l.next < len(l.order); l.next++ {
+		l.writeFlow(l.order[l.next])
 	}
-	status := "❌"
-	if ok {
-		status = "✅"
+}
+
+func (l *assertionLogger) writeFlow(name string) {
+	fl := l.flows[name]
+	if len(fl.sections) == 0 {
+		return
 	}
-	if flowName != "" && flowName != l.currentFlowName {
-		_, _ = fmt.Fprintf(l.writer, "- flow %s\n", flowName)
-		l.currentFlowName = flowName
-		l.currentRequestTarget = ""
+	if name != "" {
+		_, _ = fmt.Fprintf(l.writer, "- flow %s\n", name)
 	}
-	if requestTarget != "" {
-		if requestTarget != l.currentRequestTarget {
-			_, _ = fmt.Fprintf(l.writer, "  - %s\n", requestTarget)
-			l.currentRequestTarget = requestTarget
+	for _, sec := range fl.sections {
+		indent := "  "
+		if sec.target != "" {
+			_, _ = fmt.Fprintf(l.writer, "  - %s\n", sec.target)
+			indent = "    "
+		}
+		shown := sec.lines
+		if l.maxLines > 0 && len(shown) > l.maxLines {
+			shown = shown[:l.maxLines]
+		}
+		for _, line := range shown {
+			_, _ = fmt.Fprintf(l.writer, "%s%s\n", indent, line)
+		}
+		if hidden := len(sec.lines) - len(shown); hidden > 0 {
+			_, _ = fmt.Fprintf(l.writer, "%s... (+%d more)\n", indent, hidden)
 		}
-		_, _ = fmt.Fprintf(l.writer, "    - assertion %s %s\n", formatExpr(expr), status)
-		return
 	}
-	l.currentRequestTarget = ""
-	_, _ = fmt.Fprintf(l.writer, "  - assertion %s %s\n", formatExpr(expr), status)
 }
 
 func stepDisplayName(step compiler.PlanStep) string {
@@ -482,106 +1822,218 @@ func stepDisplayName(step compiler.PlanStep) string {
 	return step.Request + ":" + step.Binding
 }
 
-func formatExpr(expr ast.Expr) string {
-	switch e := expr.(type) {
-	case *ast.StringLit:
-		return strconv.Quote(e.Value)
-	case *ast.NumberLit:
-		return e.Raw
-	case *ast.BoolLit:
-		if e.Value {
-			return "true"
-		}
-		return "false"
-	case *ast.NullLit:
-		return "null"
-	case *ast.ArrayLit:
-		parts := make([]string, 0, len(e.Elements))
-		for _, el := range e.Elements {
-			parts = append(parts, formatExpr(el))
-		}
-		return "[" + strings.Join(parts, ", ") + "]"
-	case *ast.ObjectLit:
-		parts := make([]string, 0, len(e.Pairs))
-		for _, pair := range e.Pairs {
-			parts = append(parts, pair.Key.Name+": "+formatExpr(pair.Value))
+// comparisonHint re-evaluates both operands of a failed comparison so the
+// diagnostic can show what was actually compared.
+func comparisonHint(expr ast.Expr, ctx requestContext) string {
+	for {
+		p, ok := expr.(*ast.ParenExpr)
+		if !ok {
+			break
 		}
-		return "{" + strings.Join(parts, ", ") + "}"
-	case *ast.DollarExpr:
-		return "$"
-	case *ast.HashExpr:
-		return "#"
-	case *ast.IdentExpr:
-		return e.Name
-	case *ast.ParenExpr:
-		return "(" + formatExpr(e.X) + ")"
-	case *ast.UnaryExpr:
-		return unaryOpString(e.Op) + formatExpr(e.X)
-	case *ast.BinaryExpr:
-		return formatExpr(e.Left) + " " + binaryOpString(e.Op) + " " + formatExpr(e.Right)
-	case *ast.FieldExpr:
-		return formatExpr(e.X) + "." + e.Name
-	case *ast.IndexExpr:
-		return formatExpr(e.X) + "[" + formatExpr(e.Index) + "]"
-	case *ast.CallExpr:
-		parts := make([]string, 0, len(e.Args))
-		for _, arg := range e.Args {
-			parts = append(parts, formatExpr(arg))
+		expr = p.X
+	}
+	if call, ok := expr.(*ast.CallExpr); ok {
+		if h := conformsHint(call, ctx); h != "" {
+			return h
 		}
-		return formatExpr(e.Callee) + "(" + strings.Join(parts, ", ") + ")"
-	default:
-		return "<expr>"
+		return membershipHint(call, ctx)
 	}
-}
-
-func unaryOpString(op ast.UnaryOp) string {
-	switch op {
-	case ast.UnaryNot:
-		return "!"
-	case ast.UnaryMinus:
-		return "-"
-	case ast.UnaryPlus:
-		return "+"
+	b, ok := expr.(*ast.BinaryExpr)
+	if !ok {
+		return ""
+	}
+	switch b.Op {
+	case ast.BinaryEq, ast.BinaryNe, ast.BinaryGt, ast.BinaryGte, ast.BinaryLt, ast.BinaryLte, ast.BinaryContains, ast.BinaryIn:
 	default:
 		return ""
 	}
-}
-
-func binaryOpString(op ast.BinaryOp) string {
-	switch op {
+	left, err := evalExpr(b.Left, ctx)
+	if err != nil {
+		return ""
+	}
+	right, err := evalExpr(b.Right, ctx)
+	if err != nil {
+		return ""
+	}
+	switch b.Op {
 	case ast.BinaryEq:
-		return "=="
+		if ctx.explain {
+			if diff := structuralDiff(right, left); diff != "" {
+				return diff
+			}
+		}
+		return fmt.Sprintf("expected %s, got %s", formatValue(right), formatValue(left))
 	case ast.BinaryNe:
-		return "!="
-	case ast.BinaryGt:
-		return ">"
-	case ast.BinaryGte:
-		return ">="
-	case ast.BinaryLt:
-		return "<"
-	case ast.BinaryLte:
-		return "<="
-	case ast.BinaryAnd:
-		return "&&"
-	case ast.BinaryOr:
-		return "||"
+		return fmt.Sprintf("expected a value other than %s, got %s", formatValue(right), formatValue(left))
 	case ast.BinaryContains:
-		return "contains"
+		return fmt.Sprintf("expected %s to contain %s", formatValue(left), formatValue(right))
 	case ast.BinaryIn:
-		return "in"
-	case ast.BinaryAdd:
-		return "+"
-	case ast.BinarySub:
-		return "-"
-	case ast.BinaryMul:
-		return "*"
-	case ast.BinaryDiv:
-		return "/"
-	case ast.BinaryMod:
-		return "%"
+		return fmt.Sprintf("expected %s to be in %s", formatValue(left), formatValue(right))
 	default:
-		return "?"
+		return fmt.Sprintf("expected a value %s %s, got %s", b.Op.String(), formatValue(right), formatValue(left))
+	}
+}
+
+// conformanceViolations validates the value of conforms(value, spec,
+// operationId, status) against the operation's response schema.
+func conformanceViolations(args []any, rctx requestContext) ([]string, error) {
+	if len(args) != 4 {
+		return nil, fmt.Errorf("conforms expects 4 args")
+	}
+	path := fmt.Sprint(args[1])
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(rctx.dir, path)
+	}
+	spec, err := rctx.specs.load(path)
+	if err != nil {
+		return nil, fmt.Errorf("conforms: %w", err)
+	}
+	status, err := asNumber(args[3])
+	if err != nil {
+		return nil, fmt.Errorf("conforms: status %s is not a number", formatValue(args[3]))
+	}
+	schema, err := spec.ResponseSchema(fmt.Sprint(args[2]), int(status))
+	if err != nil {
+		return nil, fmt.Errorf("conforms: %w", err)
+	}
+	return spec.Validate(schema, args[0]), nil
+}
+
+// specCache keeps the OpenAPI specs conforms loads during a run, keyed by
+// path, so each file is read and parsed once.
+type specCache struct {
+	mu    sync.Mutex
+	specs map[string]*openapi.Spec
+}
+
+func newSpecCache() *specCache {
+	return &specCache{specs: map[string]*openapi.Spec{}}
+}
+
+// load returns the spec at path, reading it on first use. A nil cache
+// reads the file on every call.
+func (c *specCache) load(path string) (*openapi.Spec, error) {
+	if c == nil {
+		return openapi.Load(path)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if spec, ok := c.specs[path]; ok {
+		return spec, nil
+	}
+	spec, err := openapi.Load(path)
+	if err != nil {
+		return nil, err
+	}
+	c.specs[path] = spec
+	return spec, nil
+}
+
+// conformsHint lists the schema violations behind a failed conforms call.
+func conformsHint(call *ast.CallExpr, ctx requestContext) string {
+	callee, ok := call.Callee.(*ast.IdentExpr)
+	if !ok || callee.Name != "conforms" {
+		return ""
+	}
+	args := make([]any, len(call.Args))
+	for i, arg := range call.Args {
+		v, err := evalExpr(arg, ctx)
+		if err != nil {
+			return ""
+		}
+		args[i] = normalizeExprValue(v)
+	}
+	violations, err := conformanceViolations(args, ctx)
+	if err != nil || len(violations) == 0 {
+		return ""
+	}
+	const maxShown = 5
+	hint := "does not conform to the schema: " + strings.Join(violations[:min(len(violations), maxShown)], "; ")
+	if len(violations) > maxShown {
+		hint += fmt.Sprintf("; and %d more", len(violations)-maxShown)
+	}
+	return hint
+}
+
+// membershipHint explains a failed notContains or notIn call.
+func membershipHint(call *ast.CallExpr, ctx requestContext) string {
+	callee, ok := call.Callee.(*ast.IdentExpr)
+	if !ok || len(call.Args) != 2 || (callee.Name != "notContains" && callee.Name != "notIn") {
+		return ""
+	}
+	left, err := evalExpr(call.Args[0], ctx)
+	if err != nil {
+		return ""
+	}
+	right, err := evalExpr(call.Args[1], ctx)
+	if err != nil {
+		return ""
+	}
+	left, right = normalizeExprValue(left), normalizeExprValue(right)
+	if callee.Name == "notContains" {
+		return fmt.Sprintf("expected %s not to contain %s", formatValue(left), formatValue(right))
+	}
+	return fmt.Sprintf("expected %s not to be in %s", formatValue(left), formatValue(right))
+}
+
+func formatValue(v any) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
 	}
+	return string(data)
+}
+
+// buildMultipart encodes a multipart directive. File paths are resolved
+// relative to rctx.dir, the directory of the file declaring the request.
+func buildMultipart(plan *compiler.Plan, dir *ast.MultipartDirective, rctx requestContext, flowName, requestID string) (string, string, *diagnostics.Diagnostic) {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	for _, part := range dir.Parts {
+		v, err := evalExpr(part.Value, rctx)
+		if err != nil {
+			return "", "", ptr(expressionDiag("E_RUNTIME_EXPRESSION", "failed to evaluate multipart directive", plan.EntryPath, part.Span, err, flowName, requestID))
+		}
+		v, err = interpolateValue(v, rctx.flowVars)
+		if err != nil {
+			return "", "", ptr(runtimeDiag("E_RUNTIME_MISSING_VARIABLE", "failed to render multipart directive", plan.EntryPath, part.Span, err.Error(), flowName, requestID))
+		}
+		value := fmt.Sprint(normalizeExprValue(v))
+		if !part.File {
+			if err := w.WriteField(part.Key.Name, value); err != nil {
+				return "", "", ptr(runtimeDiag("E_RUNTIME_MULTIPART", "failed to encode multipart field", plan.EntryPath, part.Span, err.Error(), flowName, requestID))
+			}
+			continue
+		}
+		path := value
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(rctx.dir, path)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", "", ptr(runtimeDiag("E_RUNTIME_MULTIPART", "failed to read multipart file", plan.EntryPath, part.Span, err.Error(), flowName, requestID))
+		}
+		fw, err := w.CreateFormFile(part.Key.Name, filepath.Base(path))
+		if err == nil {
+			_, err = fw.Write(data)
+		}
+		if err != nil {
+			return "", "", ptr(runtimeDiag("E_RUNTIME_MULTIPART", "failed to encode multipart file", plan.EntryPath, part.Span, err.Error(), flowName, requestID))
+		}
+	}
+	if err := w.Close(); err != nil {
+		return "", "", ptr(runtimeDiag("E_RUNTIME_MULTIPART", "failed to encode multipart body", plan.EntryPath, dir.Span, err.Error(), flowName, requestID))
+	}
+	return buf.String(), w.FormDataContentType(), nil
+}
+
+// requestDir is the directory that relative file paths in req resolve
+// from: that of the file declaring it, which may be an imported one.
+func requestDir(plan *compiler.Plan, req compiler.PlanRequest) string {
+	if req.File == "" {
+		return filepath.Dir(plan.EntryPath)
+	}
+	return filepath.Dir(req.File)
 }
 
 func resolveLines(req compiler.PlanRequest, plan *compiler.Plan) []ast.ReqLine {
@@ -637,9 +2089,17 @@ func renderPath(path string, vars map[string]any) (string, error) {
 		}
 	}
 	out := pathParamRuntimeRE.ReplaceAllStringFunc(path, func(token string) string {
-		name := strings.TrimPrefix(token, ":")
-		v := vars[name]
-		return url.PathEscape(fmt.Sprint(v))
+		m := pathParamRuntimeRE.FindStringSubmatch(token)
+		value := fmt.Sprint(vars[m[1]])
+		if m[2] == "" {
+			return url.PathEscape(value)
+		}
+		// :name* keeps slashes so the value can span several segments.
+		segments := strings.Split(value, "/")
+		for i, seg := range segments {
+			segments[i] = url.PathEscape(seg)
+		}
+		return strings.Join(segments, "/")
 	})
 	return out, nil
 }
@@ -655,14 +2115,42 @@ func (e *missingTemplateVariableError) Error() string {
 func interpolateString(in string, vars map[string]any) (string, error) {
 	out := in
 	for _, m := range templateVarRuntimeRE.FindAllStringSubmatch(in, -1) {
-		if _, ok := vars[m[1]]; !ok {
+		if name, ok := strings.CutPrefix(m[1], "env:"); ok {
+			out = strings.ReplaceAll(out, m[0], os.Getenv(name))
+			continue
+		}
+		v, ok := lookupTemplateVar(m[1], vars)
+		if !ok {
 			return "", &missingTemplateVariableError{name: m[1]}
 		}
-		out = strings.ReplaceAll(out, m[0], fmt.Sprint(vars[m[1]]))
+		out = strings.ReplaceAll(out, m[0], fmt.Sprint(v))
 	}
 	return out, nil
 }
 
+// lookupTemplateVar resolves a template name such as user.id by walking
+// object fields from the root variable.
+func lookupTemplateVar(name string, vars map[string]any) (any, bool) {
+	parts := strings.Split(name, ".")
+	v, ok := vars[parts[0]]
+	if !ok {
+		return nil, false
+	}
+	for _, part := range parts[1:] {
+		if _, ok := v.(templatePlaceholder); ok {
+			return v, true
+		}
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if v, ok = obj[part]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
 func isMissingTemplateVariableError(err error) bool {
 	var target *missingTemplateVariableError
 	return errors.As(err, &target)
@@ -701,6 +2189,16 @@ func interpolateValue(v any, vars map[string]any) (any, error) {
 	}
 }
 
+// serviceBase swaps in the base_for URL when path starts with @name and
+// returns the path without that prefix.
+func serviceBase(plan *compiler.Plan, base, path string) (string, string) {
+	name, ok := compiler.ServiceName(path)
+	if !ok {
+		return base, path
+	}
+	return plan.Services[name], strings.TrimPrefix(path, "@"+name)
+}
+
 func combineURL(base, path string) string {
 	if strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") {
 		return path
@@ -721,12 +2219,53 @@ func applyQuery(urlStr string, q map[string]any) string {
 	}
 	query := u.Query()
 	for k, v := range q {
+		if list, ok := v.([]any); ok {
+			query.Del(k)
+			for _, item := range list {
+				query.Add(k, fmt.Sprint(item))
+			}
+			continue
+		}
 		query.Set(k, fmt.Sprint(v))
 	}
 	u.RawQuery = query.Encode()
 	return u.String()
 }
 
+// sentHeaders returns request headers as they go on the wire: canonical keys
+// and string values. It is stored back on req so post hooks, assertions, and
+// bindings see exactly what was sent.
+func sentHeaders(in map[string]any) map[string]any {
+	out := make(map[string]any, len(in))
+	for k, v := range in {
+		out[http.CanonicalHeaderKey(k)] = fmt.Sprint(v)
+	}
+	return out
+}
+
+// effectiveQuery returns the query params actually sent, including ones
+// written in the request path. Like response headers, repeated params become
+// lists and single params stay strings.
+func effectiveQuery(urlStr string) map[string]any {
+	out := map[string]any{}
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return out
+	}
+	for k, vals := range u.Query() {
+		if len(vals) == 1 {
+			out[k] = vals[0]
+			continue
+		}
+		arr := make([]any, 0, len(vals))
+		for _, v := range vals {
+			arr = append(arr, v)
+		}
+		out[k] = arr
+	}
+	return out
+}
+
 func execHook(block *ast.HookBlock, rctx requestContext) error {
 	for _, stmt := range block.Stmts {
 		switch s := stmt.(type) {
@@ -851,6 +2390,12 @@ func normalizePrintfArgs(format string, args []any) []any {
 }
 
 func coercePrintfIntArg(v any) any {
+	if n, ok := v.(json.Number); ok {
+		if i, err := n.Int64(); err == nil {
+			return i
+		}
+		return v
+	}
 	f, ok := v.(float64)
 	if !ok || math.IsNaN(f) || math.IsInf(f, 0) || math.Trunc(f) != f {
 		return v
@@ -926,11 +2471,10 @@ func evalExpr(expr ast.Expr, rctx requestContext) (any, error) {
 	case *ast.StringLit:
 		return e.Value, nil
 	case *ast.NumberLit:
-		f, err := strconv.ParseFloat(e.Raw, 64)
-		if err != nil {
+		if _, err := strconv.ParseFloat(e.Raw, 64); err != nil {
 			return nil, err
 		}
-		return f, nil
+		return preciseNumber(json.Number(e.Raw)), nil
 	case *ast.BoolLit:
 		return e.Value, nil
 	case *ast.NullLit:
@@ -975,7 +2519,17 @@ func evalExpr(expr ast.Expr, rctx requestContext) (any, error) {
 		}
 		if b, ok := rctx.flowViews[e.Name]; ok {
 			resVal := responseExprValue(b.Res)
-			return map[string]any{"res": resVal, "req": b.Req, "status": float64(b.Status), "header": b.Header}, nil
+			return map[string]any{"res": resVal, "req": b.Req, "status": float64(b.Status), "header": b.Header, "body": b.Body, "elapsed_ms": b.ElapsedMs, "status_text": http.StatusText(b.Status)}, nil
+		}
+		// These names were added after programs could already use them for
+		// variables and bindings, so those keep precedence.
+		switch e.Name {
+		case "body":
+			return rctx.body, nil
+		case "elapsed_ms":
+			return rctx.elapsedMs, nil
+		case "status_text":
+			return http.StatusText(rctx.status), nil
 		}
 		return nil, fmt.Errorf("undefined identifier %s", e.Name)
 	case *ast.ParenExpr:
@@ -1019,45 +2573,29 @@ func evalExpr(expr ast.Expr, rctx requestContext) (any, error) {
 		case ast.BinaryNe:
 			return !deepEqual(left, right), nil
 		case ast.BinaryGt:
-			l, err := asNumber(left)
-			if err != nil {
-				return nil, err
-			}
-			r, err := asNumber(right)
+			c, err := compareNumbers(left, right)
 			if err != nil {
 				return nil, err
 			}
-			return l > r, nil
+			return c > 0, nil
 		case ast.BinaryGte:
-			l, err := asNumber(left)
+			c, err := compareNumbers(left, right)
 			if err != nil {
 				return nil, err
 			}
-			r, err := asNumber(right)
-			if err != nil {
-				return nil, err
-			}
-			return l >= r, nil
+			return c >= 0, nil
 		case ast.BinaryLt:
-			l, err := asNumber(left)
-			if err != nil {
-				return nil, err
-			}
-			r, err := asNumber(right)
+			c, err := compareNumbers(left, right)
 			if err != nil {
 				return nil, err
 			}
-			return l < r, nil
+			return c < 0, nil
 		case ast.BinaryLte:
-			l, err := asNumber(left)
-			if err != nil {
-				return nil, err
-			}
-			r, err := asNumber(right)
+			c, err := compareNumbers(left, right)
 			if err != nil {
 				return nil, err
 			}
-			return l <= r, nil
+			return c <= 0, nil
 		case ast.BinaryAnd:
 			l, err := asBool(left)
 			if err != nil {
@@ -1155,6 +2693,9 @@ func evalExpr(expr ast.Expr, rctx requestContext) (any, error) {
 			return math.Mod(l, r), nil
 		}
 	case *ast.FieldExpr:
+		if v, ok := responseMetaField(e, rctx); ok {
+			return v, nil
+		}
 		x, err := evalExpr(e.X, rctx)
 		if err != nil {
 			return nil, err
@@ -1162,6 +2703,9 @@ func evalExpr(expr ast.Expr, rctx requestContext) (any, error) {
 		if err := newJSONAccessError(x); err != nil {
 			return nil, err
 		}
+		if x == nil && e.Optional {
+			return nil, nil
+		}
 		obj, ok := x.(map[string]any)
 		if !ok {
 			return nil, fmt.Errorf("field access on non-object")
@@ -1215,28 +2759,235 @@ func evalExpr(expr ast.Expr, rctx requestContext) (any, error) {
 		switch callee.Name {
 		case "env":
 			if len(args) != 1 {
-				return nil, fmt.Errorf("env expects 1 arg")
+				return nil, fmt.Errorf("env expects 1 arg")
+			}
+			return os.Getenv(fmt.Sprint(normArgs[0])), nil
+		case "uuid":
+			if len(args) != 0 {
+				return nil, fmt.Errorf("uuid expects no args")
+			}
+			return randomID(), nil
+		case "len":
+			if len(args) != 1 {
+				return nil, fmt.Errorf("len expects 1 arg")
+			}
+			return lengthOf(normArgs[0], "len")
+		case "length":
+			if len(args) != 2 {
+				return nil, fmt.Errorf("length expects 2 args")
+			}
+			if err := newJSONAccessError(args[0]); err != nil {
+				return nil, err
+			}
+			v, err := jsonPathLookup(normArgs[0], fmt.Sprint(normArgs[1]))
+			if err != nil {
+				return nil, err
+			}
+			if v == nil {
+				return float64(0), nil
+			}
+			return lengthOf(v, "length")
+		case "allEqual", "anyEqual":
+			if len(args) != 2 {
+				return nil, fmt.Errorf("%s expects 2 args", callee.Name)
+			}
+			arr, ok := normArgs[0].([]any)
+			if !ok {
+				return nil, fmt.Errorf("%s expects an array as first arg", callee.Name)
+			}
+			want := callee.Name == "anyEqual"
+			for _, item := range arr {
+				if deepEqual(item, normArgs[1]) == want {
+					return want, nil
+				}
+			}
+			return !want, nil
+		case "isSorted", "isSortedDesc":
+			if len(args) != 1 {
+				return nil, fmt.Errorf("%s expects 1 arg", callee.Name)
+			}
+			arr, ok := normArgs[0].([]any)
+			if !ok {
+				return nil, fmt.Errorf("%s expects an array", callee.Name)
+			}
+			desc := callee.Name == "isSortedDesc"
+			for i := 1; i < len(arr); i++ {
+				cmp, err := compareOrdered(arr[i-1], arr[i])
+				if err != nil {
+					return nil, fmt.Errorf("%s: %w", callee.Name, err)
+				}
+				if (!desc && cmp > 0) || (desc && cmp < 0) {
+					return false, nil
+				}
+			}
+			return true, nil
+		case "unique":
+			if len(args) != 1 {
+				return nil, fmt.Errorf("unique expects 1 arg")
+			}
+			arr, ok := normArgs[0].([]any)
+			if !ok {
+				return nil, fmt.Errorf("unique expects an array")
+			}
+			for i := range arr {
+				for j := i + 1; j < len(arr); j++ {
+					if deepEqual(arr[i], arr[j]) {
+						return false, nil
+					}
+				}
+			}
+			return true, nil
+		case "matches":
+			if len(args) != 2 {
+				return nil, fmt.Errorf("matches expects 2 args")
+			}
+			if err := newJSONAccessError(args[0]); err != nil {
+				return nil, err
+			}
+			shape, ok := normArgs[1].(map[string]any)
+			if !ok {
+				return nil, fmt.Errorf("matches expects an object shape as second arg")
+			}
+			return matchesShape(normArgs[0], shape)
+		case "calls":
+			if len(args) != 1 {
+				return nil, fmt.Errorf("calls expects 1 arg")
+			}
+			if rctx.calls == nil {
+				return nil, fmt.Errorf("calls is only available in flow assertions")
+			}
+			return float64(rctx.calls[fmt.Sprint(normArgs[0])]), nil
+		case "notContains":
+			if len(args) != 2 {
+				return nil, fmt.Errorf("notContains expects 2 args")
+			}
+			switch normArgs[0].(type) {
+			case string, []any:
+			default:
+				return nil, fmt.Errorf("notContains expects a string or array as first arg")
+			}
+			return !contains(normArgs[0], normArgs[1]), nil
+		case "notIn":
+			if len(args) != 2 {
+				return nil, fmt.Errorf("notIn expects 2 args")
+			}
+			arr, ok := normArgs[1].([]any)
+			if !ok {
+				return nil, fmt.Errorf("notIn expects an array as second arg")
+			}
+			for _, item := range arr {
+				if deepEqual(normArgs[0], item) {
+					return false, nil
+				}
+			}
+			return true, nil
+		case "status_class":
+			if len(args) > 1 {
+				return nil, fmt.Errorf("status_class expects 0 or 1 args")
+			}
+			code := float64(rctx.status)
+			if len(args) == 1 {
+				n, err := asNumber(normArgs[0])
+				if err != nil {
+					return nil, fmt.Errorf("status_class: %s is not a number", formatValue(normArgs[0]))
+				}
+				code = n
+			}
+			return math.Floor(code / 100), nil
+		case "isInt":
+			if len(args) != 1 {
+				return nil, fmt.Errorf("isInt expects 1 arg")
+			}
+			// Only numbers qualify; numeric strings such as "3" do not.
+			switch n := normArgs[0].(type) {
+			case float64:
+				return !math.IsInf(n, 0) && n == math.Trunc(n), nil
+			case int, int64, json.Number:
+				return true, nil
+			}
+			return false, nil
+		case "isEmptyArray":
+			if len(args) != 1 {
+				return nil, fmt.Errorf("isEmptyArray expects 1 arg")
+			}
+			// A missing field is not an empty array; use isMissing for that.
+			arr, ok := normArgs[0].([]any)
+			return ok && len(arr) == 0, nil
+		case "isMissing":
+			if len(args) != 1 {
+				return nil, fmt.Errorf("isMissing expects 1 arg")
 			}
-			return os.Getenv(fmt.Sprint(normArgs[0])), nil
-		case "uuid":
-			if len(args) != 0 {
-				return nil, fmt.Errorf("uuid expects no args")
+			return normArgs[0] == nil, nil
+		case "humanBytes":
+			if len(args) != 1 {
+				return nil, fmt.Errorf("humanBytes expects 1 arg")
 			}
-			return randomID(), nil
-		case "len":
+			n, err := asNumber(normArgs[0])
+			if err != nil || n < 0 || math.IsInf(n, 0) || math.IsNaN(n) {
+				return nil, fmt.Errorf("humanBytes: %s is not a byte count", formatValue(normArgs[0]))
+			}
+			return humanBytes(n), nil
+		case "parseBytes":
 			if len(args) != 1 {
-				return nil, fmt.Errorf("len expects 1 arg")
+				return nil, fmt.Errorf("parseBytes expects 1 arg")
 			}
-			switch v := normArgs[0].(type) {
-			case []any:
-				return float64(len(v)), nil
-			case map[string]any:
-				return float64(len(v)), nil
-			case string:
-				return float64(len(v)), nil
-			default:
-				return nil, fmt.Errorf("len unsupported for type")
+			s, ok := normArgs[0].(string)
+			if !ok {
+				return nil, fmt.Errorf("parseBytes expects a string")
+			}
+			return parseBytes(s)
+		case "default":
+			if len(args) != 2 {
+				return nil, fmt.Errorf("default expects 2 args")
+			}
+			if normArgs[0] == nil {
+				return args[1], nil
+			}
+			return args[0], nil
+		case "numEq":
+			if len(args) != 2 {
+				return nil, fmt.Errorf("numEq expects 2 args")
+			}
+			a, err := asNumber(normArgs[0])
+			if err != nil {
+				return nil, fmt.Errorf("numEq: %s is not a number", formatValue(normArgs[0]))
+			}
+			b, err := asNumber(normArgs[1])
+			if err != nil {
+				return nil, fmt.Errorf("numEq: %s is not a number", formatValue(normArgs[1]))
+			}
+			return a == b, nil
+		case "regexExtract":
+			if len(args) != 3 {
+				return nil, fmt.Errorf("regexExtract expects 3 args")
+			}
+			re, err := regexp.Compile(fmt.Sprint(normArgs[0]))
+			if err != nil {
+				return nil, fmt.Errorf("invalid regex: %w", err)
+			}
+			m := re.FindStringSubmatch(fmt.Sprint(normArgs[1]))
+			if m == nil {
+				return nil, fmt.Errorf("regexExtract: pattern %q did not match", re.String())
+			}
+			idx := -1
+			if name, ok := normArgs[2].(string); ok {
+				idx = re.SubexpIndex(name)
+				if idx < 0 {
+					return nil, fmt.Errorf("regexExtract: no group named %q", name)
+				}
+			} else {
+				n, err := asNumber(normArgs[2])
+				if err != nil || n != float64(int(n)) || int(n) < 0 || int(n) >= len(m) {
+					return nil, fmt.Errorf("regexExtract: invalid group %v (pattern has %d groups)", normArgs[2], len(m)-1)
+				}
+				idx = int(n)
 			}
+			return m[idx], nil
+		case "headerNum":
+			if len(args) != 1 {
+				return nil, fmt.Errorf("headerNum expects 1 arg")
+			}
+			return headerNumber(rctx.headers, fmt.Sprint(normArgs[0]))
 		case "regex":
 			if len(args) != 2 {
 				return nil, fmt.Errorf("regex expects 2 args")
@@ -1259,11 +3010,185 @@ func evalExpr(expr ast.Expr, rctx requestContext) (any, error) {
 				return nil, fmt.Errorf("now expects no args")
 			}
 			return time.Now().UTC().Format(time.RFC3339Nano), nil
+		case "isBefore", "isAfter":
+			if len(args) != 2 {
+				return nil, fmt.Errorf("%s expects 2 args", callee.Name)
+			}
+			a, err := asTime(normArgs[0])
+			if err != nil {
+				return nil, err
+			}
+			b, err := asTime(normArgs[1])
+			if err != nil {
+				return nil, err
+			}
+			if callee.Name == "isBefore" {
+				return a.Before(b), nil
+			}
+			return a.After(b), nil
+		case "within":
+			if len(args) != 2 {
+				return nil, fmt.Errorf("within expects 2 args")
+			}
+			ts, err := asTime(normArgs[0])
+			if err != nil {
+				return nil, err
+			}
+			d, err := asDuration(normArgs[1])
+			if err != nil {
+				return nil, err
+			}
+			elapsed := time.Since(ts)
+			if elapsed < 0 {
+				elapsed = -elapsed
+			}
+			return elapsed <= d, nil
 		case "urlencode":
 			if len(args) != 1 {
 				return nil, fmt.Errorf("urlencode expects 1 arg")
 			}
 			return url.QueryEscape(fmt.Sprint(normArgs[0])), nil
+		case "upper":
+			if len(args) != 1 {
+				return nil, fmt.Errorf("upper expects 1 arg")
+			}
+			return strings.ToUpper(fmt.Sprint(normArgs[0])), nil
+		case "lower":
+			if len(args) != 1 {
+				return nil, fmt.Errorf("lower expects 1 arg")
+			}
+			return strings.ToLower(fmt.Sprint(normArgs[0])), nil
+		case "trim":
+			if len(args) != 1 {
+				return nil, fmt.Errorf("trim expects 1 arg")
+			}
+			return strings.TrimSpace(fmt.Sprint(normArgs[0])), nil
+		case "split":
+			if len(args) != 2 {
+				return nil, fmt.Errorf("split expects 2 args")
+			}
+			s, ok := normArgs[0].(string)
+			if !ok {
+				return nil, fmt.Errorf("split: %s is not a string", formatValue(normArgs[0]))
+			}
+			sep, ok := normArgs[1].(string)
+			if !ok {
+				return nil, fmt.Errorf("split: separator %s is not a string", formatValue(normArgs[1]))
+			}
+			parts := strings.Split(s, sep)
+			out := make([]any, len(parts))
+			for i, p := range parts {
+				out[i] = p
+			}
+			return out, nil
+		case "join":
+			if len(args) != 2 {
+				return nil, fmt.Errorf("join expects 2 args")
+			}
+			arr, ok := normArgs[0].([]any)
+			if !ok {
+				return nil, fmt.Errorf("join: %s is not an array", formatValue(normArgs[0]))
+			}
+			sep, ok := normArgs[1].(string)
+			if !ok {
+				return nil, fmt.Errorf("join: separator %s is not a string", formatValue(normArgs[1]))
+			}
+			parts := make([]string, len(arr))
+			for i, el := range arr {
+				switch el.(type) {
+				case nil, []any, map[string]any:
+					return nil, fmt.Errorf("join: element %d is %s, not a string, number, or bool", i, formatValue(el))
+				}
+				parts[i] = fmt.Sprint(el)
+			}
+			return strings.Join(parts, sep), nil
+		case "keys":
+			if len(args) != 1 {
+				return nil, fmt.Errorf("keys expects 1 arg")
+			}
+			obj, ok := normArgs[0].(map[string]any)
+			if !ok {
+				return nil, fmt.Errorf("keys: %s is not an object", formatValue(normArgs[0]))
+			}
+			names := make([]string, 0, len(obj))
+			for k := range obj {
+				names = append(names, k)
+			}
+			slices.Sort(names)
+			out := make([]any, len(names))
+			for i, k := range names {
+				out[i] = k
+			}
+			return out, nil
+		case "contains_key":
+			if len(args) != 2 {
+				return nil, fmt.Errorf("contains_key expects 2 args")
+			}
+			obj, ok := normArgs[0].(map[string]any)
+			if !ok {
+				return nil, fmt.Errorf("contains_key: %s is not an object", formatValue(normArgs[0]))
+			}
+			key, ok := normArgs[1].(string)
+			if !ok {
+				return nil, fmt.Errorf("contains_key: key %s is not a string", formatValue(normArgs[1]))
+			}
+			_, found := obj[key]
+			return found, nil
+		case "file":
+			if len(args) != 1 {
+				return nil, fmt.Errorf("file expects 1 arg")
+			}
+			path := fmt.Sprint(normArgs[0])
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(rctx.dir, path)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("file: %w", err)
+			}
+			v, err := decodeJSON(data)
+			if err != nil {
+				return nil, fmt.Errorf("file: %s is not valid JSON: %w", path, err)
+			}
+			return v, nil
+		case "conforms":
+			violations, err := conformanceViolations(normArgs, rctx)
+			if err != nil {
+				return nil, err
+			}
+			return len(violations) == 0, nil
+		case "resolveURL":
+			if len(args) != 2 {
+				return nil, fmt.Errorf("resolveURL expects 2 args")
+			}
+			base, err := url.Parse(fmt.Sprint(normArgs[0]))
+			if err != nil {
+				return nil, fmt.Errorf("resolveURL: invalid base: %w", err)
+			}
+			ref, err := url.Parse(fmt.Sprint(normArgs[1]))
+			if err != nil {
+				return nil, fmt.Errorf("resolveURL: invalid reference: %w", err)
+			}
+			return base.ResolveReference(ref).String(), nil
+		case "icontains":
+			if len(args) != 2 {
+				return nil, fmt.Errorf("icontains expects 2 args")
+			}
+			return strings.Contains(strings.ToLower(fmt.Sprint(normArgs[0])), strings.ToLower(fmt.Sprint(normArgs[1]))), nil
+		case "secret":
+			if len(args) != 1 {
+				return nil, fmt.Errorf("secret expects 1 arg")
+			}
+			resolve := rctx.secrets
+			if resolve == nil {
+				resolve = envSecretResolver
+			}
+			path := fmt.Sprint(normArgs[0])
+			v, err := resolve(path)
+			if err != nil {
+				return nil, secretError{path: path, cause: err}
+			}
+			return v, nil
 		default:
 			return nil, fmt.Errorf("unknown function %s", callee.Name)
 		}
@@ -1271,21 +3196,254 @@ func evalExpr(expr ast.Expr, rctx requestContext) (any, error) {
 	return nil, fmt.Errorf("unsupported expression")
 }
 
+// matchesShape checks that v is an object whose fields have the JSON types
+// named in shape. Extra fields in v are ignored.
+func matchesShape(v any, shape map[string]any) (bool, error) {
+	obj, ok := v.(map[string]any)
+	if !ok {
+		return false, nil
+	}
+	for field, want := range shape {
+		name, ok := want.(string)
+		if !ok {
+			return false, fmt.Errorf("matches shape field %s must be a type name string", field)
+		}
+		switch name {
+		case "number", "string", "array", "object", "bool", "null":
+		default:
+			return false, fmt.Errorf("matches shape field %s has unknown type %q (use number, string, array, object, bool, or null)", field, name)
+		}
+		got, present := obj[field]
+		if !present || jsonTypeName(got) != name {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func jsonTypeName(v any) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case float64, int, int64, json.Number:
+		return "number"
+	case string:
+		return "string"
+	case bool:
+		return "bool"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
+
+func lengthOf(v any, fn string) (any, error) {
+	switch v := v.(type) {
+	case []any:
+		return float64(len(v)), nil
+	case map[string]any:
+		return float64(len(v)), nil
+	case string:
+		return float64(len(v)), nil
+	default:
+		return nil, fmt.Errorf("%s unsupported for type", fn)
+	}
+}
+
 func asNumber(v any) (float64, error) {
 	switch n := v.(type) {
 	case float64:
 		return n, nil
+	case json.Number:
+		return n.Float64()
 	case int:
 		return float64(n), nil
 	case int64:
 		return float64(n), nil
 	case string:
 		return strconv.ParseFloat(n, 64)
+	case []any:
+		return 0, fmt.Errorf("expected number, got multi-valued list; use headerNum for headers")
 	default:
 		return 0, fmt.Errorf("expected number")
 	}
 }
 
+// byteUnits are the size units humanBytes and parseBytes use, largest
+// first. The plain units are decimal; the "i" units are binary.
+var byteUnits = []struct {
+	name string
+	size float64
+}{
+	{"TB", 1e12}, {"GB", 1e9}, {"MB", 1e6}, {"KB", 1e3},
+	{"TiB", 1 << 40}, {"GiB", 1 << 30}, {"MiB", 1 << 20}, {"KiB", 1 << 10},
+	{"B", 1},
+}
+
+// humanBytes renders n bytes in the largest decimal unit it reaches, with
+// at most one decimal place: 1500000 is "1.5 MB" and 512 is "512 B".
+func humanBytes(n float64) string {
+	for i, u := range byteUnits {
+		if strings.Contains(u.name, "i") || n < u.size {
+			continue
+		}
+		v := math.Round(n/u.size*10) / 10
+		if v >= 1000 && i > 0 {
+			// 999999 rounds up to the next unit rather than "1000 KB".
+			u = byteUnits[i-1]
+			v = math.Round(n/u.size*10) / 10
+		}
+		return strconv.FormatFloat(v, 'f', -1, 64) + " " + u.name
+	}
+	return strconv.FormatFloat(n, 'f', -1, 64) + " B"
+}
+
+// parseBytes converts a size such as "1.5MB", "2 KiB" or "512" (bytes)
+// into a byte count. Units are case-insensitive.
+func parseBytes(s string) (float64, error) {
+	text := strings.TrimSpace(s)
+	num, unit := text, "B"
+	for _, u := range byteUnits {
+		if len(text) > len(u.name) && strings.EqualFold(text[len(text)-len(u.name):], u.name) {
+			num, unit = strings.TrimSpace(text[:len(text)-len(u.name)]), u.name
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil || n < 0 || math.IsInf(n, 0) || math.IsNaN(n) {
+		return 0, fmt.Errorf("parseBytes: invalid size %q", s)
+	}
+	for _, u := range byteUnits {
+		if u.name == unit {
+			n *= u.size
+			break
+		}
+	}
+	return n, nil
+}
+
+// redirectCount counts the redirects the client followed to produce res by
+// walking the redirect responses recorded on each request.
+func redirectCount(res *http.Response) int {
+	n := 0
+	for r := res.Request; r != nil && r.Response != nil; r = r.Response.Request {
+		n++
+	}
+	return n
+}
+
+// mediaType returns the lower-cased media type of a Content-Type header
+// without its parameters, or "" when the header is missing or malformed.
+func mediaType(header string) string {
+	mt, _, err := mime.ParseMediaType(header)
+	if err != nil && !errors.Is(err, mime.ErrInvalidMediaParameter) {
+		return ""
+	}
+	return mt
+}
+
+// responseMetaField resolves res.redirectCount, res.contentType and
+// res.proto, and the same fields on binding.res. They take precedence over
+// body fields of the same name, which stay reachable through #.
+func responseMetaField(e *ast.FieldExpr, rctx requestContext) (any, bool) {
+	switch e.Name {
+	case "redirectCount", "contentType", "proto":
+	default:
+		return nil, false
+	}
+	var redirects int
+	var contentType, proto string
+	switch x := e.X.(type) {
+	case *ast.IdentExpr:
+		if x.Name != "res" {
+			return nil, false
+		}
+		redirects, contentType, proto = rctx.redirects, rctx.contentType, rctx.proto
+	case *ast.FieldExpr:
+		id, ok := x.X.(*ast.IdentExpr)
+		if !ok || x.Name != "res" {
+			return nil, false
+		}
+		if _, shadowed := rctx.flowVars[id.Name]; shadowed {
+			return nil, false
+		}
+		b, ok := rctx.flowViews[id.Name]
+		if !ok {
+			return nil, false
+		}
+		redirects, contentType, proto = b.Redirects, b.ContentType, b.Proto
+	default:
+		return nil, false
+	}
+	switch e.Name {
+	case "contentType":
+		return contentType, true
+	case "proto":
+		return proto, true
+	}
+	return float64(redirects), true
+}
+
+// headerNumber parses a response header as a number. Multi-valued headers
+// use their first value.
+func headerNumber(headers map[string]any, name string) (float64, error) {
+	v, ok := headers[http.CanonicalHeaderKey(name)]
+	if !ok {
+		for key, val := range headers {
+			if strings.EqualFold(key, name) {
+				v, ok = val, true
+				break
+			}
+		}
+	}
+	if !ok {
+		return 0, fmt.Errorf("headerNum: header %s not found", name)
+	}
+	if values, isList := v.([]any); isList {
+		if len(values) == 0 {
+			return 0, fmt.Errorf("headerNum: header %s has no values", name)
+		}
+		v = values[0]
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(fmt.Sprint(v)), 64)
+	if err != nil {
+		return 0, fmt.Errorf("headerNum: header %s value %q is not a number", name, fmt.Sprint(v))
+	}
+	return n, nil
+}
+
+// asTime accepts RFC3339 strings or unix epoch seconds.
+func asTime(v any) (time.Time, error) {
+	if str, ok := v.(string); ok {
+		if t, err := time.Parse(time.RFC3339Nano, str); err == nil {
+			return t, nil
+		}
+	}
+	n, err := asNumber(v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("expected RFC3339 timestamp or unix seconds, got %v", v)
+	}
+	sec, frac := math.Modf(n)
+	return time.Unix(int64(sec), int64(frac*1e9)).UTC(), nil
+}
+
+// asDuration accepts Go duration strings such as "5m" or a number of seconds.
+func asDuration(v any) (time.Duration, error) {
+	if str, ok := v.(string); ok {
+		if d, err := time.ParseDuration(str); err == nil {
+			return d, nil
+		}
+	}
+	n, err := asNumber(v)
+	if err != nil {
+		return 0, fmt.Errorf("expected duration like \"5m\" or seconds, got %v", v)
+	}
+	return time.Duration(n * float64(time.Second)), nil
+}
+
 func asBool(v any) (bool, error) {
 	b, ok := v.(bool)
 	if !ok {
@@ -1309,6 +3467,181 @@ func contains(left, right any) bool {
 	return false
 }
 
+// structuralDiff describes how got differs from want, path by path, when both
+// are objects or both are arrays. It returns "" for any other pair.
+func structuralDiff(want, got any) string {
+	switch want.(type) {
+	case map[string]any, []any:
+	default:
+		return ""
+	}
+	if fmt.Sprintf("%T", want) != fmt.Sprintf("%T", got) {
+		return ""
+	}
+	var changes []string
+	var walk func(path string, want, got any)
+	walk = func(path string, want, got any) {
+		switch w := want.(type) {
+		case map[string]any:
+			if g, ok := got.(map[string]any); ok {
+				keys := make([]string, 0, len(w)+len(g))
+				for k := range w {
+					keys = append(keys, k)
+				}
+				for k := range g {
+					if _, ok := w[k]; !ok {
+						keys = append(keys, k)
+					}
+				}
+				slices.Sort(keys)
+				for _, k := range keys {
+					wv, inWant := w[k]
+					gv, inGot := g[k]
+					switch {
+					case !inGot:
+						changes = append(changes, fmt.Sprintf("removed %s.%s", path, k))
+					case !inWant:
+						changes = append(changes, fmt.Sprintf("added %s.%s = %s", path, k, formatValue(gv)))
+					default:
+						walk(path+"."+k, wv, gv)
+					}
+				}
+				return
+			}
+		case []any:
+			if g, ok := got.([]any); ok {
+				for i := 0; i < len(w) || i < len(g); i++ {
+					elem := fmt.Sprintf("%s[%d]", path, i)
+					switch {
+					case i >= len(g):
+						changes = append(changes, "removed "+elem)
+					case i >= len(w):
+						changes = append(changes, fmt.Sprintf("added %s = %s", elem, formatValue(g[i])))
+					default:
+						walk(elem, w[i], g[i])
+					}
+				}
+				return
+			}
+		}
+		if !deepEqual(want, got) {
+			changes = append(changes, fmt.Sprintf("changed %s: expected %s, got %s", path, formatValue(want), formatValue(got)))
+		}
+	}
+	walk("$", want, got)
+	if len(changes) == 0 {
+		return ""
+	}
+	return "structural diff: " + strings.Join(changes, "; ")
+}
+
+// compareOrdered compares two numbers or two strings, returning -1, 0, or 1.
+func compareOrdered(a, b any) (int, error) {
+	if as, ok := a.(string); ok {
+		bs, ok := b.(string)
+		if !ok {
+			return 0, fmt.Errorf("expected an array of numbers or strings, got %s and %s", formatValue(a), formatValue(b))
+		}
+		return strings.Compare(as, bs), nil
+	}
+	af, aok := bigNumber(a)
+	bf, bok := bigNumber(b)
+	if !aok || !bok {
+		return 0, fmt.Errorf("expected an array of numbers or strings, got %s and %s", formatValue(a), formatValue(b))
+	}
+	return af.Cmp(bf), nil
+}
+
+// decodeJSON decodes a JSON document like json.Unmarshal, except that
+// integers too large for a float64 stay exact as json.Number values; see
+// preciseNumber.
+func decodeJSON(data []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("invalid character after top-level value")
+	}
+	return preciseNumbers(v), nil
+}
+
+func preciseNumbers(v any) any {
+	switch x := v.(type) {
+	case json.Number:
+		return preciseNumber(x)
+	case []any:
+		for i, item := range x {
+			x[i] = preciseNumbers(item)
+		}
+	case map[string]any:
+		for k, item := range x {
+			x[k] = preciseNumbers(item)
+		}
+	}
+	return v
+}
+
+// preciseNumber converts n to a float64 unless n is an integer that a
+// float64 cannot hold exactly, such as a 64-bit id. Those stay json.Number,
+// in canonical form so equal integers compare equal.
+func preciseNumber(n json.Number) any {
+	if i, ok := new(big.Int).SetString(string(n), 10); ok {
+		f, acc := new(big.Float).SetInt(i).Float64()
+		if acc != big.Exact {
+			return json.Number(i.String())
+		}
+		return f
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return n
+	}
+	return f
+}
+
+// compareNumbers compares two values coerced with asNumber, returning -1, 0,
+// or 1. Numbers are compared exactly so large json.Number ids order correctly.
+func compareNumbers(a, b any) (int, error) {
+	if af, ok := bigNumber(a); ok {
+		if bf, ok := bigNumber(b); ok {
+			return af.Cmp(bf), nil
+		}
+	}
+	l, err := asNumber(a)
+	if err != nil {
+		return 0, err
+	}
+	r, err := asNumber(b)
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case l < r:
+		return -1, nil
+	case l > r:
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// bigNumber returns v as an exact big.Float when it is a number.
+func bigNumber(v any) (*big.Float, bool) {
+	switch n := v.(type) {
+	case float64:
+		if math.IsNaN(n) {
+			return nil, false
+		}
+		return big.NewFloat(n), true
+	case json.Number:
+		f, _, err := big.ParseFloat(string(n), 10, 256, big.ToNearestEven)
+		return f, err == nil
+	}
+	return nil, false
+}
+
 func deepEqual(a, b any) bool {
 	aj, _ := json.Marshal(a)
 	bj, _ := json.Marshal(b)
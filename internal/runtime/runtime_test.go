@@ -3,13 +3,22 @@ package runtime
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/mehditeymorian/pipetest/internal/ast"
 	"github.com/mehditeymorian/pipetest/internal/compiler"
 	"github.com/mehditeymorian/pipetest/internal/diagnostics"
 	"github.com/mehditeymorian/pipetest/internal/parser"
@@ -701,8 +710,10 @@ func captureStdout(t *testing.T, fn func()) string {
 func mustCompilePlan(t *testing.T, path, src string) *compiler.Plan {
 	t.Helper()
 	plan, diags := compilePlan(t, path, src)
-	if len(diags) != 0 {
-		t.Fatalf("compile failed: %+v", diags)
+	for _, d := range diags {
+		if d.Severity == "error" {
+			t.Fatalf("compile failed: %+v", diags)
+		}
 	}
 	return plan
 }
@@ -767,3 +778,3084 @@ flow "inheritance":
 		t.Fatalf("expected child pre hook header, got %q", fromPre)
 	}
 }
+
+func TestExecuteIContainsBuiltin(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"message":"Order ACCEPTED for Processing"}`))
+	}))
+	defer srv.Close()
+
+	src := `
+base "` + srv.URL + `"
+
+req check:
+	GET /orders
+	? icontains(#.message, "accepted")
+	? icontains(#.message, "order accepted FOR processing")
+	? not icontains(#.message, "rejected")
+
+flow "icontains":
+	check
+`
+	plan := mustCompilePlan(t, "runtime-icontains.pt", src)
+	result := Execute(context.Background(), plan, Options{})
+	if len(result.Diags) != 0 {
+		t.Fatalf("expected no diagnostics, got %+v", result.Diags)
+	}
+}
+
+func TestExecuteSecretBuiltinUsesResolver(t *testing.T) {
+	authSeen := ""
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authSeen = r.Header.Get("Authorization")
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"ok":true}`))
+	}))
+	defer srv.Close()
+
+	src := `
+base "` + srv.URL + `"
+
+req secured:
+	GET /secured
+	auth bearer secret("payments/api-token")
+	? status == 200
+
+flow "secret":
+	secured
+`
+	plan := mustCompilePlan(t, "runtime-secret.pt", src)
+	resolver := func(path string) (string, error) {
+		if path != "payments/api-token" {
+			return "", fmt.Errorf("unexpected path %s", path)
+		}
+		return "s3cr3t", nil
+	}
+	result := Execute(context.Background(), plan, Options{SecretResolver: resolver})
+	if len(result.Diags) != 0 {
+		t.Fatalf("expected no diagnostics, got %+v", result.Diags)
+	}
+	if authSeen != "Bearer s3cr3t" {
+		t.Fatalf("expected resolved secret in header, got %q", authSeen)
+	}
+
+	failing := func(path string) (string, error) { return "", errors.New("vault sealed") }
+	result = Execute(context.Background(), plan, Options{SecretResolver: failing})
+	if len(result.Diags) != 1 || result.Diags[0].Code != "E_RUNTIME_SECRET" {
+		t.Fatalf("expected E_RUNTIME_SECRET, got %+v", result.Diags)
+	}
+	if !strings.Contains(result.Diags[0].Hint, "vault sealed") {
+		t.Fatalf("expected resolver error in hint, got %q", result.Diags[0].Hint)
+	}
+}
+
+func TestExecuteSecretBuiltinDefaultsToEnvironment(t *testing.T) {
+	t.Setenv("SECRET_PAYMENTS_API_TOKEN", "from-env")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"ok":true}`))
+	}))
+	defer srv.Close()
+
+	src := `
+base "` + srv.URL + `"
+
+let token = secret("payments/api-token")
+
+req check:
+	GET /check
+	? token == "from-env"
+
+flow "secret-env":
+	check
+`
+	plan := mustCompilePlan(t, "runtime-secret-env.pt", src)
+	result := Execute(context.Background(), plan, Options{})
+	if len(result.Diags) != 0 {
+		t.Fatalf("expected no diagnostics, got %+v", result.Diags)
+	}
+}
+
+func TestExecuteSharedRequestRunsOnceAcrossFlows(t *testing.T) {
+	logins := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/login":
+			logins++
+			_, _ = w.Write([]byte(`{"token":"abc"}`))
+		case "/me":
+			if r.Header.Get("Authorization") != "Bearer abc" {
+				w.WriteHeader(http.StatusUnauthorized)
+			}
+			_, _ = w.Write([]byte(`{}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	src := `
+base "` + srv.URL + `"
+
+req login:
+	shared
+	POST /login
+	? status == 200
+	let token = #.token
+
+req me:
+	GET /me
+	auth bearer token
+	? status == 200
+
+flow "first":
+	login -> me
+	? login.status == 200
+
+flow "second":
+	login -> me
+	? login.res.token == "abc"
+`
+	plan := mustCompilePlan(t, "runtime-shared.pt", src)
+	result := Execute(context.Background(), plan, Options{})
+	if len(result.Diags) != 0 {
+		t.Fatalf("expected no diagnostics, got %+v", result.Diags)
+	}
+	if logins != 1 {
+		t.Fatalf("expected shared login to run once, got %d", logins)
+	}
+	if len(result.Flows) != 2 || len(result.Flows[1].Steps) != 2 {
+		t.Fatalf("unexpected flow result: %+v", result.Flows)
+	}
+}
+
+func TestValidateReportsUndefinedDottedTemplateVariable(t *testing.T) {
+	src := `
+base "http://127.0.0.1:1"
+
+req login:
+	POST /login
+	let session = #.session
+
+req profile:
+	GET /users/{{session.user}}/orders/{{account.id}}
+
+flow "dotted":
+	login -> profile
+`
+	plan, diags := compilePlan(t, "runtime-validate.pt", src)
+	if len(diags) != 0 {
+		t.Fatalf("expected compiler to accept dotted templates, got %+v", diags)
+	}
+	got := Validate(plan)
+	if len(got) != 1 {
+		t.Fatalf("expected one diagnostic, got %+v", got)
+	}
+	if got[0].Code != "E_RUNTIME_MISSING_VARIABLE" || !strings.Contains(got[0].Hint, "account.id") {
+		t.Fatalf("unexpected diagnostic: %+v", got[0])
+	}
+	if got[0].Flow == nil || *got[0].Flow != "dotted" || got[0].Request == nil || *got[0].Request != "profile" {
+		t.Fatalf("expected flow/request context, got %+v", got[0])
+	}
+}
+
+func TestExecuteDottedTemplateVariables(t *testing.T) {
+	var gotPath string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"user":{"id":"u1"}}`))
+	}))
+	defer srv.Close()
+
+	src := `
+base "` + srv.URL + `"
+
+req me:
+	GET /me
+	let profile = #.user
+
+req orders:
+	GET /users/{{profile.id}}/orders
+
+flow "dotted":
+	me -> orders
+`
+	plan := mustCompilePlan(t, "runtime-dotted.pt", src)
+	result := Execute(context.Background(), plan, Options{})
+	if len(result.Diags) != 0 {
+		t.Fatalf("expected no diagnostics, got %+v", result.Diags)
+	}
+	if gotPath != "/users/u1/orders" {
+		t.Fatalf("unexpected rendered path: %q", gotPath)
+	}
+}
+
+func TestExecuteTimestampBuiltins(t *testing.T) {
+	recent := time.Now().Add(-2 * time.Second).UTC().Format(time.RFC3339)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"created_at":"2024-03-01T10:00:00Z","updated_at":1709290800,"seen_at":"` + recent + `"}`))
+	}))
+	defer srv.Close()
+
+	src := `
+base "` + srv.URL + `"
+
+req check:
+	GET /orders
+	? isBefore(#.created_at, #.updated_at)
+	? isAfter(#.updated_at, "2024-03-01T10:59:59Z")
+	? not isAfter(#.created_at, #.created_at)
+	? within(#.seen_at, "1m")
+	? within(now(), 5)
+	? not within(#.created_at, "1h")
+
+flow "timestamps":
+	check
+`
+	plan := mustCompilePlan(t, "runtime-timestamps.pt", src)
+	result := Execute(context.Background(), plan, Options{})
+	if len(result.Diags) != 0 {
+		t.Fatalf("expected no diagnostics, got %+v", result.Diags)
+	}
+}
+
+func TestExecuteParallelRequestsHonorsDependsOn(t *testing.T) {
+	var mu sync.Mutex
+	arrived, completed := 0, 0
+	both := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/a", "/b":
+			mu.Lock()
+			arrived++
+			if arrived == 2 {
+				close(both)
+			}
+			mu.Unlock()
+			select {
+			case <-both:
+			case <-time.After(2 * time.Second):
+				w.WriteHeader(http.StatusGatewayTimeout)
+			}
+			mu.Lock()
+			completed++
+			mu.Unlock()
+			_, _ = w.Write([]byte(`{"id":"` + strings.TrimPrefix(r.URL.Path, "/") + `"}`))
+		case "/c/a/b":
+			mu.Lock()
+			done := completed
+			mu.Unlock()
+			if done != 2 {
+				w.WriteHeader(http.StatusConflict)
+			}
+			_, _ = w.Write([]byte(`{}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	src := `
+base "` + srv.URL + `"
+
+req a:
+	GET /a
+	? status == 200
+	let first = #.id
+
+req b:
+	depends_on
+	GET /b
+	? status == 200
+	let second = #.id
+
+req c:
+	depends_on a, b
+	GET /c/:first/:second
+	? status == 200
+
+flow "fan-in":
+	a -> b -> c
+`
+	plan := mustCompilePlan(t, "runtime-parallel.pt", src)
+	result := Execute(context.Background(), plan, Options{ParallelRequests: 2})
+	if len(result.Diags) != 0 {
+		t.Fatalf("expected no diagnostics, got %+v", result.Diags)
+	}
+	if len(result.Flows) != 1 {
+		t.Fatalf("unexpected flow result: %+v", result.Flows)
+	}
+	var order []string
+	for _, step := range result.Flows[0].Steps {
+		order = append(order, step.Binding)
+	}
+	if got := strings.Join(order, ","); got != "a,b,c" {
+		t.Fatalf("expected deterministic step order, got %s", got)
+	}
+}
+
+func TestExecuteRequestAssertionsSeeFinalRequest(t *testing.T) {
+	var gotQuery, gotAuth, gotTrace string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotQuery = r.URL.RawQuery
+		gotAuth = r.Header.Get("Authorization")
+		gotTrace = r.Header.Get("X-Trace")
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+
+	src := `
+base "` + srv.URL + `"
+
+req list:
+	GET /items
+	query page = 2
+	header X-Trace = "directive"
+	pre hook {
+	  req.header["Authorization"] = "Bearer abc"
+	  req.header["X-Trace"] = "hook"
+	  req.query["size"] = 10
+	}
+	? req.url contains "page=2"
+	? req.url contains "size=10"
+	? req.header["Authorization"] == "Bearer abc"
+	? req.header["X-Trace"] == "hook"
+
+flow "final-request":
+	list
+	? list.req.url contains "page=2&size=10"
+`
+	plan := mustCompilePlan(t, "runtime-final-request.pt", src)
+	result := Execute(context.Background(), plan, Options{})
+	if len(result.Diags) != 0 {
+		t.Fatalf("expected no diagnostics, got %+v", result.Diags)
+	}
+	if gotQuery != "page=2&size=10" || gotAuth != "Bearer abc" || gotTrace != "hook" {
+		t.Fatalf("unexpected request sent: query=%q auth=%q trace=%q", gotQuery, gotAuth, gotTrace)
+	}
+}
+
+func TestExecuteXMLBodyDirective(t *testing.T) {
+	var gotBody, gotType string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw, _ := io.ReadAll(r.Body)
+		gotBody = string(raw)
+		gotType = r.Header.Get("Content-Type")
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+
+	src := `
+base "` + srv.URL + `"
+let sku = "A-1"
+
+req order:
+	POST /orders
+	xml """<order>
+	<sku>{{sku}}</sku>
+</order>"""
+	? status == 200
+	? req.header["Content-Type"] == "application/xml"
+
+flow "xml":
+	order
+`
+	plan := mustCompilePlan(t, "runtime-xml.pt", src)
+	result := Execute(context.Background(), plan, Options{})
+	if len(result.Diags) != 0 {
+		t.Fatalf("expected no diagnostics, got %+v", result.Diags)
+	}
+	if gotBody != "<order>\n\t<sku>A-1</sku>\n</order>" {
+		t.Fatalf("unexpected xml body: %q", gotBody)
+	}
+	if gotType != "application/xml" {
+		t.Fatalf("unexpected content type: %q", gotType)
+	}
+}
+
+func TestCompileXMLAndJSONBodiesConflict(t *testing.T) {
+	src := `
+req order:
+	POST /orders
+	json { sku: "A-1" }
+	xml """<order/>"""
+
+flow "xml":
+	order
+`
+	_, diags := compilePlan(t, "runtime-xml-conflict.pt", src)
+	if len(diags) != 1 || diags[0].Code != "E_SEM_MULTIPLE_BODIES" {
+		t.Fatalf("expected E_SEM_MULTIPLE_BODIES, got %+v", diags)
+	}
+}
+
+func TestExecuteMethodDirective(t *testing.T) {
+	var mu sync.Mutex
+	var methods []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		methods = append(methods, r.Method)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+
+	src := `
+base "` + srv.URL + `"
+let verb = "get"
+
+req item:
+	GET /items
+	method verb
+	? status == 200
+
+flow "a-read":
+	item
+
+flow "b-write":
+	let verb = "POST"
+	item
+
+flow "c-bogus":
+	let verb = "FETCH"
+	item
+`
+	plan := mustCompilePlan(t, "runtime-method.pt", src)
+	result := Execute(context.Background(), plan, Options{})
+	if !reflect.DeepEqual(methods, []string{"GET", "POST"}) {
+		t.Fatalf("unexpected methods sent: %v", methods)
+	}
+	if len(result.Diags) != 1 || result.Diags[0].Code != "E_RUNTIME_INVALID_METHOD" || *result.Diags[0].Flow != "c-bogus" {
+		t.Fatalf("expected E_RUNTIME_INVALID_METHOD for c-bogus, got %+v", result.Diags)
+	}
+}
+
+func TestCompileMethodDirectiveRejectsInvalidLiteral(t *testing.T) {
+	src := `
+req item:
+	GET /items
+	method "FETCH"
+
+req templated:
+	GET /items
+	method "{{verb}}"
+
+flow "method":
+	item -> templated
+`
+	_, diags := compilePlan(t, "runtime-method-invalid.pt", src)
+	if len(diags) != 2 || diags[0].Code != "E_SEM_INVALID_METHOD" || diags[1].Code != "E_SEM_UNDEFINED_VARIABLE" {
+		t.Fatalf("expected E_SEM_INVALID_METHOD and an undefined template variable, got %+v", diags)
+	}
+}
+
+func TestExecuteTextBodyDirective(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]string{"body": string(raw), "type": r.Header.Get("Content-Type")})
+	}))
+	defer srv.Close()
+
+	src := `
+base "` + srv.URL + `"
+let name = "ana"
+
+req note:
+	POST /echo
+	text "hello {{name}}"
+	? #.body == "hello ana"
+	? #.type == "text/plain"
+
+req soap(note):
+	header Content-Type = "text/xml"
+	text """<ping name="{{name}}"/>"""
+	? #.body == "<ping name=\"ana\"/>"
+	? #.type == "text/xml"
+
+flow "text":
+	note -> soap
+`
+	plan := mustCompilePlan(t, "runtime-text.pt", src)
+	result := Execute(context.Background(), plan, Options{})
+	if len(result.Diags) != 0 {
+		t.Fatalf("expected no diagnostics, got %+v", result.Diags)
+	}
+}
+
+func TestCompileTextAndJSONBodiesConflict(t *testing.T) {
+	src := `
+req note:
+	POST /notes
+	json { body: "hi" }
+	text "hi"
+
+flow "text":
+	note
+`
+	_, diags := compilePlan(t, "runtime-text-conflict.pt", src)
+	if len(diags) != 1 || diags[0].Code != "E_SEM_MULTIPLE_BODIES" {
+		t.Fatalf("expected E_SEM_MULTIPLE_BODIES, got %+v", diags)
+	}
+}
+
+func TestExecuteFormBodyDirective(t *testing.T) {
+	var gotBody, gotType string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw, _ := io.ReadAll(r.Body)
+		gotBody = string(raw)
+		gotType = r.Header.Get("Content-Type")
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"access_token":"t-1"}`))
+	}))
+	defer srv.Close()
+
+	src := `
+base "` + srv.URL + `"
+let client = "cli ent"
+
+req token:
+	POST /oauth/token
+	form { grant_type: "client_credentials", client_id: "{{client}}", scope: "read&write", ttl: 60 }
+	? status == 200
+	? req.header["Content-Type"] == "application/x-www-form-urlencoded"
+
+flow "oauth":
+	token
+`
+	plan := mustCompilePlan(t, "runtime-form.pt", src)
+	result := Execute(context.Background(), plan, Options{})
+	if len(result.Diags) != 0 {
+		t.Fatalf("expected no diagnostics, got %+v", result.Diags)
+	}
+	if gotBody != "client_id=cli+ent&grant_type=client_credentials&scope=read%26write&ttl=60" {
+		t.Fatalf("unexpected form body: %q", gotBody)
+	}
+	if gotType != "application/x-www-form-urlencoded" {
+		t.Fatalf("unexpected content type: %q", gotType)
+	}
+}
+
+func TestCompileFormAndJSONBodiesConflict(t *testing.T) {
+	src := `
+req token:
+	POST /oauth/token
+	json { grant_type: "password" }
+	form { grant_type: "password" }
+
+flow "oauth":
+	token
+`
+	_, diags := compilePlan(t, "runtime-form-conflict.pt", src)
+	if len(diags) != 1 || diags[0].Code != "E_SEM_MULTIPLE_BODIES" {
+		t.Fatalf("expected E_SEM_MULTIPLE_BODIES, got %+v", diags)
+	}
+}
+
+func TestExecuteLengthBuiltin(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"data":{"items":[1,2,3],"meta":{"a":1,"b":2},"name":"abcd","total":3}}`))
+	}))
+	defer srv.Close()
+
+	src := `
+base "` + srv.URL + `"
+
+req list:
+	GET /items
+	? length(#, "$.data.items") == 3
+	? length(#, "$.data.meta") == 2
+	? length(#, "$.data.name") == 4
+	? length(#, "$.data.missing") == 0
+	? length(#, "$.data.total") == 3
+
+flow "length":
+	list
+`
+	plan := mustCompilePlan(t, "runtime-length.pt", src)
+	result := Execute(context.Background(), plan, Options{})
+	if len(result.Diags) != 1 {
+		t.Fatalf("expected one diagnostic, got %+v", result.Diags)
+	}
+	if result.Diags[0].Code != "E_RUNTIME_EXPRESSION" || !strings.Contains(result.Diags[0].Hint, "length unsupported") {
+		t.Fatalf("expected length type error on the numeric field, got %+v", result.Diags[0])
+	}
+}
+
+func TestExecuteAllEqualAnyEqualBuiltins(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"active":[true,true],"mixed":["a","b","a"],"none":[],"tags":[{"k":1},{"k":2}]}`))
+	}))
+	defer srv.Close()
+
+	src := `
+base "` + srv.URL + `"
+
+req list:
+	GET /items
+	? allEqual(#.active, true)
+	? anyEqual(#.active, true)
+	? not allEqual(#.mixed, "a")
+	? anyEqual(#.mixed, "b")
+	? not anyEqual(#.mixed, "c")
+	? allEqual(#.none, 1)
+	? not anyEqual(#.none, 1)
+	? anyEqual(#.tags, { k: 2 })
+
+flow "collections":
+	list
+`
+	plan := mustCompilePlan(t, "runtime-all-any.pt", src)
+	result := Execute(context.Background(), plan, Options{})
+	if len(result.Diags) != 0 {
+		t.Fatalf("expected no diagnostics, got %+v", result.Diags)
+	}
+}
+
+func TestExecuteDefaultAcceptHeader(t *testing.T) {
+	var accepts []string
+	var mu sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		accepts = append(accepts, r.Header.Get("Accept"))
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+
+	src := `
+base "` + srv.URL + `"
+
+req plain:
+	GET /plain
+	? status == 200
+
+req explicit:
+	GET /explicit
+	header Accept = "text/plain"
+	? status == 200
+
+flow "accept":
+	plain -> explicit
+`
+	plan := mustCompilePlan(t, "runtime-accept.pt", src)
+
+	result := Execute(context.Background(), plan, Options{DefaultAccept: "application/json"})
+	if len(result.Diags) != 0 {
+		t.Fatalf("expected no diagnostics, got %+v", result.Diags)
+	}
+	if len(accepts) != 2 || accepts[0] != "application/json" || accepts[1] != "text/plain" {
+		t.Fatalf("unexpected Accept headers with default: %q", accepts)
+	}
+
+	accepts = nil
+	result = Execute(context.Background(), plan, Options{})
+	if len(result.Diags) != 0 {
+		t.Fatalf("expected no diagnostics, got %+v", result.Diags)
+	}
+	if len(accepts) != 2 || accepts[0] != "" || accepts[1] != "text/plain" {
+		t.Fatalf("unexpected Accept headers without default: %q", accepts)
+	}
+}
+
+func TestExecuteComparisonFailureHintShowsOperands(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"count":3}`))
+	}))
+	defer srv.Close()
+
+	src := `
+base "` + srv.URL + `"
+
+req equal:
+	GET /items
+	? #.count == 5
+
+req greater:
+	GET /items
+	? #.count > 5
+
+flow "equal":
+	equal
+
+flow "greater":
+	greater
+`
+	plan := mustCompilePlan(t, "runtime-comparison-hint.pt", src)
+	result := Execute(context.Background(), plan, Options{})
+	if len(result.Diags) != 2 {
+		t.Fatalf("expected 2 diagnostics, got %+v", result.Diags)
+	}
+	if got := result.Diags[0].Hint; got != "expected 5, got 3" {
+		t.Fatalf("unexpected == hint: %q", got)
+	}
+	if got := result.Diags[1].Hint; got != "expected a value > 5, got 3" {
+		t.Fatalf("unexpected > hint: %q", got)
+	}
+}
+
+func TestExecuteTemplatedBase(t *testing.T) {
+	var gotPath string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+
+	src := `
+base "http://{{host}}/{{version}}"
+let host = "` + strings.TrimPrefix(srv.URL, "http://") + `"
+
+req ping:
+	GET /ping
+	? status == 200
+
+flow "base":
+	let version = "v2"
+	ping
+`
+	plan := mustCompilePlan(t, "runtime-templated-base.pt", src)
+	result := Execute(context.Background(), plan, Options{})
+	if len(result.Diags) != 0 {
+		t.Fatalf("expected no diagnostics, got %+v", result.Diags)
+	}
+	if gotPath != "/v2/ping" {
+		t.Fatalf("unexpected request path: %q", gotPath)
+	}
+
+	if diags := Validate(plan); len(diags) != 0 {
+		t.Fatalf("expected templated base to validate, got %+v", diags)
+	}
+}
+
+func TestExecuteExpectBodyFailsOnEmptyResponse(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/full" {
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"id":1}`))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	src := `
+base "` + srv.URL + `"
+
+req full:
+	GET /full
+	expect_body
+	? status == 200
+
+req empty:
+	GET /empty
+	expect_body
+	? status == 200
+
+req unchecked:
+	GET /empty
+	? status == 200
+
+flow "body":
+	full -> unchecked -> empty
+`
+	plan := mustCompilePlan(t, "runtime-expect-body.pt", src)
+	result := Execute(context.Background(), plan, Options{})
+	if len(result.Diags) != 1 {
+		t.Fatalf("expected one diagnostic, got %+v", result.Diags)
+	}
+	d := result.Diags[0]
+	if d.Code != "E_ASSERT_EMPTY_BODY" || d.Request == nil || *d.Request != "empty" {
+		t.Fatalf("unexpected diagnostic: %+v", d)
+	}
+}
+
+func TestExecuteMatchesShapeBuiltin(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"user":{"id":7,"name":"ada","roles":["admin"],"meta":{},"active":true,"deleted_at":null}}`))
+	}))
+	defer srv.Close()
+
+	src := `
+base "` + srv.URL + `"
+
+req profile:
+	GET /profile
+	? matches(#.user, { id: "number", name: "string", roles: "array", meta: "object", active: "bool", deleted_at: "null" })
+	? not matches(#.user, { id: "string" })
+	? not matches(#.user, { email: "string" })
+	? not matches(#.user.name, { id: "number" })
+
+req badShape:
+	GET /profile
+	? matches(#.user, { id: "integer" })
+
+flow "shape":
+	profile
+
+flow "bad-shape":
+	badShape
+`
+	plan := mustCompilePlan(t, "runtime-matches.pt", src)
+	result := Execute(context.Background(), plan, Options{})
+	if len(result.Diags) != 1 {
+		t.Fatalf("expected one diagnostic, got %+v", result.Diags)
+	}
+	if d := result.Diags[0]; d.Code != "E_RUNTIME_EXPRESSION" || !strings.Contains(d.Hint, `unknown type "integer"`) {
+		t.Fatalf("unexpected diagnostic: %+v", d)
+	}
+}
+
+func TestExecuteNumericHeaderComparisons(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-RateLimit-Remaining", "42")
+		w.Header().Add("X-Retry", "3")
+		w.Header().Add("X-Retry", "9")
+		w.Header().Set("X-Name", "ada")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	src := `
+base "` + srv.URL + `"
+
+req limits:
+	GET /limits
+	? header["X-Ratelimit-Remaining"] > 10
+	? headerNum("x-ratelimit-remaining") >= 42
+	? headerNum("X-Retry") == 3
+
+req badHeader:
+	GET /limits
+	? headerNum("X-Name") > 0
+
+flow "limits":
+	limits
+
+flow "bad-header":
+	badHeader
+`
+	plan := mustCompilePlan(t, "runtime-header-num.pt", src)
+	result := Execute(context.Background(), plan, Options{})
+	if len(result.Diags) != 1 {
+		t.Fatalf("expected one diagnostic, got %+v", result.Diags)
+	}
+	if d := result.Diags[0]; d.Code != "E_RUNTIME_EXPRESSION" || !strings.Contains(d.Hint, `"ada" is not a number`) {
+		t.Fatalf("unexpected diagnostic: %+v", d)
+	}
+}
+
+func TestExecuteRawPathParamKeepsSlashes(t *testing.T) {
+	var paths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.EscapedPath())
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	src := `
+base "` + srv.URL + `"
+let file_path = "docs/read me.txt"
+
+req escaped:
+	GET /files/:file_path
+
+req raw:
+	GET /files/:file_path*/meta
+
+flow "paths":
+	escaped -> raw
+`
+	plan := mustCompilePlan(t, "runtime-raw-path.pt", src)
+	result := Execute(context.Background(), plan, Options{})
+	if len(result.Diags) != 0 {
+		t.Fatalf("unexpected diagnostics: %+v", result.Diags)
+	}
+	want := []string{"/files/docs%2Fread%20me.txt", "/files/docs/read%20me.txt/meta"}
+	if strings.Join(paths, " ") != strings.Join(want, " ") {
+		t.Fatalf("expected paths %v, got %v", want, paths)
+	}
+}
+
+func TestExecuteRedirectCount(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/start":
+			http.Redirect(w, r, "/hop", http.StatusFound)
+		case "/hop":
+			http.Redirect(w, r, "/final", http.StatusFound)
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"ok":true}`))
+		}
+	}))
+	defer srv.Close()
+
+	src := `
+base "` + srv.URL + `"
+
+req start:
+	GET /start
+	? res.redirectCount == 2
+	? #.ok == true
+
+req direct:
+	GET /final
+	? res.redirectCount == 0
+
+flow "redirects":
+	start -> direct
+	? start.res.redirectCount == 2
+`
+	plan := mustCompilePlan(t, "runtime-redirects.pt", src)
+	result := Execute(context.Background(), plan, Options{})
+	if len(result.Diags) != 0 {
+		t.Fatalf("unexpected diagnostics: %+v", result.Diags)
+	}
+}
+
+func TestExecuteResponseContentType(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/plain" {
+			_, _ = w.Write([]byte("hi"))
+			return
+		}
+		w.Header().Set("Content-Type", "Application/JSON; charset=utf-8")
+		_, _ = w.Write([]byte(`{"contentType":"body"}`))
+	}))
+	defer srv.Close()
+
+	src := `
+base "` + srv.URL + `"
+
+req typed:
+	GET /json
+	? res.contentType == "application/json"
+	? #.contentType == "body"
+
+req plain:
+	GET /plain
+	? res.contentType == "text/plain"
+
+flow "types":
+	typed -> plain
+	? typed.res.contentType == "application/json"
+`
+	plan := mustCompilePlan(t, "runtime-content-type.pt", src)
+	result := Execute(context.Background(), plan, Options{})
+	if len(result.Diags) != 0 {
+		t.Fatalf("unexpected diagnostics: %+v", result.Diags)
+	}
+}
+
+func TestExecuteResponseProto(t *testing.T) {
+	h2 := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprintf(w, `{"proto":%q}`, r.Proto)
+	}))
+	h2.EnableHTTP2 = true
+	h2.StartTLS()
+	defer h2.Close()
+	h1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer h1.Close()
+
+	src := `
+req modern:
+	GET ` + h2.URL + `/
+	? res.proto == "HTTP/2.0"
+	? #.proto == "HTTP/2.0"
+
+req legacy:
+	GET ` + h1.URL + `/
+	? res.proto == "HTTP/1.1"
+
+flow "protocols":
+	modern -> legacy
+	? modern.res.proto == "HTTP/2.0"
+`
+	plan := mustCompilePlan(t, "runtime-proto.pt", src)
+	result := Execute(context.Background(), plan, Options{Client: h2.Client()})
+	if len(result.Diags) != 0 {
+		t.Fatalf("unexpected diagnostics: %+v", result.Diags)
+	}
+}
+
+func TestExecuteExportedImportedLets(t *testing.T) {
+	var got string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("X-Api-Url")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	shared := `
+let host = "` + srv.URL + `"
+export let api_url = host + "/v1"
+`
+	src := `
+import "shared.pt"
+let host = "entry"
+
+req ping:
+	GET {{api_url}}/ping
+	header X-Api-Url = api_url
+	? status == 200
+
+flow "ping":
+	ping
+	? host == "entry"
+`
+	var mods []compiler.Module
+	for _, f := range []struct{ path, src string }{{"main.pt", src}, {"shared.pt", shared}} {
+		prog, lexErrs, parseErrs := parser.Parse(f.path, f.src)
+		if len(lexErrs) != 0 || len(parseErrs) != 0 {
+			t.Fatalf("parse failed: lex=%+v parse=%+v", lexErrs, parseErrs)
+		}
+		mods = append(mods, compiler.Module{Path: f.path, Program: prog})
+	}
+	plan, diags := compiler.Compile("main.pt", mods)
+	if len(diags) != 0 {
+		t.Fatalf("compile failed: %+v", diags)
+	}
+	result := Execute(context.Background(), plan, Options{})
+	if len(result.Diags) != 0 {
+		t.Fatalf("unexpected diagnostics: %+v", result.Diags)
+	}
+	if got != srv.URL+"/v1" {
+		t.Fatalf("expected exported let built from the private host, got %q", got)
+	}
+}
+
+func TestExecuteStepPause(t *testing.T) {
+	var hits []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits = append(hits, r.URL.Path)
+		if r.URL.Path == "/second" {
+			w.WriteHeader(http.StatusCreated)
+		}
+	}))
+	defer srv.Close()
+
+	src := `
+base "` + srv.URL + `"
+
+req first:
+	GET /first
+
+req second:
+	GET /second
+
+flow "one":
+	first -> second:created
+	? created.status == 201
+
+flow "two":
+	second
+`
+	plan := mustCompilePlan(t, "runtime-step.pt", src)
+	var paused []StepResult
+	script := []bool{true, true}
+	opt := Options{StepPause: func(fr FlowResult, sr StepResult) bool {
+		if fr.Name != "one" || len(fr.Steps) != len(paused)+1 || fr.Steps[len(fr.Steps)-1] != sr {
+			t.Fatalf("unexpected flow state %+v for step %+v", fr, sr)
+		}
+		paused = append(paused, sr)
+		next := script[0]
+		script = script[1:]
+		return next
+	}}
+	plan.Flows = plan.Flows[:1]
+	result := Execute(context.Background(), plan, opt)
+	want := []StepResult{
+		{Request: "first", Binding: "first", Status: 200},
+		{Request: "second", Binding: "created", Status: 201},
+	}
+	if !reflect.DeepEqual(paused, want) {
+		t.Fatalf("unexpected paused steps: %+v", paused)
+	}
+	if len(result.Diags) != 0 || len(result.Flows) != 1 {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+
+	plan = mustCompilePlan(t, "runtime-step.pt", src)
+	hits, paused = nil, nil
+	script = []bool{false}
+	result = Execute(context.Background(), plan, opt)
+	if len(paused) != 1 || !reflect.DeepEqual(hits, []string{"/first"}) || len(result.Flows) != 1 || len(result.Diags) != 0 {
+		t.Fatalf("expected the run to stop after the first step, got hits %v flows %+v diags %+v", hits, result.Flows, result.Diags)
+	}
+	wantNotRun := []NotRunStep{{Flow: "one", Index: 1}, {Flow: "two", Index: 0}}
+	if !result.Stopped || !reflect.DeepEqual(result.NotRun, wantNotRun) {
+		t.Fatalf("expected the unreached steps to be listed, got stopped=%v %+v", result.Stopped, result.NotRun)
+	}
+}
+
+func TestExecuteLargeIntegerIDsCompareExactly(t *testing.T) {
+	var paths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":9007199254740993,"ids":[1,9007199254740993],"ratio":1.5,"count":3}`))
+	}))
+	defer srv.Close()
+
+	src := `
+base "` + srv.URL + `"
+
+req item:
+	GET /item
+	? #.id == 9007199254740993
+	? #.id != 9007199254740992
+	? #.id > 9007199254740992
+	? 9007199254740993 in #.ids
+	? isInt(#.id)
+	? #.ratio == 1.5
+	? #.count == 3
+	? #.count + 1 == 4
+	let id = #.id
+
+req fetch:
+	GET /items/{{id}}
+
+flow "ids":
+	item -> fetch
+`
+	plan := mustCompilePlan(t, "runtime-bigint.pt", src)
+	result := Execute(context.Background(), plan, Options{})
+	if len(result.Diags) != 0 {
+		t.Fatalf("unexpected diagnostics: %+v", result.Diags)
+	}
+	if len(paths) != 2 || paths[1] != "/items/9007199254740993" {
+		t.Fatalf("expected the id to be interpolated exactly, got %v", paths)
+	}
+}
+
+func TestAssertionLoggerOrdersConcurrentFlows(t *testing.T) {
+	var out bytes.Buffer
+	l := newAssertionLogger(Options{LogWriter: &out, MaxAssertions: 3}, []string{"first", "second"})
+	expr := &ast.BinaryExpr{Op: ast.BinaryEq, Left: &ast.IdentExpr{Name: "status"}, Right: &ast.NumberLit{Raw: "200"}}
+
+	var wg sync.WaitGroup
+	for _, flow := range []string{"second", "first"} {
+		for _, target := range []string{"a", "b"} {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 5; i++ {
+					l.log(flow, target, expr, i%2 == 0)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+	l.log("second", "", expr, true)
+	l.flowDone("second")
+	if out.Len() != 0 {
+		t.Fatalf("expected second flow to wait for the first, got:\n%s", out.String())
+	}
+	l.flowDone("first")
+	l.flush()
+
+	section := func(target string) []string {
+		return []string{"  - " + target, "    - assertion status == 200 ✅", "    - assertion status == 200 ❌", "    - assertion status == 200 ✅", "    ... (+2 more)"}
+	}
+	got := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(got) != 23 || got[0] != "- flow first" || got[11] != "- flow second" || got[22] != "  - assertion status == 200 ✅" {
+		t.Fatalf("unexpected assertion log:\n%s", out.String())
+	}
+	for _, start := range []int{1, 6, 12, 17} {
+		target := strings.TrimPrefix(got[start], "  - ")
+		if !reflect.DeepEqual(got[start:start+5], section(target)) {
+			t.Fatalf("interleaved section at line %d:\n%s", start+1, out.String())
+		}
+	}
+}
+
+func TestExecuteSharedVars(t *testing.T) {
+	var seen []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/login" {
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"token":"abc"}`))
+			return
+		}
+		seen = append(seen, r.Header.Get("Authorization"))
+	}))
+	defer srv.Close()
+
+	src := `
+base "` + srv.URL + `"
+let token = "none"
+
+req login:
+	POST /login
+	let token = #.token
+
+req me:
+	GET /me
+	header Authorization = "Bearer {{token}}"
+
+flow "b profile":
+	me
+
+flow "a login":
+	login -> me
+`
+	plan := mustCompilePlan(t, "runtime-shared-vars.pt", src)
+	result := Execute(context.Background(), plan, Options{})
+	if len(result.Diags) != 0 {
+		t.Fatalf("unexpected diagnostics: %+v", result.Diags)
+	}
+	if !reflect.DeepEqual(seen, []string{"Bearer abc", "Bearer none"}) {
+		t.Fatalf("expected flows to be isolated by default, got %v", seen)
+	}
+
+	seen = nil
+	result = Execute(context.Background(), plan, Options{SharedVars: true})
+	if len(result.Diags) != 0 {
+		t.Fatalf("unexpected diagnostics: %+v", result.Diags)
+	}
+	if !reflect.DeepEqual(seen, []string{"Bearer abc", "Bearer abc"}) {
+		t.Fatalf("expected the login flow's token in the later flow, got %v", seen)
+	}
+}
+
+func TestExecuteBasicAuth(t *testing.T) {
+	var got []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, r.Header.Get("Authorization"))
+		user, pass, ok := r.BasicAuth()
+		if !ok || user != "alice" || pass != "p@ss:word" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer srv.Close()
+
+	src := `
+base "` + srv.URL + `"
+let user = "alice"
+
+req login:
+	GET /reports
+	auth basic user "p@ss:word"
+	? status == 200
+
+req wrong(login):
+	auth basic "{{user}}" "nope"
+	? status == 401
+
+flow "legacy":
+	login -> wrong
+`
+	plan := mustCompilePlan(t, "runtime-basic-auth.pt", src)
+	result := Execute(context.Background(), plan, Options{})
+	if len(result.Diags) != 0 {
+		t.Fatalf("unexpected diagnostics: %+v", result.Diags)
+	}
+	want := []string{"Basic YWxpY2U6cEBzczp3b3Jk", "Basic YWxpY2U6bm9wZQ=="}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected Authorization headers: %v", got)
+	}
+}
+
+func TestExecuteOptionalChainingThroughNull(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"user":{"name":"ana","address":null}}`))
+	}))
+	defer srv.Close()
+
+	src := `
+base "` + srv.URL + `"
+
+req profile:
+	GET /profile
+	? #.user?.address?.city == null
+	? #?.user?.name == "ana"
+	let city = #.user.address?.city
+
+flow "optional":
+	profile
+	? city == null
+`
+	plan := mustCompilePlan(t, "runtime-optional.pt", src)
+	result := Execute(context.Background(), plan, Options{})
+	if len(result.Diags) != 0 {
+		t.Fatalf("unexpected diagnostics: %+v", result.Diags)
+	}
+
+	strict := strings.Replace(src, "#.user?.address?.city", "#.user.address.city", 1)
+	plan = mustCompilePlan(t, "runtime-optional-strict.pt", strict)
+	result = Execute(context.Background(), plan, Options{})
+	if len(result.Diags) == 0 || result.Diags[0].Hint != "field access on non-object" {
+		t.Fatalf("expected field access diagnostic without ?., got %+v", result.Diags)
+	}
+}
+
+func TestExecuteBodyIdentifier(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/page" {
+			w.Header().Set("Content-Type", "text/html")
+			_, _ = w.Write([]byte("<html><h1>hi</h1></html>"))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"ok":true}`))
+	}))
+	defer srv.Close()
+
+	src := `
+base "` + srv.URL + `"
+
+req page:
+	GET /page
+	? status == 200
+	? body contains "<html>"
+	? len(body) == 24
+
+req api:
+	GET /api
+	? #.ok == true
+	? body == "{\"ok\":true}"
+
+flow "bodies":
+	page -> api
+	? page.body contains "<h1>hi</h1>"
+	? api.res.ok == true
+`
+	plan := mustCompilePlan(t, "runtime-body.pt", src)
+	result := Execute(context.Background(), plan, Options{})
+	if len(result.Diags) != 0 {
+		t.Fatalf("expected no diagnostics, got %+v", result.Diags)
+	}
+}
+
+func TestExecuteVariablesShadowResponseIdentifiers(t *testing.T) {
+	var gotBody string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/send" {
+			raw, _ := io.ReadAll(r.Body)
+			gotBody = string(raw)
+		}
+		_, _ = w.Write([]byte("pong"))
+	}))
+	defer srv.Close()
+
+	src := `
+base "` + srv.URL + `"
+let body = "hello"
+let elapsed_ms = 5
+
+req send:
+	POST /send
+	json { msg: body, took: elapsed_ms }
+	? body == "hello"
+	? elapsed_ms == 5
+	? status_text == "OK"
+
+req status_text:
+	GET /status
+
+flow "shadow":
+	send -> status_text
+	? status_text.status == 200
+`
+	plan := mustCompilePlan(t, "runtime-shadow.pt", src)
+	result := Execute(context.Background(), plan, Options{})
+	if len(result.Diags) != 0 {
+		t.Fatalf("expected no diagnostics, got %+v", result.Diags)
+	}
+	if gotBody != `{"msg":"hello","took":5}` {
+		t.Fatalf("expected the variables in the body, got %s", gotBody)
+	}
+}
+
+func TestExecuteElapsedMs(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(30 * time.Millisecond)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+
+	src := `
+base "` + srv.URL + `"
+
+req slow:
+	GET /slow
+	? elapsed_ms >= 30
+	? elapsed_ms < 10000
+
+flow "latency":
+	slow
+	? slow.elapsed_ms >= 30
+`
+	plan := mustCompilePlan(t, "runtime-elapsed.pt", src)
+	result := Execute(context.Background(), plan, Options{})
+	if len(result.Diags) != 0 {
+		t.Fatalf("expected no diagnostics, got %+v", result.Diags)
+	}
+}
+
+func TestExecuteStatusTextAndClass(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/gone" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	src := `
+base "` + srv.URL + `"
+
+req ping:
+	GET /ping
+	? status_text == "No Content"
+	? status_class() == 2
+
+req missing:
+	GET /gone
+	? status_text == "Not Found"
+	? status_class() == 4
+
+flow "status":
+	ping -> missing
+	? missing.status_text == "Not Found"
+	? status_class(ping.status) == 2
+	? status_class(missing.status) == 4
+`
+	plan := mustCompilePlan(t, "runtime-status-class.pt", src)
+	result := Execute(context.Background(), plan, Options{})
+	if len(result.Diags) != 0 {
+		t.Fatalf("expected no diagnostics, got %+v", result.Diags)
+	}
+}
+
+func TestExecuteIsEmptyArrayAndIsMissing(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"empty":[],"items":[1,2],"name":""}`))
+	}))
+	defer srv.Close()
+
+	src := `
+base "` + srv.URL + `"
+
+req list:
+	GET /list
+	? isEmptyArray(#.empty)
+	? not isMissing(#.empty)
+	? not isEmptyArray(#.items)
+	? not isMissing(#.items)
+	? not isEmptyArray(#.absent)
+	? isMissing(#.absent)
+	? not isEmptyArray(#.name)
+	? not isMissing(#.name)
+
+flow "collections":
+	list
+`
+	plan := mustCompilePlan(t, "runtime-empty-missing.pt", src)
+	result := Execute(context.Background(), plan, Options{})
+	if len(result.Diags) != 0 {
+		t.Fatalf("expected no diagnostics, got %+v", result.Diags)
+	}
+}
+
+func TestExecuteDefaultBuiltin(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"name":"widget","stock":0}`))
+	}))
+	defer srv.Close()
+
+	src := `
+base "` + srv.URL + `"
+
+req item:
+	GET /item
+	? default(#.count, 0) >= 0
+	? default(#.count, 7) == 7
+	? default(#.stock, 7) == 0
+	? default(#.name, "none") == "widget"
+
+flow "defaults":
+	item
+`
+	plan := mustCompilePlan(t, "runtime-default.pt", src)
+	result := Execute(context.Background(), plan, Options{})
+	if len(result.Diags) != 0 {
+		t.Fatalf("expected no diagnostics, got %+v", result.Diags)
+	}
+
+	plan = mustCompilePlan(t, "runtime-default-arity.pt", strings.Replace(src, "default(#.count, 0)", "default(#.count)", 1))
+	result = Execute(context.Background(), plan, Options{})
+	if len(result.Diags) != 1 || !strings.Contains(result.Diags[0].Hint, "default expects 2 args") {
+		t.Fatalf("expected an arity error, got %+v", result.Diags)
+	}
+}
+
+func TestExecuteHumanBytesAndParseBytes(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"size":1500000}`))
+	}))
+	defer srv.Close()
+
+	src := `
+base "` + srv.URL + `"
+
+req upload:
+	GET /upload
+	? humanBytes(#.size) == "1.5 MB"
+	? parseBytes("1.5MB") == #.size
+	? humanBytes(512) == "512 B"
+	? humanBytes(999999) == "1 MB"
+	? parseBytes("2 kib") == 2048
+	? parseBytes("512") == 512
+	? parseBytes(humanBytes(1500)) == 1500
+	? parseBytes(humanBytes(3000000000)) == 3000000000
+
+flow "sizes":
+	upload
+`
+	plan := mustCompilePlan(t, "runtime-bytes.pt", src)
+	result := Execute(context.Background(), plan, Options{})
+	if len(result.Diags) != 0 {
+		t.Fatalf("expected no diagnostics, got %+v", result.Diags)
+	}
+
+	plan = mustCompilePlan(t, "runtime-bytes-invalid.pt", strings.Replace(src, `parseBytes("512")`, `parseBytes("12 parsecs")`, 1))
+	result = Execute(context.Background(), plan, Options{})
+	if len(result.Diags) != 1 || !strings.Contains(result.Diags[0].Hint, `invalid size "12 parsecs"`) {
+		t.Fatalf("expected an invalid size error, got %+v", result.Diags)
+	}
+}
+
+func TestExecuteStringCaseAndTrimBuiltins(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"status":"  Active\n","code":"eu-west"}`))
+	}))
+	defer srv.Close()
+
+	src := `
+base "` + srv.URL + `"
+
+req account:
+	GET /account
+	? trim(#.status) == "Active"
+	? lower(trim(#.status)) == "active"
+	? upper(#.code) == "EU-WEST"
+	? lower("MiXeD") == "mixed"
+	? upper(true) == "TRUE"
+
+flow "normalize":
+	account
+`
+	plan := mustCompilePlan(t, "runtime-string-builtins.pt", src)
+	result := Execute(context.Background(), plan, Options{})
+	if len(result.Diags) != 0 {
+		t.Fatalf("expected no diagnostics, got %+v", result.Diags)
+	}
+}
+
+func TestExecuteSplitAndJoinBuiltins(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Ids", "a1,b2,c3")
+		_, _ = w.Write([]byte(`{"tags":["red","green"],"mixed":["v",2,true],"nested":[["x"]]}`))
+	}))
+	defer srv.Close()
+
+	src := `
+base "` + srv.URL + `"
+
+req list:
+	GET /list
+	? len(split(header["X-Ids"], ",")) == 3
+	? split(header["X-Ids"], ",")[1] == "b2"
+	? split("", ",") == [""]
+	? join(#.tags, ", ") == "red, green"
+	? join(#.mixed, "-") == "v-2-true"
+	? join(split("a.b.c", "."), "/") == "a/b/c"
+
+flow "lists":
+	list
+`
+	plan := mustCompilePlan(t, "runtime-split-join.pt", src)
+	result := Execute(context.Background(), plan, Options{})
+	if len(result.Diags) != 0 {
+		t.Fatalf("expected no diagnostics, got %+v", result.Diags)
+	}
+
+	for expr, want := range map[string]string{
+		`join(#.nested, ",") == ""`: "join: element 0 is",
+		`join("abc", ",") == ""`:    "is not an array",
+		`split(#.tags, ",") == []`:  "split: [",
+		`split("a,b", 1) == []`:     "separator 1 is not a string",
+	} {
+		bad := strings.Replace(src, `join(#.tags, ", ") == "red, green"`, expr, 1)
+		plan := mustCompilePlan(t, "runtime-split-join-invalid.pt", bad)
+		result := Execute(context.Background(), plan, Options{})
+		if len(result.Diags) != 1 || !strings.Contains(result.Diags[0].Hint, want) {
+			t.Fatalf("%s: expected %q, got %+v", expr, want, result.Diags)
+		}
+	}
+}
+
+func TestExecuteRequestRenderingIsStableAcrossRuns(t *testing.T) {
+	var mu sync.Mutex
+	var queries []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		queries = append(queries, r.URL.RawQuery)
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	src := `
+base "` + srv.URL + `"
+
+req search:
+	GET /search
+	header X-Zeta = "z"
+	header X-Alpha = "a"
+	query zeta = 1
+	query alpha = 2
+	query tag = ["b", "a"]
+	query mid = "m"
+	? req.url == "` + srv.URL + `/search?alpha=2&mid=m&tag=b&tag=a&zeta=1"
+
+flow "search":
+	search
+`
+	plan := mustCompilePlan(t, "runtime-stable-rendering.pt", src)
+	var firstLog string
+	for i := 0; i < 5; i++ {
+		var log bytes.Buffer
+		result := Execute(context.Background(), plan, Options{Verbose: true, LogWriter: &log})
+		if len(result.Diags) != 0 {
+			t.Fatalf("run %d: expected no diagnostics, got %+v", i, result.Diags)
+		}
+		if i == 0 {
+			firstLog = log.String()
+		} else if log.String() != firstLog {
+			t.Fatalf("run %d: log differs:\n%s\nvs\n%s", i, log.String(), firstLog)
+		}
+	}
+	for i, q := range queries {
+		if q != "alpha=2&mid=m&tag=b&tag=a&zeta=1" {
+			t.Fatalf("run %d: expected sorted query, got %q", i, q)
+		}
+	}
+}
+
+func TestExecuteSkipsAssertionScopes(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	src := `
+base "` + srv.URL + `"
+
+req bad:
+	GET /bad
+	? status == 500
+
+req good:
+	GET /good
+	? status == 200
+
+flow "request-fails":
+	bad
+
+flow "flow-fails":
+	good
+	? good.status == 500
+`
+	plan := mustCompilePlan(t, "runtime-assert-scopes.pt", src)
+
+	result := Execute(context.Background(), plan, Options{})
+	if len(result.Diags) != 2 {
+		t.Fatalf("expected both scopes to fail by default, got %+v", result.Diags)
+	}
+
+	var log bytes.Buffer
+	result = Execute(context.Background(), plan, Options{SkipRequestAsserts: true, LogWriter: &log})
+	if len(result.Diags) != 1 || result.Diags[0].Message != "flow assertion failed" {
+		t.Fatalf("expected only the flow assertion to fail, got %+v", result.Diags)
+	}
+	if result.Assertions != (AssertionCounts{Failed: 1, Skipped: 2}) {
+		t.Fatalf("unexpected counts: %+v", result.Assertions)
+	}
+	if !strings.Contains(log.String(), "- assertion status == 500 ⏭️ skipped") {
+		t.Fatalf("expected skipped request assertions in the log, got:\n%s", log.String())
+	}
+	wantSkipped := []SkippedAssertion{{Flow: "flow-fails", Request: "good"}, {Flow: "request-fails", Request: "bad"}}
+	if !reflect.DeepEqual(result.Skipped, wantSkipped) {
+		t.Fatalf("unexpected skipped assertions: %+v", result.Skipped)
+	}
+
+	log.Reset()
+	result = Execute(context.Background(), plan, Options{SkipFlowAsserts: true, LogWriter: &log})
+	if len(result.Diags) != 1 || result.Diags[0].Message != "request assertion failed" {
+		t.Fatalf("expected only the request assertion to fail, got %+v", result.Diags)
+	}
+	if result.Assertions != (AssertionCounts{Passed: 1, Failed: 1, Skipped: 1}) {
+		t.Fatalf("unexpected counts: %+v", result.Assertions)
+	}
+	if !strings.Contains(log.String(), "- assertion good.status == 500 ⏭️ skipped") {
+		t.Fatalf("expected the skipped flow assertion in the log, got:\n%s", log.String())
+	}
+	if want := []SkippedAssertion{{Flow: "flow-fails", FlowLevel: true}}; !reflect.DeepEqual(result.Skipped, want) {
+		t.Fatalf("unexpected skipped assertions: %+v", result.Skipped)
+	}
+}
+
+func TestExecuteKeysAndContainsKey(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"metadata":{"trace_id":"t-1","span":null,"region":"eu","attempt":2}}`))
+	}))
+	defer srv.Close()
+
+	src := `
+base "` + srv.URL + `"
+
+req trace:
+	GET /trace
+	? keys(#.metadata) == ["attempt", "region", "span", "trace_id"]
+	? len(keys(#.metadata)) == 4
+	? keys({}) == []
+	? contains_key(#.metadata, "trace_id")
+	? contains_key(#.metadata, "span")
+	? not contains_key(#.metadata, "user")
+
+flow "metadata":
+	trace
+`
+	plan := mustCompilePlan(t, "runtime-keys.pt", src)
+	result := Execute(context.Background(), plan, Options{})
+	if len(result.Diags) != 0 {
+		t.Fatalf("expected no diagnostics, got %+v", result.Diags)
+	}
+
+	plan = mustCompilePlan(t, "runtime-keys-invalid.pt", strings.Replace(src, `len(keys(#.metadata))`, `len(keys(#.metadata.region))`, 1))
+	result = Execute(context.Background(), plan, Options{})
+	if len(result.Diags) != 1 || !strings.Contains(result.Diags[0].Hint, `keys: "eu" is not an object`) {
+		t.Fatalf("expected a non-object error, got %+v", result.Diags)
+	}
+}
+
+func TestExecuteRecordThenReplay(t *testing.T) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := hits.Add(1)
+		if r.URL.Path == "/flaky" && n == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Served", r.Method+" "+r.URL.Path)
+		_, _ = w.Write([]byte(`{"id":7}`))
+	}))
+
+	src := `
+base "` + srv.URL + `"
+
+req flaky:
+	GET /flaky
+	retry 2 every 1ms
+	? status == 200
+
+req create:
+	POST /items
+	json { name: "widget" }
+	? status == 200
+	? #.id == 7
+	? header["X-Served"] == "POST /items"
+
+flow "recorded":
+	flaky -> create
+`
+	plan := mustCompilePlan(t, "runtime-record.pt", src)
+	dir := t.TempDir()
+	result := Execute(context.Background(), plan, Options{Client: &http.Client{Transport: NewRecordingTransport(dir, nil)}})
+	if len(result.Diags) != 0 {
+		t.Fatalf("record: expected no diagnostics, got %+v", result.Diags)
+	}
+	if hits.Load() != 3 {
+		t.Fatalf("record: expected 3 requests including the retry, got %d", hits.Load())
+	}
+	srv.Close()
+
+	result = Execute(context.Background(), plan, Options{Client: &http.Client{Transport: NewReplayTransport(dir)}})
+	if len(result.Diags) != 0 {
+		t.Fatalf("replay: expected the final recorded responses, got %+v", result.Diags)
+	}
+	if hits.Load() != 3 {
+		t.Fatalf("replay: expected no network requests, got %d", hits.Load()-3)
+	}
+
+	result = Execute(context.Background(), plan, Options{Client: &http.Client{Transport: NewReplayTransport(t.TempDir())}})
+	if len(result.Diags) == 0 || result.Diags[0].Code != "E_RUNTIME_TRANSPORT" || !strings.Contains(result.Diags[0].Hint, "no recording for GET "+srv.URL+"/flaky") {
+		t.Fatalf("expected a missing recording error, got %+v", result.Diags)
+	}
+}
+
+func TestExecuteDeleteWithJSONBody(t *testing.T) {
+	var gotMethod, gotBody string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw, _ := io.ReadAll(r.Body)
+		gotMethod, gotBody = r.Method, string(raw)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	src := `
+base "` + srv.URL + `"
+
+req remove:
+	DELETE /items/1
+	json { reason: "duplicate" }
+	? status == 204
+
+flow "cleanup":
+	remove
+`
+	plan := mustCompilePlan(t, "runtime-delete-body.pt", src)
+	result := Execute(context.Background(), plan, Options{})
+	if len(result.Diags) != 0 {
+		t.Fatalf("expected no diagnostics, got %+v", result.Diags)
+	}
+	if gotMethod != http.MethodDelete || gotBody != `{"reason":"duplicate"}` {
+		t.Fatalf("unexpected request: %s %q", gotMethod, gotBody)
+	}
+}
+
+func TestExecuteRetryDirective(t *testing.T) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if hits.Add(1) <= 2 {
+			_, _ = w.Write([]byte(`{"state":"pending"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"state":"ready"}`))
+	}))
+	defer srv.Close()
+
+	src := `
+base "` + srv.URL + `"
+
+req job:
+	GET /job
+	retry 2 every 10ms
+	? #.state == "ready"
+	let state = #.state
+
+flow "poll":
+	job
+	? state == "ready"
+`
+	plan := mustCompilePlan(t, "runtime-retry.pt", src)
+	var log bytes.Buffer
+	result := Execute(context.Background(), plan, Options{LogWriter: &log})
+	if len(result.Diags) != 0 {
+		t.Fatalf("expected no diagnostics, got %+v", result.Diags)
+	}
+	if hits.Load() != 3 {
+		t.Fatalf("expected 3 attempts, got %d", hits.Load())
+	}
+	if strings.Contains(log.String(), "❌") || result.Assertions != (AssertionCounts{Passed: 2}) {
+		t.Fatalf("expected only the final attempt to be logged, got counts %+v and log:\n%s", result.Assertions, log.String())
+	}
+
+	hits.Store(0)
+	plan = mustCompilePlan(t, "runtime-retry-exhausted.pt", strings.Replace(src, "retry 2", "retry 1", 1))
+	result = Execute(context.Background(), plan, Options{})
+	if hits.Load() != 2 {
+		t.Fatalf("expected 2 attempts, got %d", hits.Load())
+	}
+	if len(result.Diags) == 0 || result.Diags[0].Code != "E_ASSERT_EXPECTED_TRUE" || result.Diags[0].Hint != `expected "ready", got "pending"` {
+		t.Fatalf("expected the assertion to fail after the last attempt, got %+v", result.Diags)
+	}
+}
+
+func TestExecuteCorrelationHeader(t *testing.T) {
+	var mu sync.Mutex
+	var ids []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		ids = append(ids, r.Header.Get("X-Test-Run"))
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprintf(w, `{"run":%q}`, r.Header.Get("X-Test-Run"))
+	}))
+	defer srv.Close()
+
+	src := `
+base "` + srv.URL + `"
+
+req first:
+	GET /first
+	? #.run == runId
+
+req second:
+	GET /second
+	? #.run == runId
+
+req custom:
+	GET /custom
+	header x-test-run = "mine"
+
+flow "one":
+	first -> second
+
+flow "two":
+	first -> custom
+	? first.res.run == runId
+`
+	plan := mustCompilePlan(t, "runtime-correlation.pt", src)
+	opt := Options{CorrelationHeader: "X-Test-Run", JitterSeed: 7}
+	result := Execute(context.Background(), plan, opt)
+	if len(result.Diags) != 0 {
+		t.Fatalf("unexpected diagnostics: %+v", result.Diags)
+	}
+	if len(ids) != 4 || ids[0] == "" || ids[1] != ids[0] || ids[2] != ids[0] || ids[3] != "mine" {
+		t.Fatalf("expected one correlation id on every request, got %v", ids)
+	}
+
+	ids = nil
+	_ = Execute(context.Background(), plan, opt)
+	if len(ids) != 4 || ids[0] == "" || ids[0] != newRunID(7) {
+		t.Fatalf("expected a reproducible run id with a seed, got %v", ids)
+	}
+}
+
+func TestExecuteDynamicLetReevaluatesPerRequest(t *testing.T) {
+	var dynamicIDs, staticIDs []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dynamicIDs = append(dynamicIDs, r.Header.Get("X-Request-Id"))
+		staticIDs = append(staticIDs, r.Header.Get("X-Run-Id"))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	src := `
+base "` + srv.URL + `"
+let dynamic request_id = uuid()
+let run_id = uuid()
+
+req ping:
+	GET /ping
+	header X-Request-Id = request_id
+	header X-Run-Id = run_id
+
+flow "ids":
+	ping -> ping:again
+`
+	plan := mustCompilePlan(t, "runtime-dynamic-let.pt", src)
+	result := Execute(context.Background(), plan, Options{})
+	if len(result.Diags) != 0 {
+		t.Fatalf("unexpected diagnostics: %+v", result.Diags)
+	}
+	if len(dynamicIDs) != 2 || dynamicIDs[0] == "" || dynamicIDs[0] == dynamicIDs[1] {
+		t.Fatalf("expected a fresh dynamic id per request, got %v", dynamicIDs)
+	}
+	if len(staticIDs) != 2 || staticIDs[0] == "" || staticIDs[0] != staticIDs[1] {
+		t.Fatalf("expected a stable static id, got %v", staticIDs)
+	}
+}
+
+func TestExecuteRequestQueryReflectsAppliedParams(t *testing.T) {
+	var rawQuery string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rawQuery = r.URL.RawQuery
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	src := `
+base "` + srv.URL + `"
+let page = 2
+
+req list:
+	GET /items?sort=name
+	query page = "{{page}}"
+	query tag = ["a", "b"]
+	? req.query.page == "2"
+	? req.query.sort == "name"
+	? req.query.tag == ["a", "b"]
+
+flow "list":
+	list
+	? list.req.query.page == "2"
+`
+	plan := mustCompilePlan(t, "runtime-req-query.pt", src)
+	result := Execute(context.Background(), plan, Options{})
+	if len(result.Diags) != 0 {
+		t.Fatalf("unexpected diagnostics: %+v", result.Diags)
+	}
+	if rawQuery != "page=2&sort=name&tag=a&tag=b" {
+		t.Fatalf("unexpected query string %q", rawQuery)
+	}
+}
+
+func TestExecuteRegexExtractBuiltin(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", "/orders?id=4821&v=2")
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+
+	src := `
+base "` + srv.URL + `"
+
+req create:
+	POST /orders
+	let id = regexExtract("id=(\\d+)", header["Location"], 1)
+	? regexExtract("v=(?P<version>\\d+)", header["Location"], "version") == "2"
+	? regexExtract("orders", header["Location"], 0) == "orders"
+
+req missing:
+	POST /orders
+	? regexExtract("token=(\\w+)", header["Location"], 1) == ""
+
+flow "create":
+	create
+	? id == "4821"
+
+flow "missing":
+	missing
+`
+	plan := mustCompilePlan(t, "runtime-regex-extract.pt", src)
+	result := Execute(context.Background(), plan, Options{})
+	if len(result.Diags) != 1 {
+		t.Fatalf("expected one diagnostic, got %+v", result.Diags)
+	}
+	if d := result.Diags[0]; d.Code != "E_RUNTIME_EXPRESSION" || !strings.Contains(d.Hint, "did not match") {
+		t.Fatalf("unexpected diagnostic: %+v", d)
+	}
+}
+
+func TestExecuteServiceBaseResolution(t *testing.T) {
+	var hits []string
+	main := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits = append(hits, "main "+r.URL.Path)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer main.Close()
+	orders := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits = append(hits, "orders "+r.URL.Path)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer orders.Close()
+
+	src := `
+base "` + main.URL + `"
+base_for "orders" "` + orders.URL + `/api"
+let id = 7
+
+req health:
+	GET /health
+
+req getOrder:
+	GET @orders/v1/orders/:id
+
+flow "services":
+	health -> getOrder
+`
+	plan := mustCompilePlan(t, "runtime-service-base.pt", src)
+	if diags := Validate(plan); len(diags) != 0 {
+		t.Fatalf("unexpected validation diagnostics: %+v", diags)
+	}
+	result := Execute(context.Background(), plan, Options{})
+	if len(result.Diags) != 0 {
+		t.Fatalf("unexpected diagnostics: %+v", result.Diags)
+	}
+	if strings.Join(hits, ", ") != "main /health, orders /api/v1/orders/7" {
+		t.Fatalf("unexpected hits: %v", hits)
+	}
+}
+
+func TestExecuteNumEqBuiltin(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"count":"5","total":5,"name":"x"}`))
+	}))
+	defer srv.Close()
+
+	src := `
+base "` + srv.URL + `"
+
+req counts:
+	GET /counts
+	? numEq(#.count, 5)
+	? numEq(#.count, #.total)
+	? numEq("5.0", 5)
+	? not numEq(#.count, 6)
+	? #.count != 5
+
+req badCount:
+	GET /counts
+	? numEq(#.name, 5)
+
+flow "counts":
+	counts
+
+flow "bad-count":
+	badCount
+`
+	plan := mustCompilePlan(t, "runtime-num-eq.pt", src)
+	result := Execute(context.Background(), plan, Options{})
+	if len(result.Diags) != 1 {
+		t.Fatalf("expected one diagnostic, got %+v", result.Diags)
+	}
+	if d := result.Diags[0]; d.Code != "E_RUNTIME_EXPRESSION" || !strings.Contains(d.Hint, `numEq: "x" is not a number`) {
+		t.Fatalf("unexpected diagnostic: %+v", d)
+	}
+}
+
+func TestExecuteSortedAndUniqueBuiltins(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"ids":[1,2,2,10],"names":["b","a"],"tags":[{"k":1},{"k":1}],"mixed":[1,"a"]}`))
+	}))
+	defer srv.Close()
+
+	src := `
+base "` + srv.URL + `"
+
+req list:
+	GET /list
+	? isSorted(#.ids)
+	? not isSortedDesc(#.ids)
+	? isSortedDesc(#.names)
+	? not isSorted(#.names)
+	? isSorted([]) and unique([])
+	? not unique(#.ids)
+	? not unique(#.tags)
+	? unique(#.names)
+
+req mixed:
+	GET /list
+	? isSorted(#.mixed)
+
+flow "list":
+	list
+
+flow "mixed":
+	mixed
+`
+	plan := mustCompilePlan(t, "runtime-sorted.pt", src)
+	result := Execute(context.Background(), plan, Options{})
+	if len(result.Diags) != 1 {
+		t.Fatalf("expected one diagnostic, got %+v", result.Diags)
+	}
+	if d := result.Diags[0]; d.Code != "E_RUNTIME_EXPRESSION" || !strings.Contains(d.Hint, "isSorted: expected an array of numbers or strings") {
+		t.Fatalf("unexpected diagnostic: %+v", d)
+	}
+}
+
+func TestExecuteIsIntBuiltin(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":3,"whole":3.0,"price":3.0000001,"neg":-12,"text":"3","none":null,"list":[1]}`))
+	}))
+	defer srv.Close()
+
+	src := `
+base "` + srv.URL + `"
+
+req item:
+	GET /item
+	? isInt(#.id)
+	? isInt(#.whole)
+	? isInt(#.neg)
+	? isInt(0)
+	? not isInt(#.price)
+	? not isInt(1.5)
+	? not isInt(#.text)
+	? not isInt(#.none)
+	? not isInt(#.list)
+	? not isInt(#.missing)
+
+flow "item":
+	item
+`
+	plan := mustCompilePlan(t, "runtime-is-int.pt", src)
+	result := Execute(context.Background(), plan, Options{})
+	if len(result.Diags) != 0 {
+		t.Fatalf("unexpected diagnostics: %+v", result.Diags)
+	}
+}
+
+func TestExecuteResolveURLBuiltin(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/app/login":
+			w.Header().Set("Location", "../dashboard?tab=1")
+		default:
+			w.Header().Set("Location", "https://sso.example.com/start")
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+
+	src := `
+base "` + srv.URL + `"
+
+req login:
+	GET /app/login
+	? resolveURL(req.url, header["Location"]) == "` + srv.URL + `/dashboard?tab=1"
+
+req sso:
+	GET /sso
+	? resolveURL(req.url, header["Location"]) == "https://sso.example.com/start"
+
+flow "locations":
+	login -> sso
+`
+	plan := mustCompilePlan(t, "runtime-resolve-url.pt", src)
+	result := Execute(context.Background(), plan, Options{})
+	if len(result.Diags) != 0 {
+		t.Fatalf("unexpected diagnostics: %+v", result.Diags)
+	}
+}
+
+func TestExecuteFileBuiltinComparesFixtures(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":1,"name":"alice","roles":["admin"]}`))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "fixtures"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	fixtures := map[string]string{
+		"user.json":  "{\n  \"name\": \"alice\",\n  \"id\": 1,\n  \"roles\": [\"admin\"]\n}\n",
+		"other.json": `{"id":2,"name":"bob","roles":[]}`,
+		"bad.json":   `{"id":`,
+	}
+	for name, content := range fixtures {
+		if err := os.WriteFile(filepath.Join(dir, "fixtures", name), []byte(content), 0o644); err != nil {
+			t.Fatalf("write fixture: %v", err)
+		}
+	}
+
+	src := `
+base "` + srv.URL + `"
+
+req user:
+	GET /user
+	? res == file("fixtures/user.json")
+
+req other:
+	GET /user
+	? res == file("fixtures/other.json")
+
+req missing:
+	GET /user
+	? res == file("fixtures/missing.json")
+
+req bad:
+	GET /user
+	? res == file("fixtures/bad.json")
+
+flow "fixtures":
+	user -> other
+
+flow "missing":
+	missing
+
+flow "bad":
+	bad
+`
+	plan := mustCompilePlan(t, filepath.Join(dir, "main.pt"), src)
+	result := Execute(context.Background(), plan, Options{})
+	if len(result.Diags) != 3 {
+		t.Fatalf("expected three diagnostics, got %+v", result.Diags)
+	}
+	byRequest := map[string]diagnostics.Diagnostic{}
+	for _, d := range result.Diags {
+		byRequest[*d.Request] = d
+	}
+	if d := byRequest["other"]; d.Code != "E_ASSERT_EXPECTED_TRUE" {
+		t.Fatalf("expected the non-matching fixture to fail, got %+v", d)
+	}
+	if d := byRequest["missing"]; d.Code != "E_RUNTIME_EXPRESSION" || !strings.Contains(d.Hint, "file: open") {
+		t.Fatalf("expected a missing file error, got %+v", d)
+	}
+	if d := byRequest["bad"]; d.Code != "E_RUNTIME_EXPRESSION" || !strings.Contains(d.Hint, "bad.json is not valid JSON") {
+		t.Fatalf("expected an invalid JSON error, got %+v", d)
+	}
+}
+
+func TestExecuteRawStringJSONBody(t *testing.T) {
+	var got map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("decode body: %v", err)
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+
+	src := "base \"" + srv.URL + "\"\nlet name = \"alice\"\n\nreq create:\n\tPOST /users\n\tjson `{\n\t\t\"name\": \"{{name}}\",\n\t\t\"profile\": {\"tags\": [\"a\", \"}\"], \"age\": 42.5, \"manager\": null}\n\t}`\n\t? status == 201\n\nflow \"create\":\n\tcreate\n"
+	plan := mustCompilePlan(t, "runtime-raw-json.pt", src)
+	result := Execute(context.Background(), plan, Options{})
+	if len(result.Diags) != 0 {
+		t.Fatalf("unexpected diagnostics: %+v", result.Diags)
+	}
+	want := map[string]any{"name": "alice", "profile": map[string]any{"tags": []any{"a", "}"}, "age": 42.5, "manager": nil}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected body: %v", got)
+	}
+}
+
+func TestExecuteConformsBuiltin(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/users/2" {
+			_, _ = w.Write([]byte(`{"id":"2","name":"bob","role":"owner"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"id":1,"name":"ada","role":"admin"}`))
+	}))
+	defer srv.Close()
+
+	spec, err := filepath.Abs(filepath.Join("..", "..", "testdata", "openapi", "users.json"))
+	if err != nil {
+		t.Fatalf("abs: %v", err)
+	}
+	src := `
+base "` + srv.URL + `"
+
+req good:
+	GET /users/1
+	? conforms(#, "` + spec + `", "getUser", status)
+
+req bad:
+	GET /users/2
+	? conforms(#, "` + spec + `", "getUser", 200)
+
+req unknown:
+	GET /users/1
+	? conforms(#, "` + spec + `", "createUser", 201)
+
+flow "good":
+	good
+
+flow "bad":
+	bad
+
+flow "unknown":
+	unknown
+`
+	plan := mustCompilePlan(t, "runtime-conforms.pt", src)
+	result := Execute(context.Background(), plan, Options{})
+	byRequest := map[string]diagnostics.Diagnostic{}
+	for _, d := range result.Diags {
+		byRequest[*d.Request] = d
+	}
+	if len(result.Diags) != 2 {
+		t.Fatalf("expected two diagnostics, got %+v", result.Diags)
+	}
+	wantHint := `does not conform to the schema: $.id: expected integer, got string; $.role: "owner" is not one of the enum values`
+	if d := byRequest["bad"]; d.Code != "E_ASSERT_EXPECTED_TRUE" || d.Hint != wantHint {
+		t.Fatalf("unexpected non-conforming diagnostic: %+v", d)
+	}
+	if d := byRequest["unknown"]; d.Code != "E_RUNTIME_EXPRESSION" || !strings.Contains(d.Hint, `conforms: operation "createUser" not found`) {
+		t.Fatalf("unexpected missing operation diagnostic: %+v", d)
+	}
+}
+
+func TestExecuteConformsLoadsYAMLSpecOncePerRun(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("..", "..", "testdata", "openapi", "users.yaml"))
+	if err != nil {
+		t.Fatalf("read spec: %v", err)
+	}
+	spec := filepath.Join(t.TempDir(), "users.yaml")
+	if err := os.WriteFile(spec, data, 0o644); err != nil {
+		t.Fatalf("write spec: %v", err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/users/2" {
+			// The spec was loaded by the first request and must not be read again.
+			_ = os.Remove(spec)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":1,"name":"ada","role":"admin"}`))
+	}))
+	defer srv.Close()
+
+	src := `
+base "` + srv.URL + `"
+
+req first:
+	GET /users/1
+	? conforms(#, "` + spec + `", "getUser", status)
+
+req second:
+	GET /users/2
+	? conforms(#, "` + spec + `", "getUser", status)
+
+flow "users":
+	first -> second
+`
+	plan := mustCompilePlan(t, "runtime-conforms-yaml.pt", src)
+	result := Execute(context.Background(), plan, Options{})
+	if len(result.Diags) != 0 {
+		t.Fatalf("unexpected diagnostics: %+v", result.Diags)
+	}
+	if _, err := os.Stat(spec); !os.IsNotExist(err) {
+		t.Fatalf("expected the handler to remove the spec, stat err=%v", err)
+	}
+}
+
+func TestExecuteNegatedMembershipBuiltins(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"roles":["admin","dev"],"name":"ada","status":"active"}`))
+	}))
+	defer srv.Close()
+
+	src := `
+base "` + srv.URL + `"
+
+req user:
+	GET /user
+	? notContains(#.roles, "guest")
+	? notContains(#.name, "bob")
+	? notIn(#.status, ["deleted", "banned"])
+
+req badRoles:
+	GET /user
+	? notContains(#.roles, "admin")
+
+req badStatus:
+	GET /user
+	? notIn(#.status, ["active", "pending"])
+
+flow "ok":
+	user
+
+flow "bad-roles":
+	badRoles
+
+flow "bad-status":
+	badStatus
+`
+	plan := mustCompilePlan(t, "runtime-negated-membership.pt", src)
+	result := Execute(context.Background(), plan, Options{})
+	hints := map[string]string{}
+	for _, d := range result.Diags {
+		if d.Code != "E_ASSERT_EXPECTED_TRUE" || d.Flow == nil {
+			t.Fatalf("unexpected diagnostic: %+v", d)
+		}
+		hints[*d.Flow] = d.Hint
+	}
+	want := map[string]string{
+		"bad-roles":  `expected ["admin","dev"] not to contain "admin"`,
+		"bad-status": `expected "active" not to be in ["active","pending"]`,
+	}
+	if !reflect.DeepEqual(hints, want) {
+		t.Fatalf("unexpected hints: %v", hints)
+	}
+}
+
+func TestExecuteJitterDelaysEachRequest(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	src := `
+base "` + srv.URL + `"
+
+req ping:
+	GET /ping
+
+flow "pings":
+	ping -> ping:second -> ping:third
+`
+	plan := mustCompilePlan(t, "runtime-jitter.pt", src)
+	opt := Options{JitterMin: 20 * time.Millisecond, JitterMax: 40 * time.Millisecond, JitterSeed: 42}
+	start := time.Now()
+	result := Execute(context.Background(), plan, opt)
+	elapsed := time.Since(start)
+	if len(result.Diags) != 0 {
+		t.Fatalf("unexpected diagnostics: %+v", result.Diags)
+	}
+	if elapsed < 60*time.Millisecond || elapsed > 120*time.Millisecond+500*time.Millisecond {
+		t.Fatalf("expected three delays of 20-40ms, took %s", elapsed)
+	}
+
+	first, second := newJitter(opt), newJitter(opt)
+	for i := 0; i < 5; i++ {
+		a, b := first(), second()
+		if a != b || a < opt.JitterMin || a > opt.JitterMax {
+			t.Fatalf("expected reproducible delays within range, got %s and %s", a, b)
+		}
+	}
+}
+
+func TestExecuteFlowCallCounts(t *testing.T) {
+	hits := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/orders" {
+			hits++
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	src := `
+base "` + srv.URL + `"
+
+req login:
+	POST /login
+
+req createOrder:
+	POST /orders
+	? calls("createOrder") == 1
+
+flow "dedup":
+	login -> createOrder -> createOrder:retry
+	? calls("login") == 1
+	? calls("createOrder") == 2
+	? calls("missing") == 0
+	? calls("createOrder") == 1
+`
+	plan := mustCompilePlan(t, "runtime-calls.pt", src)
+	result := Execute(context.Background(), plan, Options{})
+	if hits != 2 {
+		t.Fatalf("expected two order calls, got %d", hits)
+	}
+	if !reflect.DeepEqual(result.Flows[0].Calls, map[string]int{"login": 1, "createOrder": 2}) {
+		t.Fatalf("unexpected call counts: %v", result.Flows[0].Calls)
+	}
+	var codes []string
+	for _, d := range result.Diags {
+		codes = append(codes, d.Code+" "+d.Hint)
+	}
+	want := []string{
+		"E_RUNTIME_EXPRESSION calls is only available in flow assertions",
+		"E_RUNTIME_EXPRESSION calls is only available in flow assertions",
+		"E_ASSERT_EXPECTED_TRUE expected 1, got 2",
+	}
+	if !reflect.DeepEqual(codes, want) {
+		t.Fatalf("unexpected diagnostics: %v", codes)
+	}
+}
+
+func TestExecuteRequestHeadersReflectSentValues(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprintf(w, `{"tenant":%q,"count":%q}`, r.Header.Get("X-Tenant"), r.Header.Get("X-Count"))
+	}))
+	defer srv.Close()
+
+	src := `
+base "` + srv.URL + `"
+let tenant = "acme"
+
+req echo:
+	GET /echo
+	header x-tenant = "{{tenant}}-eu"
+	pre hook {
+	  req.header["X-Count"] = 5
+	}
+	? req.header["X-Tenant"] == #.tenant
+	? req.header["X-Tenant"] == "acme-eu"
+	? req.header["X-Count"] == #.count
+
+flow "echo":
+	echo
+	? echo.req.header["X-Count"] == "5"
+`
+	plan := mustCompilePlan(t, "runtime-sent-headers.pt", src)
+	result := Execute(context.Background(), plan, Options{})
+	if len(result.Diags) != 0 {
+		t.Fatalf("unexpected diagnostics: %+v", result.Diags)
+	}
+}
+
+func TestExecuteAssertEventuallyPollsUntilDone(t *testing.T) {
+	polls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/jobs":
+			_, _ = w.Write([]byte(`{"id":"j1"}`))
+		case "/jobs/j1":
+			polls++
+			status := "pending"
+			if polls >= 3 {
+				status = "done"
+			}
+			fmt.Fprintf(w, `{"status":%q}`, status)
+		default:
+			_, _ = w.Write([]byte(`{"status":"pending"}`))
+		}
+	}))
+	defer srv.Close()
+
+	src := `
+base "` + srv.URL + `"
+
+req startJob:
+	POST /jobs
+	let jobId = #.id
+
+req getJob:
+	GET /jobs/:jobId
+
+req getStuck:
+	GET /stuck
+
+flow "async":
+	startJob
+	assert_eventually timeout 2s interval 10ms:
+		getJob:poll
+		? poll.res.status == "done"
+	? calls("getJob") == 3
+
+flow "stuck":
+	startJob
+	assert_eventually timeout 50ms interval 10ms:
+		getStuck
+		? getStuck.res.status == "done"
+`
+	plan := mustCompilePlan(t, "runtime-eventually.pt", src)
+	result := Execute(context.Background(), plan, Options{})
+	if polls != 3 {
+		t.Fatalf("expected three polls, got %d", polls)
+	}
+	var async, stuck FlowResult
+	for _, fr := range result.Flows {
+		switch fr.Name {
+		case "async":
+			async = fr
+		case "stuck":
+			stuck = fr
+		}
+	}
+	if async.Failed {
+		t.Fatalf("expected async flow to pass, got diags %+v", result.Diags)
+	}
+	if !stuck.Failed {
+		t.Fatalf("expected stuck flow to fail")
+	}
+	if len(result.Diags) != 1 || result.Diags[0].Code != "E_ASSERT_EVENTUALLY_TIMEOUT" {
+		t.Fatalf("expected one E_ASSERT_EVENTUALLY_TIMEOUT, got %+v", result.Diags)
+	}
+	if result.Diags[0].Hint != `expected "done", got "pending"` {
+		t.Fatalf("unexpected hint: %q", result.Diags[0].Hint)
+	}
+}
+
+func TestExecuteAssertEventuallyRespectsContext(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"status":"pending"}`))
+	}))
+	defer srv.Close()
+
+	src := `
+base "` + srv.URL + `"
+
+req getJob:
+	GET /jobs
+
+flow "async":
+	getJob
+	assert_eventually timeout 1h interval 1h:
+		getJob:poll
+		? poll.res.status == "done"
+`
+	plan := mustCompilePlan(t, "runtime-eventually-ctx.pt", src)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	result := Execute(ctx, plan, Options{})
+	if time.Since(start) > 5*time.Second {
+		t.Fatalf("expected polling to stop when the context is done")
+	}
+	if len(result.Diags) != 1 || result.Diags[0].Code != "E_ASSERT_EVENTUALLY_TIMEOUT" {
+		t.Fatalf("expected E_ASSERT_EVENTUALLY_TIMEOUT, got %+v", result.Diags)
+	}
+}
+
+func TestExecuteJSONBodyKeysAreSorted(t *testing.T) {
+	var bodies []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(data))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	src := `
+base "` + srv.URL + `"
+
+req first:
+	POST /a
+	json { b: 1, a: { d: [{ z: 1, y: 2 }], c: 3 } }
+
+req second:
+	POST /b
+	json { a: { c: 3, d: [{ y: 2, z: 1 }] }, b: 1 }
+
+flow "bodies":
+	first -> second
+`
+	plan := mustCompilePlan(t, "runtime-sorted-json.pt", src)
+	result := Execute(context.Background(), plan, Options{})
+	if len(result.Diags) != 0 {
+		t.Fatalf("unexpected diagnostics: %+v", result.Diags)
+	}
+	want := `{"a":{"c":3,"d":[{"y":2,"z":1}]},"b":1}`
+	if len(bodies) != 2 || bodies[0] != want || bodies[1] != want {
+		t.Fatalf("expected identical sorted bodies, got %q", bodies)
+	}
+}
+
+func TestExecuteRequestJSONVisibleAfterSend(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.Copy(w, r.Body)
+	}))
+	defer srv.Close()
+
+	src := `
+base "` + srv.URL + `"
+
+req signup:
+	POST /users
+	json { email: "a@example.com", profile: { age: 30 } }
+	post hook {
+		printf "sent age=%v", req.json.profile.age
+	}
+	? req.json.email == #.email
+
+req ping:
+	GET /ping
+	? req.json == null
+
+flow "signup":
+	signup -> ping
+	? signup.req.json.email == "a@example.com"
+`
+	plan := mustCompilePlan(t, "runtime-req-json.pt", src)
+	out := captureStdout(t, func() {
+		result := Execute(context.Background(), plan, Options{})
+		if len(result.Diags) != 0 {
+			t.Fatalf("unexpected diagnostics: %+v", result.Diags)
+		}
+	})
+	if !strings.Contains(out, "sent age=30") {
+		t.Fatalf("expected post hook to read req.json, got %q", out)
+	}
+}
+
+func TestExecuteExplainStructuralDiff(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"user":{"name":"alice","roles":["admin","dev"]},"extra":true}`))
+	}))
+	defer srv.Close()
+
+	src := `
+base "` + srv.URL + `"
+
+req profile:
+	GET /profile
+	? res == { user: { name: "bob", roles: ["admin"], age: 30 } }
+
+flow "profile":
+	profile
+`
+	plan := mustCompilePlan(t, "runtime-explain.pt", src)
+	result := Execute(context.Background(), plan, Options{Explain: true})
+	if len(result.Diags) != 1 {
+		t.Fatalf("expected one diagnostic, got %+v", result.Diags)
+	}
+	want := `structural diff: added $.extra = true; removed $.user.age; changed $.user.name: expected "bob", got "alice"; added $.user.roles[1] = "dev"`
+	if result.Diags[0].Hint != want {
+		t.Fatalf("unexpected hint:\n got %s\nwant %s", result.Diags[0].Hint, want)
+	}
+
+	result = Execute(context.Background(), plan, Options{})
+	if len(result.Diags) != 1 || strings.Contains(result.Diags[0].Hint, "structural diff") {
+		t.Fatalf("expected a plain hint without --explain, got %+v", result.Diags)
+	}
+}
+
+func TestExecuteEnvTemplatePlaceholders(t *testing.T) {
+	var gotPath, gotKey string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotKey = r.Header.Get("X-Api-Key")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+	t.Setenv("PIPETEST_API_KEY", "k-123")
+	t.Setenv("PIPETEST_TENANT", "acme")
+
+	src := `
+base "` + srv.URL + `"
+
+req items:
+	GET /tenants/{{env:PIPETEST_TENANT}}/items
+	header X-Api-Key = "{{env:PIPETEST_API_KEY}}"
+	? status == 200
+
+flow "env":
+	items
+`
+	plan := mustCompilePlan(t, "runtime-env-template.pt", src)
+	result := Execute(context.Background(), plan, Options{})
+	if len(result.Diags) != 0 {
+		t.Fatalf("unexpected diagnostics: %+v", result.Diags)
+	}
+	if gotPath != "/tenants/acme/items" || gotKey != "k-123" {
+		t.Fatalf("expected env values to be rendered, got path=%q key=%q", gotPath, gotKey)
+	}
+}
+
+func TestExecuteTimeoutsAsFailures(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	src := `
+base "` + srv.URL + `"
+timeout 50ms
+
+req slow:
+	GET /slow
+
+flow "slow":
+	slow
+`
+	plan := mustCompilePlan(t, "runtime-timeout-failure.pt", src)
+	result := Execute(context.Background(), plan, Options{})
+	if len(result.Diags) != 1 || result.Diags[0].Code != "E_RUNTIME_TRANSPORT" {
+		t.Fatalf("expected transport error by default, got %+v", result.Diags)
+	}
+	result = Execute(context.Background(), plan, Options{TimeoutsAsFailures: true})
+	if len(result.Diags) != 1 || result.Diags[0].Code != "E_RUNTIME_TIMEOUT" {
+		t.Fatalf("expected timeout diagnostic, got %+v", result.Diags)
+	}
+
+	srv.Close()
+	result = Execute(context.Background(), plan, Options{TimeoutsAsFailures: true})
+	if len(result.Diags) != 1 || result.Diags[0].Code != "E_RUNTIME_TRANSPORT" {
+		t.Fatalf("expected connection errors to stay transport errors, got %+v", result.Diags)
+	}
+}
+
+type flakyTransport struct {
+	failures int
+	calls    int
+	bodies   []string
+}
+
+func (f *flakyTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	f.calls++
+	if r.Body != nil {
+		raw, _ := io.ReadAll(r.Body)
+		f.bodies = append(f.bodies, string(raw))
+		r.Body = io.NopCloser(bytes.NewReader(raw))
+	}
+	if f.calls <= f.failures {
+		return nil, errors.New("connection refused")
+	}
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestExecuteRetriesTransportErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"ok":true}`))
+	}))
+	defer srv.Close()
+
+	src := `
+base "` + srv.URL + `"
+
+req create:
+	POST /items
+	json { name: "a" }
+	? status == 200
+
+flow "retry":
+	create
+`
+	plan := mustCompilePlan(t, "runtime-transport-retry.pt", src)
+
+	flaky := &flakyTransport{failures: 2}
+	result := Execute(context.Background(), plan, Options{Client: &http.Client{Transport: flaky}, TransportRetries: 2, TransportRetryDelay: time.Millisecond})
+	if len(result.Diags) != 0 {
+		t.Fatalf("expected retries to recover, got %+v", result.Diags)
+	}
+	if flaky.calls != 3 {
+		t.Fatalf("expected 3 attempts, got %d", flaky.calls)
+	}
+	for _, body := range flaky.bodies {
+		if body != `{"name":"a"}` {
+			t.Fatalf("expected body to be resent on every attempt, got %q", flaky.bodies)
+		}
+	}
+
+	flaky = &flakyTransport{failures: 2}
+	result = Execute(context.Background(), plan, Options{Client: &http.Client{Transport: flaky}, TransportRetries: 1, TransportRetryDelay: time.Millisecond})
+	if len(result.Diags) != 1 || result.Diags[0].Code != "E_RUNTIME_TRANSPORT" {
+		t.Fatalf("expected transport error after retries are exhausted, got %+v", result.Diags)
+	}
+	if flaky.calls != 2 {
+		t.Fatalf("expected 2 attempts, got %d", flaky.calls)
+	}
+}
+
+func TestExecuteImportedRequestReadsFilesFromItsDirectory(t *testing.T) {
+	var gotFile, gotKind, gotRegion string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f, _, err := r.FormFile("avatar")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer f.Close()
+		raw, _ := io.ReadAll(f)
+		gotFile, gotKind, gotRegion = string(raw), r.FormValue("kind"), r.Header.Get("X-Region")
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "lib", "fixtures"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	for name, data := range map[string]string{"avatar.png": "PNGDATA", "meta.json": `{"kind":"avatar","region":"eu"}`} {
+		if err := os.WriteFile(filepath.Join(dir, "lib", "fixtures", name), []byte(data), 0o644); err != nil {
+			t.Fatalf("write fixture: %v", err)
+		}
+	}
+	uploads := `
+export let region = file("fixtures/meta.json").region
+
+req upload:
+	POST /avatars
+	header X-Region = region
+	multipart { kind: file("fixtures/meta.json").kind, avatar: @"fixtures/avatar.png" }
+	? status == 200
+`
+	src := `
+import "lib/uploads.pt"
+base "` + srv.URL + `"
+
+flow "upload":
+	upload
+`
+	var mods []compiler.Module
+	for _, f := range []struct{ path, src string }{{filepath.Join(dir, "main.pt"), src}, {filepath.Join(dir, "lib", "uploads.pt"), uploads}} {
+		prog, lexErrs, parseErrs := parser.Parse(f.path, f.src)
+		if len(lexErrs) != 0 || len(parseErrs) != 0 {
+			t.Fatalf("parse failed: lex=%+v parse=%+v", lexErrs, parseErrs)
+		}
+		mods = append(mods, compiler.Module{Path: f.path, Program: prog})
+	}
+	plan, diags := compiler.Compile(filepath.Join(dir, "main.pt"), mods)
+	if len(diags) != 0 {
+		t.Fatalf("compile failed: %+v", diags)
+	}
+	result := Execute(context.Background(), plan, Options{})
+	if len(result.Diags) != 0 {
+		t.Fatalf("expected no diagnostics, got %+v", result.Diags)
+	}
+	if gotFile != "PNGDATA" || gotKind != "avatar" || gotRegion != "eu" {
+		t.Fatalf("expected files read from lib/, got file=%q kind=%q region=%q", gotFile, gotKind, gotRegion)
+	}
+}
+
+func TestExecuteMultipartUpload(t *testing.T) {
+	var gotName, gotFile, gotFilename string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		gotName = r.FormValue("name")
+		f, header, err := r.FormFile("avatar")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer f.Close()
+		raw, _ := io.ReadAll(f)
+		gotFile, gotFilename = string(raw), header.Filename
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "fixtures"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "fixtures", "avatar.png"), []byte("PNGDATA"), 0o644); err != nil {
+		t.Fatalf("write upload: %v", err)
+	}
+	src := `
+base "` + srv.URL + `"
+let user = "ada"
+
+req upload:
+	POST /avatars
+	multipart { name: "{{user}}", avatar: @"fixtures/avatar.png" }
+	? status == 200
+
+flow "upload":
+	upload
+`
+	plan := mustCompilePlan(t, filepath.Join(dir, "upload.pt"), src)
+	result := Execute(context.Background(), plan, Options{})
+	if len(result.Diags) != 0 {
+		t.Fatalf("expected no diagnostics, got %+v", result.Diags)
+	}
+	if gotName != "ada" || gotFile != "PNGDATA" || gotFilename != "avatar.png" {
+		t.Fatalf("unexpected multipart form: name=%q file=%q filename=%q", gotName, gotFile, gotFilename)
+	}
+}
@@ -0,0 +1,3 @@
+// Package yaml decodes the subset of YAML used by OpenAPI specs and
+// variable files into the same values encoding/json produces.
+package yaml
@@ -0,0 +1,606 @@
+package yaml
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var numberRE = regexp.MustCompile(`^[-+]?(\.[0-9]+|[0-9]+(\.[0-9]*)?)([eE][-+]?[0-9]+)?$`)
+
+// Unmarshal decodes one YAML document. Mappings become map[string]any,
+// sequences []any, numbers float64, and nulls nil, as encoding/json does.
+// Block and flow collections, plain and quoted scalars, literal (|) and
+// folded (>) block scalars, and comments are supported; anchors, aliases,
+// tags, and multiple documents are not.
+func Unmarshal(data []byte) (any, error) {
+	text := strings.TrimPrefix(strings.ReplaceAll(string(data), "\r\n", "\n"), "\ufeff")
+	d := &decoder{}
+	for i, raw := range strings.Split(text, "\n") {
+		body := strings.TrimLeft(raw, " ")
+		d.lines = append(d.lines, line{
+			num:    i + 1,
+			indent: len(raw) - len(body),
+			text:   strings.TrimRight(stripComment(body), " \t"),
+			raw:    raw,
+			tab:    strings.HasPrefix(body, "\t"),
+		})
+	}
+	for d.pos < len(d.lines) {
+		t := d.lines[d.pos].text
+		if t != "" && t != "---" && !strings.HasPrefix(t, "%") {
+			break
+		}
+		d.pos++
+	}
+	if l, err := d.next(); err != nil || l == nil {
+		return nil, err
+	}
+	v, err := d.parseBlock(-1)
+	if err != nil {
+		return nil, err
+	}
+	l, err := d.next()
+	if err != nil {
+		return nil, err
+	}
+	if l != nil {
+		switch l.text {
+		case "...":
+		case "---":
+			return nil, l.errorf("multiple documents are not supported")
+		default:
+			return nil, l.errorf("unexpected %q", l.text)
+		}
+	}
+	return v, nil
+}
+
+type line struct {
+	num    int
+	indent int
+	text   string // content after the indentation, without a comment
+	raw    string
+	tab    bool // indented with a tab
+}
+
+// endsDocument reports whether l is a --- or ... document marker.
+func (l *line) endsDocument() bool {
+	return l.indent == 0 && (l.text == "---" || l.text == "...")
+}
+
+func (l *line) errorf(format string, args ...any) error {
+	return fmt.Errorf("line %d: %s", l.num, fmt.Sprintf(format, args...))
+}
+
+type decoder struct {
+	lines []line
+	pos   int
+}
+
+// next skips blank and comment-only lines and returns the line at the new
+// position, or nil at the end of the input.
+func (d *decoder) next() (*line, error) {
+	for ; d.pos < len(d.lines); d.pos++ {
+		l := &d.lines[d.pos]
+		if l.text == "" {
+			continue
+		}
+		if l.tab {
+			return nil, l.errorf("tabs are not allowed in indentation")
+		}
+		return l, nil
+	}
+	return nil, nil
+}
+
+// parseBlock parses the node that starts on the current line. parent is
+// the indentation of the enclosing node.
+func (d *decoder) parseBlock(parent int) (any, error) {
+	l := &d.lines[d.pos]
+	if isSeqItem(l.text) {
+		return d.parseSeq(l.indent)
+	}
+	if _, _, ok := splitKey(l.text); ok {
+		return d.parseMap(l.indent)
+	}
+	d.pos++
+	return d.parseValue(l.text, parent, *l, false)
+}
+
+func (d *decoder) parseSeq(indent int) (any, error) {
+	out := []any{}
+	for {
+		l, err := d.next()
+		if err != nil {
+			return nil, err
+		}
+		if l == nil || l.indent < indent || l.endsDocument() {
+			return out, nil
+		}
+		if l.indent > indent {
+			return nil, l.errorf("unexpected indentation")
+		}
+		if !isSeqItem(l.text) {
+			return out, nil
+		}
+		rest := strings.TrimLeft(l.text[1:], " ")
+		var v any
+		if rest == "" {
+			d.pos++
+			v, err = d.parseValue("", indent, *l, false)
+		} else {
+			// The item's content is parsed as if it started its own line,
+			// so "- name: x" opens a mapping at the column of name.
+			l.indent += len(l.text) - len(rest)
+			l.text = rest
+			v, err = d.parseBlock(indent)
+		}
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+	}
+}
+
+func (d *decoder) parseMap(indent int) (any, error) {
+	out := map[string]any{}
+	for {
+		l, err := d.next()
+		if err != nil {
+			return nil, err
+		}
+		if l == nil || l.indent < indent || l.endsDocument() {
+			return out, nil
+		}
+		if l.indent > indent {
+			return nil, l.errorf("unexpected indentation")
+		}
+		if isSeqItem(l.text) {
+			return out, nil
+		}
+		key, rest, ok := splitKey(l.text)
+		if !ok {
+			return nil, l.errorf("expected a mapping key, got %q", l.text)
+		}
+		d.pos++
+		v, err := d.parseValue(rest, indent, *l, true)
+		if err != nil {
+			return nil, err
+		}
+		out[key] = v
+	}
+}
+
+// parseValue parses the value after a mapping key or sequence dash on line
+// l. An empty rest means the value, if any, is on the following lines;
+// under a mapping key a sequence may start at the key's own indentation.
+func (d *decoder) parseValue(rest string, parent int, l line, inMap bool) (any, error) {
+	switch {
+	case rest == "":
+		next, err := d.next()
+		if err != nil || next == nil {
+			return nil, err
+		}
+		if next.indent > parent {
+			return d.parseBlock(parent)
+		}
+		if inMap && next.indent == parent && isSeqItem(next.text) {
+			return d.parseSeq(parent)
+		}
+		return nil, nil
+	case rest[0] == '|' || rest[0] == '>':
+		return d.blockScalar(rest, parent, l)
+	case rest[0] == '&' || rest[0] == '*' || rest[0] == '!':
+		return nil, l.errorf("anchors, aliases, and tags are not supported")
+	case rest[0] == '[' || rest[0] == '{':
+		for !flowClosed(rest) {
+			next, err := d.next()
+			if err != nil {
+				return nil, err
+			}
+			if next == nil {
+				break
+			}
+			rest += " " + next.text
+			d.pos++
+		}
+		return parseFlow(rest, l)
+	case rest[0] == '"' || rest[0] == '\'':
+		s, n, err := unquote(rest)
+		if err != nil {
+			return nil, l.errorf("%v", err)
+		}
+		if strings.TrimSpace(rest[n:]) != "" {
+			return nil, l.errorf("unexpected %q after quoted string", strings.TrimSpace(rest[n:]))
+		}
+		return s, nil
+	}
+	// A plain scalar continues on more indented lines, joined by spaces.
+	for {
+		next, err := d.next()
+		if err != nil {
+			return nil, err
+		}
+		if next == nil || next.indent <= parent || next.endsDocument() {
+			break
+		}
+		if _, _, ok := splitKey(next.text); ok {
+			return nil, next.errorf("unexpected indentation")
+		}
+		rest += " " + next.text
+		d.pos++
+	}
+	return resolvePlain(rest), nil
+}
+
+// blockScalar reads a | or > scalar from the raw lines after l. Comments
+// and blank lines inside it are content.
+func (d *decoder) blockScalar(header string, parent int, l line) (any, error) {
+	folded := header[0] == '>'
+	var chomp byte
+	indent := 0
+	for _, c := range header[1:] {
+		switch {
+		case (c == '-' || c == '+') && chomp == 0:
+			chomp = byte(c)
+		case c >= '1' && c <= '9' && indent == 0:
+			indent = max(parent, 0) + int(c-'0')
+		default:
+			return nil, l.errorf("invalid block scalar header %q", header)
+		}
+	}
+	var lines []string
+	for ; d.pos < len(d.lines); d.pos++ {
+		raw := d.lines[d.pos].raw
+		if strings.TrimSpace(raw) == "" {
+			lines = append(lines, "")
+			continue
+		}
+		lead := len(raw) - len(strings.TrimLeft(raw, " "))
+		if indent == 0 {
+			if lead <= parent {
+				break
+			}
+			indent = lead
+		}
+		if lead < indent {
+			break
+		}
+		lines = append(lines, raw[indent:])
+	}
+	end := len(lines)
+	for end > 0 && lines[end-1] == "" {
+		end--
+	}
+	trailing := len(lines) - end
+	lines = lines[:end]
+
+	var b strings.Builder
+	for i, ln := range lines {
+		if i > 0 {
+			prev := lines[i-1]
+			switch {
+			case !folded || ln == "":
+				b.WriteByte('\n')
+			case prev == "":
+				// The break before a run of empty lines is dropped.
+			case strings.HasPrefix(ln, " ") || strings.HasPrefix(prev, " "):
+				b.WriteByte('\n')
+			default:
+				b.WriteByte(' ')
+			}
+		}
+		b.WriteString(ln)
+	}
+	if len(lines) > 0 && chomp != '-' {
+		b.WriteByte('\n')
+	}
+	if chomp == '+' {
+		b.WriteString(strings.Repeat("\n", trailing))
+	}
+	return b.String(), nil
+}
+
+func isSeqItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// splitKey splits "key: value" into its key and the text after the colon.
+func splitKey(text string) (string, string, bool) {
+	if text == "" || text[0] == '[' || text[0] == '{' {
+		return "", "", false
+	}
+	if text[0] == '"' || text[0] == '\'' {
+		key, n, err := unquote(text)
+		if err != nil {
+			return "", "", false
+		}
+		rest := strings.TrimLeft(text[n:], " ")
+		if !strings.HasPrefix(rest, ":") || len(rest) > 1 && rest[1] != ' ' {
+			return "", "", false
+		}
+		return key, strings.TrimSpace(rest[1:]), true
+	}
+	for i := 0; i < len(text); i++ {
+		if text[i] == ':' && (i+1 == len(text) || text[i+1] == ' ') {
+			return strings.TrimSpace(text[:i]), strings.TrimSpace(text[i+1:]), true
+		}
+	}
+	return "", "", false
+}
+
+// stripComment removes a # comment that starts the text or follows a
+// space outside quotes.
+func stripComment(s string) string {
+	end := len(s)
+	eachUnquoted(s, func(i int) bool {
+		if s[i] == '#' && (i == 0 || s[i-1] == ' ' || s[i-1] == '\t') {
+			end = i
+			return false
+		}
+		return true
+	})
+	return s[:end]
+}
+
+// flowClosed reports whether every bracket opened in s is closed.
+func flowClosed(s string) bool {
+	depth := 0
+	eachUnquoted(s, func(i int) bool {
+		switch s[i] {
+		case '[', '{':
+			depth++
+		case ']', '}':
+			depth--
+		}
+		return true
+	})
+	return depth <= 0
+}
+
+// eachUnquoted calls fn with the index of every byte of s outside quoted
+// scalars until fn returns false.
+func eachUnquoted(s string, fn func(i int) bool) {
+	var q byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case q == '\'' && c == '\'' && i+1 < len(s) && s[i+1] == '\'':
+			i++
+		case q == '"' && c == '\\':
+			i++
+		case q != 0:
+			if c == q {
+				q = 0
+			}
+		case (c == '"' || c == '\'') && opensQuote(s[:i]):
+			q = c
+		default:
+			if !fn(i) {
+				return
+			}
+		}
+	}
+}
+
+// opensQuote reports whether a quote after prefix starts a quoted scalar
+// rather than sitting inside a plain one, as in "it's".
+func opensQuote(prefix string) bool {
+	t := strings.TrimRight(prefix, " ")
+	if t == "" {
+		return true
+	}
+	switch t[len(t)-1] {
+	case '[', '{', ',':
+		return true
+	case ':', '-', '?':
+		return len(t) < len(prefix)
+	}
+	return false
+}
+
+// unquote decodes the quoted scalar at the start of s and returns it with
+// the number of bytes it spans.
+func unquote(s string) (string, int, error) {
+	q := s[0]
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case q == '\'' && c == '\'' && i+1 < len(s) && s[i+1] == '\'':
+			b.WriteByte('\'')
+			i++
+		case c == q:
+			return b.String(), i + 1, nil
+		case q == '"' && c == '\\':
+			n, err := unescape(&b, s[i+1:])
+			if err != nil {
+				return "", 0, err
+			}
+			i += n
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", 0, errors.New("unterminated quoted string")
+}
+
+var escapes = map[byte]string{
+	'0': "\x00", 'a': "\a", 'b': "\b", 't': "\t", '\t': "\t", 'n': "\n", 'v': "\v", 'f': "\f",
+	'r': "\r", 'e': "\x1b", ' ': " ", '"': "\"", '/': "/", '\\': "\\", 'N': "\u0085", '_': "\u00a0",
+}
+
+// unescape writes the escape sequence that follows a backslash and returns
+// its length.
+func unescape(b *strings.Builder, s string) (int, error) {
+	if s == "" {
+		return 0, errors.New("unterminated quoted string")
+	}
+	if e, ok := escapes[s[0]]; ok {
+		b.WriteString(e)
+		return 1, nil
+	}
+	size := map[byte]int{'x': 2, 'u': 4, 'U': 8}[s[0]]
+	if size == 0 || len(s) <= size {
+		return 0, fmt.Errorf("invalid escape \\%c", s[0])
+	}
+	r, err := strconv.ParseUint(s[1:1+size], 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid escape \\%s", s[:1+size])
+	}
+	b.WriteRune(rune(r))
+	return 1 + size, nil
+}
+
+func resolvePlain(s string) any {
+	switch s {
+	case "", "~", "null", "Null", "NULL":
+		return nil
+	case "true", "True", "TRUE":
+		return true
+	case "false", "False", "FALSE":
+		return false
+	}
+	if numberRE.MatchString(s) {
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return f
+		}
+	}
+	if strings.HasPrefix(s, "0x") {
+		if n, err := strconv.ParseInt(s[2:], 16, 64); err == nil {
+			return float64(n)
+		}
+	}
+	return s
+}
+
+type flowParser struct {
+	s string
+	i int
+}
+
+// parseFlow decodes a [...] or {...} collection written on line l.
+func parseFlow(s string, l line) (any, error) {
+	p := &flowParser{s: s}
+	v, err := p.value()
+	if err == nil {
+		if p.space(); p.i < len(p.s) {
+			err = fmt.Errorf("unexpected %q after flow collection", p.s[p.i:])
+		}
+	}
+	if err != nil {
+		return nil, l.errorf("%v", err)
+	}
+	return v, nil
+}
+
+func (p *flowParser) space() {
+	for p.i < len(p.s) && p.s[p.i] == ' ' {
+		p.i++
+	}
+}
+
+func (p *flowParser) at(c byte) bool {
+	return p.i < len(p.s) && p.s[p.i] == c
+}
+
+func (p *flowParser) value() (any, error) {
+	p.space()
+	if p.i == len(p.s) {
+		return nil, errors.New("unterminated flow collection")
+	}
+	switch p.s[p.i] {
+	case '[':
+		p.i++
+		out := []any{}
+		for {
+			if p.space(); p.at(']') {
+				p.i++
+				return out, nil
+			}
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, v)
+			if err := p.sep(']'); err != nil {
+				return nil, err
+			}
+		}
+	case '{':
+		p.i++
+		out := map[string]any{}
+		for {
+			if p.space(); p.at('}') {
+				p.i++
+				return out, nil
+			}
+			key, err := p.key()
+			if err != nil {
+				return nil, err
+			}
+			var v any
+			if p.space(); p.at(':') {
+				p.i++
+				if v, err = p.value(); err != nil {
+					return nil, err
+				}
+			}
+			out[key] = v
+			if err := p.sep('}'); err != nil {
+				return nil, err
+			}
+		}
+	case '"', '\'':
+		s, n, err := unquote(p.s[p.i:])
+		if err != nil {
+			return nil, err
+		}
+		p.i += n
+		return s, nil
+	case '&', '*', '!':
+		return nil, errors.New("anchors, aliases, and tags are not supported")
+	}
+	start := p.i
+	for p.i < len(p.s) && !strings.ContainsRune(",]}", rune(p.s[p.i])) {
+		p.i++
+	}
+	return resolvePlain(strings.TrimSpace(p.s[start:p.i])), nil
+}
+
+// sep consumes the comma between flow entries and leaves the closing
+// bracket for the caller.
+func (p *flowParser) sep(closer byte) error {
+	p.space()
+	switch {
+	case p.at(','):
+		p.i++
+		return nil
+	case p.at(closer):
+		return nil
+	case p.i == len(p.s):
+		return errors.New("unterminated flow collection")
+	}
+	return fmt.Errorf("expected ',' or '%c', got %q", closer, p.s[p.i:])
+}
+
+func (p *flowParser) key() (string, error) {
+	p.space()
+	if p.at('"') || p.at('\'') {
+		s, n, err := unquote(p.s[p.i:])
+		p.i += n
+		return s, err
+	}
+	start := p.i
+	for p.i < len(p.s) {
+		c := p.s[p.i]
+		if c == ',' || c == '}' || c == ':' && (p.i+1 == len(p.s) || strings.IndexByte(" ,}", p.s[p.i+1]) >= 0) {
+			break
+		}
+		p.i++
+	}
+	return strings.TrimSpace(p.s[start:p.i]), nil
+}
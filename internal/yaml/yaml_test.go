@@ -0,0 +1,151 @@
+package yaml
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestUnmarshalMatchesJSON(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		src  string
+		want string
+	}{
+		{
+			name: "mappings and sequences",
+			src: `
+# leading comment
+openapi: 3.0.3
+info:
+  title: Users API   # trailing comment
+  version: "1.0"
+paths:
+  /users/{id}:
+    get:
+      operationId: getUser
+      tags:
+      - users
+      - "admin # not a comment"
+      responses:
+        '200':
+          description: ok
+`,
+			want: `{"openapi":"3.0.3","info":{"title":"Users API","version":"1.0"},"paths":{"/users/{id}":{"get":{"operationId":"getUser","tags":["users","admin # not a comment"],"responses":{"200":{"description":"ok"}}}}}}`,
+		},
+		{
+			name: "scalars",
+			src: `
+int: 42
+neg: -3
+float: 2.5
+exp: 1e3
+yes: true
+no: False
+nothing: null
+tilde: ~
+empty:
+url: http://example.com/a:b
+quoted: 'it''s'
+escaped: "tab\tline\nsnow ☃"
+plain: it's fine
+`,
+			want: `{"int":42,"neg":-3,"float":2.5,"exp":1000,"yes":true,"no":false,"nothing":null,"tilde":null,"empty":null,"url":"http://example.com/a:b","quoted":"it's","escaped":"tab\tline\nsnow ☃","plain":"it's fine"}`,
+		},
+		{
+			name: "sequence of mappings",
+			src: `
+- name: ada
+  langs: [go, "c"]
+- name: bob
+  meta: {admin: true, "age": 30, tags: []}
+-
+  - nested
+- - deeper
+`,
+			want: `[{"name":"ada","langs":["go","c"]},{"name":"bob","meta":{"admin":true,"age":30,"tags":[]}},["nested"],["deeper"]]`,
+		},
+		{
+			name: "multi-line flow and plain scalars",
+			src: `
+required: [
+  id,
+  name,
+]
+description: a long
+  description
+`,
+			want: `{"required":["id","name"],"description":"a long description"}`,
+		},
+		{
+			name: "block scalars",
+			src: `
+literal: |
+  line one
+    indented # kept
+
+  line three
+folded: >
+  folded
+  text
+
+  para
+strip: |-
+  no newline
+keep: |+
+  kept
+
+after: 1
+`,
+			want: `{"literal":"line one\n  indented # kept\n\nline three\n","folded":"folded text\npara\n","strip":"no newline","keep":"kept\n\n","after":1}`,
+		},
+		{
+			name: "document markers",
+			src:  "%YAML 1.2\n---\na: 1\n...\n",
+			want: `{"a":1}`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := Unmarshal([]byte(tc.src))
+			if err != nil {
+				t.Fatalf("unmarshal: %v", err)
+			}
+			var want any
+			if err := json.Unmarshal([]byte(tc.want), &want); err != nil {
+				t.Fatalf("decode want: %v", err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				gotJSON, _ := json.Marshal(got)
+				t.Fatalf("got %s\nwant %s", gotJSON, tc.want)
+			}
+		})
+	}
+}
+
+func TestUnmarshalEmptyDocument(t *testing.T) {
+	got, err := Unmarshal([]byte("# only a comment\n"))
+	if err != nil || got != nil {
+		t.Fatalf("expected nil, got %v, %v", got, err)
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	for _, tc := range []struct {
+		src  string
+		want string
+	}{
+		{src: "a: 1\n\tb: 2\n", want: "line 2: tabs are not allowed in indentation"},
+		{src: "a: 1\n   b: 2\n", want: `line 2: unexpected indentation`},
+		{src: "a: &x 1\n", want: "line 1: anchors, aliases, and tags are not supported"},
+		{src: "a: 1\n---\nb: 2\n", want: "line 2: multiple documents are not supported"},
+		{src: "a: \"open\n", want: "line 1: unterminated quoted string"},
+		{src: "a: [1, 2\n", want: "line 1: unterminated flow collection"},
+		{src: "a: 1\njust text\n", want: `line 2: expected a mapping key, got "just text"`},
+	} {
+		_, err := Unmarshal([]byte(tc.src))
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Fatalf("%q: expected error %q, got %v", tc.src, tc.want, err)
+		}
+	}
+}